@@ -275,11 +275,7 @@ func (s *Server) handleAdminStats(c *gin.Context) {
 	s.db.DB.Model(&models.Message{}).Count(&messageCount)
 
 	// Подсчет активных WebSocket соединений (примерный)
-	activeConnections := 0
-	s.wsClients.Range(func(_, _ interface{}) bool {
-		activeConnections++
-		return true
-	})
+	activeConnections := s.wsClients.count()
 
 	stats := AdminStatsResponse{
 		UserCount:         userCount,
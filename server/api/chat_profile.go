@@ -0,0 +1,338 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"messenger/database"
+	"messenger/logger"
+	"messenger/models"
+)
+
+// Ограничения оформления чата
+const (
+	maxChatDescriptionLength = 255
+	maxChatAvatarSize        = 5 * 1024 * 1024
+)
+
+// Путь, по которому скачиваются файлы; изображение чата отдается по нему
+const fileDownloadPath = "/api/files/download/"
+
+// Публичное имя: латиница в нижнем регистре, цифры и подчеркивание, от 5 до 32 символов
+var chatHandlePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{4,31}$`)
+
+// chatPreview - открытые сведения о чате, найденном по публичному имени
+type chatPreview struct {
+	ID           uint   `json:"id"`
+	Name         string `json:"name"`
+	Type         string `json:"type"`
+	Description  string `json:"description,omitempty"`
+	Handle       string `json:"handle"`
+	Avatar       string `json:"avatar,omitempty"`
+	MembersCount int64  `json:"members_count"`
+	IsMember     bool   `json:"is_member"`
+}
+
+// stringValue возвращает значение строки или пустую строку для nil
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// loadChatEditor загружает групповой чат или канал, оформление которого пользователь
+// вправе менять, и его участие в чате. При ошибке ответ уже отправлен.
+func (s *Server) loadChatEditor(c *gin.Context) (*models.User, *models.Chat, *models.ChatUser, bool) {
+	user, chat, member, ok := s.loadChatMembership(c)
+	if !ok {
+		return nil, nil, nil, false
+	}
+	if !chat.HasRoles() {
+		SendBadRequest(c, "Изменять можно только групповые чаты и каналы")
+		return nil, nil, nil, false
+	}
+	if !chatAllows(user, chat, member, models.PermChangeInfo) {
+		SendForbidden(c, "Недостаточно прав для изменения чата")
+		return nil, nil, nil, false
+	}
+	return user, chat, member, true
+}
+
+// normalizeChatDescription проверяет описание чата и возвращает его без пробелов по краям
+func normalizeChatDescription(description string) (string, *sendMessageError) {
+	description = strings.TrimSpace(description)
+	if utf8.RuneCountInString(description) > maxChatDescriptionLength {
+		return "", &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", fmt.Sprintf("Описание должно быть не длиннее %d символов", maxChatDescriptionLength)}
+	}
+	return description, nil
+}
+
+// setChatDescription меняет описание чата и уведомляет участников
+func (s *Server) setChatDescription(actor *models.User, chat *models.Chat, description string) (*messageResponse, *sendMessageError) {
+	description, sendErr := normalizeChatDescription(description)
+	if sendErr != nil {
+		return nil, sendErr
+	}
+	if description == chat.Description {
+		return nil, nil
+	}
+
+	if err := s.db.UpdateChatDescription(chat.ID, description); err != nil {
+		logger.Errorf("Ошибка изменения описания чата %d: %v", chat.ID, err)
+		return nil, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка изменения описания чата"}
+	}
+	chat.Description = description
+
+	s.sendToChat(chat.ID, WSTypeChatUpdated, chatUpdatedEvent{ChatID: chat.ID, Description: &description, ActorID: actor.ID}, 0)
+
+	event := models.SystemEvent{Kind: models.SystemEventDescriptionChanged}
+	if description == "" {
+		event.Kind = models.SystemEventDescriptionRemoved
+	}
+	return s.postSystemMessage(chat.ID, actor, event)
+}
+
+// normalizeChatHandle проверяет публичное имя и приводит его к виду, в котором оно хранится
+func normalizeChatHandle(handle string) (string, *sendMessageError) {
+	handle = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(handle), "@"))
+	if handle != "" && !chatHandlePattern.MatchString(handle) {
+		return "", &sendMessageError{http.StatusBadRequest, "BAD_REQUEST",
+			"Публичное имя должно начинаться с латинской буквы и состоять из 5-32 латинских букв, цифр и подчеркиваний"}
+	}
+	return handle, nil
+}
+
+// setChatHandle назначает чату публичное имя и уведомляет участников. Пустое имя убирает его.
+func (s *Server) setChatHandle(actor *models.User, chat *models.Chat, handle string) (*messageResponse, *sendMessageError) {
+	handle, sendErr := normalizeChatHandle(handle)
+	if sendErr != nil {
+		return nil, sendErr
+	}
+	if handle == stringValue(chat.Handle) {
+		return nil, nil
+	}
+
+	var value *string
+	if handle != "" {
+		value = &handle
+	}
+	if err := s.db.SetChatHandle(chat.ID, value); err != nil {
+		if errors.Is(err, database.ErrHandleTaken) {
+			return nil, &sendMessageError{http.StatusConflict, "HANDLE_TAKEN", "Это публичное имя уже занято"}
+		}
+		logger.Errorf("Ошибка изменения публичного имени чата %d: %v", chat.ID, err)
+		return nil, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка изменения публичного имени"}
+	}
+	chat.Handle = value
+
+	s.sendToChat(chat.ID, WSTypeChatUpdated, chatUpdatedEvent{ChatID: chat.ID, Handle: &handle, ActorID: actor.ID}, 0)
+
+	event := models.SystemEvent{
+		Kind:   models.SystemEventHandleChanged,
+		Params: map[string]string{models.SystemParamHandle: handle},
+	}
+	if handle == "" {
+		event = models.SystemEvent{Kind: models.SystemEventHandleRemoved}
+	}
+	return s.postSystemMessage(chat.ID, actor, event)
+}
+
+// setChatAvatar меняет изображение чата и уведомляет участников. nil убирает изображение.
+// Прежнее изображение удаляется.
+func (s *Server) setChatAvatar(actor *models.User, chat *models.Chat, file *models.File) (*messageResponse, *sendMessageError) {
+	var fileID *uint
+	avatar := ""
+	if file != nil {
+		fileID = &file.ID
+		avatar = fileDownloadPath + file.DownloadToken
+	}
+
+	if err := s.db.SetChatAvatar(chat.ID, fileID, avatar); err != nil {
+		logger.Errorf("Ошибка изменения изображения чата %d: %v", chat.ID, err)
+		return nil, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка изменения изображения чата"}
+	}
+	previous := chat.AvatarFileID
+	chat.AvatarFileID = fileID
+	chat.Avatar = avatar
+
+	if previous != nil {
+		s.removeStoredFile(*previous)
+	}
+
+	s.sendToChat(chat.ID, WSTypeChatUpdated, chatUpdatedEvent{ChatID: chat.ID, Avatar: &avatar, ActorID: actor.ID}, 0)
+
+	event := models.SystemEvent{Kind: models.SystemEventAvatarChanged}
+	if file == nil {
+		event.Kind = models.SystemEventAvatarRemoved
+	}
+	return s.postSystemMessage(chat.ID, actor, event)
+}
+
+// removeStoredFile удаляет файл с диска вместе с информацией о нем
+func (s *Server) removeStoredFile(fileID uint) {
+	file, err := s.db.GetFileByID(fileID)
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			logger.Errorf("Ошибка получения файла #%d: %v", fileID, err)
+		}
+		return
+	}
+	if err := s.db.DeleteFile(fileID); err != nil {
+		logger.Errorf("Ошибка удаления информации о файле #%d: %v", fileID, err)
+		return
+	}
+	if err := os.Remove(file.FilePath); err != nil && !os.IsNotExist(err) {
+		logger.Errorf("Ошибка удаления файла %s: %v", file.FilePath, err)
+	}
+}
+
+// handleUploadChatAvatar загружает изображение группового чата или канала
+func (s *Server) handleUploadChatAvatar(c *gin.Context) {
+	user, chat, _, ok := s.loadChatEditor(c)
+	if !ok {
+		return
+	}
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		SendBadRequest(c, "Не передан файл изображения")
+		return
+	}
+	if header.Size > maxChatAvatarSize {
+		SendBadRequest(c, fmt.Sprintf("Изображение должно быть не больше %d МБ", maxChatAvatarSize/(1024*1024)))
+		return
+	}
+	mimeType := header.Header.Get("Content-Type")
+	if !isAllowedFileType(mimeType) || determineFileType(mimeType) != models.FileTypeImage {
+		SendBadRequest(c, "Изображение чата должно быть картинкой")
+		return
+	}
+
+	if err := os.MkdirAll(uploadDir, 0755); err != nil {
+		logger.Errorf("Ошибка создания директории для загрузки: %v", err)
+		SendInternalError(c, "Ошибка сохранения изображения")
+		return
+	}
+	token, err := generateDownloadToken()
+	if err != nil {
+		SendInternalError(c, "Ошибка сохранения изображения")
+		return
+	}
+	filePath := filepath.Join(uploadDir, token+filepath.Ext(header.Filename))
+
+	src, err := header.Open()
+	if err != nil {
+		SendInternalError(c, "Ошибка открытия файла")
+		return
+	}
+	defer src.Close()
+
+	dst, err := os.Create(filePath)
+	if err != nil {
+		SendInternalError(c, "Ошибка сохранения изображения")
+		return
+	}
+	size, err := io.Copy(dst, io.LimitReader(src, maxChatAvatarSize))
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filePath)
+		logger.Errorf("Ошибка сохранения изображения чата %d: %v", chat.ID, err)
+		SendInternalError(c, "Ошибка сохранения изображения")
+		return
+	}
+
+	file := models.File{
+		FileName:      header.Filename,
+		FileSize:      size,
+		FileType:      models.FileTypeImage,
+		FilePath:      filePath,
+		MimeType:      mimeType,
+		DownloadToken: token,
+	}
+	if err := s.db.CreateFile(&file); err != nil {
+		os.Remove(filePath)
+		SendInternalError(c, "Ошибка сохранения информации о файле")
+		return
+	}
+
+	message, sendErr := s.setChatAvatar(user, chat, &file)
+	if sendErr != nil && (chat.AvatarFileID == nil || *chat.AvatarFileID != file.ID) {
+		// Изображение не назначено: файл больше не нужен
+		s.removeStoredFile(file.ID)
+	}
+	if sendErr != nil {
+		SendError(c, sendErr.Status, sendErr.Code, sendErr.Message)
+		return
+	}
+	logger.Infof("Пользователь %d изменил изображение чата %d", user.ID, chat.ID)
+
+	c.JSON(http.StatusOK, gin.H{"avatar": chat.Avatar, "message": message})
+}
+
+// handleDeleteChatAvatar удаляет изображение группового чата или канала
+func (s *Server) handleDeleteChatAvatar(c *gin.Context) {
+	user, chat, _, ok := s.loadChatEditor(c)
+	if !ok {
+		return
+	}
+	if chat.AvatarFileID == nil && chat.Avatar == "" {
+		SendNotFound(c, "У чата нет изображения")
+		return
+	}
+
+	message, sendErr := s.setChatAvatar(user, chat, nil)
+	if sendErr != nil {
+		SendError(c, sendErr.Status, sendErr.Code, sendErr.Message)
+		return
+	}
+	c.JSON(http.StatusOK, chatChangeResponse{Message: message})
+}
+
+// handleResolveChatHandle находит группу или канал по публичному имени
+func (s *Server) handleResolveChatHandle(c *gin.Context) {
+	userID := c.GetUint("userID")
+	handle := strings.ToLower(strings.TrimPrefix(c.Param("handle"), "@"))
+	if !chatHandlePattern.MatchString(handle) {
+		SendNotFound(c, "Чат не найден")
+		return
+	}
+
+	chat, err := s.db.GetChatByHandle(handle)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			SendNotFound(c, "Чат не найден")
+			return
+		}
+		SendInternalError(c, "Ошибка поиска чата")
+		return
+	}
+	count, err := s.db.CountChatMembers(chat.ID)
+	if err != nil {
+		SendInternalError(c, "Ошибка получения данных чата")
+		return
+	}
+
+	c.JSON(http.StatusOK, chatPreview{
+		ID:           chat.ID,
+		Name:         chat.Name,
+		Type:         chat.Type,
+		Description:  chat.Description,
+		Handle:       handle,
+		Avatar:       chat.Avatar,
+		MembersCount: count,
+		IsMember:     s.db.IsUserInChat(userID, chat.ID),
+	})
+}
@@ -0,0 +1,183 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+
+	"messenger/database"
+	"messenger/logger"
+	"messenger/models"
+)
+
+// Максимальная длина названия папки
+const maxFolderNameLength = 64
+
+// mutedForever - значение muted_until для чата, заглушенного без срока
+var mutedForever = time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+// Структура запроса для изменения личных настроек чата. Передаются только изменяемые поля.
+type chatSettingsRequest struct {
+	Archived   *bool      `json:"archived"`
+	Pinned     *bool      `json:"pinned"`
+	Muted      *bool      `json:"muted"`       // false снимает заглушение
+	MutedUntil *time.Time `json:"muted_until"` // Срок заглушения; без него чат заглушается бессрочно
+	Folder     *string    `json:"folder"`      // Пустая строка убирает чат из папки
+}
+
+// Структура запроса для изменения списка закрепленных чатов
+type pinnedChatsRequest struct {
+	ChatIDs []uint `json:"chat_ids"` // В порядке отображения
+}
+
+// chatSettingsResponse - личные настройки чата. Также рассылается событием
+// на все устройства пользователя.
+type chatSettingsResponse struct {
+	ChatID     uint       `json:"chat_id"`
+	Archived   bool       `json:"archived"`
+	PinOrder   int        `json:"pin_order"`
+	MutedUntil *time.Time `json:"muted_until,omitempty"`
+	Folder     string     `json:"folder,omitempty"`
+}
+
+// pinnedChatsEvent сообщает устройствам пользователя новый порядок закрепленных чатов
+type pinnedChatsEvent struct {
+	ChatIDs []uint `json:"chat_ids"`
+}
+
+func newChatSettingsResponse(member *models.ChatUser) chatSettingsResponse {
+	return chatSettingsResponse{
+		ChatID:     member.ChatID,
+		Archived:   member.Archived,
+		PinOrder:   member.PinOrder,
+		MutedUntil: member.MutedUntil,
+		Folder:     member.Folder,
+	}
+}
+
+// handleUpdateChatSettings меняет личные настройки чата: архив, закрепление, заглушение и папку
+func (s *Server) handleUpdateChatSettings(c *gin.Context) {
+	userID := c.GetUint("userID")
+	chatID, ok := parseChatID(c)
+	if !ok {
+		return
+	}
+
+	var req chatSettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		SendBadRequest(c, "Некорректные данные запроса: "+err.Error())
+		return
+	}
+
+	update := database.ChatSettingsUpdate{
+		Archived: req.Archived,
+		Pinned:   req.Pinned,
+	}
+	if req.Folder != nil {
+		folder := strings.TrimSpace(*req.Folder)
+		if utf8.RuneCountInString(folder) > maxFolderNameLength {
+			SendBadRequest(c, fmt.Sprintf("Название папки должно быть не длиннее %d символов", maxFolderNameLength))
+			return
+		}
+		update.Folder = &folder
+	}
+	if req.Muted != nil || req.MutedUntil != nil {
+		update.SetMute = true
+		switch {
+		case req.Muted != nil && !*req.Muted:
+			update.MutedUntil = nil
+		case req.MutedUntil != nil:
+			if !req.MutedUntil.After(time.Now()) {
+				SendBadRequest(c, "Срок заглушения должен быть в будущем")
+				return
+			}
+			update.MutedUntil = req.MutedUntil
+		default:
+			update.MutedUntil = &mutedForever
+		}
+	}
+
+	member, err := s.db.UpdateChatSettings(chatID, userID, update)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrNotChatMember):
+			SendForbidden(c, "У вас нет доступа к этому чату")
+		case errors.Is(err, database.ErrTooManyPinnedChats):
+			SendError(c, http.StatusConflict, "TOO_MANY_PINNED", fmt.Sprintf("Можно закрепить не больше %d чатов", database.MaxPinnedChats))
+		default:
+			logger.Errorf("Ошибка изменения настроек чата %d пользователем %d: %v", chatID, userID, err)
+			SendInternalError(c, "Ошибка изменения настроек чата")
+		}
+		return
+	}
+
+	settings := newChatSettingsResponse(member)
+	if err := s.sendMessageToUser(userID, wsResponse{Type: WSTypeChatSettings, Payload: settings}); err != nil {
+		logger.Errorf("Ошибка отправки настроек чата %d пользователю %d: %v", chatID, userID, err)
+	}
+
+	c.JSON(http.StatusOK, settings)
+}
+
+// handleSetPinnedChats заменяет список закрепленных чатов пользователя
+func (s *Server) handleSetPinnedChats(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var req pinnedChatsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		SendBadRequest(c, "Некорректные данные запроса: "+err.Error())
+		return
+	}
+	seen := make(map[uint]bool, len(req.ChatIDs))
+	for _, chatID := range req.ChatIDs {
+		if seen[chatID] {
+			SendBadRequest(c, "Чат указан в списке дважды")
+			return
+		}
+		seen[chatID] = true
+	}
+	if req.ChatIDs == nil {
+		req.ChatIDs = []uint{}
+	}
+
+	if err := s.db.SetPinnedChats(userID, req.ChatIDs); err != nil {
+		switch {
+		case errors.Is(err, database.ErrNotChatMember):
+			SendForbidden(c, "У вас нет доступа к одному или нескольким чатам")
+		case errors.Is(err, database.ErrTooManyPinnedChats):
+			SendError(c, http.StatusConflict, "TOO_MANY_PINNED", fmt.Sprintf("Можно закрепить не больше %d чатов", database.MaxPinnedChats))
+		default:
+			logger.Errorf("Ошибка изменения закрепленных чатов пользователя %d: %v", userID, err)
+			SendInternalError(c, "Ошибка изменения закрепленных чатов")
+		}
+		return
+	}
+
+	event := pinnedChatsEvent{ChatIDs: req.ChatIDs}
+	if err := s.sendMessageToUser(userID, wsResponse{Type: WSTypePinnedChats, Payload: event}); err != nil {
+		logger.Errorf("Ошибка отправки закрепленных чатов пользователю %d: %v", userID, err)
+	}
+
+	c.JSON(http.StatusOK, event)
+}
+
+// handleGetChatFolders возвращает папки пользователя
+func (s *Server) handleGetChatFolders(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	folders, err := s.db.GetChatFolders(userID)
+	if err != nil {
+		logger.Errorf("Ошибка получения папок пользователя %d: %v", userID, err)
+		SendInternalError(c, "Ошибка получения папок")
+		return
+	}
+	if folders == nil {
+		folders = []database.ChatFolder{}
+	}
+	c.JSON(http.StatusOK, gin.H{"folders": folders})
+}
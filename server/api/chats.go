@@ -2,10 +2,13 @@ package api
 
 import (
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 
+	"messenger/database"
 	"messenger/logger"
 	"messenger/models"
 	"messenger/utils/crypto"
@@ -16,6 +19,9 @@ type chatResponse struct {
 	ID           uint      `json:"id"`
 	Name         string    `json:"name"`
 	Type         string    `json:"type"`
+	Description  string    `json:"description,omitempty"`
+	Handle       string    `json:"handle,omitempty"`
+	Avatar       string    `json:"avatar,omitempty"`
 	CreatedAt    time.Time `json:"created_at"`
 	LastActivity time.Time `json:"last_activity"`
 	Users        []struct {
@@ -24,26 +30,36 @@ type chatResponse struct {
 		Avatar   string `json:"avatar,omitempty"`
 	} `json:"users"`
 	LastMessage *struct {
-		ID        uint      `json:"id"`
-		Content   string    `json:"content"`
-		Type      string    `json:"type"`
-		CreatedAt time.Time `json:"created_at"`
+		ID        uint                `json:"id"`
+		Content   string              `json:"content"`
+		Type      string              `json:"type"`
+		Event     *models.SystemEvent `json:"event,omitempty"`
+		CreatedAt time.Time           `json:"created_at"`
 		User      struct {
 			ID       uint   `json:"id"`
 			Username string `json:"username"`
 		} `json:"user"`
 	} `json:"last_message,omitempty"`
-	UnreadCount int `json:"unread_count"`
+	UnreadCount  int   `json:"unread_count"`
+	MembersCount int64 `json:"members_count,omitempty"` // Только для каналов: подписчики в списке чатов не раскрываются
+
+	// Личные настройки текущего пользователя
+	Archived   bool       `json:"archived"`
+	PinOrder   int        `json:"pin_order"`
+	MutedUntil *time.Time `json:"muted_until,omitempty"`
+	Folder     string     `json:"folder,omitempty"`
 }
 
 // Структура запроса для создания чата
 type createChatRequest struct {
-	Type    string `json:"type" binding:"required,oneof=direct group"`
-	Name    string `json:"name"`                        // Для групповых чатов
-	UserIDs []uint `json:"user_ids" binding:"required"` // Для личных чатов (1 ID), для групповых (>=1 ID)
+	Type    string `json:"type" binding:"required,oneof=direct group channel"`
+	Name    string `json:"name"`     // Для групповых чатов и каналов
+	UserIDs []uint `json:"user_ids"` // Для личных чатов (1 ID), для групповых (>=1 ID), для каналов - первые подписчики
 }
 
-// handleGetChats возвращает список чатов пользователя
+// handleGetChats возвращает список чатов пользователя: сначала закрепленные,
+// затем по времени последней активности. Архивные чаты возвращаются только
+// с archived=true. Фильтры: archived, pinned, folder.
 func (s *Server) handleGetChats(c *gin.Context) {
 	// Получаем ID текущего пользователя из контекста (установлен middleware аутентификации)
 	userID, exists := c.Get("userID")
@@ -61,10 +77,38 @@ func (s *Server) handleGetChats(c *gin.Context) {
 
 	// Получаем список чатов из базы данных
 	// TODO: Реализовать метод GetUserChats в Database
-	var chats []models.Chat
-	result := s.db.DB.Preload("Users").
+	query := s.db.DB.
 		Joins("JOIN chat_users ON chat_users.chat_id = chats.id").
-		Where("chat_users.user_id = ?", userIDUint).
+		Where("chat_users.user_id = ?", userIDUint)
+
+	archived := false
+	if value := c.Query("archived"); value != "" {
+		var err error
+		if archived, err = strconv.ParseBool(value); err != nil {
+			SendBadRequest(c, "Некорректное значение archived")
+			return
+		}
+	}
+	query = query.Where("chat_users.archived = ?", archived)
+	if value := c.Query("pinned"); value != "" {
+		pinned, err := strconv.ParseBool(value)
+		if err != nil {
+			SendBadRequest(c, "Некорректное значение pinned")
+			return
+		}
+		if pinned {
+			query = query.Where("chat_users.pin_order > 0")
+		} else {
+			query = query.Where("chat_users.pin_order = 0")
+		}
+	}
+	if folder, ok := c.GetQuery("folder"); ok {
+		query = query.Where("chat_users.folder = ?", strings.TrimSpace(folder))
+	}
+
+	var chats []models.Chat
+	result := query.
+		Order("chat_users.pin_order = 0, chat_users.pin_order, chats.last_activity DESC").
 		Find(&chats)
 
 	if result.Error != nil {
@@ -73,27 +117,94 @@ func (s *Server) handleGetChats(c *gin.Context) {
 		return
 	}
 
+	// Получаем курсоры прочтения текущего пользователя во всех его чатах
+	var memberships []models.ChatUser
+	if err := s.db.DB.Where("user_id = ?", userIDUint).Find(&memberships).Error; err != nil {
+		logger.Errorf("Ошибка получения курсоров прочтения: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения чатов"})
+		return
+	}
+	membershipByChat := make(map[uint]models.ChatUser, len(memberships))
+	for _, m := range memberships {
+		membershipByChat[m.ChatID] = m
+	}
+
+	// Участники личных и групповых чатов загружаются одним запросом. Подписчики каналов
+	// не загружаются: их может быть очень много, и список видят только администраторы.
+	var memberChatIDs, channelIDs []uint
+	for _, chat := range chats {
+		if chat.Type == models.ChatTypeChannel {
+			channelIDs = append(channelIDs, chat.ID)
+		} else {
+			memberChatIDs = append(memberChatIDs, chat.ID)
+		}
+	}
+	chatMembers, err := s.db.GetChatsMembers(memberChatIDs)
+	if err != nil {
+		logger.Errorf("Ошибка получения участников чатов: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения чатов"})
+		return
+	}
+	channelMembers, err := s.db.CountChatsMembers(channelIDs)
+	if err != nil {
+		logger.Errorf("Ошибка подсчета подписчиков каналов: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения чатов"})
+		return
+	}
+
+	// Непрочитанные в темах считаются по курсорам тем, для всех чатов одним запросом
+	topicUnread, err := s.db.GetTopicUnreadCounts(userIDUint)
+	if err != nil {
+		logger.Errorf("Ошибка получения непрочитанных в темах: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения чатов"})
+		return
+	}
+
+	// Последние сообщения всех чатов загружаются одним запросом
+	lastMessageIDs := make([]uint, 0, len(chats))
+	for _, chat := range chats {
+		if chat.LastMessageID != nil {
+			lastMessageIDs = append(lastMessageIDs, *chat.LastMessageID)
+		}
+	}
+	lastMessages, err := s.db.GetMessagesByIDs(lastMessageIDs)
+	if err != nil {
+		logger.Errorf("Ошибка получения последних сообщений чатов: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения чатов"})
+		return
+	}
+
 	// Формируем ответ API
 	response := make([]chatResponse, 0, len(chats))
 	for _, chat := range chats {
+		membership := membershipByChat[chat.ID]
+
 		// Создаем базовый ответ о чате
 		chatResp := chatResponse{
 			ID:           chat.ID,
 			Name:         chat.Name,
 			Type:         chat.Type,
+			Description:  chat.Description,
+			Handle:       stringValue(chat.Handle),
+			Avatar:       chat.Avatar,
 			CreatedAt:    chat.CreatedAt,
 			LastActivity: chat.LastActivity,
 			Users: make([]struct {
 				ID       uint   `json:"id"`
 				Username string `json:"username"`
 				Avatar   string `json:"avatar,omitempty"`
-			}, 0, len(chat.Users)),
-			UnreadCount: 0, // Будет заполнено позже
+			}, 0, len(chatMembers[chat.ID])),
+			UnreadCount:  0, // Будет заполнено позже
+			MembersCount: channelMembers[chat.ID],
+			Archived:     membership.Archived,
+			PinOrder:     membership.PinOrder,
+			MutedUntil:   membership.MutedUntil,
+			Folder:       membership.Folder,
 		}
 
 		// Добавляем информацию о пользователях чата
-		for _, user := range chat.Users {
-			if user.ID == userIDUint {
+		for _, user := range chatMembers[chat.ID] {
+			if user.UserID == userIDUint {
 				continue // Пропускаем текущего пользователя
 			}
 			chatResp.Users = append(chatResp.Users, struct {
@@ -101,21 +212,23 @@ func (s *Server) handleGetChats(c *gin.Context) {
 				Username string `json:"username"`
 				Avatar   string `json:"avatar,omitempty"`
 			}{
-				ID:       user.ID,
+				ID:       user.UserID,
 				Username: user.Username,
 				Avatar:   user.Avatar,
 			})
 		}
 
-		// Получаем последнее сообщение в чате
-		var lastMessage models.Message
-		result := s.db.DB.Where("chat_id = ?", chat.ID).
-			Order("created_at DESC").
-			Limit(1).
-			Preload("User").
-			First(&lastMessage)
+		// Последнее сообщение в чате. Сообщение, отправленное до вступления, не показывается,
+		// если новым участникам не видна прежняя история.
+		var lastMessage *models.Message
+		if chat.LastMessageID != nil {
+			lastMessage = lastMessages[*chat.LastMessageID]
+		}
+		if since := chat.HistoryVisibleSince(&membership); lastMessage != nil && since != nil && lastMessage.CreatedAt.Before(*since) {
+			lastMessage = nil
+		}
 
-		if result.Error == nil {
+		if lastMessage != nil {
 			// Расшифровываем содержимое сообщения
 			var content string
 			if len(lastMessage.Content) > 0 {
@@ -129,12 +242,15 @@ func (s *Server) handleGetChats(c *gin.Context) {
 			} else {
 				content = lastMessage.PlainText
 			}
+			// Контакт и местоположение показываются текстовым описанием
+			content = previewContent(lastMessage.Type, content)
 
 			chatResp.LastMessage = &struct {
-				ID        uint      `json:"id"`
-				Content   string    `json:"content"`
-				Type      string    `json:"type"`
-				CreatedAt time.Time `json:"created_at"`
+				ID        uint                `json:"id"`
+				Content   string              `json:"content"`
+				Type      string              `json:"type"`
+				Event     *models.SystemEvent `json:"event,omitempty"`
+				CreatedAt time.Time           `json:"created_at"`
 				User      struct {
 					ID       uint   `json:"id"`
 					Username string `json:"username"`
@@ -143,6 +259,7 @@ func (s *Server) handleGetChats(c *gin.Context) {
 				ID:        lastMessage.ID,
 				Content:   content,
 				Type:      lastMessage.Type,
+				Event:     decryptSystemEvent(lastMessage),
 				CreatedAt: lastMessage.CreatedAt,
 				User: struct {
 					ID       uint   `json:"id"`
@@ -154,14 +271,9 @@ func (s *Server) handleGetChats(c *gin.Context) {
 			}
 		}
 
-		// Получаем количество непрочитанных сообщений
-		var unreadCount int64
-		s.db.DB.Model(&models.Message{}).
-			Joins("LEFT JOIN message_reads ON messages.id = message_reads.message_id AND message_reads.user_id = ?", userIDUint).
-			Where("messages.chat_id = ? AND messages.user_id != ? AND message_reads.id IS NULL", chat.ID, userIDUint).
-			Count(&unreadCount)
-
-		chatResp.UnreadCount = int(unreadCount)
+		// Непрочитанные - чужие сообщения общей ленты после курсора прочтения (счетчик ведется в БД)
+		// и непрочитанные во всех темах
+		chatResp.UnreadCount = membership.UnreadCount + topicUnread[chat.ID]
 
 		response = append(response, chatResp)
 	}
@@ -196,7 +308,6 @@ func (s *Server) handleCreateChat(c *gin.Context) {
 			SendBadRequest(c, "Нельзя создать чат с самим собой")
 			return
 		}
-		// TODO: Проверить, существует ли уже личный чат между этими двумя пользователями
 		req.Name = ""
 	} else if req.Type == "group" {
 		if len(req.UserIDs) < 1 {
@@ -207,6 +318,11 @@ func (s *Server) handleCreateChat(c *gin.Context) {
 			SendBadRequest(c, "Для группового чата должно быть указано имя")
 			return
 		}
+	} else if req.Type == models.ChatTypeChannel {
+		if req.Name == "" {
+			SendBadRequest(c, "Для канала должно быть указано имя")
+			return
+		}
 	}
 
 	// Проверяем существование всех указанных пользователей
@@ -222,6 +338,23 @@ func (s *Server) handleCreateChat(c *gin.Context) {
 		return
 	}
 
+	// У пары пользователей один личный чат: повторный запрос возвращает существующий
+	if req.Type == models.ChatTypeDirect {
+		chat, created, err := s.db.FindOrCreateDirectChat(currentUserID, req.UserIDs[0])
+		if err != nil {
+			logger.Errorf("Ошибка получения личного чата пользователей %d и %d: %v", currentUserID, req.UserIDs[0], err)
+			SendInternalError(c, "Не удалось создать чат")
+			return
+		}
+		status := http.StatusOK
+		if created {
+			logger.Infof("Пользователь %d создал чат #%d (тип: %s)", currentUserID, chat.ID, chat.Type)
+			status = http.StatusCreated
+		}
+		c.JSON(status, s.newChatResponse(chat))
+		return
+	}
+
 	// Начинаем транзакцию
 	tx := s.db.DB.Begin()
 	if tx.Error != nil {
@@ -250,7 +383,10 @@ func (s *Server) handleCreateChat(c *gin.Context) {
 			ChatID:   newChat.ID,
 			UserID:   uid,
 			JoinedAt: time.Now(),
-			IsAdmin:  uid == currentUserID && req.Type == "group", // Создатель - админ в группе
+			Role:     models.ChatRoleMember,
+		}
+		if uid == currentUserID && req.Type != models.ChatTypeDirect {
+			chatUsers[i].Role = models.ChatRoleOwner // Создатель - владелец группы или канала
 		}
 	}
 
@@ -271,8 +407,13 @@ func (s *Server) handleCreateChat(c *gin.Context) {
 
 	logger.Infof("Пользователь %d создал чат #%d (тип: %s)", currentUserID, newChat.ID, newChat.Type)
 
+	c.JSON(http.StatusCreated, s.newChatResponse(&newChat))
+}
+
+// newChatResponse формирует ответ с только что созданным или найденным чатом
+func (s *Server) newChatResponse(newChat *models.Chat) chatResponse {
 	// Загружаем данные о пользователях для ответа
-	if err := s.db.DB.Preload("Users").First(&newChat, newChat.ID).Error; err != nil {
+	if err := s.db.DB.Preload("Users").First(newChat, newChat.ID).Error; err != nil {
 		logger.Errorf("Ошибка загрузки пользователей для ответа: %v", err)
 		// Продолжаем, но ответ будет без списка пользователей
 	}
@@ -282,6 +423,9 @@ func (s *Server) handleCreateChat(c *gin.Context) {
 		ID:           newChat.ID,
 		Name:         newChat.Name,
 		Type:         newChat.Type,
+		Description:  newChat.Description,
+		Handle:       stringValue(newChat.Handle),
+		Avatar:       newChat.Avatar,
 		CreatedAt:    newChat.CreatedAt,
 		LastActivity: newChat.LastActivity,
 		Users: make([]struct {
@@ -305,30 +449,452 @@ func (s *Server) handleCreateChat(c *gin.Context) {
 		}
 	}
 
-	c.JSON(http.StatusCreated, chatResp)
+	return chatResp
+}
+
+// Структура ответа с подробной информацией о чате
+type chatDetailsResponse struct {
+	ID                uint                   `json:"id"`
+	Name              string                 `json:"name"`
+	Type              string                 `json:"type"`
+	Description       string                 `json:"description,omitempty"`
+	Handle            string                 `json:"handle,omitempty"`
+	Avatar            string                 `json:"avatar,omitempty"`
+	CreatedAt         time.Time              `json:"created_at"`
+	LastActivity      time.Time              `json:"last_activity"`
+	Members           []database.ChatMember  `json:"members,omitempty"` // Подписчиков канала видят только его администраторы
+	MembersCount      int64                  `json:"members_count"`
+	Role              models.ChatRole        `json:"role"`        // Роль текущего пользователя
+	Permissions       models.ChatPermissions `json:"permissions"` // Полная матрица прав группы или канала
+	SignMessages      bool                   `json:"sign_messages,omitempty"`
+	SlowMode          int                    `json:"slow_mode,omitempty"`          // Секунд между сообщениями участника
+	HistoryVisibility string                 `json:"history_visibility,omitempty"` // Только для групп
+	LastReadSeq       uint64                 `json:"last_read_seq"`
+}
+
+// Структура запроса для изменения чата. Передаются только изменяемые поля.
+type updateChatRequest struct {
+	Name              *string `json:"name"`
+	Description       *string `json:"description"`        // Пустая строка удаляет описание
+	Handle            *string `json:"handle"`             // Пустая строка удаляет публичное имя
+	SignMessages      *bool   `json:"sign_messages"`      // Только для каналов
+	SlowMode          *int    `json:"slow_mode"`          // Секунд между сообщениями участника, 0 выключает. Только для групп
+	HistoryVisibility *string `json:"history_visibility"` // "full" или "joined". Только для групп
+}
+
+// Структура запроса для добавления участников: один user_id или список user_ids
+type addChatUsersRequest struct {
+	UserID  uint   `json:"user_id"`
+	UserIDs []uint `json:"user_ids"`
+}
+
+// Структура ответа на изменение чата. Message - служебное сообщение об изменении.
+type chatChangeResponse struct {
+	UserIDs  []uint             `json:"user_ids,omitempty"` // Добавленные участники
+	Message  *messageResponse   `json:"message,omitempty"`
+	Messages []*messageResponse `json:"messages,omitempty"` // Все служебные сообщения, если изменено несколько полей
 }
 
 // handleGetChat возвращает информацию о конкретном чате
 func (s *Server) handleGetChat(c *gin.Context) {
-	// TODO: Реализовать получение информации о чате
+	user, chat, member, ok := s.loadChatMembership(c)
+	if !ok {
+		return
+	}
+
+	count, err := s.db.CountChatMembers(chat.ID)
+	if err != nil {
+		logger.Errorf("Ошибка подсчета участников чата %d: %v", chat.ID, err)
+		SendInternalError(c, "Ошибка получения участников чата")
+		return
+	}
+
+	resp := chatDetailsResponse{
+		ID:           chat.ID,
+		Name:         chat.Name,
+		Type:         chat.Type,
+		Description:  chat.Description,
+		Handle:       stringValue(chat.Handle),
+		Avatar:       chat.Avatar,
+		CreatedAt:    chat.CreatedAt,
+		LastActivity: chat.LastActivity,
+		MembersCount: count,
+		Role:         member.Role,
+		SignMessages: chat.SignMessages,
+		SlowMode:     chat.SlowMode,
+		LastReadSeq:  member.LastReadSeq,
+	}
+	if chat.HasRoles() {
+		resp.Permissions = chat.EffectivePermissions()
+	}
+	if chat.Type == models.ChatTypeGroup {
+		resp.HistoryVisibility = chat.HistoryVisibility
+	}
+	if chat.Type != models.ChatTypeChannel || chatAllows(user, chat, member, models.PermAddMembers) {
+		if resp.Members, err = s.db.GetChatMembers(chat.ID); err != nil {
+			logger.Errorf("Ошибка получения участников чата %d: %v", chat.ID, err)
+			SendInternalError(c, "Ошибка получения участников чата")
+			return
+		}
+	}
+	c.JSON(http.StatusOK, resp)
 }
 
 // handleUpdateChat обновляет информацию о чате
 func (s *Server) handleUpdateChat(c *gin.Context) {
-	// TODO: Реализовать обновление информации о чате
+	user, chat, member, ok := s.loadChatEditor(c)
+	if !ok {
+		return
+	}
+
+	var req updateChatRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		SendBadRequest(c, "Некорректные данные запроса: "+err.Error())
+		return
+	}
+
+	if req.Name == nil && req.Description == nil && req.Handle == nil && req.SignMessages == nil && req.SlowMode == nil &&
+		req.HistoryVisibility == nil {
+		SendBadRequest(c, "Не указаны изменяемые поля")
+		return
+	}
+	if req.SignMessages != nil && chat.Type != models.ChatTypeChannel {
+		SendBadRequest(c, "Подпись постов настраивается только в каналах")
+		return
+	}
+	if req.SlowMode != nil && chat.Type != models.ChatTypeGroup {
+		SendBadRequest(c, "Медленный режим настраивается только в групповых чатах")
+		return
+	}
+	// Права на изменение чата недостаточно: медленный режим, как и освобождение
+	// от него, - привилегия администраторов
+	if req.SlowMode != nil && !slowModeExempt(user, member) {
+		SendForbidden(c, "Медленный режим могут настраивать только администраторы")
+		return
+	}
+
+	// Все поля проверяются до изменения первого из них, чтобы запрос с ошибкой
+	// не применялся частично
+	var sendErr *sendMessageError
+	if req.Handle != nil {
+		_, sendErr = normalizeChatHandle(*req.Handle)
+	}
+	if sendErr == nil && req.Name != nil {
+		_, sendErr = normalizeChatName(*req.Name)
+	}
+	if sendErr == nil && req.Description != nil {
+		_, sendErr = normalizeChatDescription(*req.Description)
+	}
+	if sendErr == nil && req.SlowMode != nil {
+		sendErr = validateSlowMode(*req.SlowMode)
+	}
+	if sendErr == nil && req.HistoryVisibility != nil {
+		sendErr = validateHistoryVisibility(*req.HistoryVisibility)
+	}
+	if sendErr != nil {
+		SendError(c, sendErr.Status, sendErr.Code, sendErr.Message)
+		return
+	}
+	if req.HistoryVisibility != nil && chat.Type != models.ChatTypeGroup {
+		SendBadRequest(c, "Видимость истории настраивается только в групповых чатах")
+		return
+	}
+
+	// Каждое изменение публикуется своим служебным сообщением. Публичное имя
+	// меняется первым: оно может оказаться занятым, и тогда остальное, включая
+	// подпись постов, не меняется.
+	var messages []*messageResponse
+	if req.Handle != nil {
+		message, sendErr := s.setChatHandle(user, chat, *req.Handle)
+		if sendErr != nil {
+			SendError(c, sendErr.Status, sendErr.Code, sendErr.Message)
+			return
+		}
+		if message != nil {
+			messages = append(messages, message)
+		}
+	}
+	if req.SignMessages != nil && *req.SignMessages != chat.SignMessages {
+		if sendErr := s.setChannelSignatures(user, chat, *req.SignMessages); sendErr != nil {
+			SendError(c, sendErr.Status, sendErr.Code, sendErr.Message)
+			return
+		}
+	}
+	if req.Name != nil && *req.Name != chat.Name {
+		message, sendErr := s.renameChat(user, chat, *req.Name)
+		if sendErr != nil {
+			SendError(c, sendErr.Status, sendErr.Code, sendErr.Message)
+			return
+		}
+		messages = append(messages, message)
+	}
+	if req.Description != nil {
+		message, sendErr := s.setChatDescription(user, chat, *req.Description)
+		if sendErr != nil {
+			SendError(c, sendErr.Status, sendErr.Code, sendErr.Message)
+			return
+		}
+		if message != nil {
+			messages = append(messages, message)
+		}
+	}
+	if req.SlowMode != nil {
+		message, sendErr := s.setChatSlowMode(user, chat, *req.SlowMode)
+		if sendErr != nil {
+			SendError(c, sendErr.Status, sendErr.Code, sendErr.Message)
+			return
+		}
+		if message != nil {
+			messages = append(messages, message)
+		}
+	}
+	if req.HistoryVisibility != nil {
+		message, sendErr := s.setChatHistoryVisibility(user, chat, *req.HistoryVisibility)
+		if sendErr != nil {
+			SendError(c, sendErr.Status, sendErr.Code, sendErr.Message)
+			return
+		}
+		if message != nil {
+			messages = append(messages, message)
+		}
+	}
+
+	resp := chatChangeResponse{}
+	if len(messages) > 0 {
+		resp.Message = messages[len(messages)-1]
+	}
+	if len(messages) > 1 {
+		resp.Messages = messages
+	}
+	c.JSON(http.StatusOK, resp)
 }
 
 // handleLeaveChat позволяет пользователю покинуть групповой чат
 func (s *Server) handleLeaveChat(c *gin.Context) {
-	// TODO: Реализовать выход из чата
+	user, chat, _, ok := s.loadChatMembership(c)
+	if !ok {
+		return
+	}
+	if !chat.HasRoles() {
+		SendBadRequest(c, "Покинуть можно только групповой чат или канал")
+		return
+	}
+
+	if _, sendErr := s.removeChatMember(user, chat, user); sendErr != nil {
+		SendError(c, sendErr.Status, sendErr.Code, sendErr.Message)
+		return
+	}
+	c.Status(http.StatusNoContent)
 }
 
 // handleAddUserToChat добавляет пользователя в групповой чат
 func (s *Server) handleAddUserToChat(c *gin.Context) {
-	// TODO: Реализовать добавление пользователя в чат
+	user, chat, member, ok := s.loadChatMembership(c)
+	if !ok {
+		return
+	}
+	if !chat.HasRoles() {
+		SendBadRequest(c, "Добавлять участников можно только в групповой чат или канал")
+		return
+	}
+	if !chatAllows(user, chat, member, models.PermAddMembers) {
+		SendForbidden(c, "Недостаточно прав для добавления участников")
+		return
+	}
+
+	var req addChatUsersRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		SendBadRequest(c, "Некорректные данные запроса: "+err.Error())
+		return
+	}
+	userIDs := req.UserIDs
+	if req.UserID != 0 {
+		userIDs = append(userIDs, req.UserID)
+	}
+	if len(userIDs) == 0 {
+		SendBadRequest(c, "Не указаны пользователи для добавления")
+		return
+	}
+
+	var users []models.User
+	if err := s.db.DB.Where("id IN ?", userIDs).Find(&users).Error; err != nil {
+		logger.Errorf("Ошибка проверки пользователей при добавлении в чат: %v", err)
+		SendInternalError(c, "Ошибка при проверке пользователей")
+		return
+	}
+	found := make(map[uint]bool, len(users))
+	for _, u := range users {
+		found[u.ID] = true
+	}
+	for _, id := range userIDs {
+		if !found[id] {
+			SendBadRequest(c, "Один или несколько указанных пользователей не найдены")
+			return
+		}
+	}
+
+	added, message, sendErr := s.addChatMembers(user, chat, users)
+	if sendErr != nil {
+		SendError(c, sendErr.Status, sendErr.Code, sendErr.Message)
+		return
+	}
+	if len(added) == 0 {
+		SendError(c, http.StatusConflict, "ALREADY_MEMBER", "Все указанные пользователи уже состоят в чате")
+		return
+	}
+	c.JSON(http.StatusCreated, chatChangeResponse{UserIDs: added, Message: message})
 }
 
 // handleRemoveUserFromChat удаляет пользователя из группового чата
 func (s *Server) handleRemoveUserFromChat(c *gin.Context) {
-	// TODO: Реализовать удаление пользователя из чата
+	user, chat, member, ok := s.loadChatMembership(c)
+	if !ok {
+		return
+	}
+	if !chat.HasRoles() {
+		SendBadRequest(c, "Удалять участников можно только из группового чата или канала")
+		return
+	}
+
+	targetID, err := strconv.ParseUint(c.Param("userID"), 10, 32)
+	if err != nil {
+		SendBadRequest(c, "Некорректный ID пользователя")
+		return
+	}
+	if uint(targetID) == user.ID {
+		SendBadRequest(c, "Нельзя удалить из чата самого себя, используйте выход из чата")
+		return
+	}
+
+	target, err := s.db.GetChatMember(chat.ID, uint(targetID))
+	if err != nil {
+		SendNotFound(c, "Пользователь не состоит в чате")
+		return
+	}
+	if !canModerateMember(user, member, target) {
+		SendForbidden(c, "Недостаточно прав для удаления этого участника")
+		return
+	}
+	targetUser, err := s.db.GetUserByID(target.UserID)
+	if err != nil {
+		SendInternalError(c, "Ошибка получения данных пользователя")
+		return
+	}
+
+	if _, sendErr := s.removeChatMember(user, chat, targetUser); sendErr != nil {
+		SendError(c, sendErr.Status, sendErr.Code, sendErr.Message)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// Структура запроса для изменения роли участника
+type setChatRoleRequest struct {
+	Role models.ChatRole `json:"role" binding:"required"`
+}
+
+// Структура запроса для изменения матрицы прав: изменяемые действия и минимальные роли
+type updateChatPermissionsRequest struct {
+	Permissions models.ChatPermissions `json:"permissions" binding:"required"`
+}
+
+// handleSetChatMemberRole меняет роль участника группового чата.
+// Назначать можно роли ниже собственной и только участникам с более низкой ролью;
+// роль владельца может передать только владелец.
+func (s *Server) handleSetChatMemberRole(c *gin.Context) {
+	user, chat, member, ok := s.loadChatMembership(c)
+	if !ok {
+		return
+	}
+	if !chat.HasRoles() {
+		SendBadRequest(c, "Роли участников есть только в групповых чатах и каналах")
+		return
+	}
+
+	targetID, err := strconv.ParseUint(c.Param("userID"), 10, 32)
+	if err != nil {
+		SendBadRequest(c, "Некорректный ID пользователя")
+		return
+	}
+	var req setChatRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		SendBadRequest(c, "Некорректные данные запроса: "+err.Error())
+		return
+	}
+	if !req.Role.Valid() {
+		SendBadRequest(c, "Неизвестная роль: "+string(req.Role))
+		return
+	}
+	if uint(targetID) == user.ID {
+		SendBadRequest(c, "Нельзя изменить собственную роль")
+		return
+	}
+
+	target, err := s.db.GetChatMember(chat.ID, uint(targetID))
+	if err != nil {
+		SendNotFound(c, "Пользователь не состоит в чате")
+		return
+	}
+	if target.Role == req.Role {
+		SendBadRequest(c, "Участник уже имеет эту роль")
+		return
+	}
+	// Без владельца чат не остается: его роль меняется только передачей другому участнику
+	if target.Role == models.ChatRoleOwner {
+		SendBadRequest(c, "Чтобы сменить владельца, передайте права владельца другому участнику")
+		return
+	}
+
+	isSystemAdmin := user.Role == "admin"
+	if req.Role == models.ChatRoleOwner {
+		if member.Role != models.ChatRoleOwner && !isSystemAdmin {
+			SendForbidden(c, "Передать права владельца может только владелец чата")
+			return
+		}
+	} else if !canModerateMember(user, member, target) || (!isSystemAdmin && req.Role.Rank() >= member.Role.Rank()) {
+		SendForbidden(c, "Недостаточно прав для назначения этой роли")
+		return
+	}
+
+	targetUser, err := s.db.GetUserByID(target.UserID)
+	if err != nil {
+		SendInternalError(c, "Ошибка получения данных пользователя")
+		return
+	}
+
+	message, sendErr := s.setChatMemberRole(user, chat, targetUser, req.Role)
+	if sendErr != nil {
+		SendError(c, sendErr.Status, sendErr.Code, sendErr.Message)
+		return
+	}
+	c.JSON(http.StatusOK, chatChangeResponse{Message: message})
+}
+
+// handleUpdateChatPermissions меняет матрицу прав группового чата. Доступно владельцу.
+func (s *Server) handleUpdateChatPermissions(c *gin.Context) {
+	user, chat, member, ok := s.loadChatMembership(c)
+	if !ok {
+		return
+	}
+	if !chat.HasRoles() {
+		SendBadRequest(c, "Права участников настраиваются только в групповых чатах и каналах")
+		return
+	}
+	if member.Role != models.ChatRoleOwner && user.Role != "admin" {
+		SendForbidden(c, "Изменять права участников может только владелец чата")
+		return
+	}
+
+	var req updateChatPermissionsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		SendBadRequest(c, "Некорректные данные запроса: "+err.Error())
+		return
+	}
+
+	message, sendErr := s.updateChatPermissions(user, chat, req.Permissions)
+	if sendErr != nil {
+		SendError(c, sendErr.Status, sendErr.Code, sendErr.Message)
+		return
+	}
+	c.JSON(http.StatusOK, chatChangeResponse{Message: message})
 }
@@ -0,0 +1,267 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+
+	"messenger/database"
+)
+
+// fakeTable - содержимое таблицы, которое возвращается на SELECT из нее. Из условий
+// запроса учитывается только первый отбор по столбцу таблицы вида column IN (...) или
+// column = $n; остальные условия не разбираются. Для подсчета запросов достаточно,
+// чтобы gorm получил строки и прошел по всем веткам обработчика.
+type fakeTable struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+// fakeDB - драйвер database/sql, который отвечает данными из fakeTable и считает запросы
+type fakeDB struct {
+	mu      sync.Mutex
+	tables  map[string]*fakeTable
+	queries int64
+}
+
+var (
+	fromTable = regexp.MustCompile(`(?i)\bFROM\s+"?(\w+)"?`)
+	keyFilter = regexp.MustCompile(`(?:"?\w+"?\.)?"?(\w+)"?\s*(?:IN\s*\(([^)]*)\)|=\s*(\$\d+))`)
+	argRef    = regexp.MustCompile(`\$(\d+)`)
+)
+
+func (d *fakeDB) Open(string) (driver.Conn, error) { return &fakeConn{db: d}, nil }
+
+type fakeConn struct{ db *fakeDB }
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("подготовленные запросы не поддерживаются")
+}
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *fakeConn) Commit() error             { return nil }
+func (c *fakeConn) Rollback() error           { return nil }
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	atomic.AddInt64(&c.db.queries, 1)
+	return driver.RowsAffected(0), nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	atomic.AddInt64(&c.db.queries, 1)
+
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	match := fromTable.FindStringSubmatch(query)
+	if match == nil {
+		return nil, fmt.Errorf("неизвестный запрос: %s", query)
+	}
+	table := c.db.tables[match[1]]
+	if table == nil {
+		table = &fakeTable{}
+	}
+	return &fakeRows{table: table.filter(query, args)}, nil
+}
+
+// filter оставляет строки, подходящие под отбор по ключу из запроса
+func (t *fakeTable) filter(query string, args []driver.NamedValue) *fakeTable {
+	for _, m := range keyFilter.FindAllStringSubmatch(query, -1) {
+		column := -1
+		for i, name := range t.columns {
+			if name == m[1] {
+				column = i
+			}
+		}
+		if column < 0 {
+			continue
+		}
+
+		wanted := make(map[string]bool)
+		for _, ref := range argRef.FindAllStringSubmatch(m[2]+m[3], -1) {
+			n, _ := strconv.Atoi(ref[1])
+			if n >= 1 && n <= len(args) {
+				wanted[fmt.Sprint(args[n-1].Value)] = true
+			}
+		}
+		result := &fakeTable{columns: t.columns}
+		for _, row := range t.rows {
+			if wanted[fmt.Sprint(row[column])] {
+				result.rows = append(result.rows, row)
+			}
+		}
+		return result
+	}
+	return t
+}
+
+type fakeRows struct {
+	table *fakeTable
+	next  int
+}
+
+func (r *fakeRows) Columns() []string { return r.table.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.table.rows) {
+		return io.EOF
+	}
+	copy(dest, r.table.rows[r.next])
+	r.next++
+	return nil
+}
+
+var fakeDriverSeq int64
+
+func fakeChatType(i int) string {
+	if i%3 == 0 {
+		return "channel"
+	}
+	return "group"
+}
+
+// newFakeServer создает сервер поверх fakeDB. Пользователь 1 состоит в chats чатах
+// вместе с пользователем 2, у каждого чата есть последнее сообщение. Каждый третий чат - канал.
+func newFakeServer(t testing.TB, chats int) (*Server, *fakeDB) {
+	t.Helper()
+
+	now := time.Now()
+	fake := &fakeDB{tables: map[string]*fakeTable{
+		"chats":      {columns: []string{"id", "name", "type", "history_visibility", "created_at", "last_activity", "last_message_id"}},
+		"chat_users": {columns: []string{"chat_id", "user_id", "joined_at", "unread_count"}},
+		"users": {columns: []string{"id", "username"}, rows: [][]driver.Value{
+			{int64(1), "alice"},
+			{int64(2), "bob"},
+		}},
+		"messages": {columns: []string{"id", "chat_id", "user_id", "seq", "type", "created_at"}},
+	}}
+	for i := 1; i <= chats; i++ {
+		id := int64(i)
+		fake.tables["chats"].rows = append(fake.tables["chats"].rows,
+			[]driver.Value{id, fmt.Sprintf("Чат %d", i), fakeChatType(i), "full", now, now, id})
+		fake.tables["chat_users"].rows = append(fake.tables["chat_users"].rows,
+			[]driver.Value{id, int64(1), now, int64(0)},
+			[]driver.Value{id, int64(2), now, int64(0)})
+		fake.tables["messages"].rows = append(fake.tables["messages"].rows,
+			[]driver.Value{id, id, int64(2), int64(1), "text", now})
+	}
+
+	name := fmt.Sprintf("fake-chats-%d", atomic.AddInt64(&fakeDriverSeq, 1))
+	sql.Register(name, fake)
+	conn, err := sql.Open(name, "")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: conn}), &gorm.Config{
+		Logger:                 gormlogger.Discard,
+		SkipDefaultTransaction: true,
+	})
+	if err != nil {
+		t.Fatalf("gorm.Open: %v", err)
+	}
+	atomic.StoreInt64(&fake.queries, 0)
+
+	return &Server{db: &database.Database{DB: db}}, fake
+}
+
+// getChats выполняет GET /chats от имени пользователя 1 и возвращает число запросов к БД
+func getChats(t *testing.T, s *Server, fake *fakeDB) (int64, int) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/chats", nil)
+	c.Set("userID", uint(1))
+
+	before := atomic.LoadInt64(&fake.queries)
+	s.handleGetChats(c)
+	queries := atomic.LoadInt64(&fake.queries) - before
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("статус %d: %s", w.Code, w.Body.String())
+	}
+	var body struct {
+		Chats []struct {
+			ID    uint   `json:"id"`
+			Type  string `json:"type"`
+			Users []struct {
+				ID uint `json:"id"`
+			} `json:"users"`
+			LastMessage *struct {
+				ID uint `json:"id"`
+			} `json:"last_message"`
+		} `json:"chats"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("разбор ответа: %v", err)
+	}
+	for _, chat := range body.Chats {
+		if chat.LastMessage == nil || chat.LastMessage.ID != chat.ID {
+			t.Fatalf("у чата %d нет последнего сообщения", chat.ID)
+		}
+		// Подписчики каналов в списке чатов не раскрываются
+		if chat.Type == "channel" && len(chat.Users) > 0 {
+			t.Fatalf("в канале %d возвращены подписчики", chat.ID)
+		}
+		if chat.Type == "group" && (len(chat.Users) != 1 || chat.Users[0].ID != 2) {
+			t.Fatalf("в группе %d участники %v, ожидался собеседник 2", chat.ID, chat.Users)
+		}
+	}
+	return queries, len(body.Chats)
+}
+
+func TestGetChatsQueryCountIsConstant(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// Наименьший список, в котором есть и группы, и канал
+	few, fakeFew := newFakeServer(t, 3)
+	queriesFew, count := getChats(t, few, fakeFew)
+	if count != 3 {
+		t.Fatalf("чатов в ответе: %d, ожидалось 3", count)
+	}
+
+	many, fakeMany := newFakeServer(t, 60)
+	queriesMany, count := getChats(t, many, fakeMany)
+	if count != 60 {
+		t.Fatalf("чатов в ответе: %d, ожидалось 60", count)
+	}
+
+	if queriesMany != queriesFew {
+		t.Fatalf("запросов для 3 чатов: %d, для 60 чатов: %d; число запросов не должно зависеть от числа чатов",
+			queriesFew, queriesMany)
+	}
+}
+
+func BenchmarkGetChats(b *testing.B) {
+	gin.SetMode(gin.TestMode)
+	s, fake := newFakeServer(b, 200)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/chats", nil)
+		c.Set("userID", uint(1))
+		s.handleGetChats(c)
+	}
+	b.ReportMetric(float64(atomic.LoadInt64(&fake.queries))/float64(b.N), "queries/op")
+}
@@ -0,0 +1,499 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+
+	"messenger/logger"
+	"messenger/models"
+	"messenger/utils/crypto"
+)
+
+// Настройки команд
+const (
+	// Допустимый срок напоминания
+	minReminderDelay = time.Minute
+	maxReminderDelay = 365 * 24 * time.Hour
+
+	// Периодичность проверки наступивших напоминаний
+	reminderCheckInterval = 30 * time.Second
+)
+
+// commandContext содержит данные для выполнения команды
+type commandContext struct {
+	User   *models.User
+	Chat   *models.Chat
+	Member *models.ChatUser
+	Args   []string
+	Origin *WSClient // Соединение, через которое отправлена команда; nil - REST
+}
+
+// commandResult содержит результат команды: опубликованное в чате сообщение
+// и/или ответ, который видит только вызвавший команду пользователь
+type commandResult struct {
+	Message  *messageResponse
+	Reply    string
+	RemindAt *time.Time // Время напоминания, установленного /remind
+}
+
+// commandReply - ответ на команду, видимый только ее автору
+type commandReply struct {
+	Command  string     `json:"command"`
+	ChatID   uint       `json:"chat_id"`
+	Text     string     `json:"text"`
+	RemindAt *time.Time `json:"remind_at,omitempty"` // Для /remind: время напоминания, чтобы клиент показал его в своем поясе
+}
+
+// slashCommand описывает команду чата
+type slashCommand struct {
+	Name        string
+	Usage       string
+	Description string
+	Permission  models.ChatPermission // Право из матрицы чата; пустое - команда доступна всем участникам
+	GroupOnly   bool                  // Команда доступна только в групповых чатах
+	MinArgs     int
+	MaxArgs     int  // -1 - без ограничения
+	RawTail     bool // Последний аргумент - остаток строки как есть, без разбора кавычек
+	Run         func(s *Server, ctx *commandContext) (*commandResult, *sendMessageError)
+}
+
+// commandInfo описывает команду в списке для автодополнения
+type commandInfo struct {
+	Name        string `json:"name"`
+	Usage       string `json:"usage"`
+	Description string `json:"description"`
+}
+
+// reminderPayload - напоминание, отправляемое пользователю в момент срабатывания
+type reminderPayload struct {
+	ID        uint      `json:"id"`
+	ChatID    uint      `json:"chat_id"`
+	Text      string    `json:"text"`
+	RemindAt  time.Time `json:"remind_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Зарегистрированные команды в порядке вывода в списке
+var slashCommands = []*slashCommand{
+	{
+		Name:        "me",
+		Usage:       "/me <действие>",
+		Description: "Описать действие от третьего лица",
+		Permission:  models.PermSendMessages,
+		MinArgs:     1,
+		MaxArgs:     1,
+		RawTail:     true,
+		Run:         (*Server).commandMe,
+	},
+	{
+		Name:        "topic",
+		Usage:       "/topic <название>",
+		Description: "Изменить название чата",
+		Permission:  models.PermChangeInfo,
+		GroupOnly:   true,
+		MinArgs:     1,
+		MaxArgs:     1,
+		RawTail:     true,
+		Run:         (*Server).commandTopic,
+	},
+	{
+		Name:        "remind",
+		Usage:       "/remind <через сколько: 30m, 2h, 1d> <текст>",
+		Description: "Создать напоминание для себя",
+		MinArgs:     2,
+		MaxArgs:     2,
+		RawTail:     true,
+		Run:         (*Server).commandRemind,
+	},
+	{
+		Name:        "poll",
+		Usage:       `/poll "вопрос" "вариант 1" "вариант 2" ...`,
+		Description: "Создать опрос",
+		GroupOnly:   true,
+		MinArgs:     1 + models.PollMinOptions,
+		MaxArgs:     1 + models.PollMaxOptions,
+		Run:         (*Server).commandPoll,
+	},
+	{
+		Name:        "invite",
+		Usage:       "/invite @пользователь ...",
+		Description: "Добавить пользователей в чат",
+		Permission:  models.PermAddMembers,
+		GroupOnly:   true,
+		MinArgs:     1,
+		MaxArgs:     10,
+		Run:         (*Server).commandInvite,
+	},
+}
+
+// findCommand возвращает команду по имени
+func findCommand(name string) *slashCommand {
+	for _, cmd := range slashCommands {
+		if cmd.Name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// allowed проверяет, может ли участник выполнить команду в чате
+func (cmd *slashCommand) allowed(user *models.User, chat *models.Chat, member *models.ChatUser) bool {
+	if cmd.GroupOnly && !chat.HasRoles() {
+		return false
+	}
+	if cmd.Permission != "" {
+		return chatAllows(user, chat, member, cmd.Permission)
+	}
+	return true
+}
+
+// submitMessage отправляет сообщение или выполняет команду, если текст начинается с /.
+// Текст, начинающийся с //, отправляется как обычное сообщение без первого слеша.
+// Возвращает опубликованное сообщение и/или ответ команды для автора.
+func (s *Server) submitMessage(userID uint, out outgoingMessage) (*messageResponse, *commandReply, *sendMessageError) {
+	if out.Type == "" || out.Type == string(models.MessageTypeText) {
+		if strings.HasPrefix(out.Content, "//") {
+			out.Content = out.Content[1:]
+		} else if name, rest, ok := parseCommandName(out.Content); ok {
+			return s.runCommand(userID, out.ChatID, name, rest, out.Origin)
+		}
+	}
+
+	message, err := s.postMessage(userID, out)
+	return message, nil, err
+}
+
+// parseCommandName выделяет имя команды: /имя, за которым следует пробел или конец текста.
+// Текст вроде "/usr/bin" командой не считается.
+func parseCommandName(content string) (string, string, bool) {
+	if !strings.HasPrefix(content, "/") {
+		return "", "", false
+	}
+
+	end := strings.IndexFunc(content, unicode.IsSpace)
+	if end == -1 {
+		end = len(content)
+	}
+	name := content[1:end]
+	if name == "" {
+		return "", "", false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_') {
+			return "", "", false
+		}
+	}
+
+	return strings.ToLower(name), content[end:], true
+}
+
+// runCommand проверяет права и аргументы и выполняет команду. origin - соединение,
+// через которое команда отправлена (nil для REST).
+func (s *Server) runCommand(userID, chatID uint, name, rest string, origin *WSClient) (*messageResponse, *commandReply, *sendMessageError) {
+	cmd := findCommand(name)
+	if cmd == nil {
+		return nil, nil, &sendMessageError{http.StatusBadRequest, "UNKNOWN_COMMAND",
+			"Неизвестная команда /" + name + ". Чтобы отправить текст, начинающийся с /, используйте //"}
+	}
+
+	member, err := s.db.GetChatMember(chatID, userID)
+	if err != nil {
+		return nil, nil, &sendMessageError{http.StatusForbidden, "FORBIDDEN", "У вас нет доступа к этому чату"}
+	}
+	chat, err := s.db.GetChatByID(chatID)
+	if err != nil {
+		return nil, nil, &sendMessageError{http.StatusNotFound, "NOT_FOUND", "Чат не найден"}
+	}
+	user, err := s.db.GetUserByID(userID)
+	if err != nil {
+		return nil, nil, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка получения данных пользователя"}
+	}
+
+	if cmd.GroupOnly && !chat.HasRoles() {
+		return nil, nil, &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", "Команда /" + cmd.Name + " доступна только в групповых чатах и каналах"}
+	}
+	if !cmd.allowed(user, chat, member) {
+		return nil, nil, &sendMessageError{http.StatusForbidden, "FORBIDDEN", "Недостаточно прав для команды /" + cmd.Name}
+	}
+	// Команды, которые пишут в чат от имени участника, недоступны заглушенному
+	if cmd.Permission == models.PermSendMessages && chat.HasRoles() {
+		if sendErr := s.checkMuted(chat.ID, userID); sendErr != nil {
+			return nil, nil, sendErr
+		}
+	}
+
+	args, err := splitCommandArgs(rest, cmd.MaxArgs, cmd.RawTail)
+	if err != nil || len(args) < cmd.MinArgs {
+		return nil, nil, &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", "Использование: " + cmd.Usage}
+	}
+
+	result, sendErr := cmd.Run(s, &commandContext{User: user, Chat: chat, Member: member, Args: args, Origin: origin})
+	if sendErr != nil {
+		return nil, nil, sendErr
+	}
+
+	var reply *commandReply
+	if result.Reply != "" {
+		reply = &commandReply{Command: cmd.Name, ChatID: chatID, Text: result.Reply, RemindAt: result.RemindAt}
+	}
+	return result.Message, reply, nil
+}
+
+// splitCommandArgs разбивает аргументы команды по пробелам. Аргумент с пробелами
+// заключается в двойные кавычки, внутри них допускаются \" и \\.
+// При rawTail последний аргумент берется как остаток строки.
+func splitCommandArgs(input string, maxArgs int, rawTail bool) ([]string, error) {
+	input = strings.TrimSpace(input)
+
+	var args []string
+	for input != "" {
+		if rawTail && len(args) == maxArgs-1 {
+			args = append(args, input)
+			break
+		}
+		if maxArgs >= 0 && len(args) == maxArgs {
+			return nil, errors.New("слишком много аргументов")
+		}
+
+		arg, rest, err := nextCommandArg(input)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		input = strings.TrimLeftFunc(rest, unicode.IsSpace)
+	}
+	return args, nil
+}
+
+// nextCommandArg возвращает первый аргумент строки и остаток после него
+func nextCommandArg(input string) (string, string, error) {
+	if !strings.HasPrefix(input, `"`) {
+		end := strings.IndexFunc(input, unicode.IsSpace)
+		if end == -1 {
+			return input, "", nil
+		}
+		return input[:end], input[end:], nil
+	}
+
+	var arg strings.Builder
+	escaped := false
+	for i, r := range input[1:] {
+		switch {
+		case escaped:
+			if r != '"' && r != '\\' {
+				arg.WriteRune('\\')
+			}
+			arg.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			return arg.String(), input[i+2:], nil
+		default:
+			arg.WriteRune(r)
+		}
+	}
+	return "", "", errors.New("незакрытая кавычка")
+}
+
+// commandMe публикует действие пользователя: "/me машет рукой" -> "alice машет рукой"
+func (s *Server) commandMe(ctx *commandContext) (*commandResult, *sendMessageError) {
+	message, err := s.postEventMessage(ctx.Chat.ID, ctx.User, models.SystemEvent{
+		Kind:   models.SystemEventAction,
+		Params: map[string]string{models.SystemParamText: ctx.Args[0]},
+	}, ctx.Origin)
+	if err != nil {
+		return nil, err
+	}
+	return &commandResult{Message: message}, nil
+}
+
+// commandTopic меняет название группового чата
+func (s *Server) commandTopic(ctx *commandContext) (*commandResult, *sendMessageError) {
+	message, err := s.renameChat(ctx.User, ctx.Chat, ctx.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	return &commandResult{Message: message}, nil
+}
+
+// commandRemind сохраняет напоминание, которое придет автору в указанное время
+func (s *Server) commandRemind(ctx *commandContext) (*commandResult, *sendMessageError) {
+	delay, err := parseReminderDelay(ctx.Args[0])
+	if err != nil || delay < minReminderDelay || delay > maxReminderDelay {
+		return nil, &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", "Укажите срок от 1 минуты до 365 дней, например 30m, 2h или 1d"}
+	}
+
+	text, encErr := crypto.Encrypt([]byte(ctx.Args[1]))
+	if encErr != nil {
+		logger.Errorf("Ошибка шифрования напоминания: %v", encErr)
+		return nil, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка сохранения напоминания"}
+	}
+
+	reminder := models.Reminder{
+		UserID:   ctx.User.ID,
+		ChatID:   ctx.Chat.ID,
+		Text:     text,
+		RemindAt: time.Now().Add(delay),
+	}
+	if err := s.db.CreateReminder(&reminder); err != nil {
+		logger.Errorf("Ошибка сохранения напоминания: %v", err)
+		return nil, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка сохранения напоминания"}
+	}
+
+	remindAt := reminder.RemindAt.UTC()
+	return &commandResult{Reply: "Напоминание установлено на " + formatUTC(remindAt), RemindAt: &remindAt}, nil
+}
+
+// parseReminderDelay разбирает срок напоминания: 30m, 2h30m, 1d, 1d12h
+func parseReminderDelay(value string) (time.Duration, error) {
+	var days time.Duration
+	if i := strings.IndexByte(value, 'd'); i != -1 {
+		n, err := strconv.Atoi(value[:i])
+		if err != nil || n < 0 {
+			return 0, errors.New("некорректное число дней")
+		}
+		days = time.Duration(n) * 24 * time.Hour
+		value = value[i+1:]
+		if value == "" {
+			return days, nil
+		}
+	}
+
+	delay, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	return days + delay, nil
+}
+
+// commandPoll создает опрос: первый аргумент - вопрос, остальные - варианты ответа
+func (s *Server) commandPoll(ctx *commandContext) (*commandResult, *sendMessageError) {
+	message, err := s.postMessage(ctx.User.ID, outgoingMessage{
+		ChatID:  ctx.Chat.ID,
+		Content: ctx.Args[0],
+		Type:    string(models.MessageTypePoll),
+		Poll:    &pollRequest{Options: ctx.Args[1:]},
+		Origin:  ctx.Origin,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &commandResult{Message: message}, nil
+}
+
+// commandInvite добавляет пользователей в групповой чат по именам
+func (s *Server) commandInvite(ctx *commandContext) (*commandResult, *sendMessageError) {
+	users := make([]models.User, 0, len(ctx.Args))
+	for _, arg := range ctx.Args {
+		username := strings.TrimPrefix(arg, "@")
+
+		var user models.User
+		if err := s.db.DB.Where("LOWER(username) = LOWER(?)", username).First(&user).Error; err != nil {
+			return nil, &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", "Пользователь " + username + " не найден"}
+		}
+		users = append(users, user)
+	}
+
+	added, message, err := s.addChatMembers(ctx.User, ctx.Chat, users)
+	if err != nil {
+		return nil, err
+	}
+	if len(added) == 0 {
+		return &commandResult{Reply: "Все указанные пользователи уже состоят в чате"}, nil
+	}
+	if message == nil {
+		return &commandResult{Reply: "Добавлено подписчиков: " + strconv.Itoa(len(added))}, nil
+	}
+	return &commandResult{Message: message}, nil
+}
+
+// handleGetChatCommands возвращает команды, доступные пользователю в чате
+func (s *Server) handleGetChatCommands(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	chatID, err := strconv.ParseUint(c.Param("chatID"), 10, 32)
+	if err != nil {
+		SendBadRequest(c, "Некорректный ID чата")
+		return
+	}
+
+	member, err := s.db.GetChatMember(uint(chatID), userID)
+	if err != nil {
+		SendForbidden(c, "У вас нет доступа к этому чату")
+		return
+	}
+	chat, err := s.db.GetChatByID(uint(chatID))
+	if err != nil {
+		SendNotFound(c, "Чат не найден")
+		return
+	}
+	user, err := s.db.GetUserByID(userID)
+	if err != nil {
+		SendInternalError(c, "Ошибка получения данных пользователя")
+		return
+	}
+
+	commands := make([]commandInfo, 0, len(slashCommands))
+	for _, cmd := range slashCommands {
+		if cmd.allowed(user, chat, member) {
+			commands = append(commands, commandInfo{Name: cmd.Name, Usage: cmd.Usage, Description: cmd.Description})
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"commands": commands,
+	})
+}
+
+// startReminders запускает доставку наступивших напоминаний.
+// Напоминания пользователей без подключения ждут их следующего подключения.
+func (s *Server) startReminders() {
+	go func() {
+		ticker := time.NewTicker(reminderCheckInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			s.deliverDueReminders()
+		}
+	}()
+}
+
+// deliverDueReminders отправляет наступившие напоминания подключенным пользователям
+func (s *Server) deliverDueReminders() {
+	now := time.Now()
+	reminders, err := s.db.GetDueReminders(s.onlineUserIDs(), now, 100)
+	if err != nil {
+		logger.Errorf("Ошибка получения напоминаний: %v", err)
+		return
+	}
+
+	for _, reminder := range reminders {
+		text, err := crypto.Decrypt(reminder.Text)
+		if err != nil {
+			logger.Errorf("Ошибка расшифровки напоминания #%d: %v", reminder.ID, err)
+			text = []byte("[Ошибка расшифровки]")
+		}
+
+		payload := reminderPayload{
+			ID:        reminder.ID,
+			ChatID:    reminder.ChatID,
+			Text:      string(text),
+			RemindAt:  reminder.RemindAt,
+			CreatedAt: reminder.CreatedAt,
+		}
+		if err := s.sendMessageToUser(reminder.UserID, wsResponse{Type: WSTypeReminder, Payload: payload}); err != nil {
+			logger.Errorf("Ошибка отправки напоминания #%d: %v", reminder.ID, err)
+			continue
+		}
+		if err := s.db.MarkReminderDelivered(reminder.ID, now); err != nil {
+			logger.Errorf("Ошибка отметки доставки напоминания #%d: %v", reminder.ID, err)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"messenger/export"
+	"messenger/logger"
+	"messenger/models"
+)
+
+// Настройки выгрузки истории чатов
+const (
+	// Директория для файлов фоновых выгрузок
+	exportDir = "./exports"
+
+	// Число сообщений, загружаемых из БД за один запрос
+	exportBatchSize = 500
+
+	// Чаты длиннее этого числа сообщений выгружаются только в фоне
+	exportSyncLimit = 5000
+
+	// Срок хранения файла фоновой выгрузки
+	exportTTL = 24 * time.Hour
+
+	// Периодичность удаления устаревших выгрузок
+	exportCleanupInterval = time.Hour
+)
+
+// Ограничение числа одновременно выполняемых фоновых выгрузок
+var exportSlots = make(chan struct{}, 2)
+
+// handleExportChat выгружает историю чата в формате json, html или txt.
+// Небольшие чаты отдаются потоком сразу, большие (или при async=true) выгружаются в фоне.
+func (s *Server) handleExportChat(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	chatID, err := strconv.ParseUint(c.Param("chatID"), 10, 32)
+	if err != nil {
+		SendBadRequest(c, "Некорректный ID чата")
+		return
+	}
+
+	member, err := s.db.GetChatMember(uint(chatID), userID)
+	if err != nil {
+		SendForbidden(c, "У вас нет доступа к этому чату")
+		return
+	}
+
+	format := c.DefaultQuery("format", export.FormatJSON)
+	if !export.IsSupported(format) {
+		SendBadRequest(c, "Неподдерживаемый формат выгрузки")
+		return
+	}
+
+	chat, err := s.db.GetChatByID(uint(chatID))
+	if err != nil {
+		SendNotFound(c, "Чат не найден")
+		return
+	}
+
+	if c.Query("async") == "true" || chat.LastSeq > exportSyncLimit {
+		job := models.ExportJob{
+			ChatID: chat.ID,
+			UserID: userID,
+			Format: format,
+			Status: models.ExportStatusPending,
+		}
+		if err := s.db.CreateExportJob(&job); err != nil {
+			logger.Errorf("Ошибка создания выгрузки чата %d: %v", chat.ID, err)
+			SendInternalError(c, "Ошибка создания выгрузки")
+			return
+		}
+
+		go s.runExportJob(job, chat)
+
+		c.JSON(http.StatusAccepted, gin.H{
+			"job": job,
+		})
+		return
+	}
+
+	c.Header("Content-Type", export.ContentType(format))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=chat-%d.%s", chat.ID, format))
+	c.Header("Cache-Control", "no-cache")
+	c.Status(http.StatusOK)
+
+	writer, err := export.NewWriter(format, c.Writer)
+	if err != nil {
+		SendBadRequest(c, err.Error())
+		return
+	}
+
+	// Заголовки уже отправлены, поэтому ошибку можно только записать в журнал
+	if _, err := s.writeChatExport(chat, chat.HistoryVisibleSince(member), writer); err != nil {
+		logger.Errorf("Ошибка выгрузки чата %d: %v", chat.ID, err)
+	}
+}
+
+// writeChatExport записывает историю чата постранично по seq. Возвращает число сообщений.
+// Если since не nil, выгружаются только сообщения, отправленные не раньше него.
+func (s *Server) writeChatExport(chat *models.Chat, since *time.Time, writer export.Writer) (int, error) {
+	info := export.ChatInfo{
+		ID:         chat.ID,
+		Name:       chat.Name,
+		Type:       chat.Type,
+		ExportedAt: time.Now(),
+	}
+	if err := writer.Begin(info); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	var afterSeq uint64
+	for {
+		messages, err := s.db.GetMessagesAfterSeq(chat.ID, afterSeq, since, exportBatchSize)
+		if err != nil {
+			return count, err
+		}
+
+		for i := range messages {
+			if err := writer.WriteMessage(newExportMessage(&messages[i])); err != nil {
+				return count, err
+			}
+			count++
+		}
+
+		if len(messages) < exportBatchSize {
+			break
+		}
+		afterSeq = messages[len(messages)-1].Seq
+	}
+
+	return count, writer.End()
+}
+
+// newExportMessage формирует выгружаемое сообщение с расшифрованным содержимым
+func newExportMessage(msg *models.Message) export.Message {
+	response := newMessageResponse(msg)
+
+	message := export.Message{
+		ID:        msg.ID,
+		Seq:       msg.Seq,
+		AuthorID:  msg.UserID,
+		Author:    msg.User.Username,
+		Type:      msg.Type,
+		Text:      response.Content,
+		Entities:  response.Entities,
+		CreatedAt: msg.CreatedAt,
+	}
+	if message.Author == "" {
+		message.Author = fmt.Sprintf("Пользователь #%d", msg.UserID)
+	}
+
+	// Сообщение считается измененным, если оно обновлялось после создания. Местоположение
+	// не редактируется, а в ранее сохраненных трансляциях время изменения сообщения
+	// сдвигалось с каждой новой точкой.
+	if msg.Type != string(models.MessageTypeLocation) && msg.UpdatedAt.Sub(msg.CreatedAt) > time.Second {
+		editedAt := msg.UpdatedAt
+		message.EditedAt = &editedAt
+	}
+
+	if msg.File != nil {
+		message.File = &export.FileRef{
+			Name:     msg.File.FileName,
+			Size:     msg.File.FileSize,
+			MimeType: msg.File.MimeType,
+			URL:      "/api/files/download/" + msg.File.DownloadToken,
+		}
+	}
+
+	return message
+}
+
+// runExportJob выполняет фоновую выгрузку и оповещает пользователя о результате
+func (s *Server) runExportJob(job models.ExportJob, chat *models.Chat) {
+	exportSlots <- struct{}{}
+	defer func() { <-exportSlots }()
+
+	job.Status = models.ExportStatusRunning
+	if err := s.db.UpdateExportJob(&job); err != nil {
+		logger.Errorf("Ошибка обновления выгрузки #%d: %v", job.ID, err)
+	}
+
+	count, path, err := s.writeExportFile(job, chat)
+	now := time.Now()
+	job.FinishedAt = &now
+	job.Messages = count
+	if err != nil {
+		logger.Errorf("Ошибка фоновой выгрузки #%d чата %d: %v", job.ID, chat.ID, err)
+		job.Status = models.ExportStatusFailed
+		job.Error = "Ошибка выгрузки истории"
+	} else {
+		expiresAt := now.Add(exportTTL)
+		job.Status = models.ExportStatusDone
+		job.FilePath = path
+		job.ExpiresAt = &expiresAt
+		if info, err := os.Stat(path); err == nil {
+			job.FileSize = info.Size()
+		}
+	}
+
+	if err := s.db.UpdateExportJob(&job); err != nil {
+		logger.Errorf("Ошибка сохранения результата выгрузки #%d: %v", job.ID, err)
+		return
+	}
+
+	if err := s.sendMessageToUser(job.UserID, wsResponse{Type: WSTypeExportFinished, Payload: job}); err != nil {
+		logger.Errorf("Ошибка оповещения о выгрузке #%d: %v", job.ID, err)
+	}
+}
+
+// writeExportFile записывает выгрузку в файл. При ошибке незавершенный файл удаляется.
+func (s *Server) writeExportFile(job models.ExportJob, chat *models.Chat) (int, string, error) {
+	// Выгружается та история, которую видит запросивший ее участник
+	member, err := s.db.GetChatMember(chat.ID, job.UserID)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if err := os.MkdirAll(exportDir, 0755); err != nil {
+		return 0, "", err
+	}
+
+	path := filepath.Join(exportDir, fmt.Sprintf("chat-%d-export-%d.%s", chat.ID, job.ID, job.Format))
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, "", err
+	}
+
+	writer, err := export.NewWriter(job.Format, file)
+	if err == nil {
+		var count int
+		count, err = s.writeChatExport(chat, chat.HistoryVisibleSince(member), writer)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			return count, path, nil
+		}
+		os.Remove(path)
+		return count, "", err
+	}
+
+	file.Close()
+	os.Remove(path)
+	return 0, "", err
+}
+
+// loadExportJob возвращает выгрузку, принадлежащую текущему пользователю
+func (s *Server) loadExportJob(c *gin.Context, userID uint) (*models.ExportJob, bool) {
+	jobID, err := strconv.ParseUint(c.Param("jobID"), 10, 32)
+	if err != nil {
+		SendBadRequest(c, "Некорректный ID выгрузки")
+		return nil, false
+	}
+
+	job, err := s.db.GetExportJob(uint(jobID))
+	if err != nil || job.UserID != userID {
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			SendInternalError(c, "Ошибка получения выгрузки")
+			return nil, false
+		}
+		SendNotFound(c, "Выгрузка не найдена")
+		return nil, false
+	}
+
+	return job, true
+}
+
+// handleGetExportJob возвращает состояние фоновой выгрузки
+func (s *Server) handleGetExportJob(c *gin.Context) {
+	job, ok := s.loadExportJob(c, c.GetUint("userID"))
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"job": job,
+	})
+}
+
+// handleDownloadExport отдает файл завершенной фоновой выгрузки
+func (s *Server) handleDownloadExport(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	job, ok := s.loadExportJob(c, userID)
+	if !ok {
+		return
+	}
+
+	// Покинувший чат пользователь теряет доступ и к выгрузкам его истории
+	if !s.db.IsUserInChat(userID, job.ChatID) {
+		SendForbidden(c, "У вас нет доступа к этому чату")
+		return
+	}
+
+	if job.Status != models.ExportStatusDone {
+		SendError(c, http.StatusConflict, "EXPORT_NOT_READY", "Выгрузка еще не готова")
+		return
+	}
+	if job.FilePath == "" || (job.ExpiresAt != nil && time.Now().After(*job.ExpiresAt)) {
+		SendError(c, http.StatusGone, "EXPORT_EXPIRED", "Срок хранения выгрузки истек")
+		return
+	}
+
+	c.Header("Content-Type", export.ContentType(job.Format))
+	c.FileAttachment(job.FilePath, fmt.Sprintf("chat-%d.%s", job.ChatID, job.Format))
+}
+
+// startExportMaintenance помечает прерванные выгрузки и запускает удаление устаревших файлов
+func (s *Server) startExportMaintenance() {
+	if err := s.db.FailInterruptedExportJobs(); err != nil {
+		logger.Errorf("Ошибка обработки прерванных выгрузок: %v", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(exportCleanupInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			s.cleanupExpiredExports()
+		}
+	}()
+}
+
+// cleanupExpiredExports удаляет файлы выгрузок с истекшим сроком хранения
+func (s *Server) cleanupExpiredExports() {
+	jobs, err := s.db.GetExpiredExportJobs(time.Now())
+	if err != nil {
+		logger.Errorf("Ошибка получения устаревших выгрузок: %v", err)
+		return
+	}
+
+	for i := range jobs {
+		if err := os.Remove(jobs[i].FilePath); err != nil && !os.IsNotExist(err) {
+			logger.Errorf("Ошибка удаления файла выгрузки #%d: %v", jobs[i].ID, err)
+			continue
+		}
+		jobs[i].FilePath = ""
+		if err := s.db.UpdateExportJob(&jobs[i]); err != nil {
+			logger.Errorf("Ошибка обновления выгрузки #%d: %v", jobs[i].ID, err)
+		}
+	}
+}
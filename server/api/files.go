@@ -15,6 +15,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 
+	"messenger/audio"
 	"messenger/server/models"
 )
 
@@ -27,7 +28,7 @@ const (
 	maxFileSize = 100 * 1024 * 1024
 
 	// Разрешенные типы файлов
-	allowedMimeTypes = "image/jpeg,image/png,image/gif,application/pdf,application/msword,application/vnd.openxmlformats-officedocument.wordprocessingml.document,audio/mpeg,audio/mp4,video/mp4,video/mpeg,application/zip,application/x-zip-compressed"
+	allowedMimeTypes = "image/jpeg,image/png,image/gif,application/pdf,application/msword,application/vnd.openxmlformats-officedocument.wordprocessingml.document,audio/mpeg,audio/mp4,audio/ogg,audio/opus,audio/webm,video/mp4,video/mpeg,application/zip,application/x-zip-compressed"
 )
 
 // Генерация уникального токена для скачивания
@@ -58,6 +59,17 @@ func determineFileType(mimeType string) models.FileType {
 	}
 }
 
+// analyzeAudioFile определяет длительность и форму волны сохраненной аудиозаписи
+func analyzeAudioFile(path string) (*audio.Info, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return audio.Analyze(f)
+}
+
 // Проверка, разрешен ли тип файла
 func isAllowedFileType(mimeType string) bool {
 	allowedTypes := strings.Split(allowedMimeTypes, ",")
@@ -71,16 +83,19 @@ func isAllowedFileType(mimeType string) bool {
 
 // Структура запроса для загрузки файла
 type FileUploadRequest struct {
-	RecipientID uint                  `form:"recipient_id" binding:"required"`
+	ChatID      uint                  `form:"chat_id"`
+	TopicID     *uint                 `form:"topic_id"`
+	RecipientID uint                  `form:"recipient_id"` // Устаревший вариант: файл отправляется в личный чат с получателем
 	Message     string                `form:"message"`
+	Type        string                `form:"type"` // file (по умолчанию) или voice
 	File        *multipart.FileHeader `form:"file" binding:"required"`
 }
 
 // Обработчик загрузки файлов
 func (s *Server) handleFileUpload(c *gin.Context) {
 	// Получаем ID отправителя из контекста аутентификации
-	senderID, exists := c.Get("userID")
-	if !exists {
+	senderID := c.GetUint("userID")
+	if senderID == 0 {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Пользователь не авторизован"})
 		return
 	}
@@ -99,6 +114,43 @@ func (s *Server) handleFileUpload(c *gin.Context) {
 		return
 	}
 
+	// Определяем чат: по chat_id или личный чат с получателем
+	chatID := req.ChatID
+	if chatID == 0 {
+		if req.RecipientID == 0 || req.RecipientID == senderID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Не указан чат"})
+			return
+		}
+		if _, err := s.db.GetUserByID(req.RecipientID); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Получатель не найден"})
+			return
+		}
+		chat, err := s.db.GetOrCreateDirectChat(senderID, req.RecipientID)
+		if err != nil {
+			log.Printf("Ошибка получения личного чата: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
+			return
+		}
+		chatID = chat.ID
+	}
+	if !s.db.IsUserInChat(senderID, chatID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "У вас нет доступа к этому чату"})
+		return
+	}
+	wait, reserved := s.reserveSlowMode(senderID, chatID)
+	if wait > 0 {
+		sendSlowModeError(c, wait)
+		return
+	}
+	if reserved {
+		// Пока файл не отправлен сообщением, медленный режим не должен мешать повторной попытке
+		defer func() {
+			if c.Writer.Status() != http.StatusOK {
+				s.releaseSlowMode(senderID, chatID)
+			}
+		}()
+	}
+
 	// Проверяем размер файла
 	if req.File.Size > maxFileSize {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Размер файла превышает максимально допустимый"})
@@ -120,6 +172,19 @@ func (s *Server) handleFileUpload(c *gin.Context) {
 		return
 	}
 
+	// Голосовое сообщение - всегда аудиозапись
+	messageType := models.MessageTypeFile
+	if req.Type == string(models.MessageTypeVoice) {
+		messageType = models.MessageTypeVoice
+		if determineFileType(mimeType) != models.FileTypeAudio {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Голосовое сообщение должно быть аудиозаписью"})
+			return
+		}
+	} else if req.Type != "" && req.Type != string(models.MessageTypeFile) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Неподдерживаемый тип сообщения"})
+		return
+	}
+
 	// Генерируем уникальный токен для скачивания
 	downloadToken, err := generateDownloadToken()
 	if err != nil {
@@ -146,31 +211,8 @@ func (s *Server) handleFileUpload(c *gin.Context) {
 		return
 	}
 
-	// Начинаем транзакцию
-	tx := s.db.DB.Begin()
-	if tx.Error != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
-		return
-	}
-
-	// Создаем сообщение
-	message := models.DirectMessage{
-		SenderID:    senderID.(uint),
-		RecipientID: req.RecipientID,
-		Content:     []byte(req.Message),
-		MessageType: "file",
-		IsRead:      false,
-	}
-
-	if err := tx.Create(&message).Error; err != nil {
-		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка сохранения сообщения"})
-		return
-	}
-
-	// Создаем запись о файле
+	// Создаем запись о файле, сообщение привяжет ее к себе
 	fileRecord := models.File{
-		MessageID:     message.ID,
 		FileName:      req.File.Filename,
 		FileSize:      req.File.Size,
 		FileType:      determineFileType(mimeType),
@@ -179,42 +221,48 @@ func (s *Server) handleFileUpload(c *gin.Context) {
 		DownloadToken: downloadToken,
 	}
 
-	if err := tx.Create(&fileRecord).Error; err != nil {
-		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка сохранения информации о файле"})
-		return
+	// Для аудиозаписей определяем длительность и форму волны
+	if fileRecord.FileType == models.FileTypeAudio {
+		if info, err := analyzeAudioFile(filePath); err == nil {
+			fileRecord.DurationMs = info.Duration.Milliseconds()
+			fileRecord.Waveform = info.Waveform
+		} else if messageType == models.MessageTypeVoice {
+			os.Remove(filePath)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Не удалось прочитать аудиозапись. Поддерживаются Ogg/Opus, WebM и MP3"})
+			return
+		}
 	}
 
-	// Фиксируем транзакцию
-	if err := tx.Commit().Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка фиксации транзакции"})
+	if err := s.db.CreateFile(&fileRecord); err != nil {
+		os.Remove(filePath)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка сохранения информации о файле"})
 		return
 	}
 
-	// Отправляем уведомление через WebSocket
-	message.File = &fileRecord
-
-	// Сериализуем данные в JSON
-	messageJSON, err := json.Marshal(message)
-	if err != nil {
-		log.Printf("Ошибка сериализации сообщения: %v", err)
-	} else {
-		wsMessage := WSMessage{
-			Type:    "file",
-			Payload: json.RawMessage(messageJSON),
-		}
-
-		// Отправляем сообщение через WebSocket
-		if err := s.sendMessageToUser(req.RecipientID, wsMessage); err != nil {
-			log.Printf("Ошибка отправки сообщения о файле через WebSocket: %v", err)
+	// Отправляем сообщение с файлом в чат (участники получат его через WebSocket)
+	message, sendErr := s.postMessage(senderID, outgoingMessage{
+		ChatID:  chatID,
+		TopicID: req.TopicID,
+		Content: req.Message,
+		Type:    string(messageType),
+		FileID:  &fileRecord.ID,
+	})
+	if sendErr != nil {
+		if err := s.db.DeleteFile(fileRecord.ID); err != nil {
+			log.Printf("Ошибка удаления информации о файле: %v", err)
 		}
+		os.Remove(filePath)
+		SendError(c, sendErr.Status, sendErr.Code, sendErr.Message)
+		return
 	}
 
 	// Возвращаем информацию о загруженном файле
 	c.JSON(http.StatusOK, gin.H{
-		"message":    "Файл успешно загружен",
-		"file":       fileRecord,
-		"message_id": message.ID,
+		"message":      "Файл успешно загружен",
+		"file":         message.File,
+		"message_id":   message.ID,
+		"chat_id":      message.ChatID,
+		"chat_message": message,
 	})
 }
 
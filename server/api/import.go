@@ -0,0 +1,651 @@
+package api
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"messenger/logger"
+	"messenger/models"
+	"messenger/richtext"
+	"messenger/tgimport"
+	"messenger/utils/crypto"
+)
+
+// Настройки импорта истории
+const (
+	// Максимальный размер загружаемой выгрузки (JSON или ZIP с медиафайлами)
+	maxImportSize = 2 << 30
+
+	// Число сообщений, сохраняемых в одной транзакции
+	importBatchSize = 200
+)
+
+// Способы обработки сообщений от несопоставленных пользователей
+const (
+	importUnmappedSkip     = "skip"     // Сообщения пропускаются
+	importUnmappedImporter = "importer" // Сообщения публикуются от имени администратора с подписью автора
+)
+
+// importSender описывает автора сообщений выгрузки и его сопоставление с пользователем
+type importSender struct {
+	ExternalID string `json:"external_id"`
+	Name       string `json:"name"`
+	Messages   int    `json:"messages"`
+	UserID     uint   `json:"user_id,omitempty"`
+	Username   string `json:"username,omitempty"`
+	MatchedBy  string `json:"matched_by,omitempty"` // user_map
+
+	// Пользователь с таким же именем. Только подсказка для user_map: отображаемое имя
+	// в Telegram выбирает сам автор, поэтому без явного сопоставления оно не применяется.
+	SuggestedUserID   uint   `json:"suggested_user_id,omitempty"`
+	SuggestedUsername string `json:"suggested_username,omitempty"`
+}
+
+// importReport содержит результат импорта или его предварительной проверки
+type importReport struct {
+	DryRun bool `json:"dry_run"`
+	Chat   struct {
+		ExternalID string `json:"external_id"`
+		Name       string `json:"name"`
+		Type       string `json:"type"`
+	} `json:"chat"`
+	ChatID          uint           `json:"chat_id,omitempty"`
+	TotalMessages   int            `json:"total_messages"`
+	Importable      int            `json:"importable"`
+	Imported        int            `json:"imported"`
+	AlreadyImported int            `json:"already_imported"`
+	SkippedService  int            `json:"skipped_service"`
+	SkippedUnmapped int            `json:"skipped_unmapped"`
+	MediaFound      int            `json:"media_found"`
+	MediaMissing    int            `json:"media_missing"`
+	Senders         []importSender `json:"senders"`
+}
+
+// telegramExport открывает содержимое загруженной выгрузки: result.json и медиафайлы из ZIP
+type telegramExport struct {
+	path    string
+	archive *zip.ReadCloser
+	result  *zip.File
+	media   map[string]*zip.File // Файлы архива относительно каталога с result.json
+}
+
+// openTelegramExport определяет формат загруженного файла: ZIP-архив или result.json
+func openTelegramExport(filename string) (*telegramExport, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 4)
+	n, _ := io.ReadFull(f, header)
+	f.Close()
+
+	export := &telegramExport{path: filename}
+	if !bytes.Equal(header[:n], []byte("PK\x03\x04")) {
+		return export, nil
+	}
+
+	archive, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil, err
+	}
+	export.archive = archive
+
+	// Выгрузка может лежать в подкаталоге архива: ищем result.json ближе всего к корню
+	for _, file := range archive.File {
+		if path.Base(file.Name) != "result.json" {
+			continue
+		}
+		if export.result == nil || strings.Count(file.Name, "/") < strings.Count(export.result.Name, "/") {
+			export.result = file
+		}
+	}
+	if export.result == nil {
+		archive.Close()
+		return nil, errors.New("в архиве нет файла result.json")
+	}
+
+	base := path.Dir(export.result.Name)
+	export.media = make(map[string]*zip.File)
+	for _, file := range archive.File {
+		name := file.Name
+		if base != "." {
+			if !strings.HasPrefix(name, base+"/") {
+				continue
+			}
+			name = strings.TrimPrefix(name, base+"/")
+		}
+		export.media[name] = file
+	}
+
+	return export, nil
+}
+
+// decode разбирает result.json. Может вызываться повторно для нескольких проходов.
+func (e *telegramExport) decode(onChat func(tgimport.Chat) error, onMessage func(tgimport.Message) error) error {
+	var r io.ReadCloser
+	var err error
+	if e.result != nil {
+		r, err = e.result.Open()
+	} else {
+		r, err = os.Open(e.path)
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return tgimport.Decode(bufio.NewReader(r), onChat, onMessage)
+}
+
+// mediaFile возвращает медиафайл сообщения, если он есть в архиве
+func (e *telegramExport) mediaFile(m *tgimport.Message) *zip.File {
+	if e.media == nil || m.MediaPath() == "" {
+		return nil
+	}
+	return e.media[path.Clean(m.MediaPath())]
+}
+
+func (e *telegramExport) Close() {
+	if e.archive != nil {
+		e.archive.Close()
+	}
+}
+
+// handleAdminImportTelegram импортирует историю чата из выгрузки Telegram Desktop.
+//
+// Принимает multipart-форму: file - result.json или ZIP-архив выгрузки с медиафайлами,
+// user_map - JSON-объект {"user123": 5, "user456": "username"} для сопоставления авторов,
+// unmapped - skip или importer, dry_run - только отчет без изменений.
+// Повторный импорт той же выгрузки добавляет лишь отсутствующие сообщения.
+func (s *Server) handleAdminImportTelegram(c *gin.Context) {
+	role, exists := c.Get("role")
+	if !exists || role.(string) != "admin" {
+		SendForbidden(c, "Недостаточно прав")
+		return
+	}
+	adminID := c.GetUint("userID")
+
+	upload, err := c.FormFile("file")
+	if err != nil {
+		SendBadRequest(c, "Не передан файл выгрузки")
+		return
+	}
+	if upload.Size > maxImportSize {
+		SendBadRequest(c, "Размер выгрузки превышает максимально допустимый")
+		return
+	}
+
+	dryRun := c.PostForm("dry_run") == "true"
+	unmapped := c.DefaultPostForm("unmapped", importUnmappedSkip)
+	if unmapped != importUnmappedSkip && unmapped != importUnmappedImporter {
+		SendBadRequest(c, "Параметр unmapped должен быть skip или importer")
+		return
+	}
+
+	userMap, err := s.parseImportUserMap(c.PostForm("user_map"))
+	if err != nil {
+		SendBadRequest(c, err.Error())
+		return
+	}
+
+	// Сохраняем выгрузку во временный файл: она читается в два прохода
+	tmp, err := os.CreateTemp("", "telegram-import-*")
+	if err != nil {
+		SendInternalError(c, "Ошибка подготовки импорта")
+		return
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err := c.SaveUploadedFile(upload, tmp.Name()); err != nil {
+		SendInternalError(c, "Ошибка сохранения выгрузки")
+		return
+	}
+
+	source, err := openTelegramExport(tmp.Name())
+	if err != nil {
+		SendBadRequest(c, "Некорректная выгрузка: "+err.Error())
+		return
+	}
+	defer source.Close()
+
+	// Первый проход: сведения о чате, авторы и отчет
+	report, senders, imported, err := s.scanTelegramExport(source, userMap, unmapped)
+	if err != nil {
+		if errors.Is(err, tgimport.ErrNotChatExport) {
+			SendBadRequest(c, "Файл не является выгрузкой одного чата Telegram")
+			return
+		}
+		logger.Errorf("Ошибка разбора выгрузки Telegram: %v", err)
+		SendBadRequest(c, "Некорректная выгрузка: "+err.Error())
+		return
+	}
+	report.DryRun = dryRun
+
+	if dryRun || report.Importable == 0 {
+		c.JSON(http.StatusOK, gin.H{"report": report})
+		return
+	}
+
+	chatID, importedChatID, sendErr := s.ensureImportedChat(report, senders, imported, adminID)
+	if sendErr != nil {
+		SendError(c, sendErr.Status, sendErr.Code, sendErr.Message)
+		return
+	}
+	report.ChatID = chatID
+
+	// Второй проход: сохранение сообщений пачками
+	count, err := s.importTelegramMessages(source, chatID, importedChatID, senders, unmapped, adminID)
+	report.Imported = count
+	if err != nil {
+		logger.Errorf("Ошибка импорта истории в чат %d: %v", chatID, err)
+		SendError(c, http.StatusInternalServerError, "IMPORT_FAILED",
+			"Импорт прерван, повторный запуск продолжит его с места остановки", report)
+		return
+	}
+
+	if err := s.db.MarkChatReadByAll(chatID); err != nil {
+		logger.Errorf("Ошибка обновления курсоров после импорта в чат %d: %v", chatID, err)
+	}
+
+	logger.Infof("Администратор %d импортировал %d сообщений из Telegram в чат %d", adminID, count, chatID)
+	c.JSON(http.StatusOK, gin.H{"report": report})
+}
+
+// parseImportUserMap разбирает сопоставление авторов: значение - ID или имя пользователя
+func (s *Server) parseImportUserMap(raw string) (map[string]*models.User, error) {
+	result := make(map[string]*models.User)
+	if raw == "" {
+		return result, nil
+	}
+
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(raw), &entries); err != nil {
+		return nil, errors.New("Некорректный формат user_map")
+	}
+
+	for externalID, value := range entries {
+		var user models.User
+		var id uint
+		var username string
+		switch {
+		case json.Unmarshal(value, &id) == nil:
+			if err := s.db.DB.First(&user, id).Error; err != nil {
+				return nil, fmt.Errorf("Пользователь %d из user_map не найден", id)
+			}
+		case json.Unmarshal(value, &username) == nil:
+			if err := s.db.DB.Where("LOWER(username) = LOWER(?)", username).First(&user).Error; err != nil {
+				return nil, fmt.Errorf("Пользователь %s из user_map не найден", username)
+			}
+		default:
+			return nil, errors.New("Некорректный формат user_map")
+		}
+		result[externalID] = &user
+	}
+	return result, nil
+}
+
+// scanTelegramExport выполняет первый проход по выгрузке: собирает авторов,
+// сопоставляет их с пользователями по user_map и считает, что будет импортировано.
+func (s *Server) scanTelegramExport(source *telegramExport, userMap map[string]*models.User, unmapped string) (*importReport, map[string]*importSender, *models.ImportedChat, error) {
+	report := &importReport{}
+	senders := make(map[string]*importSender)
+	var order []string
+	var imported *models.ImportedChat
+	var already map[int64]bool
+	pending := make(map[string]int) // Еще не импортированные сообщения каждого автора
+
+	onChat := func(chat tgimport.Chat) error {
+		report.Chat.ExternalID = strconv.FormatInt(chat.ID, 10)
+		report.Chat.Name = chat.Name
+		report.Chat.Type = chat.Type
+
+		existing, err := s.db.GetImportedChat(models.ImportSourceTelegram, report.Chat.ExternalID)
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if existing != nil {
+			imported = existing
+			report.ChatID = existing.ChatID
+			if already, err = s.db.GetImportedMessageIDs(existing.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	onMessage := func(m tgimport.Message) error {
+		report.TotalMessages++
+		if m.Type != tgimport.MessageTypeRegular {
+			report.SkippedService++
+			return nil
+		}
+
+		sender, ok := senders[m.FromID]
+		if !ok {
+			sender = &importSender{ExternalID: m.FromID, Name: m.From}
+			senders[m.FromID] = sender
+			order = append(order, m.FromID)
+		}
+		sender.Messages++
+
+		if already[m.ID] {
+			report.AlreadyImported++
+			return nil
+		}
+		pending[m.FromID]++
+		if m.MediaPath() != "" {
+			if source.mediaFile(&m) != nil {
+				report.MediaFound++
+			} else {
+				report.MediaMissing++
+			}
+		}
+		return nil
+	}
+
+	if err := source.decode(onChat, onMessage); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Сопоставление только явное через user_map. Совпадение имени пользователя
+	// лишь предлагается в отчете, чтобы не приписать сообщения чужой учетной записи.
+	for _, id := range order {
+		sender := senders[id]
+		if user := userMap[id]; user != nil {
+			sender.UserID = user.ID
+			sender.Username = user.Username
+			sender.MatchedBy = "user_map"
+		} else if sender.Name != "" {
+			var match models.User
+			if err := s.db.DB.Where("LOWER(username) = LOWER(?)", sender.Name).First(&match).Error; err == nil {
+				sender.SuggestedUserID = match.ID
+				sender.SuggestedUsername = match.Username
+			}
+		}
+		report.Senders = append(report.Senders, *sender)
+	}
+
+	// Число импортируемых сообщений зависит от сопоставления, поэтому считается после него
+	for id, sender := range senders {
+		if sender.UserID == 0 && unmapped == importUnmappedSkip {
+			report.SkippedUnmapped += pending[id]
+		} else {
+			report.Importable += pending[id]
+		}
+	}
+
+	return report, senders, imported, nil
+}
+
+// ensureImportedChat возвращает чат для импорта, создавая его при первом импорте.
+// Личная переписка попадает в личный чат двух сопоставленных собеседников.
+func (s *Server) ensureImportedChat(report *importReport, senders map[string]*importSender, imported *models.ImportedChat, adminID uint) (uint, uint, *sendMessageError) {
+	var members []models.ChatUser
+	seen := make(map[uint]bool)
+	now := time.Now()
+	for _, sender := range senders {
+		if sender.UserID != 0 && !seen[sender.UserID] {
+			seen[sender.UserID] = true
+			members = append(members, models.ChatUser{UserID: sender.UserID, JoinedAt: now})
+		}
+	}
+
+	if imported != nil {
+		if _, err := s.db.GetChatByID(imported.ChatID); err != nil {
+			return 0, 0, &sendMessageError{http.StatusConflict, "CHAT_DELETED", "Чат предыдущего импорта удален"}
+		}
+		if err := s.db.EnsureChatMembers(imported.ChatID, members); err != nil {
+			return 0, 0, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка добавления участников"}
+		}
+		return imported.ChatID, imported.ID, nil
+	}
+
+	chat := models.Chat{
+		Name:         report.Chat.Name,
+		Type:         models.ChatTypeGroup,
+		LastActivity: now,
+	}
+
+	if report.Chat.Type == tgimport.ChatTypePersonal {
+		if len(members) != 2 {
+			return 0, 0, &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", "Для личной переписки должны быть сопоставлены оба собеседника"}
+		}
+		direct, err := s.db.GetOrCreateDirectChat(members[0].UserID, members[1].UserID)
+		if err != nil {
+			return 0, 0, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка создания личного чата"}
+		}
+		chat = *direct
+		members = nil
+	} else if !seen[adminID] {
+		// Импортировавший администратор управляет созданной группой
+		members = append(members, models.ChatUser{UserID: adminID, JoinedAt: now, Role: models.ChatRoleOwner})
+	} else {
+		for i := range members {
+			if members[i].UserID == adminID {
+				members[i].Role = models.ChatRoleOwner
+			}
+		}
+	}
+
+	record := models.ImportedChat{
+		Source:     models.ImportSourceTelegram,
+		ExternalID: report.Chat.ExternalID,
+		ImportedBy: adminID,
+	}
+	if err := s.db.CreateImportedChat(&chat, members, &record); err != nil {
+		logger.Errorf("Ошибка создания чата для импорта: %v", err)
+		return 0, 0, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка создания чата"}
+	}
+	return chat.ID, record.ID, nil
+}
+
+// importTelegramMessages выполняет второй проход и сохраняет сообщения пачками.
+// Возвращает число импортированных сообщений.
+func (s *Server) importTelegramMessages(source *telegramExport, chatID, importedChatID uint, senders map[string]*importSender, unmapped string, adminID uint) (int, error) {
+	already, err := s.db.GetImportedMessageIDs(importedChatID)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	var batch []models.Message
+	var externalIDs []int64
+	var written []string // Файлы, записанные для текущей пачки
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := s.db.InsertImportedMessages(importedChatID, batch, externalIDs); err != nil {
+			for _, p := range written {
+				os.Remove(p)
+			}
+			return err
+		}
+		count += len(batch)
+		batch, externalIDs, written = batch[:0], externalIDs[:0], written[:0]
+		return nil
+	}
+
+	onMessage := func(m tgimport.Message) error {
+		if m.Type != tgimport.MessageTypeRegular || already[m.ID] {
+			return nil
+		}
+
+		authorID := uint(0)
+		if sender := senders[m.FromID]; sender != nil {
+			authorID = sender.UserID
+		}
+		text, entities := m.Content()
+		if authorID == 0 {
+			if unmapped == importUnmappedSkip {
+				return nil
+			}
+			authorID = adminID
+			text, entities = signImportedText(m.From, text, entities)
+		}
+
+		createdAt, err := m.Time()
+		if err != nil {
+			return fmt.Errorf("сообщение %d: некорректная дата: %w", m.ID, err)
+		}
+
+		message := models.Message{
+			ChatID:    chatID,
+			UserID:    authorID,
+			Type:      string(models.MessageTypeText),
+			CreatedAt: createdAt,
+			UpdatedAt: createdAt,
+		}
+		if edited := m.EditedTime(); edited != nil {
+			message.UpdatedAt = *edited
+		}
+
+		if m.MediaPath() != "" {
+			file, filePath, err := s.copyImportedMedia(source, &m)
+			if err != nil {
+				return err
+			}
+			if file != nil {
+				message.Type = string(models.MessageTypeFile)
+				message.File = file
+				written = append(written, filePath)
+			} else if text == "" {
+				// Файл не попал в выгрузку: оставляем отметку, чтобы история была полной
+				text = "[Вложение не включено в выгрузку: " + mediaName(&m) + "]"
+			}
+		}
+
+		if text == "" && message.File == nil {
+			return nil
+		}
+
+		if message.Content, err = crypto.Encrypt([]byte(text)); err != nil {
+			return err
+		}
+		if len(entities) > 0 {
+			data, err := json.Marshal(entities)
+			if err != nil {
+				return err
+			}
+			if message.Entities, err = crypto.Encrypt(data); err != nil {
+				return err
+			}
+		}
+
+		batch = append(batch, message)
+		externalIDs = append(externalIDs, m.ID)
+		if len(batch) >= importBatchSize {
+			return flush()
+		}
+		return nil
+	}
+
+	if err := source.decode(func(tgimport.Chat) error { return nil }, onMessage); err != nil {
+		return count, err
+	}
+	return count, flush()
+}
+
+// signImportedText добавляет к тексту имя автора, если сообщение публикуется от имени администратора
+func signImportedText(author, text string, entities []richtext.Entity) (string, []richtext.Entity) {
+	if author == "" {
+		author = "Неизвестный автор"
+	}
+	prefix := author + ": "
+	shift := richtext.UTF16Len(prefix)
+
+	signed := make([]richtext.Entity, 0, len(entities)+1)
+	signed = append(signed, richtext.Entity{Type: richtext.EntityBold, Offset: 0, Length: richtext.UTF16Len(author)})
+	for _, e := range entities {
+		if len(signed) >= richtext.MaxEntities {
+			break
+		}
+		e.Offset += shift
+		signed = append(signed, e)
+	}
+	return prefix + text, signed
+}
+
+// copyImportedMedia копирует медиафайл сообщения из архива в каталог загрузок.
+// Возвращает nil, если файла нет в выгрузке или он превышает допустимый размер.
+func (s *Server) copyImportedMedia(source *telegramExport, m *tgimport.Message) (*models.File, string, error) {
+	entry := source.mediaFile(m)
+	if entry == nil || entry.UncompressedSize64 > maxFileSize {
+		return nil, "", nil
+	}
+
+	if err := os.MkdirAll(uploadDir, 0755); err != nil {
+		return nil, "", err
+	}
+
+	token, err := generateDownloadToken()
+	if err != nil {
+		return nil, "", err
+	}
+	name := mediaName(m)
+	filePath := filepath.Join(uploadDir, token+filepath.Ext(name))
+
+	src, err := entry.Open()
+	if err != nil {
+		return nil, "", err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(filePath)
+	if err != nil {
+		return nil, "", err
+	}
+	size, err := io.Copy(dst, io.LimitReader(src, maxFileSize))
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filePath)
+		return nil, "", err
+	}
+
+	mimeType := m.MimeType
+	if mimeType == "" {
+		mimeType = mime.TypeByExtension(strings.ToLower(filepath.Ext(name)))
+	}
+	if mimeType == "" && m.Photo != "" {
+		mimeType = "image/jpeg"
+	}
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+
+	return &models.File{
+		FileName:      name,
+		FileSize:      size,
+		FileType:      determineFileType(mimeType),
+		FilePath:      filePath,
+		MimeType:      mimeType,
+		DownloadToken: token,
+	}, filePath, nil
+}
+
+// mediaName возвращает имя прикрепленного файла
+func mediaName(m *tgimport.Message) string {
+	if m.FileName != "" {
+		return m.FileName
+	}
+	return path.Base(m.MediaPath())
+}
@@ -0,0 +1,335 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+
+	"messenger/database"
+	"messenger/logger"
+	"messenger/models"
+)
+
+// Ограничения пригласительных ссылок
+const (
+	maxInviteNameLength = 100
+	maxInviteUses       = 100000
+	maxInviteLifetime   = 365 * 24 * time.Hour
+)
+
+// Структура запроса для создания пригласительной ссылки
+type createInviteRequest struct {
+	Name             string     `json:"name"`
+	ExpiresAt        *time.Time `json:"expires_at"`
+	MaxUses          int        `json:"max_uses"` // 0 - без ограничения
+	ApprovalRequired bool       `json:"approval_required"`
+}
+
+// invitePreview - сведения о чате, которые видны по ссылке до вступления
+type invitePreview struct {
+	ChatName            string `json:"chat_name"`
+	MembersCount        int64  `json:"members_count"`
+	ApprovalRequired    bool   `json:"approval_required"`
+	RegistrationEnabled bool   `json:"registration_enabled"` // Может ли новый пользователь зарегистрироваться, чтобы вступить
+}
+
+// Структура ответа на вступление в чат по ссылке
+type joinChatResponse struct {
+	ChatID  uint             `json:"chat_id"`
+	Message *messageResponse `json:"message,omitempty"`
+}
+
+// generateInviteCode создает случайный код пригласительной ссылки
+func generateInviteCode() (string, error) {
+	code := make([]byte, 12)
+	if _, err := rand.Read(code); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(code), nil
+}
+
+// maintenanceMode сообщает, включен ли режим обслуживания
+func (s *Server) maintenanceMode() bool {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	return s.config.Server.MaintenanceMode
+}
+
+// loadInviteManager загружает чат для управления ссылками. Управлять ссылками
+// может тот, кому разрешено добавлять участников. При ошибке ответ уже отправлен.
+func (s *Server) loadInviteManager(c *gin.Context) (*models.User, *models.Chat, bool) {
+	user, chat, member, ok := s.loadChatMembership(c)
+	if !ok {
+		return nil, nil, false
+	}
+	if !chat.HasRoles() {
+		SendBadRequest(c, "Пригласительные ссылки доступны только для групповых чатов и каналов")
+		return nil, nil, false
+	}
+	if !chatAllows(user, chat, member, models.PermAddMembers) {
+		SendForbidden(c, "Недостаточно прав для управления пригласительными ссылками")
+		return nil, nil, false
+	}
+	return user, chat, true
+}
+
+// handleCreateChatInvite создает пригласительную ссылку в групповой чат
+func (s *Server) handleCreateChatInvite(c *gin.Context) {
+	user, chat, ok := s.loadInviteManager(c)
+	if !ok {
+		return
+	}
+
+	var req createInviteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		SendBadRequest(c, "Некорректные данные запроса: "+err.Error())
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if utf8.RuneCountInString(req.Name) > maxInviteNameLength {
+		SendBadRequest(c, "Слишком длинное название ссылки")
+		return
+	}
+	if req.MaxUses < 0 || req.MaxUses > maxInviteUses {
+		SendBadRequest(c, fmt.Sprintf("Число использований должно быть от 0 до %d", maxInviteUses))
+		return
+	}
+	now := time.Now()
+	if req.ExpiresAt != nil && (!req.ExpiresAt.After(now) || req.ExpiresAt.Sub(now) > maxInviteLifetime) {
+		SendBadRequest(c, "Срок действия ссылки должен быть в будущем и не дольше года")
+		return
+	}
+
+	code, err := generateInviteCode()
+	if err != nil {
+		logger.Errorf("Ошибка генерации кода приглашения: %v", err)
+		SendInternalError(c, "Ошибка создания ссылки")
+		return
+	}
+
+	invite := models.ChatInvite{
+		ChatID:           chat.ID,
+		Code:             code,
+		Name:             req.Name,
+		CreatedBy:        user.ID,
+		ExpiresAt:        req.ExpiresAt,
+		MaxUses:          req.MaxUses,
+		ApprovalRequired: req.ApprovalRequired,
+	}
+	if err := s.db.CreateChatInvite(&invite); err != nil {
+		logger.Errorf("Ошибка создания пригласительной ссылки в чат %d: %v", chat.ID, err)
+		SendInternalError(c, "Ошибка создания ссылки")
+		return
+	}
+	logger.Infof("Пользователь %d создал пригласительную ссылку #%d в чат %d", user.ID, invite.ID, chat.ID)
+
+	c.JSON(http.StatusCreated, invite)
+}
+
+// handleGetChatInvites возвращает пригласительные ссылки чата
+func (s *Server) handleGetChatInvites(c *gin.Context) {
+	_, chat, ok := s.loadInviteManager(c)
+	if !ok {
+		return
+	}
+
+	invites, err := s.db.GetChatInvites(chat.ID)
+	if err != nil {
+		logger.Errorf("Ошибка получения ссылок чата %d: %v", chat.ID, err)
+		SendInternalError(c, "Ошибка получения ссылок")
+		return
+	}
+	c.JSON(http.StatusOK, invites)
+}
+
+// loadChatInvite загружает ссылку чата из пути запроса. При ошибке ответ уже отправлен.
+func (s *Server) loadChatInvite(c *gin.Context, chatID uint) (*models.ChatInvite, bool) {
+	inviteID, err := strconv.ParseUint(c.Param("inviteID"), 10, 32)
+	if err != nil {
+		SendBadRequest(c, "Некорректный ID ссылки")
+		return nil, false
+	}
+	invite, err := s.db.GetChatInvite(chatID, uint(inviteID))
+	if err != nil {
+		if errors.Is(err, database.ErrInviteNotFound) {
+			SendNotFound(c, "Ссылка не найдена")
+			return nil, false
+		}
+		SendInternalError(c, "Ошибка получения ссылки")
+		return nil, false
+	}
+	return invite, true
+}
+
+// handleRevokeChatInvite отзывает пригласительную ссылку
+func (s *Server) handleRevokeChatInvite(c *gin.Context) {
+	user, chat, ok := s.loadInviteManager(c)
+	if !ok {
+		return
+	}
+	invite, ok := s.loadChatInvite(c, chat.ID)
+	if !ok {
+		return
+	}
+
+	revoked, err := s.db.RevokeChatInvite(invite.ID, time.Now())
+	if err != nil {
+		logger.Errorf("Ошибка отзыва ссылки #%d: %v", invite.ID, err)
+		SendInternalError(c, "Ошибка отзыва ссылки")
+		return
+	}
+	if !revoked {
+		SendError(c, http.StatusConflict, "INVITE_REVOKED", "Ссылка уже отозвана")
+		return
+	}
+	logger.Infof("Пользователь %d отозвал пригласительную ссылку #%d в чат %d", user.ID, invite.ID, chat.ID)
+
+	c.Status(http.StatusNoContent)
+}
+
+// handleGetChatInviteMembers возвращает пользователей, вступивших по ссылке
+func (s *Server) handleGetChatInviteMembers(c *gin.Context) {
+	_, chat, ok := s.loadInviteManager(c)
+	if !ok {
+		return
+	}
+	invite, ok := s.loadChatInvite(c, chat.ID)
+	if !ok {
+		return
+	}
+
+	members, err := s.db.GetChatInviteMembers(invite.ID)
+	if err != nil {
+		logger.Errorf("Ошибка получения вступивших по ссылке #%d: %v", invite.ID, err)
+		SendInternalError(c, "Ошибка получения участников")
+		return
+	}
+	c.JSON(http.StatusOK, members)
+}
+
+// handleGetInvitePreview показывает, в какой чат ведет ссылка. Доступно без авторизации,
+// чтобы новый пользователь мог узнать о чате до регистрации.
+func (s *Server) handleGetInvitePreview(c *gin.Context) {
+	if s.maintenanceMode() {
+		SendError(c, http.StatusServiceUnavailable, "MAINTENANCE", "Сервер на обслуживании, попробуйте позже")
+		return
+	}
+
+	invite, err := s.db.GetChatInviteByCode(c.Param("code"))
+	if err != nil || !invite.IsActive(time.Now()) {
+		if err != nil && !errors.Is(err, database.ErrInviteNotFound) {
+			SendInternalError(c, "Ошибка получения ссылки")
+			return
+		}
+		SendNotFound(c, "Ссылка недействительна")
+		return
+	}
+	chat, err := s.db.GetChatByID(invite.ChatID)
+	if err != nil {
+		SendNotFound(c, "Ссылка недействительна")
+		return
+	}
+	count, err := s.db.CountChatMembers(chat.ID)
+	if err != nil {
+		SendInternalError(c, "Ошибка получения данных чата")
+		return
+	}
+
+	s.configLock.RLock()
+	registrationEnabled := s.config.Server.RegistrationEnabled
+	s.configLock.RUnlock()
+
+	c.JSON(http.StatusOK, invitePreview{
+		ChatName:            chat.Name,
+		MembersCount:        count,
+		ApprovalRequired:    invite.ApprovalRequired,
+		RegistrationEnabled: registrationEnabled,
+	})
+}
+
+// handleJoinChat добавляет пользователя в чат по пригласительной ссылке
+func (s *Server) handleJoinChat(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	// В режиме обслуживания вступать могут только администраторы системы
+	if role, _ := c.Get("role"); s.maintenanceMode() && role != "admin" {
+		SendError(c, http.StatusServiceUnavailable, "MAINTENANCE", "Сервер на обслуживании, попробуйте позже")
+		return
+	}
+
+	code := c.Param("code")
+	invite, err := s.db.GetChatInviteByCode(code)
+	if err != nil {
+		if errors.Is(err, database.ErrInviteNotFound) {
+			SendNotFound(c, "Ссылка недействительна")
+			return
+		}
+		SendInternalError(c, "Ошибка получения ссылки")
+		return
+	}
+	chatID := invite.ChatID
+
+	user, err := s.db.GetUserByID(userID)
+	if err != nil {
+		SendInternalError(c, "Ошибка получения данных пользователя")
+		return
+	}
+
+	if invite.ApprovalRequired {
+		s.requestToJoin(c, user, code, chatID)
+		return
+	}
+
+	invite, err = s.db.JoinChatByInvite(code, userID, time.Now())
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrInviteNotFound), errors.Is(err, database.ErrInviteInactive):
+			SendNotFound(c, "Ссылка недействительна")
+		case errors.Is(err, database.ErrAlreadyMember):
+			SendError(c, http.StatusConflict, "ALREADY_MEMBER", "Вы уже состоите в этом чате", gin.H{"chat_id": chatID})
+		case errors.Is(err, database.ErrUserBanned):
+			sendBannedError(c, chatID)
+		default:
+			logger.Errorf("Ошибка вступления пользователя %d в чат по ссылке: %v", userID, err)
+			SendInternalError(c, "Ошибка вступления в чат")
+		}
+		return
+	}
+	logger.Infof("Пользователь %d вступил в чат %d по ссылке #%d", userID, invite.ChatID, invite.ID)
+
+	message := s.announceInviteJoin(invite.ChatID, invite.ID, user, user,
+		models.SystemEvent{Kind: models.SystemEventMemberJoined})
+
+	c.JSON(http.StatusOK, joinChatResponse{ChatID: invite.ChatID, Message: message})
+}
+
+// announceInviteJoin сообщает участникам о вступлении пользователя по ссылке и, если чат
+// объявляет о новых участниках, публикует служебное сообщение от имени actor
+func (s *Server) announceInviteJoin(chatID, inviteID uint, joined, actor *models.User, event models.SystemEvent) *messageResponse {
+	s.sendToChat(chatID, WSTypeChatMembers, chatMembersEvent{
+		ChatID:   chatID,
+		Action:   membersJoined,
+		UserIDs:  []uint{joined.ID},
+		ActorID:  actor.ID,
+		InviteID: inviteID,
+	}, 0)
+
+	chat, err := s.db.GetChatByID(chatID)
+	if err != nil || !announcesMembers(chat) {
+		return nil
+	}
+	message, sendErr := s.postSystemMessage(chatID, actor, event)
+	if sendErr != nil {
+		// Пользователь уже в чате: отсутствие служебного сообщения не отменяет вступления
+		logger.Errorf("Ошибка публикации сообщения о вступлении в чат %d: %s", chatID, sendErr.Message)
+	}
+	return message
+}
@@ -0,0 +1,258 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"messenger/database"
+	"messenger/logger"
+	"messenger/models"
+)
+
+const (
+	// Срок, в течение которого заявку на вступление можно рассмотреть
+	joinRequestTTL = 7 * 24 * time.Hour
+
+	// Периодичность закрытия просроченных заявок
+	joinRequestCheckInterval = 10 * time.Minute
+)
+
+// joinRequestEvent сообщает о новой заявке на вступление или о решении по ней.
+// Рассылается тем, кто вправе рассматривать заявки, и автору заявки.
+type joinRequestEvent struct {
+	ChatID    uint                      `json:"chat_id"`
+	RequestID uint                      `json:"request_id"`
+	UserID    uint                      `json:"user_id"`
+	Status    models.JoinRequestStatus  `json:"status"`
+	Request   *database.JoinRequestInfo `json:"request,omitempty"` // Для новой заявки
+	DecidedBy *uint                     `json:"decided_by,omitempty"`
+}
+
+// Структура ответа на подачу заявки на вступление
+type joinRequestResponse struct {
+	Request *models.ChatJoinRequest `json:"request"`
+}
+
+// Структура ответа на рассмотрение заявки
+type joinRequestDecisionResponse struct {
+	Request *models.ChatJoinRequest `json:"request"`
+	Message *messageResponse        `json:"message,omitempty"`
+}
+
+func newJoinRequestEvent(request *models.ChatJoinRequest) joinRequestEvent {
+	return joinRequestEvent{
+		ChatID:    request.ChatID,
+		RequestID: request.ID,
+		UserID:    request.UserID,
+		Status:    request.Status,
+		DecidedBy: request.DecidedBy,
+	}
+}
+
+// joinRequestManagerIDs возвращает участников чата, которым разрешено рассматривать заявки,
+// то есть добавлять участников
+func (s *Server) joinRequestManagerIDs(chatID uint) ([]uint, error) {
+	chat, err := s.db.GetChatByID(chatID)
+	if err != nil {
+		return nil, err
+	}
+	var roles []models.ChatRole
+	for _, role := range models.ChatRoles {
+		if chat.Allows(role, models.PermAddMembers) {
+			roles = append(roles, role)
+		}
+	}
+	return s.db.GetChatMemberIDsByRoles(chatID, roles)
+}
+
+// notifyJoinRequest рассылает событие о заявке тем, кто рассматривает заявки чата,
+// и, если notifyRequester, автору заявки
+func (s *Server) notifyJoinRequest(event joinRequestEvent, notifyRequester bool) {
+	managerIDs, err := s.joinRequestManagerIDs(event.ChatID)
+	if err != nil {
+		logger.Errorf("Ошибка получения администраторов чата %d: %v", event.ChatID, err)
+	}
+	if notifyRequester {
+		managerIDs = append(managerIDs, event.UserID)
+	}
+
+	message := wsResponse{Type: WSTypeJoinRequest, Payload: event}
+	for _, userID := range managerIDs {
+		if err := s.sendMessageToUser(userID, message); err != nil {
+			logger.Errorf("Ошибка отправки события о заявке #%d пользователю %d: %v", event.RequestID, userID, err)
+		}
+	}
+}
+
+// requestToJoin подает заявку на вступление по ссылке, требующей одобрения
+func (s *Server) requestToJoin(c *gin.Context, user *models.User, code string, chatID uint) {
+	request, err := s.db.CreateJoinRequest(code, user.ID, time.Now(), joinRequestTTL)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrInviteNotFound), errors.Is(err, database.ErrInviteInactive):
+			SendNotFound(c, "Ссылка недействительна")
+		case errors.Is(err, database.ErrAlreadyMember):
+			SendError(c, http.StatusConflict, "ALREADY_MEMBER", "Вы уже состоите в этом чате", gin.H{"chat_id": chatID})
+		case errors.Is(err, database.ErrJoinRequestPending):
+			SendError(c, http.StatusConflict, "REQUEST_PENDING", "Заявка на вступление уже подана и ожидает рассмотрения", gin.H{"chat_id": chatID})
+		case errors.Is(err, database.ErrUserBanned):
+			sendBannedError(c, chatID)
+		default:
+			logger.Errorf("Ошибка подачи заявки пользователем %d на вступление в чат %d: %v", user.ID, chatID, err)
+			SendInternalError(c, "Ошибка подачи заявки на вступление")
+		}
+		return
+	}
+	logger.Infof("Пользователь %d подал заявку #%d на вступление в чат %d", user.ID, request.ID, request.ChatID)
+
+	event := newJoinRequestEvent(request)
+	event.Request = &database.JoinRequestInfo{
+		ID:        request.ID,
+		ChatID:    request.ChatID,
+		UserID:    user.ID,
+		Username:  user.Username,
+		Avatar:    user.Avatar,
+		InviteID:  request.InviteID,
+		CreatedAt: request.CreatedAt,
+		ExpiresAt: request.ExpiresAt,
+	}
+	s.notifyJoinRequest(event, false)
+
+	c.JSON(http.StatusAccepted, joinRequestResponse{Request: request})
+}
+
+// handleGetJoinRequests возвращает рассматриваемые заявки на вступление в чат
+func (s *Server) handleGetJoinRequests(c *gin.Context) {
+	_, chat, ok := s.loadInviteManager(c)
+	if !ok {
+		return
+	}
+
+	requests, err := s.db.GetPendingJoinRequests(chat.ID, time.Now())
+	if err != nil {
+		logger.Errorf("Ошибка получения заявок на вступление в чат %d: %v", chat.ID, err)
+		SendInternalError(c, "Ошибка получения заявок")
+		return
+	}
+	if requests == nil {
+		requests = []database.JoinRequestInfo{}
+	}
+	c.JSON(http.StatusOK, requests)
+}
+
+// parseJoinRequestID извлекает ID заявки из пути запроса. При ошибке ответ уже отправлен.
+func parseJoinRequestID(c *gin.Context) (uint, bool) {
+	requestID, err := strconv.ParseUint(c.Param("requestID"), 10, 32)
+	if err != nil {
+		SendBadRequest(c, "Некорректный ID заявки")
+		return 0, false
+	}
+	return uint(requestID), true
+}
+
+// handleApproveJoinRequest одобряет заявку: пользователь вступает в чат
+func (s *Server) handleApproveJoinRequest(c *gin.Context) {
+	user, chat, ok := s.loadInviteManager(c)
+	if !ok {
+		return
+	}
+	requestID, ok := parseJoinRequestID(c)
+	if !ok {
+		return
+	}
+
+	request, err := s.db.ApproveJoinRequest(chat.ID, requestID, user.ID, time.Now())
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrJoinRequestNotFound):
+			SendNotFound(c, "Заявка не найдена или уже рассмотрена")
+		case errors.Is(err, database.ErrInviteNotFound):
+			SendNotFound(c, "Чат не найден")
+		case errors.Is(err, database.ErrAlreadyMember):
+			SendError(c, http.StatusConflict, "ALREADY_MEMBER", "Пользователь уже состоит в чате")
+		case errors.Is(err, database.ErrInviteInactive):
+			SendError(c, http.StatusConflict, "INVITE_INACTIVE", "Ссылка, по которой подана заявка, отозвана, истекла или исчерпана")
+		case errors.Is(err, database.ErrUserBanned):
+			SendError(c, http.StatusForbidden, errCodeBanned, "Пользователь заблокирован в чате, сначала снимите блокировку")
+		default:
+			logger.Errorf("Ошибка одобрения заявки #%d в чат %d: %v", requestID, chat.ID, err)
+			SendInternalError(c, "Ошибка одобрения заявки")
+		}
+		return
+	}
+	logger.Infof("Пользователь %d одобрил заявку #%d пользователя %d на вступление в чат %d", user.ID, request.ID, request.UserID, chat.ID)
+
+	s.notifyJoinRequest(newJoinRequestEvent(request), true)
+
+	var message *messageResponse
+	if joined, err := s.db.GetUserByID(request.UserID); err == nil {
+		message = s.announceInviteJoin(chat.ID, request.InviteID, joined, user, models.SystemEvent{
+			Kind:    models.SystemEventJoinApproved,
+			Targets: []models.SystemEventUser{eventUser(joined)},
+		})
+	} else {
+		logger.Errorf("Ошибка получения пользователя %d: %v", request.UserID, err)
+	}
+
+	c.JSON(http.StatusOK, joinRequestDecisionResponse{Request: request, Message: message})
+}
+
+// handleDeclineJoinRequest отклоняет заявку на вступление
+func (s *Server) handleDeclineJoinRequest(c *gin.Context) {
+	user, chat, ok := s.loadInviteManager(c)
+	if !ok {
+		return
+	}
+	requestID, ok := parseJoinRequestID(c)
+	if !ok {
+		return
+	}
+
+	request, err := s.db.DeclineJoinRequest(chat.ID, requestID, user.ID, time.Now())
+	if err != nil {
+		if errors.Is(err, database.ErrJoinRequestNotFound) {
+			SendNotFound(c, "Заявка не найдена или уже рассмотрена")
+			return
+		}
+		logger.Errorf("Ошибка отклонения заявки #%d в чат %d: %v", requestID, chat.ID, err)
+		SendInternalError(c, "Ошибка отклонения заявки")
+		return
+	}
+	logger.Infof("Пользователь %d отклонил заявку #%d на вступление в чат %d", user.ID, request.ID, chat.ID)
+
+	s.notifyJoinRequest(newJoinRequestEvent(request), true)
+
+	c.JSON(http.StatusOK, joinRequestDecisionResponse{Request: request})
+}
+
+// startJoinRequestExpiry запускает фоновое закрытие просроченных заявок на вступление
+func (s *Server) startJoinRequestExpiry() {
+	go func() {
+		ticker := time.NewTicker(joinRequestCheckInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			s.expireJoinRequests()
+		}
+	}()
+}
+
+// expireJoinRequests закрывает просроченные заявки и уведомляет о них
+func (s *Server) expireJoinRequests() {
+	expired, err := s.db.ExpireJoinRequests(time.Now())
+	if err != nil {
+		logger.Errorf("Ошибка закрытия просроченных заявок на вступление: %v", err)
+		return
+	}
+
+	for i := range expired {
+		s.notifyJoinRequest(newJoinRequestEvent(&expired[i]), true)
+	}
+	if len(expired) > 0 {
+		logger.Infof("Закрыто просроченных заявок на вступление: %d", len(expired))
+	}
+}
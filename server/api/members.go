@@ -0,0 +1,411 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+
+	"messenger/database"
+	"messenger/logger"
+	"messenger/models"
+)
+
+// Максимальная длина названия чата
+const maxChatNameLength = 100
+
+// Действия в событии изменения состава чата
+const (
+	membersAdded   = "added"
+	membersRemoved = "removed"
+	membersLeft    = "left"
+	membersJoined  = "joined" // Вступление по пригласительной ссылке
+)
+
+// chatUpdatedEvent сообщает участникам об изменении данных чата
+type chatUpdatedEvent struct {
+	ChatID            uint                   `json:"chat_id"`
+	Name              string                 `json:"name,omitempty"`
+	Permissions       models.ChatPermissions `json:"permissions,omitempty"`
+	SignMessages      *bool                  `json:"sign_messages,omitempty"`
+	Description       *string                `json:"description,omitempty"` // Пустая строка - описание удалено
+	Handle            *string                `json:"handle,omitempty"`      // Пустая строка - публичное имя удалено
+	Avatar            *string                `json:"avatar,omitempty"`      // Пустая строка - изображение удалено
+	SlowMode          *int                   `json:"slow_mode,omitempty"`   // 0 - медленный режим выключен
+	HistoryVisibility *string                `json:"history_visibility,omitempty"`
+	ActorID           uint                   `json:"actor_id"`
+}
+
+// chatMembersEvent сообщает об изменении состава чата
+type chatMembersEvent struct {
+	ChatID     uint   `json:"chat_id"`
+	Action     string `json:"action"`
+	UserIDs    []uint `json:"user_ids"`
+	ActorID    uint   `json:"actor_id"`
+	NewOwnerID uint   `json:"new_owner_id,omitempty"` // Новый владелец, если чат покинул прежний
+	InviteID   uint   `json:"invite_id,omitempty"`    // Ссылка, по которой вступил пользователь
+}
+
+// chatRoleEvent сообщает об изменении роли участника
+type chatRoleEvent struct {
+	ChatID  uint            `json:"chat_id"`
+	UserID  uint            `json:"user_id"`
+	Role    models.ChatRole `json:"role"`
+	ActorID uint            `json:"actor_id"`
+}
+
+// Названия ролей для служебных сообщений
+var chatRoleTitles = map[models.ChatRole]string{
+	models.ChatRoleOwner:     "владельцем",
+	models.ChatRoleAdmin:     "администратором",
+	models.ChatRoleModerator: "модератором",
+	models.ChatRoleMember:    "участником",
+}
+
+// chatAllows проверяет, разрешено ли участнику действие в чате. Администратору
+// системы разрешено все. В личных чатах матрица прав не действует: собеседники
+// могут писать и звонить друг другу, остальные действия относятся к группам и каналам.
+func chatAllows(user *models.User, chat *models.Chat, member *models.ChatUser, perm models.ChatPermission) bool {
+	if user.Role == "admin" {
+		return true
+	}
+	if !chat.HasRoles() {
+		return perm == models.PermSendMessages || perm == models.PermStartCalls
+	}
+	return chat.Allows(member.Role, perm)
+}
+
+// canModerateMember проверяет, может ли участник исключить другого участника или
+// изменить его роль: для этого нужна роль не ниже администратора и выше, чем у цели
+func canModerateMember(user *models.User, member, target *models.ChatUser) bool {
+	if user.Role == "admin" {
+		return true
+	}
+	return member.Role.AtLeast(models.ChatRoleAdmin) && member.Role.Rank() > target.Role.Rank()
+}
+
+// checkChatPermission проверяет участие пользователя в чате и право на действие.
+// Общая проверка для REST и WebSocket.
+func (s *Server) checkChatPermission(userID, chatID uint, perm models.ChatPermission) (*models.User, *models.Chat, *models.ChatUser, *sendMessageError) {
+	member, err := s.db.GetChatMember(chatID, userID)
+	if err != nil {
+		return nil, nil, nil, &sendMessageError{http.StatusForbidden, "FORBIDDEN", "У вас нет доступа к этому чату"}
+	}
+	chat, err := s.db.GetChatByID(chatID)
+	if err != nil {
+		return nil, nil, nil, &sendMessageError{http.StatusNotFound, "NOT_FOUND", "Чат не найден"}
+	}
+	user, err := s.db.GetUserByID(userID)
+	if err != nil {
+		return nil, nil, nil, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка получения данных пользователя"}
+	}
+	if !chatAllows(user, chat, member, perm) {
+		return nil, nil, nil, &sendMessageError{http.StatusForbidden, "FORBIDDEN", permissionDeniedMessages[perm]}
+	}
+	return user, chat, member, nil
+}
+
+// Сообщения об отказе для каждого действия матрицы прав
+var permissionDeniedMessages = map[models.ChatPermission]string{
+	models.PermSendMessages:   "Вам запрещено отправлять сообщения в этот чат",
+	models.PermAddMembers:     "Недостаточно прав для добавления участников",
+	models.PermPinMessages:    "Недостаточно прав для закрепления сообщений",
+	models.PermChangeInfo:     "Недостаточно прав для изменения чата",
+	models.PermDeleteMessages: "Недостаточно прав для удаления чужих сообщений",
+	models.PermStartCalls:     "Недостаточно прав для начала звонка",
+}
+
+// parseChatID разбирает ID чата из пути запроса. При ошибке ответ уже отправлен.
+func parseChatID(c *gin.Context) (uint, bool) {
+	chatID, err := strconv.ParseUint(c.Param("chatID"), 10, 32)
+	if err != nil {
+		SendBadRequest(c, "Некорректный ID чата")
+		return 0, false
+	}
+	return uint(chatID), true
+}
+
+// loadChatMembership загружает чат, участника и пользователя для запроса к чату.
+// При ошибке ответ уже отправлен.
+func (s *Server) loadChatMembership(c *gin.Context) (*models.User, *models.Chat, *models.ChatUser, bool) {
+	chatID, ok := parseChatID(c)
+	if !ok {
+		return nil, nil, nil, false
+	}
+
+	member, err := s.db.GetChatMember(chatID, c.GetUint("userID"))
+	if err != nil {
+		SendForbidden(c, "У вас нет доступа к этому чату")
+		return nil, nil, nil, false
+	}
+	chat, err := s.db.GetChatByID(chatID)
+	if err != nil {
+		SendNotFound(c, "Чат не найден")
+		return nil, nil, nil, false
+	}
+	user, err := s.db.GetUserByID(member.UserID)
+	if err != nil {
+		SendInternalError(c, "Ошибка получения данных пользователя")
+		return nil, nil, nil, false
+	}
+	return user, chat, member, true
+}
+
+// messageVisible сообщает, видно ли пользователю сообщение чата chatID, отправленное в момент
+// sentAt: пользователь состоит в чате, а сообщение не относится к истории до его вступления,
+// скрытой от новых участников группы
+func (s *Server) messageVisible(userID, chatID uint, sentAt time.Time) bool {
+	member, err := s.db.GetChatMember(chatID, userID)
+	if err != nil {
+		return false
+	}
+	chat, err := s.db.GetChatByID(chatID)
+	if err != nil {
+		return false
+	}
+	since := chat.HistoryVisibleSince(member)
+	return since == nil || !sentAt.Before(*since)
+}
+
+// normalizeChatName проверяет название чата и возвращает его без пробелов по краям
+func normalizeChatName(name string) (string, *sendMessageError) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", "Название чата не может быть пустым"}
+	}
+	if utf8.RuneCountInString(name) > maxChatNameLength {
+		return "", &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", "Слишком длинное название чата"}
+	}
+	return name, nil
+}
+
+// renameChat меняет название группового чата и уведомляет участников
+func (s *Server) renameChat(actor *models.User, chat *models.Chat, name string) (*messageResponse, *sendMessageError) {
+	name, sendErr := normalizeChatName(name)
+	if sendErr != nil {
+		return nil, sendErr
+	}
+
+	if err := s.db.UpdateChatName(chat.ID, name); err != nil {
+		logger.Errorf("Ошибка изменения названия чата %d: %v", chat.ID, err)
+		return nil, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка изменения названия чата"}
+	}
+	chat.Name = name
+
+	s.sendToChat(chat.ID, WSTypeChatUpdated, chatUpdatedEvent{ChatID: chat.ID, Name: name, ActorID: actor.ID}, 0)
+
+	return s.postSystemMessage(chat.ID, actor, models.SystemEvent{
+		Kind:   models.SystemEventChatRenamed,
+		Params: map[string]string{models.SystemParamName: name},
+	})
+}
+
+// setChannelSignatures включает или выключает подпись новых постов канала именем автора
+func (s *Server) setChannelSignatures(actor *models.User, chat *models.Chat, sign bool) *sendMessageError {
+	if err := s.db.UpdateChatSignMessages(chat.ID, sign); err != nil {
+		logger.Errorf("Ошибка изменения подписи постов канала %d: %v", chat.ID, err)
+		return &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка изменения канала"}
+	}
+	chat.SignMessages = sign
+
+	s.sendToChat(chat.ID, WSTypeChatUpdated, chatUpdatedEvent{ChatID: chat.ID, SignMessages: &sign, ActorID: actor.ID}, 0)
+	return nil
+}
+
+// validateHistoryVisibility проверяет значение видимости истории группы
+func validateHistoryVisibility(visibility string) *sendMessageError {
+	if visibility != models.HistoryVisibilityFull && visibility != models.HistoryVisibilityJoined {
+		return &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", "Видимость истории должна быть full или joined"}
+	}
+	return nil
+}
+
+// setChatHistoryVisibility меняет видимость истории группы для участников и уведомляет их
+func (s *Server) setChatHistoryVisibility(actor *models.User, chat *models.Chat, visibility string) (*messageResponse, *sendMessageError) {
+	if sendErr := validateHistoryVisibility(visibility); sendErr != nil {
+		return nil, sendErr
+	}
+	if visibility == chat.HistoryVisibility {
+		return nil, nil
+	}
+
+	if err := s.db.UpdateChatHistoryVisibility(chat.ID, visibility); err != nil {
+		logger.Errorf("Ошибка изменения видимости истории чата %d: %v", chat.ID, err)
+		return nil, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка изменения чата"}
+	}
+	chat.HistoryVisibility = visibility
+
+	s.sendToChat(chat.ID, WSTypeChatUpdated, chatUpdatedEvent{ChatID: chat.ID, HistoryVisibility: &visibility, ActorID: actor.ID}, 0)
+
+	return s.postSystemMessage(chat.ID, actor, models.SystemEvent{
+		Kind:   models.SystemEventHistoryVisibility,
+		Params: map[string]string{models.SystemParamVisibility: visibility},
+	})
+}
+
+// addChatMembers добавляет пользователей в групповой чат или канал и уведомляет участников.
+// Возвращает ID действительно добавленных и служебное сообщение о добавлении.
+func (s *Server) addChatMembers(actor *models.User, chat *models.Chat, users []models.User) ([]uint, *messageResponse, *sendMessageError) {
+	userIDs := make([]uint, len(users))
+	byID := make(map[uint]*models.User, len(users))
+	for i := range users {
+		userIDs[i] = users[i].ID
+		byID[users[i].ID] = &users[i]
+	}
+
+	added, err := s.db.AddChatMembers(chat.ID, userIDs)
+	if err == database.ErrUserBanned {
+		return nil, nil, &sendMessageError{http.StatusForbidden, errCodeBanned, "Пользователь заблокирован в чате, сначала снимите блокировку"}
+	}
+	if err != nil {
+		logger.Errorf("Ошибка добавления участников в чат %d: %v", chat.ID, err)
+		return nil, nil, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка добавления участников"}
+	}
+	if len(added) == 0 {
+		return nil, nil, nil
+	}
+
+	logger.Infof("Пользователь %d добавил в чат %d пользователей: %v", actor.ID, chat.ID, added)
+
+	// События рассылаются после добавления, поэтому их получат и новые участники
+	s.sendToChat(chat.ID, WSTypeChatMembers, chatMembersEvent{
+		ChatID:  chat.ID,
+		Action:  membersAdded,
+		UserIDs: added,
+		ActorID: actor.ID,
+	}, 0)
+
+	if !announcesMembers(chat) {
+		return added, nil, nil
+	}
+	targets := make([]models.SystemEventUser, len(added))
+	for i, id := range added {
+		targets[i] = eventUser(byID[id])
+	}
+	message, sendErr := s.postSystemMessage(chat.ID, actor, models.SystemEvent{
+		Kind:    models.SystemEventMembersAdded,
+		Targets: targets,
+	})
+	return added, message, sendErr
+}
+
+// announcesMembers сообщает, публикуются ли в чате служебные сообщения об изменении
+// состава. В каналах подписчики приходят и уходят молча.
+func announcesMembers(chat *models.Chat) bool {
+	return chat.Type != models.ChatTypeChannel
+}
+
+// removeChatMember исключает участника из группового чата или выводит из него самого
+// инициатора и уведомляет участников. Если чат опустел или это канал, служебное
+// сообщение не публикуется и возвращается nil без ошибки.
+func (s *Server) removeChatMember(actor *models.User, chat *models.Chat, user *models.User) (*messageResponse, *sendMessageError) {
+	removal, err := s.db.RemoveChatMember(chat.ID, user.ID)
+	if err != nil {
+		if err == database.ErrNotChatMember {
+			return nil, &sendMessageError{http.StatusNotFound, "NOT_FOUND", "Пользователь не состоит в чате"}
+		}
+		logger.Errorf("Ошибка исключения пользователя %d из чата %d: %v", user.ID, chat.ID, err)
+		return nil, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка исключения участника"}
+	}
+
+	event := chatMembersEvent{
+		ChatID:     chat.ID,
+		Action:     membersRemoved,
+		UserIDs:    []uint{user.ID},
+		ActorID:    actor.ID,
+		NewOwnerID: removal.NewOwnerID,
+	}
+	systemEvent := models.SystemEvent{
+		Kind:    models.SystemEventMemberRemoved,
+		Targets: []models.SystemEventUser{eventUser(user)},
+	}
+	if actor.ID == user.ID {
+		event.Action = membersLeft
+		systemEvent = models.SystemEvent{Kind: models.SystemEventMemberLeft}
+	}
+	logger.Infof("Пользователь %d исключен из чата %d (инициатор %d)", user.ID, chat.ID, actor.ID)
+
+	// Исключенный пользователь уже не участник чата, поэтому событие отправляется ему отдельно
+	if err := s.sendMessageToUser(user.ID, wsResponse{Type: WSTypeChatMembers, Payload: event}); err != nil {
+		logger.Errorf("Ошибка отправки события о составе чата пользователю %d: %v", user.ID, err)
+	}
+	if removal.ChatDeleted {
+		logger.Infof("Чат %d удален: в нем не осталось участников", chat.ID)
+		return nil, nil
+	}
+	s.sendToChat(chat.ID, WSTypeChatMembers, event, 0)
+	if !announcesMembers(chat) {
+		return nil, nil
+	}
+
+	if removal.NewOwnerID != 0 {
+		if newOwner, err := s.db.GetUserByID(removal.NewOwnerID); err == nil {
+			systemEvent.Params = map[string]string{models.SystemParamNewOwner: newOwner.Username}
+		}
+	}
+	return s.postSystemMessage(chat.ID, actor, systemEvent)
+}
+
+// setChatMemberRole меняет роль участника и уведомляет участников чата
+func (s *Server) setChatMemberRole(actor *models.User, chat *models.Chat, target *models.User, role models.ChatRole) (*messageResponse, *sendMessageError) {
+	if err := s.db.SetChatMemberRole(chat.ID, target.ID, role); err != nil {
+		if err == database.ErrNotChatMember {
+			return nil, &sendMessageError{http.StatusNotFound, "NOT_FOUND", "Пользователь не состоит в чате"}
+		}
+		logger.Errorf("Ошибка изменения роли пользователя %d в чате %d: %v", target.ID, chat.ID, err)
+		return nil, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка изменения роли"}
+	}
+	logger.Infof("Пользователь %d назначил пользователя %d в чате %d ролью %s", actor.ID, target.ID, chat.ID, role)
+
+	s.sendToChat(chat.ID, WSTypeChatMemberRole, chatRoleEvent{
+		ChatID:  chat.ID,
+		UserID:  target.ID,
+		Role:    role,
+		ActorID: actor.ID,
+	}, 0)
+
+	event := models.SystemEvent{
+		Kind:    models.SystemEventRoleChanged,
+		Targets: []models.SystemEventUser{eventUser(target)},
+		Params:  map[string]string{models.SystemParamRole: string(role)},
+	}
+	if role == models.ChatRoleOwner {
+		event = models.SystemEvent{
+			Kind:    models.SystemEventOwnershipTransferred,
+			Targets: []models.SystemEventUser{eventUser(target)},
+		}
+	}
+	return s.postSystemMessage(chat.ID, actor, event)
+}
+
+// updateChatPermissions сохраняет матрицу прав группы и уведомляет участников
+func (s *Server) updateChatPermissions(actor *models.User, chat *models.Chat, changes models.ChatPermissions) (*messageResponse, *sendMessageError) {
+	if err := chat.ValidatePermissions(changes); err != nil {
+		return nil, &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", err.Error()}
+	}
+
+	permissions := make(models.ChatPermissions, len(chat.Permissions)+len(changes))
+	for perm, role := range chat.Permissions {
+		permissions[perm] = role
+	}
+	for perm, role := range changes {
+		permissions[perm] = role
+	}
+
+	if err := s.db.UpdateChatPermissions(chat.ID, permissions); err != nil {
+		logger.Errorf("Ошибка изменения прав чата %d: %v", chat.ID, err)
+		return nil, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка изменения прав чата"}
+	}
+	chat.Permissions = permissions
+
+	s.sendToChat(chat.ID, WSTypeChatUpdated, chatUpdatedEvent{
+		ChatID:      chat.ID,
+		Permissions: chat.EffectivePermissions(),
+		ActorID:     actor.ID,
+	}, 0)
+
+	return s.postSystemMessage(chat.ID, actor, models.SystemEvent{Kind: models.SystemEventPermissionsChanged})
+}
@@ -2,17 +2,19 @@ package api
 
 import (
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
 
+	"messenger/database"
 	"messenger/logger"
 	"messenger/models"
-	"messenger/redis"
+	"messenger/richtext"
+	"messenger/unfurl"
 	"messenger/utils/crypto"
 )
 
@@ -22,9 +24,11 @@ type SendMessageRequest struct {
 	Content     string `json:"content" binding:"required"`
 }
 
-// Запрос на отметку сообщений как прочитанных
+// Запрос на отметку сообщений чата как прочитанных до seq включительно.
+// Вместо seq можно передать message_id последнего прочитанного сообщения.
 type MarkReadRequest struct {
-	SenderID uint `json:"sender_id" binding:"required"`
+	Seq       uint64 `json:"seq"`
+	MessageID uint   `json:"message_id"`
 }
 
 // Структура для создания нового сообщения
@@ -37,21 +41,35 @@ type newMessagePayload struct {
 
 // Структура для новых сообщений
 type newMessageRequest struct {
-	Content string `json:"content" binding:"required"`
-	Type    string `json:"type" binding:"required,oneof=text file"`
-	FileID  *uint  `json:"file_id,omitempty"`
+	Content  string           `json:"content"` // Обязателен для текста, необязателен для файла, контакта и местоположения
+	Type     string           `json:"type" binding:"required,oneof=text file poll contact location"`
+	FileID   *uint            `json:"file_id,omitempty"`
+	Poll     *pollRequest     `json:"poll,omitempty"`     // Для сообщений типа poll
+	Contact  *contactPayload  `json:"contact,omitempty"`  // Для сообщений типа contact
+	Location *locationPayload `json:"location,omitempty"` // Для сообщений типа location
+	TopicID  *uint            `json:"topic_id,omitempty"` // Тема группового чата
 }
 
 // Структура для сообщений с сервера
 type messageResponse struct {
-	ID        uint         `json:"id"`
-	ChatID    uint         `json:"chat_id"`
-	UserID    uint         `json:"user_id"`
-	Content   string       `json:"content"`
-	Type      string       `json:"type"`
-	FileID    *uint        `json:"file_id,omitempty"`
-	File      *models.File `json:"file,omitempty"`
-	CreatedAt time.Time    `json:"created_at"`
+	ID        uint                `json:"id"`
+	ChatID    uint                `json:"chat_id"`
+	TopicID   *uint               `json:"topic_id,omitempty"`
+	Seq       uint64              `json:"seq"`
+	UserID    uint                `json:"user_id"`
+	Content   string              `json:"content"`
+	Entities  []richtext.Entity   `json:"entities,omitempty"`
+	Type      string              `json:"type"`
+	FileID    *uint               `json:"file_id,omitempty"`
+	File      *models.File        `json:"file,omitempty"`
+	Preview   *unfurl.Preview     `json:"preview,omitempty"`
+	Poll      *pollResponse       `json:"poll,omitempty"`
+	Contact   *contactPayload     `json:"contact,omitempty"`
+	Location  *locationPayload    `json:"location,omitempty"`
+	Event     *models.SystemEvent `json:"event,omitempty"`     // Описание события служебного сообщения
+	Views     uint64              `json:"views,omitempty"`     // Просмотры поста канала
+	Anonymous bool                `json:"anonymous,omitempty"` // Пост канала без подписи: автор не указывается
+	CreatedAt time.Time           `json:"created_at"`
 	User      struct {
 		ID       uint   `json:"id"`
 		Username string `json:"username"`
@@ -61,7 +79,7 @@ type messageResponse struct {
 
 // handleGetMessages возвращает сообщения чата
 func (s *Server) handleGetMessages(c *gin.Context) {
-	userID := c.GetUint("user_id")
+	userID := c.GetUint("userID")
 
 	// Получаем ID чата из параметров URL
 	chatIDStr := c.Param("chatID")
@@ -72,14 +90,20 @@ func (s *Server) handleGetMessages(c *gin.Context) {
 	}
 
 	// Проверяем доступ к чату
-	if !s.db.IsUserInChat(userID, uint(chatID)) {
+	member, err := s.db.GetChatMember(uint(chatID), userID)
+	if err != nil {
 		c.JSON(http.StatusForbidden, gin.H{"error": "У вас нет доступа к этому чату"})
 		return
 	}
+	chat, err := s.db.GetChatByID(uint(chatID))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Чат не найден"})
+		return
+	}
 
-	// Получаем сообщения чата
+	// Получаем сообщения чата, видимые участнику
 	limit := 50 // можно сделать параметром
-	messages, err := s.db.GetChatMessages(uint(chatID), limit)
+	messages, err := s.db.GetChatMessages(uint(chatID), chat.HistoryVisibleSince(member), limit)
 	if err != nil {
 		logger.Errorf("Ошибка получения сообщений: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения сообщений"})
@@ -88,39 +112,14 @@ func (s *Server) handleGetMessages(c *gin.Context) {
 
 	// Преобразуем сообщения для ответа
 	var response []messageResponse
-	for _, msg := range messages {
-		// Расшифровываем содержимое сообщения
-		var content string
-		if len(msg.Content) > 0 {
-			plaintext, err := crypto.Decrypt(msg.Content)
-			if err != nil {
-				logger.Errorf("Ошибка расшифровки сообщения #%d: %v", msg.ID, err)
-				content = "[Ошибка расшифровки]"
-			} else {
-				content = string(plaintext)
-			}
-		} else {
-			content = msg.PlainText
-		}
-
-		// Создаем объект ответа
-		msgResp := messageResponse{
-			ID:        msg.ID,
-			ChatID:    msg.ChatID,
-			UserID:    msg.UserID,
-			Content:   content,
-			Type:      msg.Type,
-			FileID:    msg.FileID,
-			File:      msg.File,
-			CreatedAt: msg.CreatedAt,
-		}
-
-		// Добавляем информацию о пользователе
-		msgResp.User.ID = msg.User.ID
-		msgResp.User.Username = msg.User.Username
-		msgResp.User.Avatar = msg.User.Avatar
+	for i := range messages {
+		response = append(response, newMessageResponse(&messages[i]))
+	}
+	s.attachPollResults(messages, response, userID)
 
-		response = append(response, msgResp)
+	// Полученная история считается доставленной
+	if len(messages) > 0 {
+		go s.markDelivered(userID, map[uint]uint64{uint(chatID): messages[len(messages)-1].Seq})
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -130,7 +129,7 @@ func (s *Server) handleGetMessages(c *gin.Context) {
 
 // handleSendMessage отправляет новое сообщение в чат
 func (s *Server) handleSendMessage(c *gin.Context) {
-	userID := c.GetUint("user_id")
+	userID := c.GetUint("userID")
 
 	// Получаем ID чата из параметров URL
 	chatIDStr := c.Param("chatID")
@@ -140,12 +139,6 @@ func (s *Server) handleSendMessage(c *gin.Context) {
 		return
 	}
 
-	// Проверяем доступ к чату
-	if !s.db.IsUserInChat(userID, uint(chatID)) {
-		c.JSON(http.StatusForbidden, gin.H{"error": "У вас нет доступа к этому чату"})
-		return
-	}
-
 	// Получаем данные сообщения из запроса
 	var req newMessageRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -153,141 +146,212 @@ func (s *Server) handleSendMessage(c *gin.Context) {
 		return
 	}
 
-	// Получаем информацию о пользователе
-	user, err := s.db.GetUserByID(userID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения данных пользователя"})
+	wait, reserved := s.reserveSlowMode(userID, uint(chatID))
+	if wait > 0 {
+		sendSlowModeError(c, wait)
+		return
+	}
+
+	// Проверка доступа, разбор разметки, сохранение и рассылка участникам.
+	// Текст, начинающийся с /, выполняется как команда.
+	message, reply, sendErr := s.submitMessage(userID, outgoingMessage{
+		ChatID:   uint(chatID),
+		TopicID:  req.TopicID,
+		Content:  req.Content,
+		Type:     req.Type,
+		FileID:   req.FileID,
+		Poll:     req.Poll,
+		Contact:  req.Contact,
+		Location: req.Location,
+	})
+	if reserved && message == nil {
+		// Сообщение не отправлено: медленный режим не должен мешать повторной попытке
+		s.releaseSlowMode(userID, uint(chatID))
+	}
+	if sendErr != nil {
+		SendError(c, sendErr.Status, sendErr.Code, sendErr.Message)
 		return
 	}
 
-	// Шифруем содержимое сообщения
-	encryptedContent, err := crypto.Encrypt([]byte(req.Content))
+	response := gin.H{}
+	status := http.StatusOK
+	if message != nil {
+		response["message"] = message
+		status = http.StatusCreated
+	}
+	if reply != nil {
+		response["command_reply"] = reply
+	}
+	c.JSON(status, response)
+}
+
+// handleMarkMessagesAsRead сдвигает курсор прочтения текущего пользователя в чате
+func (s *Server) handleMarkMessagesAsRead(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	chatID, err := strconv.ParseUint(c.Param("chatID"), 10, 32)
 	if err != nil {
-		logger.Errorf("Ошибка шифрования сообщения: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка шифрования сообщения"})
+		SendBadRequest(c, "Некорректный ID чата")
 		return
 	}
 
-	// Создаем новое сообщение
-	message := models.Message{
-		ChatID:    uint(chatID),
-		UserID:    userID,
-		Content:   encryptedContent,
-		Type:      req.Type,
-		FileID:    req.FileID,
-		PlainText: req.Content, // Только для ответа, не сохраняется в БД
+	if !s.db.IsUserInChat(userID, uint(chatID)) {
+		SendForbidden(c, "У вас нет доступа к этому чату")
+		return
 	}
 
-	// Сохраняем сообщение в базе данных
-	if err := s.db.CreateMessage(&message); err != nil {
-		logger.Errorf("Ошибка создания сообщения: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка создания сообщения"})
+	var req MarkReadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		SendBadRequest(c, "Неверный формат запроса")
 		return
 	}
 
-	// Обновляем время последней активности чата
-	chat, err := s.db.GetChatByID(uint(chatID))
-	if err == nil && chat != nil {
-		chat.LastActivity = time.Now()
-		if err := s.db.UpdateChat(chat); err != nil {
-			logger.Errorf("Ошибка обновления времени активности чата: %v", err)
+	seq := req.Seq
+	if req.MessageID != 0 {
+		message, err := s.db.GetMessageByID(req.MessageID)
+		if err != nil || message.ChatID != uint(chatID) {
+			SendNotFound(c, "Сообщение не найдено")
+			return
 		}
+		seq = message.Seq
+	}
+	if seq == 0 {
+		SendBadRequest(c, "Не указан seq или message_id")
+		return
 	}
 
-	// Формируем ответ
-	response := messageResponse{
-		ID:        message.ID,
-		ChatID:    message.ChatID,
-		UserID:    message.UserID,
-		Content:   req.Content, // Отправляем открытый текст в ответе
-		Type:      message.Type,
-		FileID:    message.FileID,
-		File:      message.File,
-		CreatedAt: message.CreatedAt,
+	if err := s.markChatRead(userID, uint(chatID), seq); err != nil {
+		SendInternalError(c, "Ошибка обновления статуса сообщений")
+		return
 	}
 
-	// Добавляем информацию о пользователе
-	response.User.ID = user.ID
-	response.User.Username = user.Username
-	response.User.Avatar = user.Avatar
+	member, err := s.db.GetChatMember(uint(chatID), userID)
+	if err != nil {
+		SendInternalError(c, "Ошибка получения статуса прочтения")
+		return
+	}
 
-	c.JSON(http.StatusCreated, gin.H{
-		"message": response,
+	c.JSON(http.StatusOK, gin.H{
+		"chat_id":       member.ChatID,
+		"last_read_seq": member.LastReadSeq,
 	})
 }
 
-// Обработчик отметки сообщений как прочитанных
-func (s *Server) handleMarkMessagesAsRead(c *gin.Context) {
-	// Получаем ID текущего пользователя из контекста аутентификации
-	userID, exists := c.Get("userID")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Пользователь не авторизован"})
+// handleGetMessageReceipts возвращает, кому сообщение доставлено и кто его прочитал
+func (s *Server) handleGetMessageReceipts(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	chatID, err := strconv.ParseUint(c.Param("chatID"), 10, 32)
+	if err != nil {
+		SendBadRequest(c, "Некорректный ID чата")
 		return
 	}
-
-	// Парсим запрос
-	var req MarkReadRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный формат запроса"})
+	messageID, err := strconv.ParseUint(c.Param("messageID"), 10, 32)
+	if err != nil {
+		SendBadRequest(c, "Некорректный ID сообщения")
 		return
 	}
 
-	// Обновляем сообщения в БД
-	if err := s.db.DB.Model(&models.Message{}).
-		Where("sender_id = ? AND recipient_id = ? AND is_read = ?", req.SenderID, userID, false).
-		Updates(map[string]interface{}{"is_read": true}).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка обновления статуса сообщений"})
+	if !s.db.IsUserInChat(userID, uint(chatID)) {
+		SendForbidden(c, "У вас нет доступа к этому чату")
+		return
+	}
+	// Кто прочитал пост канала, не раскрывается: доступно только число просмотров
+	if s.isChannel(uint(chatID)) {
+		SendBadRequest(c, "Для постов канала доступно только число просмотров")
 		return
 	}
 
-	// Отправляем уведомление о прочтении через WebSocket
-	// Формируем WebSocket сообщение
-	chatID := uint(req.SenderID)
-	wsMessage := WSMessage{
-		Type: "read",
-		Payload: ReadReceiptPayload{
-			ChatID:    chatID,
-			UserID:    userID,
-			Timestamp: time.Now(),
-		},
+	message, err := s.db.GetMessageByID(uint(messageID))
+	if err != nil || message.ChatID != uint(chatID) || !s.messageVisible(userID, message.ChatID, message.CreatedAt) {
+		if err != nil && err != gorm.ErrRecordNotFound {
+			SendInternalError(c, "Ошибка получения сообщения")
+			return
+		}
+		SendNotFound(c, "Сообщение не найдено")
+		return
 	}
 
-	// Если включен Redis, отправляем уведомление через него
-	if s.redis != nil && s.redis.IsEnabled() {
-		// Создаем канал для личного чата
-		channel := redis.CreatePrivateChatChannel(userID.(uint), req.SenderID)
+	receipts, err := s.db.GetMessageReceipts(message.ChatID, message.Seq, message.UserID)
+	if err != nil {
+		logger.Errorf("Ошибка получения статусов сообщения #%d: %v", message.ID, err)
+		SendInternalError(c, "Ошибка получения статусов сообщения")
+		return
+	}
 
-		// Создаем сообщение для Redis
-		redisMsg := redis.PubSubMessage{
-			Type:        "read_receipt",
-			RecipientID: req.SenderID,
-			SenderID:    userID.(uint),
-			Content:     []byte(fmt.Sprintf(`{"reader_id":%d}`, userID)),
+	seenBy := make([]database.MemberReceipt, 0, len(receipts))
+	deliveredTo := make([]database.MemberReceipt, 0, len(receipts))
+	for _, r := range receipts {
+		if r.LastReadSeq >= message.Seq {
+			seenBy = append(seenBy, r)
+		} else {
+			deliveredTo = append(deliveredTo, r)
 		}
+	}
 
-		// Публикуем сообщение
-		if err := s.redis.PublishMessage(channel, redisMsg); err != nil {
-			fmt.Printf("Ошибка публикации уведомления о прочтении в Redis: %v\n", err)
+	c.JSON(http.StatusOK, gin.H{
+		"message_id":   message.ID,
+		"seq":          message.Seq,
+		"seen_by":      seenBy,
+		"delivered_to": deliveredTo,
+	})
+}
+
+// messageDeletedEvent сообщает участникам об удалении сообщения
+type messageDeletedEvent struct {
+	ChatID    uint   `json:"chat_id"`
+	MessageID uint   `json:"message_id"`
+	Seq       uint64 `json:"seq"`
+	ActorID   uint   `json:"actor_id"`
+}
+
+// handleDeleteMessage удаляет сообщение. Свое сообщение может удалить автор,
+// чужое - участник с правом удаления чужих сообщений.
+func (s *Server) handleDeleteMessage(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	chatID, messageID, ok := parseMessagePath(c)
+	if !ok {
+		return
+	}
+
+	message, err := s.db.GetMessageByID(messageID)
+	if err != nil || message.ChatID != chatID {
+		if err != nil && err != gorm.ErrRecordNotFound {
+			SendInternalError(c, "Ошибка получения сообщения")
+			return
 		}
-	} else {
-		// Если Redis не используется, отправляем через прямое WebSocket соединение
-		s.mu.Lock()
-		client, ok := s.clients[req.SenderID]
-		s.mu.Unlock()
-
-		if ok {
-			// Сериализуем сообщение в JSON
-			messageJSON, err := serializeWSMessage(wsMessage)
-			if err != nil {
-				fmt.Printf("Ошибка сериализации уведомления: %v\n", err)
-			} else {
-				// Отправляем уведомление отправителю
-				client.send <- messageJSON
-			}
+		SendNotFound(c, "Сообщение не найдено")
+		return
+	}
+
+	perm := models.PermSendMessages
+	if message.UserID != userID {
+		perm = models.PermDeleteMessages
+	}
+	if _, _, _, sendErr := s.checkChatPermission(userID, chatID, perm); sendErr != nil {
+		// Автор, которому запретили писать, все равно может удалить свое сообщение
+		if message.UserID != userID || !s.db.IsUserInChat(userID, chatID) {
+			SendError(c, sendErr.Status, sendErr.Code, sendErr.Message)
+			return
 		}
 	}
 
-	c.JSON(http.StatusOK, gin.H{"status": "success"})
+	if err := s.db.DeleteMessage(message.ID); err != nil {
+		logger.Errorf("Ошибка удаления сообщения #%d: %v", message.ID, err)
+		SendInternalError(c, "Ошибка удаления сообщения")
+		return
+	}
+	logger.Infof("Пользователь %d удалил сообщение #%d в чате %d", userID, message.ID, chatID)
+
+	s.sendToChat(chatID, WSTypeMessageDeleted, messageDeletedEvent{
+		ChatID:    chatID,
+		MessageID: message.ID,
+		Seq:       message.Seq,
+		ActorID:   userID,
+	}, 0)
+
+	c.Status(http.StatusNoContent)
 }
 
 // Функция для обработки новых сообщений от клиента
@@ -350,10 +414,6 @@ func (s *Server) handleNewMessage(c *gin.Context, conn *websocket.Conn, userID u
 		return
 	}
 
-	// Обновляем last_message и last_activity в чате
-	chat.LastActivity = time.Now()
-	s.db.UpdateChat(chat)
-
 	// Подготавливаем данные пользователя для отправки
 	user, err := s.db.GetUserByID(userID)
 	if err == nil {
@@ -369,35 +429,11 @@ func (s *Server) handleNewMessage(c *gin.Context, conn *websocket.Conn, userID u
 
 // Функция для отправки сообщения всем участникам чата
 func (s *Server) broadcastMessageToChat(chatID, senderID uint, message *models.Message) {
-	// Получаем список пользователей чата
-	chatUsers, err := s.db.GetChatUsers(chatID)
-	if err != nil {
-		return
-	}
-
-	// Отправляем сообщение каждому участнику чата, кроме отправителя
-	for _, user := range chatUsers {
-		if user.ID == senderID {
-			continue // Пропускаем отправителя
-		}
-
-		// Проверяем, подключен ли пользователь
-		s.wsClients.Range(func(k, v interface{}) bool {
-			clientUserID, ok := k.(uint)
-			if !ok {
-				return true // Продолжаем перебор
-			}
-
-			if clientUserID == user.ID {
-				conn, ok := v.(*websocket.Conn)
-				if ok {
-					// Отправляем уведомление о новом сообщении
-					s.sendWSResponse(conn, "new_message", message)
-				}
-			}
-			return true
-		})
-	}
+	// Отправляем сообщение подключенным участникам чата, кроме отправителя
+	response := newMessageResponse(message)
+	s.forEachOnlineMember(chatID, senderID, func(client *WSClient) {
+		client.sendChatMessage(response)
+	})
 }
 
 // Сериализация WebSocket сообщения в JSON
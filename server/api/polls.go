@@ -0,0 +1,375 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"messenger/database"
+	"messenger/logger"
+	"messenger/models"
+	"messenger/utils/crypto"
+)
+
+// Максимальная длина вопроса опроса в символах
+const pollMaxQuestionLength = 300
+
+// pollRequest описывает опрос в запросе на отправку сообщения типа poll.
+// Вопрос передается в поле content сообщения.
+type pollRequest struct {
+	Options        []string   `json:"options"`
+	Anonymous      *bool      `json:"anonymous,omitempty"` // По умолчанию опрос анонимный
+	MultipleChoice bool       `json:"multiple_choice"`
+	ClosesAt       *time.Time `json:"closes_at,omitempty"`
+}
+
+// Запрос на голосование в опросе
+type pollVoteRequest struct {
+	OptionIDs []uint `json:"option_ids" binding:"required"`
+}
+
+// pollResponse содержит состояние опроса и текущие результаты
+type pollResponse struct {
+	ID             uint                 `json:"id"`
+	MessageID      uint                 `json:"message_id"`
+	ChatID         uint                 `json:"chat_id"`
+	Anonymous      bool                 `json:"anonymous"`
+	MultipleChoice bool                 `json:"multiple_choice"`
+	ClosesAt       *time.Time           `json:"closes_at,omitempty"`
+	Closed         bool                 `json:"closed"`
+	TotalVoters    int                  `json:"total_voters"`
+	Options        []pollOptionResponse `json:"options"`
+	MyVotes        []uint               `json:"my_votes,omitempty"` // Варианты, выбранные текущим пользователем
+}
+
+// pollOptionResponse содержит вариант ответа и число голосов за него
+type pollOptionResponse struct {
+	ID     uint   `json:"id"`
+	Text   string `json:"text"`
+	Votes  int    `json:"votes"`
+	Voters []uint `json:"voters,omitempty"` // Только для неанонимных опросов
+}
+
+// buildPoll проверяет параметры опроса и подготавливает модель с шифрованными вариантами
+func buildPoll(question string, req *pollRequest, chatID uint) (*models.Poll, *sendMessageError) {
+	if req == nil {
+		return nil, &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", "Не указаны параметры опроса"}
+	}
+	if utf8.RuneCountInString(question) > pollMaxQuestionLength {
+		return nil, &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", "Слишком длинный вопрос опроса"}
+	}
+	if len(req.Options) < models.PollMinOptions || len(req.Options) > models.PollMaxOptions {
+		return nil, &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", "Опрос должен содержать от 2 до 10 вариантов ответа"}
+	}
+	if req.ClosesAt != nil && !req.ClosesAt.After(time.Now()) {
+		return nil, &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", "Время закрытия опроса должно быть в будущем"}
+	}
+
+	poll := &models.Poll{
+		ChatID:         chatID,
+		Anonymous:      req.Anonymous == nil || *req.Anonymous,
+		MultipleChoice: req.MultipleChoice,
+		ClosesAt:       req.ClosesAt,
+	}
+
+	seen := make(map[string]bool, len(req.Options))
+	for i, option := range req.Options {
+		option = strings.TrimSpace(option)
+		if option == "" || utf8.RuneCountInString(option) > models.PollMaxOptionLength {
+			return nil, &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", "Некорректный вариант ответа"}
+		}
+		if seen[option] {
+			return nil, &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", "Варианты ответа не должны повторяться"}
+		}
+		seen[option] = true
+
+		encrypted, err := crypto.Encrypt([]byte(option))
+		if err != nil {
+			logger.Errorf("Ошибка шифрования варианта опроса: %v", err)
+			return nil, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка шифрования опроса"}
+		}
+		poll.Options = append(poll.Options, models.PollOption{Position: i, Text: encrypted})
+	}
+
+	return poll, nil
+}
+
+// newPollResponse формирует результаты опроса. Для анонимных опросов голосовавшие не раскрываются.
+// viewerID определяет, чьи голоса попадут в my_votes (0 - ничьи).
+func newPollResponse(poll *models.Poll, votes []models.PollVote, viewerID uint) *pollResponse {
+	response := &pollResponse{
+		ID:             poll.ID,
+		MessageID:      poll.MessageID,
+		ChatID:         poll.ChatID,
+		Anonymous:      poll.Anonymous,
+		MultipleChoice: poll.MultipleChoice,
+		ClosesAt:       poll.ClosesAt,
+		Closed:         poll.IsClosed(time.Now()),
+		Options:        make([]pollOptionResponse, 0, len(poll.Options)),
+	}
+
+	index := make(map[uint]int, len(poll.Options))
+	for i, option := range poll.Options {
+		text, err := crypto.Decrypt(option.Text)
+		if err != nil {
+			logger.Errorf("Ошибка расшифровки варианта опроса #%d: %v", option.ID, err)
+			text = []byte("[Ошибка расшифровки]")
+		}
+		index[option.ID] = i
+		response.Options = append(response.Options, pollOptionResponse{ID: option.ID, Text: string(text)})
+	}
+
+	voters := make(map[uint]bool)
+	for _, vote := range votes {
+		i, ok := index[vote.OptionID]
+		if !ok || vote.PollID != poll.ID {
+			continue
+		}
+		response.Options[i].Votes++
+		if !poll.Anonymous {
+			response.Options[i].Voters = append(response.Options[i].Voters, vote.UserID)
+		}
+		if viewerID != 0 && vote.UserID == viewerID {
+			response.MyVotes = append(response.MyVotes, vote.OptionID)
+		}
+		voters[vote.UserID] = true
+	}
+	response.TotalVoters = len(voters)
+
+	return response
+}
+
+// attachPollResults заполняет результаты опросов в сообщениях одним запросом голосов
+func (s *Server) attachPollResults(messages []models.Message, responses []messageResponse, viewerID uint) {
+	var pollIDs []uint
+	for _, msg := range messages {
+		if msg.Poll != nil {
+			pollIDs = append(pollIDs, msg.Poll.ID)
+		}
+	}
+	if len(pollIDs) == 0 {
+		return
+	}
+
+	votes, err := s.db.GetPollVotes(pollIDs)
+	if err != nil {
+		logger.Errorf("Ошибка получения голосов опросов: %v", err)
+		return
+	}
+
+	for i := range messages {
+		if messages[i].Poll != nil {
+			responses[i].Poll = newPollResponse(messages[i].Poll, votes, viewerID)
+		}
+	}
+}
+
+// loadPollForMember возвращает опрос, если пользователь состоит в его чате и видит сообщение с ним
+func (s *Server) loadPollForMember(c *gin.Context, userID uint) (*models.Poll, bool) {
+	pollID, err := strconv.ParseUint(c.Param("pollID"), 10, 32)
+	if err != nil {
+		SendBadRequest(c, "Некорректный ID опроса")
+		return nil, false
+	}
+
+	poll, err := s.db.GetPoll(uint(pollID))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			SendNotFound(c, "Опрос не найден")
+		} else {
+			SendInternalError(c, "Ошибка получения опроса")
+		}
+		return nil, false
+	}
+
+	if !s.db.IsUserInChat(userID, poll.ChatID) {
+		SendForbidden(c, "У вас нет доступа к этому чату")
+		return nil, false
+	}
+	// Опрос из скрытой истории неотличим от несуществующего
+	if !s.messageVisible(userID, poll.ChatID, poll.CreatedAt) {
+		SendNotFound(c, "Опрос не найден")
+		return nil, false
+	}
+
+	return poll, true
+}
+
+// handleVotePoll сохраняет голос пользователя, заменяя предыдущий
+func (s *Server) handleVotePoll(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	poll, ok := s.loadPollForMember(c, userID)
+	if !ok {
+		return
+	}
+
+	var req pollVoteRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.OptionIDs) == 0 {
+		SendBadRequest(c, "Не выбраны варианты ответа")
+		return
+	}
+	if !poll.MultipleChoice && len(req.OptionIDs) > 1 {
+		SendBadRequest(c, "В опросе можно выбрать только один вариант")
+		return
+	}
+
+	valid := make(map[uint]bool, len(poll.Options))
+	for _, option := range poll.Options {
+		valid[option.ID] = true
+	}
+	seen := make(map[uint]bool, len(req.OptionIDs))
+	for _, optionID := range req.OptionIDs {
+		if !valid[optionID] || seen[optionID] {
+			SendBadRequest(c, "Некорректный вариант ответа")
+			return
+		}
+		seen[optionID] = true
+	}
+
+	if err := s.db.SetPollVotes(poll.ID, userID, req.OptionIDs); err != nil {
+		if errors.Is(err, database.ErrPollClosed) {
+			SendError(c, http.StatusConflict, "POLL_CLOSED", "Опрос закрыт")
+			return
+		}
+		logger.Errorf("Ошибка сохранения голоса в опросе #%d: %v", poll.ID, err)
+		SendInternalError(c, "Ошибка сохранения голоса")
+		return
+	}
+
+	s.respondPollUpdated(c, poll, userID)
+}
+
+// handleRetractPollVote отзывает голос пользователя
+func (s *Server) handleRetractPollVote(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	poll, ok := s.loadPollForMember(c, userID)
+	if !ok {
+		return
+	}
+
+	retracted, err := s.db.RetractPollVotes(poll.ID, userID)
+	if err != nil {
+		if errors.Is(err, database.ErrPollClosed) {
+			SendError(c, http.StatusConflict, "POLL_CLOSED", "Опрос закрыт")
+			return
+		}
+		logger.Errorf("Ошибка отзыва голоса в опросе #%d: %v", poll.ID, err)
+		SendInternalError(c, "Ошибка отзыва голоса")
+		return
+	}
+	if !retracted {
+		SendNotFound(c, "Вы не голосовали в этом опросе")
+		return
+	}
+
+	s.respondPollUpdated(c, poll, userID)
+}
+
+// handleClosePoll закрывает опрос. Закрыть опрос может его автор или модератор чата.
+func (s *Server) handleClosePoll(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	poll, ok := s.loadPollForMember(c, userID)
+	if !ok {
+		return
+	}
+
+	message, err := s.db.GetMessageByID(poll.MessageID)
+	if err != nil {
+		SendInternalError(c, "Ошибка получения опроса")
+		return
+	}
+	// Чужой опрос может закрыть тот, кому разрешено удалять чужие сообщения
+	if message.UserID != userID {
+		if _, _, _, sendErr := s.checkChatPermission(userID, poll.ChatID, models.PermDeleteMessages); sendErr != nil {
+			SendForbidden(c, "Закрыть опрос может только его автор или модератор чата")
+			return
+		}
+	}
+
+	closed, err := s.db.ClosePoll(poll.ID, time.Now())
+	if err != nil {
+		logger.Errorf("Ошибка закрытия опроса #%d: %v", poll.ID, err)
+		SendInternalError(c, "Ошибка закрытия опроса")
+		return
+	}
+	if !closed {
+		SendError(c, http.StatusConflict, "POLL_CLOSED", "Опрос уже закрыт")
+		return
+	}
+
+	s.respondPollUpdated(c, poll, userID)
+}
+
+// respondPollUpdated отвечает актуальными результатами опроса и рассылает их участникам чата
+func (s *Server) respondPollUpdated(c *gin.Context, poll *models.Poll, userID uint) {
+	response, err := s.broadcastPollUpdate(poll.ID, userID)
+	if err != nil {
+		SendInternalError(c, "Ошибка получения результатов опроса")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"poll": response,
+	})
+}
+
+// broadcastPollUpdate рассылает участникам чата событие poll_updated с текущими результатами.
+// Возвращает результаты с точки зрения viewerID.
+func (s *Server) broadcastPollUpdate(pollID, viewerID uint) (*pollResponse, error) {
+	poll, err := s.db.GetPoll(pollID)
+	if err != nil {
+		logger.Errorf("Ошибка получения опроса #%d: %v", pollID, err)
+		return nil, err
+	}
+	votes, err := s.db.GetPollVotes([]uint{poll.ID})
+	if err != nil {
+		logger.Errorf("Ошибка получения голосов опроса #%d: %v", poll.ID, err)
+		return nil, err
+	}
+
+	// Общее событие не содержит my_votes: свой выбор клиент знает из ответа на голосование.
+	// Участники, от которых опрос скрыт историей до вступления, события не получают.
+	s.sendToMessageViewers(poll.ChatID, poll.CreatedAt, WSTypePollUpdated, newPollResponse(poll, votes, 0), 0)
+
+	return newPollResponse(poll, votes, viewerID), nil
+}
+
+// schedulePollClose закрывает опрос по наступлении времени закрытия
+func (s *Server) schedulePollClose(poll *models.Poll) {
+	if poll.ClosesAt == nil || poll.ClosedAt != nil {
+		return
+	}
+
+	pollID, closesAt := poll.ID, *poll.ClosesAt
+	time.AfterFunc(time.Until(closesAt), func() {
+		closed, err := s.db.ClosePoll(pollID, closesAt)
+		if err != nil {
+			logger.Errorf("Ошибка автоматического закрытия опроса #%d: %v", pollID, err)
+			return
+		}
+		if closed {
+			s.broadcastPollUpdate(pollID, 0)
+		}
+	})
+}
+
+// scheduleExistingPolls восстанавливает таймеры закрытия опросов после перезапуска сервера
+func (s *Server) scheduleExistingPolls() {
+	polls, err := s.db.GetScheduledPolls()
+	if err != nil {
+		logger.Errorf("Ошибка получения опросов с временем закрытия: %v", err)
+		return
+	}
+	for i := range polls {
+		s.schedulePollClose(&polls[i])
+	}
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"messenger/logger"
+	"messenger/models"
+	"messenger/richtext"
+	"messenger/unfurl"
+	"messenger/utils/crypto"
+)
+
+// resolveLinkPreview загружает предпросмотр первой ссылки сообщения, сохраняет его
+// и рассылает участникам чата событие message_updated. Вызывается асинхронно после отправки.
+func (s *Server) resolveLinkPreview(message messageResponse) {
+	if s.unfurler == nil || message.Type != string(models.MessageTypeText) {
+		return
+	}
+
+	// Ссылки из разметки не остаются в тексте, поэтому учитываем и сущности
+	link := unfurl.FindURL(message.Content)
+	for _, entity := range message.Entities {
+		if link != "" {
+			break
+		}
+		if entity.Type == richtext.EntityLink && entity.URL != "" && !strings.HasPrefix(entity.URL, "mailto:") {
+			link = entity.URL
+		}
+	}
+	if link == "" {
+		return
+	}
+
+	preview, err := s.unfurler.Unfurl(context.Background(), link)
+	if err != nil {
+		logger.Debugf("Предпросмотр ссылки для сообщения #%d не получен: %v", message.ID, err)
+		return
+	}
+
+	data, err := json.Marshal(preview)
+	if err != nil {
+		logger.Errorf("Ошибка сериализации предпросмотра ссылки: %v", err)
+		return
+	}
+
+	encrypted, err := crypto.Encrypt(data)
+	if err != nil {
+		logger.Errorf("Ошибка шифрования предпросмотра ссылки: %v", err)
+		return
+	}
+
+	if err := s.db.SetMessagePreview(message.ID, encrypted); err != nil {
+		logger.Errorf("Ошибка сохранения предпросмотра для сообщения #%d: %v", message.ID, err)
+		return
+	}
+
+	message.Preview = preview
+	s.sendToChat(message.ChatID, WSTypeMessageUpdated, message, 0)
+}
+
+// decryptPreview расшифровывает сохраненный предпросмотр ссылки
+func decryptPreview(message *models.Message) *unfurl.Preview {
+	if len(message.Preview) == 0 {
+		return nil
+	}
+
+	data, err := crypto.Decrypt(message.Preview)
+	if err != nil {
+		logger.Errorf("Ошибка расшифровки предпросмотра сообщения #%d: %v", message.ID, err)
+		return nil
+	}
+
+	var preview unfurl.Preview
+	if err := json.Unmarshal(data, &preview); err != nil {
+		logger.Errorf("Ошибка разбора предпросмотра сообщения #%d: %v", message.ID, err)
+		return nil
+	}
+	return &preview
+}
@@ -0,0 +1,348 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+
+	"messenger/database"
+	"messenger/logger"
+	"messenger/models"
+)
+
+const (
+	// Максимальный срок ограничения; бессрочные ограничения задаются нулевым сроком
+	maxRestrictionDuration = 366 * 24 * time.Hour
+
+	// Максимальная длина причины ограничения
+	maxRestrictionReasonLength = 255
+)
+
+// Коды ошибок для заблокированных и заглушенных пользователей
+const (
+	errCodeBanned = "BANNED"
+	errCodeMuted  = "MUTED"
+)
+
+// Действия в событии об ограничении
+const (
+	restrictionApplied = "applied"
+	restrictionLifted  = "lifted"
+)
+
+// chatRestrictionEvent сообщает о наложении или снятии ограничения. Отправляется участникам
+// чата и отдельно самому пользователю, который после блокировки уже не состоит в чате.
+type chatRestrictionEvent struct {
+	ChatID    uint                       `json:"chat_id"`
+	UserID    uint                       `json:"user_id"`
+	Type      models.ChatRestrictionType `json:"type"`
+	Action    string                     `json:"action"`
+	ExpiresAt *time.Time                 `json:"expires_at,omitempty"`
+	Reason    string                     `json:"reason,omitempty"`
+	ActorID   uint                       `json:"actor_id"`
+}
+
+// Структура запроса на ограничение участника. Тело запроса необязательно.
+type restrictMemberRequest struct {
+	DurationSeconds int64  `json:"duration_seconds"` // 0 - бессрочно, для исключения - без запрета вернуться
+	Reason          string `json:"reason"`
+}
+
+// Структура ответа на наложение или снятие ограничения
+type restrictionResponse struct {
+	Restriction *models.ChatRestriction `json:"restriction,omitempty"`
+	Message     *messageResponse        `json:"message,omitempty"`
+}
+
+// loadRestrictionTarget проверяет, что пользователь может ограничивать цель запроса в чате.
+// Участника ограничивает тот, кто вправе его исключить; пользователя вне чата - администратор.
+// Для пользователя вне чата targetMember равен nil.
+func (s *Server) loadRestrictionTarget(c *gin.Context) (user *models.User, chat *models.Chat, target *models.User, targetMember *models.ChatUser, ok bool) {
+	user, chat, member, ok := s.loadChatMembership(c)
+	if !ok {
+		return nil, nil, nil, nil, false
+	}
+	if !chat.HasRoles() {
+		SendBadRequest(c, "Ограничения участников доступны только в групповых чатах и каналах")
+		return nil, nil, nil, nil, false
+	}
+
+	targetID, err := strconv.ParseUint(c.Param("userID"), 10, 32)
+	if err != nil {
+		SendBadRequest(c, "Некорректный ID пользователя")
+		return nil, nil, nil, nil, false
+	}
+	if uint(targetID) == user.ID {
+		SendBadRequest(c, "Нельзя ограничить самого себя")
+		return nil, nil, nil, nil, false
+	}
+	target, err = s.db.GetUserByID(uint(targetID))
+	if err != nil {
+		SendNotFound(c, "Пользователь не найден")
+		return nil, nil, nil, nil, false
+	}
+
+	targetMember, err = s.db.GetChatMember(chat.ID, target.ID)
+	if err != nil {
+		targetMember = nil
+		if user.Role != "admin" && !member.Role.AtLeast(models.ChatRoleAdmin) {
+			SendForbidden(c, "Недостаточно прав для ограничения участников")
+			return nil, nil, nil, nil, false
+		}
+	} else if !canModerateMember(user, member, targetMember) {
+		SendForbidden(c, "Недостаточно прав для ограничения этого участника")
+		return nil, nil, nil, nil, false
+	}
+	return user, chat, target, targetMember, true
+}
+
+// handleBanChatMember исключает пользователя из чата и запрещает ему возвращаться
+func (s *Server) handleBanChatMember(c *gin.Context) {
+	s.restrictChatMember(c, models.ChatRestrictionBan)
+}
+
+// handleMuteChatMember запрещает участнику писать в чат
+func (s *Server) handleMuteChatMember(c *gin.Context) {
+	s.restrictChatMember(c, models.ChatRestrictionMute)
+}
+
+// handleKickChatMember исключает участника; со сроком он не сможет вернуться, пока срок не выйдет
+func (s *Server) handleKickChatMember(c *gin.Context) {
+	s.restrictChatMember(c, models.ChatRestrictionKick)
+}
+
+// handleUnbanChatMember досрочно снимает блокировку
+func (s *Server) handleUnbanChatMember(c *gin.Context) {
+	s.liftChatRestriction(c, models.ChatRestrictionBan)
+}
+
+// handleUnmuteChatMember досрочно разрешает участнику писать в чат
+func (s *Server) handleUnmuteChatMember(c *gin.Context) {
+	s.liftChatRestriction(c, models.ChatRestrictionMute)
+}
+
+// restrictChatMember накладывает ограничение, уведомляет пользователя и участников чата
+// и публикует служебное сообщение
+func (s *Server) restrictChatMember(c *gin.Context, restrictionType models.ChatRestrictionType) {
+	user, chat, target, targetMember, ok := s.loadRestrictionTarget(c)
+	if !ok {
+		return
+	}
+	if targetMember == nil && restrictionType != models.ChatRestrictionBan {
+		SendNotFound(c, "Пользователь не состоит в чате")
+		return
+	}
+
+	var req restrictMemberRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			SendBadRequest(c, "Некорректные данные запроса: "+err.Error())
+			return
+		}
+	}
+	duration := time.Duration(req.DurationSeconds) * time.Second
+	if req.DurationSeconds < 0 || duration > maxRestrictionDuration {
+		SendBadRequest(c, fmt.Sprintf("Срок ограничения должен быть от 0 до %d секунд", int64(maxRestrictionDuration/time.Second)))
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if utf8.RuneCountInString(req.Reason) > maxRestrictionReasonLength {
+		SendBadRequest(c, "Слишком длинная причина")
+		return
+	}
+
+	now := time.Now()
+	restriction := models.ChatRestriction{
+		ChatID:    chat.ID,
+		UserID:    target.ID,
+		Type:      restrictionType,
+		Reason:    req.Reason,
+		CreatedBy: user.ID,
+		CreatedAt: now,
+	}
+	if duration > 0 {
+		expiresAt := now.Add(duration)
+		restriction.ExpiresAt = &expiresAt
+	} else if restrictionType == models.ChatRestrictionKick {
+		// Исключение без срока не мешает вернуться и остается только в журнале
+		restriction.ExpiresAt = &now
+	}
+
+	removal, err := s.db.RestrictChatMember(&restriction)
+	if err != nil {
+		if errors.Is(err, database.ErrNotChatMember) {
+			SendNotFound(c, "Пользователь не состоит в чате")
+			return
+		}
+		logger.Errorf("Ошибка ограничения пользователя %d в чате %d: %v", target.ID, chat.ID, err)
+		SendInternalError(c, "Ошибка ограничения участника")
+		return
+	}
+	logger.Infof("Пользователь %d наложил ограничение %s на пользователя %d в чате %d", user.ID, restrictionType, target.ID, chat.ID)
+
+	s.notifyRestriction(chatRestrictionEvent{
+		ChatID:    chat.ID,
+		UserID:    target.ID,
+		Type:      restrictionType,
+		Action:    restrictionApplied,
+		ExpiresAt: restriction.ExpiresAt,
+		Reason:    restriction.Reason,
+		ActorID:   user.ID,
+	}, true)
+
+	// Инициатор остается в чате, поэтому исключение не может удалить чат
+	if removal != nil {
+		event := chatMembersEvent{
+			ChatID:     chat.ID,
+			Action:     membersRemoved,
+			UserIDs:    []uint{target.ID},
+			ActorID:    user.ID,
+			NewOwnerID: removal.NewOwnerID,
+		}
+		if err := s.sendMessageToUser(target.ID, wsResponse{Type: WSTypeChatMembers, Payload: event}); err != nil {
+			logger.Errorf("Ошибка отправки события о составе чата пользователю %d: %v", target.ID, err)
+		}
+		s.sendToChat(chat.ID, WSTypeChatMembers, event, 0)
+	}
+
+	response := restrictionResponse{Restriction: &restriction}
+	if announcesMembers(chat) {
+		message, sendErr := s.postSystemMessage(chat.ID, user, restrictionEvent(target, &restriction))
+		if sendErr != nil {
+			// Ограничение уже действует: отсутствие служебного сообщения его не отменяет
+			logger.Errorf("Ошибка публикации сообщения об ограничении в чате %d: %s", chat.ID, sendErr.Message)
+		}
+		response.Message = message
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// liftChatRestriction досрочно снимает ограничение и уведомляет пользователя и участников чата
+func (s *Server) liftChatRestriction(c *gin.Context, restrictionType models.ChatRestrictionType) {
+	user, chat, target, _, ok := s.loadRestrictionTarget(c)
+	if !ok {
+		return
+	}
+
+	if err := s.db.LiftChatRestriction(chat.ID, target.ID, restrictionType, user.ID, time.Now()); err != nil {
+		if errors.Is(err, database.ErrRestrictionNotFound) {
+			SendNotFound(c, "Действующее ограничение не найдено")
+			return
+		}
+		logger.Errorf("Ошибка снятия ограничения с пользователя %d в чате %d: %v", target.ID, chat.ID, err)
+		SendInternalError(c, "Ошибка снятия ограничения")
+		return
+	}
+	logger.Infof("Пользователь %d снял ограничение %s с пользователя %d в чате %d", user.ID, restrictionType, target.ID, chat.ID)
+
+	s.notifyRestriction(chatRestrictionEvent{
+		ChatID:  chat.ID,
+		UserID:  target.ID,
+		Type:    restrictionType,
+		Action:  restrictionLifted,
+		ActorID: user.ID,
+	}, true)
+
+	var response restrictionResponse
+	if announcesMembers(chat) {
+		event := models.SystemEvent{
+			Kind:    models.SystemEventMemberUnbanned,
+			Targets: []models.SystemEventUser{eventUser(target)},
+		}
+		if restrictionType == models.ChatRestrictionMute {
+			event.Kind = models.SystemEventMemberUnmuted
+		}
+		message, sendErr := s.postSystemMessage(chat.ID, user, event)
+		if sendErr != nil {
+			logger.Errorf("Ошибка публикации сообщения о снятии ограничения в чате %d: %s", chat.ID, sendErr.Message)
+		}
+		response.Message = message
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// notifyRestriction отправляет событие об ограничении пользователю на все его устройства
+// и, если toChat, участникам чата
+func (s *Server) notifyRestriction(event chatRestrictionEvent, toChat bool) {
+	if err := s.sendMessageToUser(event.UserID, wsResponse{Type: WSTypeChatRestriction, Payload: event}); err != nil {
+		logger.Errorf("Ошибка отправки события об ограничении пользователю %d: %v", event.UserID, err)
+	}
+	if toChat {
+		s.sendToChat(event.ChatID, WSTypeChatRestriction, event, event.UserID)
+	}
+}
+
+// restrictionEvent описывает наложенное ограничение для служебного сообщения
+func restrictionEvent(target *models.User, restriction *models.ChatRestriction) models.SystemEvent {
+	event := models.SystemEvent{
+		Kind:    models.SystemEventMemberKicked,
+		Targets: []models.SystemEventUser{eventUser(target)},
+		Params:  map[string]string{},
+	}
+	switch restriction.Type {
+	case models.ChatRestrictionBan:
+		event.Kind = models.SystemEventMemberBanned
+	case models.ChatRestrictionMute:
+		event.Kind = models.SystemEventMemberMuted
+	}
+	if restriction.ExpiresAt != nil && restriction.ExpiresAt.After(restriction.CreatedAt) {
+		event.Params[models.SystemParamExpiresAt] = restriction.ExpiresAt.Format(time.RFC3339)
+	}
+	if restriction.Reason != "" {
+		event.Params[models.SystemParamReason] = restriction.Reason
+	}
+	return event
+}
+
+// handleGetChatRestrictions возвращает действующие ограничения чата. Список видят
+// администраторы чата.
+func (s *Server) handleGetChatRestrictions(c *gin.Context) {
+	user, chat, member, ok := s.loadChatMembership(c)
+	if !ok {
+		return
+	}
+	if !chat.HasRoles() {
+		SendBadRequest(c, "Ограничения участников доступны только в групповых чатах и каналах")
+		return
+	}
+	if user.Role != "admin" && !member.Role.AtLeast(models.ChatRoleAdmin) {
+		SendForbidden(c, "Недостаточно прав для просмотра ограничений")
+		return
+	}
+
+	restrictions, err := s.db.GetActiveChatRestrictions(chat.ID, time.Now())
+	if err != nil {
+		logger.Errorf("Ошибка получения ограничений чата %d: %v", chat.ID, err)
+		SendInternalError(c, "Ошибка получения ограничений")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"restrictions": restrictions})
+}
+
+// checkMuted возвращает ошибку отправки, если участнику запрещено писать в чат
+func (s *Server) checkMuted(chatID, userID uint) *sendMessageError {
+	restriction, err := s.db.GetActiveRestriction(chatID, userID, models.ChatRestrictionMute, time.Now())
+	if errors.Is(err, database.ErrRestrictionNotFound) {
+		return nil
+	}
+	if err != nil {
+		logger.Errorf("Ошибка проверки ограничений пользователя %d в чате %d: %v", userID, chatID, err)
+		return &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка проверки прав"}
+	}
+	if restriction.ExpiresAt != nil {
+		return &sendMessageError{http.StatusForbidden, errCodeMuted,
+			"Вам запрещено писать в этот чат до " + formatUTC(*restriction.ExpiresAt)}
+	}
+	return &sendMessageError{http.StatusForbidden, errCodeMuted, "Вам запрещено писать в этот чат"}
+}
+
+// sendBannedError сообщает, что пользователю запрещено вступать в чат
+func sendBannedError(c *gin.Context, chatID uint) {
+	SendError(c, http.StatusForbidden, errCodeBanned, "Вступление в этот чат запрещено", gin.H{"chat_id": chatID})
+}
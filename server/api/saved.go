@@ -0,0 +1,172 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"messenger/logger"
+	"messenger/models"
+)
+
+// Ограничения постраничной выборки закладок
+const (
+	savedMessagesDefaultLimit = 50
+	savedMessagesMaxLimit     = 100
+)
+
+// Запрос на добавление сообщения в закладки
+type saveMessageRequest struct {
+	MessageID uint `json:"message_id" binding:"required"`
+}
+
+// savedMessageResponse содержит закладку с сообщением и информацией о чате
+type savedMessageResponse struct {
+	ID      uint      `json:"id"`
+	SavedAt time.Time `json:"saved_at"`
+	Chat    struct {
+		ID   uint   `json:"id"`
+		Name string `json:"name"`
+		Type string `json:"type"`
+	} `json:"chat"`
+	Message messageResponse `json:"message"`
+}
+
+// handleSaveMessage добавляет сообщение в закладки текущего пользователя
+func (s *Server) handleSaveMessage(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var req saveMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		SendBadRequest(c, "Неверный формат запроса")
+		return
+	}
+
+	// Недоступное сообщение неотличимо от несуществующего
+	message, err := s.db.GetMessageByID(req.MessageID)
+	if err != nil || !s.messageVisible(userID, message.ChatID, message.CreatedAt) {
+		SendNotFound(c, "Сообщение не найдено")
+		return
+	}
+
+	saved, err := s.db.SaveMessage(userID, message.ID)
+	if err != nil {
+		logger.Errorf("Ошибка сохранения закладки на сообщение #%d: %v", message.ID, err)
+		SendInternalError(c, "Ошибка сохранения закладки")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"id":         saved.ID,
+		"message_id": saved.MessageID,
+		"saved_at":   saved.CreatedAt,
+	})
+}
+
+// handleDeleteSavedMessage удаляет сообщение из закладок текущего пользователя
+func (s *Server) handleDeleteSavedMessage(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	messageID, err := strconv.ParseUint(c.Param("messageID"), 10, 32)
+	if err != nil {
+		SendBadRequest(c, "Некорректный ID сообщения")
+		return
+	}
+
+	deleted, err := s.db.DeleteSavedMessage(userID, uint(messageID))
+	if err != nil {
+		SendInternalError(c, "Ошибка удаления закладки")
+		return
+	}
+	if !deleted {
+		SendNotFound(c, "Закладка не найдена")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Закладка удалена"})
+}
+
+// handleGetSavedMessages возвращает закладки текущего пользователя от новых к старым.
+// Параметр before задает ID закладки, с которой продолжается выборка.
+func (s *Server) handleGetSavedMessages(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	limit := savedMessagesDefaultLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			SendBadRequest(c, "Некорректный параметр limit")
+			return
+		}
+		if n < savedMessagesMaxLimit {
+			limit = n
+		} else {
+			limit = savedMessagesMaxLimit
+		}
+	}
+
+	var beforeID uint
+	if v := c.Query("before"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			SendBadRequest(c, "Некорректный параметр before")
+			return
+		}
+		beforeID = uint(n)
+	}
+
+	saved, err := s.db.GetSavedMessages(userID, beforeID, limit)
+	if err != nil {
+		logger.Errorf("Ошибка получения закладок пользователя %d: %v", userID, err)
+		SendInternalError(c, "Ошибка получения закладок")
+		return
+	}
+
+	// Загружаем чаты закладок одним запросом
+	chatIDs := make([]uint, 0, len(saved))
+	seen := make(map[uint]bool)
+	messages := make([]models.Message, 0, len(saved))
+	for _, item := range saved {
+		if !seen[item.Message.ChatID] {
+			seen[item.Message.ChatID] = true
+			chatIDs = append(chatIDs, item.Message.ChatID)
+		}
+		messages = append(messages, item.Message)
+	}
+
+	chats, err := s.db.GetChatsByIDs(chatIDs)
+	if err != nil {
+		SendInternalError(c, "Ошибка получения чатов")
+		return
+	}
+	chatByID := make(map[uint]models.Chat, len(chats))
+	for _, chat := range chats {
+		chatByID[chat.ID] = chat
+	}
+
+	responses := make([]messageResponse, 0, len(messages))
+	for i := range messages {
+		responses = append(responses, newMessageResponse(&messages[i]))
+	}
+	s.attachPollResults(messages, responses, userID)
+
+	result := make([]savedMessageResponse, 0, len(saved))
+	for i, item := range saved {
+		entry := savedMessageResponse{
+			ID:      item.ID,
+			SavedAt: item.CreatedAt,
+			Message: responses[i],
+		}
+		chat := chatByID[item.Message.ChatID]
+		entry.Chat.ID = chat.ID
+		entry.Chat.Name = chat.Name
+		entry.Chat.Type = chat.Type
+		result = append(result, entry)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"saved": result,
+	})
+}
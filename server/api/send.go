@@ -0,0 +1,323 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"messenger/database"
+	"messenger/logger"
+	"messenger/models"
+	"messenger/richtext"
+	"messenger/utils/crypto"
+)
+
+// outgoingMessage описывает сообщение, которое пользователь отправляет через REST или WebSocket
+type outgoingMessage struct {
+	ChatID   uint
+	TopicID  *uint // Тема группового чата; nil - общая лента
+	Content  string
+	Type     string
+	FileID   *uint
+	Poll     *pollRequest
+	Contact  *contactPayload
+	Location *locationPayload
+
+	// Соединение, через которое отправлено сообщение; nil - отправлено через REST.
+	// Оно получает сообщение в ответе, остальные устройства отправителя - рассылкой.
+	Origin *WSClient
+}
+
+// sendMessageError описывает причину отказа в отправке сообщения
+type sendMessageError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+// postMessage проверяет, сохраняет и рассылает новое сообщение пользователя.
+// Общая точка отправки для REST и WebSocket: соединению, через которое сообщение
+// отправлено, оно не рассылается, его получает вызывающий код в виде ответа.
+func (s *Server) postMessage(userID uint, out outgoingMessage) (*messageResponse, *sendMessageError) {
+	if out.Type == "" {
+		out.Type = string(models.MessageTypeText)
+	}
+	// Файл и голосовое сообщение могут быть отправлены без подписи
+	isVoice := out.Type == string(models.MessageTypeVoice)
+	isFile := out.Type == string(models.MessageTypeFile) || isVoice
+	// Контакт и местоположение передаются структурой, а не текстом
+	isStructured := out.Type == string(models.MessageTypeContact) || out.Type == string(models.MessageTypeLocation)
+	if out.ChatID == 0 || (out.Content == "" && !isFile && !isStructured) || isFile != (out.FileID != nil) {
+		return nil, &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", "Отсутствуют обязательные поля"}
+	}
+	switch models.MessageType(out.Type) {
+	case models.MessageTypeText, models.MessageTypeFile, models.MessageTypeVoice, models.MessageTypePoll,
+		models.MessageTypeContact, models.MessageTypeLocation:
+	default:
+		return nil, &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", "Неподдерживаемый тип сообщения"}
+	}
+
+	user, chat, member, sendErr := s.checkChatPermission(userID, out.ChatID, models.PermSendMessages)
+	if sendErr != nil {
+		return nil, sendErr
+	}
+	if chat.HasRoles() {
+		if sendErr := s.checkMuted(chat.ID, userID); sendErr != nil {
+			return nil, sendErr
+		}
+	}
+
+	// Тема должна принадлежать чату; в закрытую тему пишут только те, кто управляет темами
+	if out.TopicID != nil {
+		topic, err := s.db.GetChatTopic(chat.ID, *out.TopicID)
+		if err != nil {
+			if errors.Is(err, database.ErrTopicNotFound) {
+				return nil, &sendMessageError{http.StatusNotFound, "NOT_FOUND", "Тема не найдена"}
+			}
+			logger.Errorf("Ошибка получения темы #%d: %v", *out.TopicID, err)
+			return nil, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка получения темы"}
+		}
+		if topic.Closed && !chatAllows(user, chat, member, models.PermChangeInfo) {
+			return nil, &sendMessageError{http.StatusForbidden, "TOPIC_CLOSED", "Тема закрыта"}
+		}
+	}
+
+	message := models.Message{
+		ChatID:  out.ChatID,
+		TopicID: out.TopicID,
+		UserID:  userID,
+		Type:    out.Type,
+		FileID:  out.FileID,
+		// Без подписи пост канала публикуется от имени канала
+		Anonymous: chat.Type == models.ChatTypeChannel && !chat.SignMessages,
+	}
+
+	var file *models.File
+	var err error
+	if out.FileID != nil {
+		file, err = s.db.GetFileByID(*out.FileID)
+		if err != nil || file.MessageID != 0 {
+			return nil, &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", "Файл не найден или уже отправлен"}
+		}
+		// Длительность известна только для распознанных аудиозаписей
+		if isVoice && (file.FileType != models.FileTypeAudio || file.DurationMs == 0) {
+			return nil, &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", "Голосовое сообщение должно содержать аудиозапись"}
+		}
+	}
+
+	// Разметка текста и подписи к файлу превращается в чистый текст и список сущностей
+	content := out.Content
+	if out.Type == string(models.MessageTypeText) || (isFile && content != "") {
+		text, entities, err := richtext.Parse(out.Content)
+		if err != nil {
+			var parseErr *richtext.ParseError
+			if errors.As(err, &parseErr) {
+				return nil, &sendMessageError{http.StatusBadRequest, "INVALID_MARKUP", parseErr.Error()}
+			}
+			return nil, &sendMessageError{http.StatusBadRequest, "INVALID_MARKUP", "Некорректная разметка сообщения"}
+		}
+		if text == "" && !isFile {
+			return nil, &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", "Сообщение не может быть пустым"}
+		}
+		content = text
+
+		if len(entities) > 0 {
+			data, err := json.Marshal(entities)
+			if err != nil {
+				logger.Errorf("Ошибка сериализации сущностей сообщения: %v", err)
+				return nil, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка обработки сообщения"}
+			}
+			if message.Entities, err = crypto.Encrypt(data); err != nil {
+				logger.Errorf("Ошибка шифрования сущностей сообщения: %v", err)
+				return nil, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка шифрования сообщения"}
+			}
+		}
+	}
+
+	// Опросы доступны только в групповых чатах и каналах
+	if out.Type == string(models.MessageTypePoll) {
+		if !chat.HasRoles() {
+			return nil, &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", "Опросы доступны только в групповых чатах и каналах"}
+		}
+
+		poll, pollErr := buildPoll(content, out.Poll, out.ChatID)
+		if pollErr != nil {
+			return nil, pollErr
+		}
+		message.Poll = poll // Создается вместе с сообщением в одной транзакции
+	}
+
+	// Контакт и местоположение хранятся как шифрованный JSON
+	if isStructured {
+		content, message.LiveLocation, sendErr = s.buildStructuredContent(out)
+		if sendErr != nil {
+			return nil, sendErr
+		}
+		if message.LiveLocation != nil {
+			message.LiveLocation.UserID = userID // Создается вместе с сообщением
+		}
+	}
+
+	// Шифруем содержимое сообщения
+	if message.Content, err = crypto.Encrypt([]byte(content)); err != nil {
+		logger.Errorf("Ошибка шифрования сообщения: %v", err)
+		return nil, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка шифрования сообщения"}
+	}
+	message.PlainText = content // Только для ответа, не сохраняется в БД
+
+	// Сохраняем сообщение в базе данных (время активности чата обновляется там же)
+	if err := s.db.CreateMessage(&message); err != nil {
+		if errors.Is(err, database.ErrFileUnavailable) {
+			return nil, &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", "Файл не найден или уже отправлен"}
+		}
+		logger.Errorf("Ошибка создания сообщения: %v", err)
+		return nil, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка создания сообщения"}
+	}
+	message.User = *user
+	message.File = file
+
+	if message.Poll != nil {
+		s.schedulePollClose(message.Poll)
+	}
+	if message.LiveLocation != nil {
+		s.scheduleLiveLocationExpiry(message.LiveLocation)
+	}
+
+	response := newMessageResponse(&message)
+
+	// Отправляем сообщение участникам чата и другим устройствам отправителя
+	s.broadcastNewMessage(response, out.Origin)
+
+	// Предпросмотр ссылки придет отдельным событием message_updated
+	go s.resolveLinkPreview(response)
+
+	return &response, nil
+}
+
+// postSystemMessage сохраняет служебное сообщение о событии от имени инициатора и рассылает
+// его остальным участникам чата. Вместе с описанием события сохраняется его текст.
+// Действие /me сохраняется с типом action. Инициатор получает сообщение в ответе.
+func (s *Server) postSystemMessage(chatID uint, actor *models.User, event models.SystemEvent) (*messageResponse, *sendMessageError) {
+	return s.postEventMessage(chatID, actor, event, nil)
+}
+
+// postEventMessage сохраняет и рассылает служебное сообщение, как postSystemMessage.
+// origin - соединение инициатора, которому сообщение не рассылается.
+func (s *Server) postEventMessage(chatID uint, actor *models.User, event models.SystemEvent, origin *WSClient) (*messageResponse, *sendMessageError) {
+	message := models.Message{
+		ChatID: chatID,
+		UserID: actor.ID,
+		Type:   string(models.MessageTypeSystem),
+	}
+	if event.Kind == models.SystemEventAction {
+		message.Type = string(models.MessageTypeAction)
+	}
+	event.Actor = eventUser(actor)
+	text := systemEventText(&event)
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		logger.Errorf("Ошибка сериализации служебного события: %v", err)
+		return nil, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка обработки сообщения"}
+	}
+	if message.Event, err = crypto.Encrypt(data); err != nil {
+		logger.Errorf("Ошибка шифрования служебного события: %v", err)
+		return nil, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка шифрования сообщения"}
+	}
+	if message.Content, err = crypto.Encrypt([]byte(text)); err != nil {
+		logger.Errorf("Ошибка шифрования служебного сообщения: %v", err)
+		return nil, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка шифрования сообщения"}
+	}
+	message.PlainText = text
+
+	if err := s.db.CreateMessage(&message); err != nil {
+		logger.Errorf("Ошибка создания служебного сообщения в чате %d: %v", chatID, err)
+		return nil, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка создания сообщения"}
+	}
+	message.User = *actor
+
+	response := newMessageResponse(&message)
+	s.broadcastNewMessage(response, origin)
+	return &response, nil
+}
+
+// newMessageResponse формирует ответ с расшифрованным содержимым сообщения
+func newMessageResponse(msg *models.Message) messageResponse {
+	content := msg.PlainText
+	if content == "" && len(msg.Content) > 0 {
+		plaintext, err := crypto.Decrypt(msg.Content)
+		if err != nil {
+			logger.Errorf("Ошибка расшифровки сообщения #%d: %v", msg.ID, err)
+			content = "[Ошибка расшифровки]"
+		} else {
+			content = string(plaintext)
+		}
+	}
+
+	response := messageResponse{
+		ID:        msg.ID,
+		ChatID:    msg.ChatID,
+		TopicID:   msg.TopicID,
+		Seq:       msg.Seq,
+		UserID:    msg.UserID,
+		Content:   content,
+		Entities:  decryptEntities(msg),
+		Type:      msg.Type,
+		FileID:    msg.FileID,
+		File:      msg.File,
+		Preview:   decryptPreview(msg),
+		Event:     decryptSystemEvent(msg),
+		Views:     msg.Views,
+		Anonymous: msg.Anonymous,
+		CreatedAt: msg.CreatedAt,
+	}
+	if msg.Poll != nil {
+		response.Poll = newPollResponse(msg.Poll, nil, 0)
+	}
+	if msg.Type == string(models.MessageTypeContact) || msg.Type == string(models.MessageTypeLocation) {
+		response.Content, response.Contact, response.Location = decodeStructured(msg.Type, content)
+	}
+
+	// Автор анонимного поста канала не раскрывается
+	if msg.Anonymous {
+		response.UserID = 0
+		return response
+	}
+
+	// Добавляем информацию о пользователе
+	response.User.ID = msg.User.ID
+	response.User.Username = msg.User.Username
+	response.User.Avatar = msg.User.Avatar
+
+	return response
+}
+
+// decryptEntities расшифровывает сохраненный список сущностей форматирования
+func decryptEntities(msg *models.Message) []richtext.Entity {
+	if len(msg.Entities) == 0 {
+		return nil
+	}
+
+	data, err := crypto.Decrypt(msg.Entities)
+	if err != nil {
+		logger.Errorf("Ошибка расшифровки форматирования сообщения #%d: %v", msg.ID, err)
+		return nil
+	}
+
+	var entities []richtext.Entity
+	if err := json.Unmarshal(data, &entities); err != nil {
+		logger.Errorf("Ошибка разбора форматирования сообщения #%d: %v", msg.ID, err)
+		return nil
+	}
+	return entities
+}
+
+// broadcastNewMessage отправляет сообщение всем подключенным участникам чата, включая
+// другие устройства отправителя, кроме соединения origin, через которое оно отправлено
+func (s *Server) broadcastNewMessage(message messageResponse, origin *WSClient) {
+	s.forEachOnlineMember(message.ChatID, 0, func(client *WSClient) {
+		if client != origin {
+			client.sendChatMessage(message)
+		}
+	})
+}
@@ -22,6 +22,7 @@ import (
 	"messenger/middleware"
 	"messenger/models"
 	"messenger/redis"
+	"messenger/unfurl"
 	"messenger/utils/crypto"
 )
 
@@ -51,8 +52,17 @@ type Server struct {
 	// Для graceful shutdown
 	httpServer *http.Server
 
-	// Добавляем поле wsClients
-	wsClients sync.Map
+	// WebSocket соединения пользователей, по одному на устройство
+	wsClients clientRegistry
+
+	// Загрузчик предпросмотров ссылок (nil, если отключен в конфигурации)
+	unfurler *unfurl.Unfurler
+
+	// Типы чатов (chatID -> string). Тип чата не меняется, поэтому кэш не сбрасывается.
+	chatTypes sync.Map
+
+	// Интервалы медленного режима участников
+	slowMode slowModeLimiter
 }
 
 // Config содержит настройки сервера
@@ -90,11 +100,22 @@ func NewServer(cfg *config.Config, db *database.Database) *Server {
 	}
 
 	server := &Server{
-		router:  router,
-		config:  cfg,
-		db:      db,
-		clients: make(map[uint]*Client),
-		redis:   redisClient,
+		router:   router,
+		config:   cfg,
+		db:       db,
+		clients:  make(map[uint]*Client),
+		redis:    redisClient,
+		slowMode: slowModeLimiter{redis: redisClient},
+	}
+
+	// Предпросмотр ссылок можно отключить для конкретной инсталляции
+	if cfg.LinkPreview.Enabled {
+		logger.Info("Включен предпросмотр ссылок")
+		server.unfurler = unfurl.New(unfurl.Options{
+			Timeout:      time.Duration(cfg.LinkPreview.TimeoutSeconds) * time.Second,
+			MaxBodyBytes: int64(cfg.LinkPreview.MaxBodyKB) * 1024,
+			CacheTTL:     time.Duration(cfg.LinkPreview.CacheTTLMinutes) * time.Minute,
+		})
 	}
 
 	// Настройка middleware
@@ -115,6 +136,20 @@ func NewServer(cfg *config.Config, db *database.Database) *Server {
 	// Проверка и автоматическая инициализация системы при запуске
 	server.initializeSystemIfNeeded()
 
+	// Восстанавливаем автоматическое закрытие опросов
+	server.scheduleExistingPolls()
+
+	// Восстанавливаем автоматическое завершение трансляций местоположения
+	server.scheduleLiveLocations()
+
+	// Фоновые выгрузки: прерванные задания и удаление устаревших файлов
+	server.startExportMaintenance()
+
+	// Доставка напоминаний, созданных командой /remind
+	server.startReminders()
+	server.startJoinRequestExpiry()
+	server.startSlowModeSweep()
+
 	// Если Redis включен, настраиваем подписку на сообщения
 	if redisClient != nil && redisClient.IsEnabled() {
 		logger.Info("Настройка подписок Redis")
@@ -222,6 +257,9 @@ func (s *Server) setupRoutes() {
 		// Скачивание файлов (публичный доступ по токену)
 		public.GET("/files/download/:token", s.handleFileDownload)
 
+		// Просмотр пригласительной ссылки до вступления
+		public.GET("/join/:code", s.handleGetInvitePreview)
+
 		// WebSocket для чата и звонков (перемещен из защищенной группы)
 		public.GET("/ws", s.handleWebSocket)
 	}
@@ -246,14 +284,72 @@ func (s *Server) setupRoutes() {
 		// API для работы с чатами
 		auth.GET("/chat", s.handleGetChats)
 		auth.POST("/chat", s.handleCreateChat)
+		auth.GET("/chat/folders", s.handleGetChatFolders)
+		auth.PUT("/chat/pinned", s.handleSetPinnedChats)
+		auth.GET("/chat/handle/:handle", s.handleResolveChatHandle)
 		auth.GET("/chat/:chatID", s.handleGetChat)
 		auth.PUT("/chat/:chatID", s.handleUpdateChat)
 		auth.POST("/chat/:chatID/leave", s.handleLeaveChat)
 		auth.POST("/chat/:chatID/users", s.handleAddUserToChat)
 		auth.DELETE("/chat/:chatID/users/:userID", s.handleRemoveUserFromChat)
+		auth.PUT("/chat/:chatID/users/:userID/role", s.handleSetChatMemberRole)
+		auth.POST("/chat/:chatID/users/:userID/ban", s.handleBanChatMember)
+		auth.DELETE("/chat/:chatID/users/:userID/ban", s.handleUnbanChatMember)
+		auth.POST("/chat/:chatID/users/:userID/mute", s.handleMuteChatMember)
+		auth.DELETE("/chat/:chatID/users/:userID/mute", s.handleUnmuteChatMember)
+		auth.POST("/chat/:chatID/users/:userID/kick", s.handleKickChatMember)
+		auth.GET("/chat/:chatID/restrictions", s.handleGetChatRestrictions)
+		auth.PUT("/chat/:chatID/permissions", s.handleUpdateChatPermissions)
+		auth.PUT("/chat/:chatID/settings", s.handleUpdateChatSettings)
+		auth.PUT("/chat/:chatID/avatar", s.handleUploadChatAvatar)
+		auth.DELETE("/chat/:chatID/avatar", s.handleDeleteChatAvatar)
+
+		// Пригласительные ссылки
+		auth.GET("/chat/:chatID/invites", s.handleGetChatInvites)
+		auth.POST("/chat/:chatID/invites", s.handleCreateChatInvite)
+		auth.DELETE("/chat/:chatID/invites/:inviteID", s.handleRevokeChatInvite)
+		auth.GET("/chat/:chatID/invites/:inviteID/members", s.handleGetChatInviteMembers)
+		auth.GET("/chat/:chatID/join-requests", s.handleGetJoinRequests)
+		auth.POST("/chat/:chatID/join-requests/:requestID/approve", s.handleApproveJoinRequest)
+		auth.POST("/chat/:chatID/join-requests/:requestID/decline", s.handleDeclineJoinRequest)
+		auth.GET("/chat/:chatID/topics", s.handleGetChatTopics)
+		auth.POST("/chat/:chatID/topics", s.handleCreateChatTopic)
+		auth.PUT("/chat/:chatID/topics/order", s.handleReorderChatTopics)
+		auth.PUT("/chat/:chatID/topics/:topicID", s.handleUpdateChatTopic)
+		auth.GET("/chat/:chatID/topics/:topicID/messages", s.handleGetTopicMessages)
+		auth.POST("/chat/:chatID/topics/:topicID/read", s.handleMarkTopicRead)
+		auth.POST("/join/:code", s.handleJoinChat)
 
 		// API для сообщений в чатах
 		auth.GET("/chat/:chatID/messages", s.handleGetMessages)
+		auth.POST("/chat/:chatID/messages", s.handleSendMessage)
+		auth.POST("/chat/:chatID/read", s.handleMarkMessagesAsRead)
+		auth.DELETE("/chat/:chatID/messages/:messageID", s.handleDeleteMessage)
+		auth.GET("/chat/:chatID/messages/:messageID/seen", s.handleGetMessageReceipts)
+		auth.GET("/chat/:chatID/commands", s.handleGetChatCommands)
+
+		// Прослушивание голосовых сообщений
+		auth.POST("/chat/:chatID/messages/:messageID/listened", s.handleMarkVoiceListened)
+		auth.GET("/chat/:chatID/messages/:messageID/listened", s.handleGetVoiceListeners)
+
+		// Трансляция местоположения
+		auth.PUT("/chat/:chatID/messages/:messageID/location", s.handleUpdateLiveLocation)
+		auth.POST("/chat/:chatID/messages/:messageID/location/stop", s.handleStopLiveLocation)
+
+		// Выгрузка истории
+		auth.GET("/chat/:chatID/export", s.handleExportChat)
+		auth.GET("/exports/:jobID", s.handleGetExportJob)
+		auth.GET("/exports/:jobID/download", s.handleDownloadExport)
+
+		// Опросы
+		auth.POST("/polls/:pollID/vote", s.handleVotePoll)
+		auth.DELETE("/polls/:pollID/vote", s.handleRetractPollVote)
+		auth.POST("/polls/:pollID/close", s.handleClosePoll)
+
+		// Закладки
+		auth.GET("/saved", s.handleGetSavedMessages)
+		auth.POST("/saved", s.handleSaveMessage)
+		auth.DELETE("/saved/:messageID", s.handleDeleteSavedMessage)
 
 		// API для файлов
 		auth.POST("/files/upload", s.handleFileUpload)
@@ -267,6 +363,8 @@ func (s *Server) setupRoutes() {
 			admin.PUT("/settings", s.handleAdminUpdateSettings) // Обновление настроек
 			// Новые маршруты
 			admin.GET("/stats", s.handleAdminStats)
+			// Импорт истории чата из выгрузки Telegram
+			admin.POST("/import/telegram", s.handleAdminImportTelegram)
 		}
 		// Маршрут статуса системы (может быть не только для админа, но защищен JWT)
 		auth.GET("/system/status", s.handleSystemStatus)
@@ -400,57 +498,38 @@ func (s *Server) processMessage(client *Client, message []byte) {
 
 // sendToUser отправляет данные через WebSocket указанному пользователю
 func (s *Server) sendToUser(userID uint, data []byte) {
-	// Проверяем, подключен ли пользователь
-	if clientObj, ok := s.wsClients.Load(userID); ok {
-		if client, ok := clientObj.(*WSClient); ok {
-			select {
-			case client.send <- data:
-				// Сообщение успешно отправлено в канал
-				logger.Debugf("Сообщение успешно отправлено пользователю %d", userID)
-			default:
-				// Буфер полон, отключаем клиента
-				logger.Warnf("Буфер клиента %d полон, отключение", userID)
-				s.wsClients.Delete(userID)
-				close(client.send)
-			}
-		}
-	} else {
+	// Отправляем на все устройства пользователя
+	clients := s.wsClients.userClients(userID)
+	if len(clients) == 0 {
 		logger.Debugf("Пользователь %d не подключен к WebSocket", userID)
+		return
+	}
+	for _, client := range clients {
+		client.enqueue(wsFrame{data: data})
 	}
 }
 
-// Отправка истории сообщений
-func (s *Server) sendMessageHistory(client *Client) {
-	// Получаем непрочитанные сообщения
-	var messages []models.DirectMessage
-	if err := s.db.DB.Where("recipient_id = ? AND is_read = ?", client.userID, false).Find(&messages).Error; err != nil {
+// Максимальное число недоставленных сообщений, отправляемых при подключении.
+// Должно быть меньше буфера отправки клиента; остальное клиент загрузит через историю чата.
+const undeliveredHistoryLimit = 200
+
+// sendMessageHistory отправляет подключившемуся клиенту сообщения, которые еще не были
+// ему доставлены. Курсоры доставки сдвигаются после фактической записи в соединение.
+func (s *Server) sendMessageHistory(client *WSClient) {
+	messages, err := s.db.GetUndeliveredMessages(client.userID, undeliveredHistoryLimit)
+	if err != nil {
 		logger.Errorf("Ошибка получения истории сообщений: %v", err)
 		return
 	}
 
-	// Отправляем каждое сообщение
-	for _, msg := range messages {
-		// Формируем сообщение WebSocket
-		wsMsg := WSMessage{
-			Type: "text",
-			Payload: json.RawMessage(fmt.Sprintf(`{
-				"id": %d,
-				"sender_id": %d,
-				"recipient_id": %d,
-				"content": %q,
-				"created_at": %q,
-				"is_read": false
-			}`, msg.ID, msg.SenderID, msg.RecipientID, msg.Content, msg.CreatedAt)),
-		}
-
-		// Отправляем клиенту
-		data, err := json.Marshal(wsMsg)
-		if err != nil {
-			logger.Errorf("Ошибка сериализации сообщения: %v", err)
-			continue
-		}
+	responses := make([]messageResponse, 0, len(messages))
+	for i := range messages {
+		responses = append(responses, newMessageResponse(&messages[i]))
+	}
+	s.attachPollResults(messages, responses, client.userID)
 
-		client.send <- data
+	for _, response := range responses {
+		client.sendChatMessage(response)
 	}
 }
 
@@ -531,14 +610,14 @@ func (s *Server) handleWebSocket(c *gin.Context) {
 	client := &WSClient{
 		server:        s,
 		conn:          conn,
-		send:          make(chan []byte, 256),
+		send:          make(chan wsFrame, 256),
 		userID:        userID,
 		authenticated: true,
 		clientInfo:    c.Request.UserAgent(),
 	}
 
-	// Сохраняем клиента в карте соединений
-	s.wsClients.Store(userID, client)
+	// Регистрируем соединение: остальные устройства пользователя остаются подключенными
+	s.wsClients.add(client)
 	logger.Debugf("WebSocket: Клиент сохранен в карте соединений, UserAgent: %s", c.Request.UserAgent())
 
 	// Отправляем пользователю сообщение для подтверждения соединения
@@ -556,6 +635,9 @@ func (s *Server) handleWebSocket(c *gin.Context) {
 	go client.writePump()
 	go client.readPump()
 
+	// Досылаем сообщения, пришедшие, пока пользователь был не в сети
+	go s.sendMessageHistory(client)
+
 	logger.Infof("WebSocket: Пользователь %d успешно подключен по WebSocket", userID)
 }
 
@@ -0,0 +1,196 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"messenger/logger"
+	"messenger/models"
+	"messenger/redis"
+)
+
+// Наибольший интервал медленного режима
+const maxSlowMode = time.Hour
+
+// Периодичность удаления истекших отметок медленного режима из памяти
+const slowModeSweepInterval = time.Minute
+
+// Код ошибки отправки в медленном режиме
+const errCodeSlowMode = "SLOW_MODE"
+
+// slowModeKey - участник чата, для которого отсчитывается интервал
+type slowModeKey struct {
+	chatID uint
+	userID uint
+}
+
+// slowModeLimiter отсчитывает интервал медленного режима после сообщения участника.
+// При включенном Redis отметки хранятся в нем и общие для всех экземпляров сервера,
+// иначе - в памяти процесса.
+type slowModeLimiter struct {
+	redis *redis.RedisClient
+
+	mu   sync.Mutex
+	next map[slowModeKey]time.Time // Когда участнику снова можно писать
+}
+
+func (k slowModeKey) redisKey() string {
+	return fmt.Sprintf("slowmode:%d:%d", k.chatID, k.userID)
+}
+
+// reserve занимает интервал для участника. Если предыдущий интервал еще не истек,
+// возвращает false и время до его окончания.
+func (l *slowModeLimiter) reserve(key slowModeKey, interval time.Duration, now time.Time) (bool, time.Duration) {
+	if l.redis != nil && l.redis.IsEnabled() {
+		reserved, remaining, err := l.redis.Reserve(key.redisKey(), interval)
+		if err == nil {
+			return reserved, remaining
+		}
+		// Без Redis ограничение действует в пределах этого экземпляра
+		logger.Errorf("Ошибка проверки медленного режима в Redis: %v", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if next, ok := l.next[key]; ok && now.Before(next) {
+		return false, next.Sub(now)
+	}
+	if l.next == nil {
+		l.next = make(map[slowModeKey]time.Time)
+	}
+	l.next[key] = now.Add(interval)
+	return true, 0
+}
+
+// sweep удаляет истекшие отметки, чтобы карта не росла
+func (l *slowModeLimiter) sweep(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for k, next := range l.next {
+		if !now.Before(next) {
+			delete(l.next, k)
+		}
+	}
+}
+
+// release освобождает интервал, если сообщение так и не было отправлено
+func (l *slowModeLimiter) release(key slowModeKey) {
+	if l.redis != nil && l.redis.IsEnabled() {
+		if err := l.redis.Release(key.redisKey()); err != nil {
+			logger.Errorf("Ошибка освобождения медленного режима в Redis: %v", err)
+		}
+	}
+
+	l.mu.Lock()
+	delete(l.next, key)
+	l.mu.Unlock()
+}
+
+// startSlowModeSweep запускает периодическую очистку отметок медленного режима в памяти
+func (s *Server) startSlowModeSweep() {
+	go func() {
+		ticker := time.NewTicker(slowModeSweepInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			s.slowMode.sweep(time.Now())
+		}
+	}()
+}
+
+// slowModeExempt сообщает, что на участника медленный режим не действует:
+// это администраторы чата и администраторы системы
+func slowModeExempt(user *models.User, member *models.ChatUser) bool {
+	return user.Role == "admin" || member.Role.AtLeast(models.ChatRoleAdmin)
+}
+
+// reserveSlowMode проверяет медленный режим перед отправкой сообщения в чат и занимает
+// интервал. Возвращает время до следующей разрешенной отправки, если интервал еще
+// не истек, и признак того, что интервал занят этим вызовом: если сообщение в итоге
+// не отправлено, его нужно освободить через releaseSlowMode.
+func (s *Server) reserveSlowMode(userID, chatID uint) (time.Duration, bool) {
+	chat, err := s.db.GetChatByID(chatID)
+	if err != nil || chat.SlowMode == 0 {
+		// Отсутствие чата и доступа к нему проверяется при отправке
+		return 0, false
+	}
+	member, err := s.db.GetChatMember(chatID, userID)
+	if err != nil {
+		return 0, false
+	}
+	user, err := s.db.GetUserByID(userID)
+	if err != nil || slowModeExempt(user, member) {
+		return 0, false
+	}
+
+	reserved, remaining := s.slowMode.reserve(slowModeKey{chatID, userID}, time.Duration(chat.SlowMode)*time.Second, time.Now())
+	if reserved {
+		return 0, true
+	}
+	// Интервал мог истечь между проверками: клиент повторит попытку через секунду
+	if remaining < time.Second {
+		remaining = time.Second
+	}
+	return remaining, false
+}
+
+// releaseSlowMode освобождает интервал, занятый reserveSlowMode
+func (s *Server) releaseSlowMode(userID, chatID uint) {
+	s.slowMode.release(slowModeKey{chatID, userID})
+}
+
+// retryAfterSeconds округляет время ожидания до целых секунд вверх
+func retryAfterSeconds(wait time.Duration) int {
+	return int((wait + time.Second - 1) / time.Second)
+}
+
+// slowModeMessage - текст ошибки отправки в медленном режиме
+func slowModeMessage(wait time.Duration) string {
+	return fmt.Sprintf("В чате включен медленный режим. Следующее сообщение можно отправить через %d с", retryAfterSeconds(wait))
+}
+
+// sendSlowModeError отвечает на REST запрос отказом из-за медленного режима
+func sendSlowModeError(c *gin.Context, wait time.Duration) {
+	seconds := retryAfterSeconds(wait)
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	SendError(c, http.StatusTooManyRequests, errCodeSlowMode, slowModeMessage(wait), gin.H{"retry_after": seconds})
+}
+
+// validateSlowMode проверяет интервал медленного режима
+func validateSlowMode(seconds int) *sendMessageError {
+	if seconds < 0 || time.Duration(seconds)*time.Second > maxSlowMode {
+		return &sendMessageError{http.StatusBadRequest, "BAD_REQUEST",
+			fmt.Sprintf("Интервал медленного режима должен быть от 0 до %d секунд", int(maxSlowMode/time.Second))}
+	}
+	return nil
+}
+
+// setChatSlowMode меняет интервал медленного режима и уведомляет участников
+func (s *Server) setChatSlowMode(actor *models.User, chat *models.Chat, seconds int) (*messageResponse, *sendMessageError) {
+	if sendErr := validateSlowMode(seconds); sendErr != nil {
+		return nil, sendErr
+	}
+	if seconds == chat.SlowMode {
+		return nil, nil
+	}
+
+	if err := s.db.UpdateChatSlowMode(chat.ID, seconds); err != nil {
+		logger.Errorf("Ошибка изменения медленного режима чата %d: %v", chat.ID, err)
+		return nil, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка изменения чата"}
+	}
+	chat.SlowMode = seconds
+
+	s.sendToChat(chat.ID, WSTypeChatUpdated, chatUpdatedEvent{ChatID: chat.ID, SlowMode: &seconds, ActorID: actor.ID}, 0)
+
+	return s.postSystemMessage(chat.ID, actor, models.SystemEvent{
+		Kind:   models.SystemEventSlowModeChanged,
+		Params: map[string]string{models.SystemParamSeconds: strconv.Itoa(seconds)},
+	})
+}
@@ -0,0 +1,440 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"messenger/database"
+	"messenger/logger"
+	"messenger/models"
+	"messenger/utils/crypto"
+)
+
+// Ограничения полей контактов и местоположений
+const (
+	contactMaxNameLength     = 128
+	locationMaxTitleLength   = 128
+	locationMaxAddressLength = 256
+	locationMaxAccuracy      = 100000 // Метры
+)
+
+// contactPayload - карточка контакта. Нужно указать телефон, email или пользователя мессенджера.
+type contactPayload struct {
+	Name   string `json:"name"`
+	Phone  string `json:"phone,omitempty"`
+	Email  string `json:"email,omitempty"`
+	UserID uint   `json:"user_id,omitempty"`
+}
+
+// locationPayload - местоположение. При live_period > 0 начинается трансляция,
+// время ее окончания сервер записывает в live_until.
+type locationPayload struct {
+	Latitude   float64    `json:"latitude"`
+	Longitude  float64    `json:"longitude"`
+	Accuracy   float64    `json:"accuracy,omitempty"` // Точность в метрах
+	Heading    int        `json:"heading,omitempty"`  // Направление движения в градусах, 1..360
+	Title      string     `json:"title,omitempty"`
+	Address    string     `json:"address,omitempty"`
+	LivePeriod int        `json:"live_period,omitempty"` // Длительность трансляции в секундах
+	LiveUntil  *time.Time `json:"live_until,omitempty"`
+}
+
+// liveLocationUpdate - новые координаты трансляции местоположения
+type liveLocationUpdate struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Accuracy  float64 `json:"accuracy,omitempty"`
+	Heading   int     `json:"heading,omitempty"`
+}
+
+// liveLocationEvent - событие live_location: новые координаты или окончание трансляции
+type liveLocationEvent struct {
+	ChatID    uint             `json:"chat_id"`
+	MessageID uint             `json:"message_id"`
+	UserID    uint             `json:"user_id"`
+	Location  *locationPayload `json:"location"`
+	Active    bool             `json:"active"`
+}
+
+// validate проверяет и нормализует карточку контакта
+func (p *contactPayload) validate() error {
+	p.Name = strings.TrimSpace(p.Name)
+	p.Email = strings.TrimSpace(p.Email)
+	if p.Name == "" || utf8.RuneCountInString(p.Name) > contactMaxNameLength {
+		return errors.New("Некорректное имя контакта")
+	}
+
+	if p.Phone != "" {
+		phone, ok := normalizePhone(p.Phone)
+		if !ok {
+			return errors.New("Некорректный номер телефона")
+		}
+		p.Phone = phone
+	}
+	if p.Email != "" {
+		addr, err := mail.ParseAddress(p.Email)
+		if err != nil || addr.Address != p.Email {
+			return errors.New("Некорректный email")
+		}
+	}
+
+	if p.Phone == "" && p.Email == "" && p.UserID == 0 {
+		return errors.New("Укажите телефон, email или пользователя")
+	}
+	return nil
+}
+
+// normalizePhone убирает из номера пробелы, дефисы и скобки. Допускается + в начале и 5-15 цифр.
+func normalizePhone(phone string) (string, bool) {
+	var b strings.Builder
+	for i, r := range strings.TrimSpace(phone) {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == '+' && i == 0:
+			b.WriteRune(r)
+		case r == ' ' || r == '-' || r == '(' || r == ')':
+		default:
+			return "", false
+		}
+	}
+
+	normalized := b.String()
+	digits := len(strings.TrimPrefix(normalized, "+"))
+	return normalized, digits >= 5 && digits <= 15
+}
+
+// validCoordinates проверяет широту и долготу
+func validCoordinates(latitude, longitude float64) bool {
+	for _, v := range []float64{latitude, longitude} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+	}
+	return latitude >= -90 && latitude <= 90 && longitude >= -180 && longitude <= 180
+}
+
+// validateMotion проверяет точность и направление движения
+func validateMotion(accuracy float64, heading int) error {
+	if math.IsNaN(accuracy) || accuracy < 0 || accuracy > locationMaxAccuracy {
+		return errors.New("Некорректная точность местоположения")
+	}
+	if heading < 0 || heading > 360 {
+		return errors.New("Направление движения должно быть от 1 до 360 градусов")
+	}
+	return nil
+}
+
+// validate проверяет местоположение
+func (p *locationPayload) validate() error {
+	if !validCoordinates(p.Latitude, p.Longitude) {
+		return errors.New("Некорректные координаты")
+	}
+	if err := validateMotion(p.Accuracy, p.Heading); err != nil {
+		return err
+	}
+
+	p.Title = strings.TrimSpace(p.Title)
+	p.Address = strings.TrimSpace(p.Address)
+	if utf8.RuneCountInString(p.Title) > locationMaxTitleLength || utf8.RuneCountInString(p.Address) > locationMaxAddressLength {
+		return errors.New("Слишком длинное название или адрес места")
+	}
+
+	if p.LivePeriod != 0 {
+		period := time.Duration(p.LivePeriod) * time.Second
+		if period < models.LiveLocationMinPeriod || period > models.LiveLocationMaxPeriod {
+			return errors.New("Трансляция местоположения может длиться от 1 минуты до 24 часов")
+		}
+	}
+	p.LiveUntil = nil // Заполняется сервером
+	return nil
+}
+
+// buildStructuredContent проверяет контакт или местоположение и возвращает JSON
+// для шифрованного содержимого сообщения. Для трансляции возвращается и ее запись.
+func (s *Server) buildStructuredContent(out outgoingMessage) (string, *models.LiveLocation, *sendMessageError) {
+	var payload interface{}
+	var live *models.LiveLocation
+
+	switch models.MessageType(out.Type) {
+	case models.MessageTypeContact:
+		if out.Contact == nil {
+			return "", nil, &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", "Не указаны данные контакта"}
+		}
+		if err := out.Contact.validate(); err != nil {
+			return "", nil, &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", err.Error()}
+		}
+		if out.Contact.UserID != 0 {
+			if _, err := s.db.GetUserByID(out.Contact.UserID); err != nil {
+				return "", nil, &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", "Пользователь контакта не найден"}
+			}
+		}
+		payload = out.Contact
+
+	case models.MessageTypeLocation:
+		if out.Location == nil {
+			return "", nil, &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", "Не указано местоположение"}
+		}
+		if err := out.Location.validate(); err != nil {
+			return "", nil, &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", err.Error()}
+		}
+		if out.Location.LivePeriod > 0 {
+			until := time.Now().Add(time.Duration(out.Location.LivePeriod) * time.Second)
+			out.Location.LiveUntil = &until
+			live = &models.LiveLocation{ChatID: out.ChatID, ExpiresAt: until}
+		}
+		payload = out.Location
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		logger.Errorf("Ошибка сериализации сообщения типа %s: %v", out.Type, err)
+		return "", nil, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка обработки сообщения"}
+	}
+	return string(data), live, nil
+}
+
+// decodeStructured разбирает содержимое контакта или местоположения и возвращает
+// его текстовое описание для клиентов, не поддерживающих эти типы
+func decodeStructured(messageType, content string) (string, *contactPayload, *locationPayload) {
+	switch models.MessageType(messageType) {
+	case models.MessageTypeContact:
+		var contact contactPayload
+		if err := json.Unmarshal([]byte(content), &contact); err != nil {
+			return "[Контакт]", nil, nil
+		}
+		parts := []string{contact.Name}
+		for _, v := range []string{contact.Phone, contact.Email} {
+			if v != "" {
+				parts = append(parts, v)
+			}
+		}
+		return "Контакт: " + strings.Join(parts, ", "), &contact, nil
+
+	case models.MessageTypeLocation:
+		var location locationPayload
+		if err := json.Unmarshal([]byte(content), &location); err != nil {
+			return "[Местоположение]", nil, nil
+		}
+		text := "Местоположение"
+		if location.LiveUntil != nil {
+			text = "Трансляция местоположения"
+		}
+		switch {
+		case location.Title != "":
+			text += ": " + location.Title
+		case location.Address != "":
+			text += ": " + location.Address
+		default:
+			text += ": " + location.String()
+		}
+		return text, nil, &location
+	}
+	return content, nil, nil
+}
+
+// previewContent возвращает текст сообщения для списка чатов
+func previewContent(messageType, content string) string {
+	text, _, _ := decodeStructured(messageType, content)
+	return text
+}
+
+// updateLiveLocation обновляет координаты трансляции или останавливает ее (update == nil).
+// Участники чата получают событие live_location.
+func (s *Server) updateLiveLocation(userID, chatID, messageID uint, update *liveLocationUpdate) (*liveLocationEvent, *sendMessageError) {
+	if update != nil {
+		if !validCoordinates(update.Latitude, update.Longitude) {
+			return nil, &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", "Некорректные координаты"}
+		}
+		if err := validateMotion(update.Accuracy, update.Heading); err != nil {
+			return nil, &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", err.Error()}
+		}
+	}
+
+	message, err := s.db.GetMessageByID(messageID)
+	if err != nil || message.ChatID != chatID {
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка получения сообщения"}
+		}
+		return nil, &sendMessageError{http.StatusNotFound, "NOT_FOUND", "Сообщение не найдено"}
+	}
+	if message.UserID != userID {
+		return nil, &sendMessageError{http.StatusForbidden, "FORBIDDEN", "Трансляцию может изменять только ее автор"}
+	}
+	if message.Type != string(models.MessageTypeLocation) {
+		return nil, &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", "Сообщение не является трансляцией местоположения"}
+	}
+	// Остановить трансляцию можно всегда, продолжать - только с правом писать в чат
+	// и без запрета писать
+	if update != nil {
+		_, chat, _, sendErr := s.checkChatPermission(userID, chatID, models.PermSendMessages)
+		if sendErr != nil {
+			return nil, sendErr
+		}
+		if chat.HasRoles() {
+			if sendErr := s.checkMuted(chat.ID, userID); sendErr != nil {
+				return nil, sendErr
+			}
+		}
+	}
+
+	plaintext, err := crypto.Decrypt(message.Content)
+	if err != nil {
+		logger.Errorf("Ошибка расшифровки местоположения #%d: %v", message.ID, err)
+		return nil, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка расшифровки сообщения"}
+	}
+	var location locationPayload
+	if err := json.Unmarshal(plaintext, &location); err != nil || location.LiveUntil == nil {
+		return nil, &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", "Сообщение не является трансляцией местоположения"}
+	}
+
+	if update != nil {
+		location.Latitude, location.Longitude = update.Latitude, update.Longitude
+		location.Accuracy, location.Heading = update.Accuracy, update.Heading
+	} else {
+		now := time.Now()
+		location.LiveUntil = &now
+	}
+
+	data, err := json.Marshal(location)
+	if err == nil {
+		data, err = crypto.Encrypt(data)
+	}
+	if err != nil {
+		logger.Errorf("Ошибка шифрования местоположения #%d: %v", message.ID, err)
+		return nil, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка шифрования сообщения"}
+	}
+
+	if err := s.db.UpdateLiveLocation(message.ID, data, update == nil); err != nil {
+		if errors.Is(err, database.ErrLiveLocationEnded) {
+			return nil, &sendMessageError{http.StatusConflict, "LIVE_LOCATION_ENDED", "Трансляция местоположения завершена"}
+		}
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &sendMessageError{http.StatusBadRequest, "BAD_REQUEST", "Сообщение не является трансляцией местоположения"}
+		}
+		logger.Errorf("Ошибка обновления трансляции #%d: %v", message.ID, err)
+		return nil, &sendMessageError{http.StatusInternalServerError, "INTERNAL_ERROR", "Ошибка обновления трансляции"}
+	}
+
+	event := &liveLocationEvent{
+		ChatID:    message.ChatID,
+		MessageID: message.ID,
+		UserID:    userID,
+		Location:  &location,
+		Active:    update != nil,
+	}
+	s.sendToChat(message.ChatID, WSTypeLiveLocation, event, userID)
+	return event, nil
+}
+
+// scheduleLiveLocationExpiry завершает трансляцию по истечении ее срока
+func (s *Server) scheduleLiveLocationExpiry(live *models.LiveLocation) {
+	if live.StoppedAt != nil {
+		return
+	}
+
+	messageID := live.MessageID
+	time.AfterFunc(time.Until(live.ExpiresAt), func() {
+		expired, err := s.db.ExpireLiveLocation(messageID, time.Now())
+		if err != nil {
+			logger.Errorf("Ошибка завершения трансляции #%d: %v", messageID, err)
+			return
+		}
+		if !expired {
+			return // Остановлена автором раньше срока
+		}
+
+		message, err := s.db.GetMessageByID(messageID)
+		if err != nil {
+			return
+		}
+		content := newMessageResponse(message)
+		s.sendToChat(message.ChatID, WSTypeLiveLocation, liveLocationEvent{
+			ChatID:    message.ChatID,
+			MessageID: message.ID,
+			UserID:    message.UserID,
+			Location:  content.Location,
+		}, 0)
+	})
+}
+
+// scheduleLiveLocations восстанавливает таймеры трансляций после перезапуска сервера
+func (s *Server) scheduleLiveLocations() {
+	live, err := s.db.GetActiveLiveLocations()
+	if err != nil {
+		logger.Errorf("Ошибка получения трансляций местоположения: %v", err)
+		return
+	}
+	for i := range live {
+		s.scheduleLiveLocationExpiry(&live[i])
+	}
+}
+
+// parseMessagePath разбирает ID чата и сообщения из пути запроса
+func parseMessagePath(c *gin.Context) (uint, uint, bool) {
+	chatID, err := strconv.ParseUint(c.Param("chatID"), 10, 32)
+	if err != nil {
+		SendBadRequest(c, "Некорректный ID чата")
+		return 0, 0, false
+	}
+	messageID, err := strconv.ParseUint(c.Param("messageID"), 10, 32)
+	if err != nil {
+		SendBadRequest(c, "Некорректный ID сообщения")
+		return 0, 0, false
+	}
+	return uint(chatID), uint(messageID), true
+}
+
+// handleUpdateLiveLocation передает новые координаты трансляции местоположения
+func (s *Server) handleUpdateLiveLocation(c *gin.Context) {
+	chatID, messageID, ok := parseMessagePath(c)
+	if !ok {
+		return
+	}
+
+	var req liveLocationUpdate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		SendBadRequest(c, "Некорректные данные местоположения")
+		return
+	}
+
+	event, sendErr := s.updateLiveLocation(c.GetUint("userID"), chatID, messageID, &req)
+	if sendErr != nil {
+		SendError(c, sendErr.Status, sendErr.Code, sendErr.Message)
+		return
+	}
+
+	c.JSON(http.StatusOK, event)
+}
+
+// handleStopLiveLocation досрочно завершает трансляцию местоположения
+func (s *Server) handleStopLiveLocation(c *gin.Context) {
+	chatID, messageID, ok := parseMessagePath(c)
+	if !ok {
+		return
+	}
+
+	event, sendErr := s.updateLiveLocation(c.GetUint("userID"), chatID, messageID, nil)
+	if sendErr != nil {
+		SendError(c, sendErr.Status, sendErr.Code, sendErr.Message)
+		return
+	}
+
+	c.JSON(http.StatusOK, event)
+}
+
+// String возвращает координаты в виде "55.755800, 37.617300"
+func (p *locationPayload) String() string {
+	return fmt.Sprintf("%.6f, %.6f", p.Latitude, p.Longitude)
+}
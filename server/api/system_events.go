@@ -0,0 +1,132 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"messenger/logger"
+	"messenger/models"
+	"messenger/utils/crypto"
+)
+
+// eventUser возвращает участника служебного события
+func eventUser(user *models.User) models.SystemEventUser {
+	return models.SystemEventUser{ID: user.ID, Username: user.Username}
+}
+
+// systemEventText описывает служебное событие на русском. Текст сохраняется как содержимое
+// служебного сообщения и показывается клиентами, которые не разбирают событие сами.
+func systemEventText(event *models.SystemEvent) string {
+	actor := event.Actor.Username
+	target := ""
+	if len(event.Targets) > 0 {
+		target = event.Targets[0].Username
+	}
+
+	var text string
+	switch event.Kind {
+	case models.SystemEventMemberJoined:
+		text = fmt.Sprintf("%s вступил(а) в чат по пригласительной ссылке", actor)
+	case models.SystemEventJoinApproved:
+		text = fmt.Sprintf("%s одобрил(а) заявку %s на вступление в чат", actor, target)
+	case models.SystemEventMembersAdded:
+		names := make([]string, len(event.Targets))
+		for i, t := range event.Targets {
+			names[i] = t.Username
+		}
+		text = fmt.Sprintf("%s добавил(а) в чат: %s", actor, strings.Join(names, ", "))
+	case models.SystemEventMemberRemoved:
+		text = fmt.Sprintf("%s удалил(а) из чата %s", actor, target)
+	case models.SystemEventMemberLeft:
+		text = fmt.Sprintf("%s покинул(а) чат", actor)
+	case models.SystemEventChatRenamed:
+		text = fmt.Sprintf("%s изменил(а) название чата на «%s»", actor, event.Params[models.SystemParamName])
+	case models.SystemEventDescriptionChanged:
+		text = fmt.Sprintf("%s изменил(а) описание чата", actor)
+	case models.SystemEventDescriptionRemoved:
+		text = fmt.Sprintf("%s удалил(а) описание чата", actor)
+	case models.SystemEventHandleChanged:
+		text = fmt.Sprintf("%s изменил(а) публичное имя чата на @%s", actor, event.Params[models.SystemParamHandle])
+	case models.SystemEventHandleRemoved:
+		text = fmt.Sprintf("%s удалил(а) публичное имя чата", actor)
+	case models.SystemEventAvatarChanged:
+		text = fmt.Sprintf("%s изменил(а) изображение чата", actor)
+	case models.SystemEventAvatarRemoved:
+		text = fmt.Sprintf("%s удалил(а) изображение чата", actor)
+	case models.SystemEventHistoryVisibility:
+		text = fmt.Sprintf("%s открыл(а) участникам всю историю чата", actor)
+		if event.Params[models.SystemParamVisibility] == models.HistoryVisibilityJoined {
+			text = fmt.Sprintf("%s скрыл(а) от участников историю до их вступления", actor)
+		}
+	case models.SystemEventSlowModeChanged:
+		text = fmt.Sprintf("%s выключил(а) медленный режим", actor)
+		if seconds := event.Params[models.SystemParamSeconds]; seconds != "" && seconds != "0" {
+			text = fmt.Sprintf("%s включил(а) медленный режим: одно сообщение в %s с", actor, seconds)
+		}
+	case models.SystemEventRoleChanged:
+		role := models.ChatRole(event.Params[models.SystemParamRole])
+		text = fmt.Sprintf("%s назначил(а) %s %s", actor, target, chatRoleTitles[role])
+	case models.SystemEventOwnershipTransferred:
+		text = fmt.Sprintf("%s передал(а) права владельца чата пользователю %s", actor, target)
+	case models.SystemEventPermissionsChanged:
+		text = fmt.Sprintf("%s изменил(а) права участников чата", actor)
+	case models.SystemEventMemberBanned:
+		text = fmt.Sprintf("%s заблокировал(а) %s", actor, target)
+	case models.SystemEventMemberUnbanned:
+		text = fmt.Sprintf("%s разблокировал(а) %s", actor, target)
+	case models.SystemEventMemberMuted:
+		text = fmt.Sprintf("%s запретил(а) %s писать в чат", actor, target)
+	case models.SystemEventMemberUnmuted:
+		text = fmt.Sprintf("%s разрешил(а) %s писать в чат", actor, target)
+	case models.SystemEventMemberKicked:
+		text = fmt.Sprintf("%s исключил(а) из чата %s", actor, target)
+	case models.SystemEventAction:
+		text = actor + " " + event.Params[models.SystemParamText]
+	default:
+		text = fmt.Sprintf("%s изменил(а) чат", actor)
+	}
+
+	if newOwner := event.Params[models.SystemParamNewOwner]; newOwner != "" {
+		text += ". Новый владелец чата: " + newOwner
+	}
+	if expiresAt, err := time.Parse(time.RFC3339, event.Params[models.SystemParamExpiresAt]); err == nil {
+		if event.Kind == models.SystemEventMemberKicked {
+			text += " без права вернуться"
+		}
+		// Текст сохраняется в сообщении, поэтому время указывается в UTC, а не в поясе сервера
+		text += " до " + formatUTC(expiresAt)
+	}
+	if reason := event.Params[models.SystemParamReason]; reason != "" {
+		text += ". Причина: " + reason
+	}
+	return text
+}
+
+// formatUTC форматирует время для текста, который читают пользователи: пояс клиента
+// серверу неизвестен, поэтому время указывается в UTC с явной пометкой
+func formatUTC(t time.Time) string {
+	return t.UTC().Format("02.01.2006 15:04") + " UTC"
+}
+
+// decryptSystemEvent расшифровывает сохраненное описание служебного события.
+// У служебных сообщений, созданных до появления событий, описания нет.
+func decryptSystemEvent(msg *models.Message) *models.SystemEvent {
+	if len(msg.Event) == 0 {
+		return nil
+	}
+
+	data, err := crypto.Decrypt(msg.Event)
+	if err != nil {
+		logger.Errorf("Ошибка расшифровки события сообщения #%d: %v", msg.ID, err)
+		return nil
+	}
+
+	var event models.SystemEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		logger.Errorf("Ошибка разбора события сообщения #%d: %v", msg.ID, err)
+		return nil
+	}
+	return &event
+}
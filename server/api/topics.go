@@ -0,0 +1,362 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+
+	"messenger/database"
+	"messenger/logger"
+	"messenger/models"
+)
+
+// Ограничения тем
+const (
+	maxTopicNameLength = 128
+	maxTopicIconLength = 16 // В символах: значок - эмодзи, в том числе составной
+	maxTopicPageSize   = 100
+	defaultTopicPage   = 50
+)
+
+// Действия с темами в событии chat_topic
+const (
+	topicCreated   = "created"
+	topicUpdated   = "updated"
+	topicReordered = "reordered"
+)
+
+// Структура запроса для создания темы
+type createTopicRequest struct {
+	Name string `json:"name"`
+	Icon string `json:"icon"`
+}
+
+// Структура запроса для изменения темы. Передаются только изменяемые поля.
+type updateTopicRequest struct {
+	Name   *string `json:"name"`
+	Icon   *string `json:"icon"` // Пустая строка убирает значок
+	Closed *bool   `json:"closed"`
+}
+
+// Структура запроса для изменения порядка тем
+type reorderTopicsRequest struct {
+	TopicIDs []uint `json:"topic_ids"` // Все темы чата в порядке отображения
+}
+
+// Структура запроса для отметки прочтения темы
+type markTopicReadRequest struct {
+	Seq uint64 `json:"seq" binding:"required"`
+}
+
+// chatTopicEvent сообщает участникам о создании, изменении или новом порядке тем
+type chatTopicEvent struct {
+	ChatID   uint              `json:"chat_id"`
+	Action   string            `json:"action"`
+	Topic    *models.ChatTopic `json:"topic,omitempty"`
+	TopicIDs []uint            `json:"topic_ids,omitempty"` // Новый порядок тем
+	ActorID  uint              `json:"actor_id"`
+}
+
+// topicReadEvent сообщает устройствам пользователя о прочтении темы
+type topicReadEvent struct {
+	ChatID      uint   `json:"chat_id"`
+	TopicID     uint   `json:"topic_id"`
+	LastReadSeq uint64 `json:"last_read_seq"`
+}
+
+// validateTopicName проверяет и нормализует название темы
+func validateTopicName(name string) (string, bool) {
+	name = strings.TrimSpace(name)
+	return name, name != "" && utf8.RuneCountInString(name) <= maxTopicNameLength
+}
+
+// validateTopicIcon проверяет и нормализует значок темы
+func validateTopicIcon(icon string) (string, bool) {
+	icon = strings.TrimSpace(icon)
+	return icon, utf8.RuneCountInString(icon) <= maxTopicIconLength
+}
+
+// loadTopicChat загружает групповой чат, в котором пользователь состоит, для работы с темами.
+// При ошибке ответ уже отправлен.
+func (s *Server) loadTopicChat(c *gin.Context) (*models.User, *models.Chat, *models.ChatUser, bool) {
+	user, chat, member, ok := s.loadChatMembership(c)
+	if !ok {
+		return nil, nil, nil, false
+	}
+	if chat.Type != models.ChatTypeGroup {
+		SendBadRequest(c, "Темы доступны только в групповых чатах")
+		return nil, nil, nil, false
+	}
+	return user, chat, member, true
+}
+
+// loadTopicManager загружает групповой чат, темами которого пользователь вправе управлять.
+// Управлять темами может тот, кому разрешено менять чат. При ошибке ответ уже отправлен.
+func (s *Server) loadTopicManager(c *gin.Context) (*models.User, *models.Chat, bool) {
+	user, chat, member, ok := s.loadTopicChat(c)
+	if !ok {
+		return nil, nil, false
+	}
+	if !chatAllows(user, chat, member, models.PermChangeInfo) {
+		SendForbidden(c, "Недостаточно прав для управления темами")
+		return nil, nil, false
+	}
+	return user, chat, true
+}
+
+// loadChatTopic загружает тему чата из пути запроса. При ошибке ответ уже отправлен.
+func (s *Server) loadChatTopic(c *gin.Context, chatID uint) (*models.ChatTopic, bool) {
+	topicID, err := strconv.ParseUint(c.Param("topicID"), 10, 32)
+	if err != nil {
+		SendBadRequest(c, "Некорректный ID темы")
+		return nil, false
+	}
+	topic, err := s.db.GetChatTopic(chatID, uint(topicID))
+	if err != nil {
+		if errors.Is(err, database.ErrTopicNotFound) {
+			SendNotFound(c, "Тема не найдена")
+			return nil, false
+		}
+		SendInternalError(c, "Ошибка получения темы")
+		return nil, false
+	}
+	return topic, true
+}
+
+// handleGetChatTopics возвращает темы чата с числом непрочитанных сообщений
+func (s *Server) handleGetChatTopics(c *gin.Context) {
+	user, chat, _, ok := s.loadTopicChat(c)
+	if !ok {
+		return
+	}
+
+	topics, err := s.db.GetChatTopics(chat.ID, user.ID)
+	if err != nil {
+		logger.Errorf("Ошибка получения тем чата %d: %v", chat.ID, err)
+		SendInternalError(c, "Ошибка получения тем")
+		return
+	}
+	if topics == nil {
+		topics = []database.TopicInfo{}
+	}
+	c.JSON(http.StatusOK, gin.H{"topics": topics})
+}
+
+// handleCreateChatTopic создает тему в групповом чате
+func (s *Server) handleCreateChatTopic(c *gin.Context) {
+	user, chat, ok := s.loadTopicManager(c)
+	if !ok {
+		return
+	}
+
+	var req createTopicRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		SendBadRequest(c, "Некорректные данные запроса: "+err.Error())
+		return
+	}
+	name, ok := validateTopicName(req.Name)
+	if !ok {
+		SendBadRequest(c, fmt.Sprintf("Название темы должно быть от 1 до %d символов", maxTopicNameLength))
+		return
+	}
+	icon, ok := validateTopicIcon(req.Icon)
+	if !ok {
+		SendBadRequest(c, "Слишком длинный значок темы")
+		return
+	}
+
+	topic := models.ChatTopic{
+		ChatID:    chat.ID,
+		Name:      name,
+		Icon:      icon,
+		CreatedBy: user.ID,
+	}
+	if err := s.db.CreateChatTopic(&topic); err != nil {
+		if errors.Is(err, database.ErrTooManyTopics) {
+			SendError(c, http.StatusConflict, "TOO_MANY_TOPICS", fmt.Sprintf("В чате может быть не больше %d тем", database.MaxChatTopics))
+			return
+		}
+		logger.Errorf("Ошибка создания темы в чате %d: %v", chat.ID, err)
+		SendInternalError(c, "Ошибка создания темы")
+		return
+	}
+	logger.Infof("Пользователь %d создал тему #%d в чате %d", user.ID, topic.ID, chat.ID)
+
+	s.sendToChat(chat.ID, WSTypeChatTopic, chatTopicEvent{ChatID: chat.ID, Action: topicCreated, Topic: &topic, ActorID: user.ID}, 0)
+
+	c.JSON(http.StatusCreated, topic)
+}
+
+// handleUpdateChatTopic переименовывает тему, меняет ее значок, закрывает или открывает ее
+func (s *Server) handleUpdateChatTopic(c *gin.Context) {
+	user, chat, ok := s.loadTopicManager(c)
+	if !ok {
+		return
+	}
+	topic, ok := s.loadChatTopic(c, chat.ID)
+	if !ok {
+		return
+	}
+
+	var req updateTopicRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		SendBadRequest(c, "Некорректные данные запроса: "+err.Error())
+		return
+	}
+	if req.Name == nil && req.Icon == nil && req.Closed == nil {
+		SendBadRequest(c, "Не указаны изменяемые поля")
+		return
+	}
+	if req.Name != nil {
+		name, ok := validateTopicName(*req.Name)
+		if !ok {
+			SendBadRequest(c, fmt.Sprintf("Название темы должно быть от 1 до %d символов", maxTopicNameLength))
+			return
+		}
+		topic.Name = name
+	}
+	if req.Icon != nil {
+		icon, ok := validateTopicIcon(*req.Icon)
+		if !ok {
+			SendBadRequest(c, "Слишком длинный значок темы")
+			return
+		}
+		topic.Icon = icon
+	}
+	if req.Closed != nil {
+		topic.Closed = *req.Closed
+	}
+
+	if err := s.db.UpdateChatTopic(topic); err != nil {
+		logger.Errorf("Ошибка изменения темы #%d: %v", topic.ID, err)
+		SendInternalError(c, "Ошибка изменения темы")
+		return
+	}
+
+	s.sendToChat(chat.ID, WSTypeChatTopic, chatTopicEvent{ChatID: chat.ID, Action: topicUpdated, Topic: topic, ActorID: user.ID}, 0)
+
+	c.JSON(http.StatusOK, topic)
+}
+
+// handleReorderChatTopics задает порядок тем чата
+func (s *Server) handleReorderChatTopics(c *gin.Context) {
+	user, chat, ok := s.loadTopicManager(c)
+	if !ok {
+		return
+	}
+
+	var req reorderTopicsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		SendBadRequest(c, "Некорректные данные запроса: "+err.Error())
+		return
+	}
+
+	if err := s.db.ReorderChatTopics(chat.ID, req.TopicIDs); err != nil {
+		if errors.Is(err, database.ErrTopicsMismatch) {
+			SendBadRequest(c, "Список должен содержать каждую тему чата ровно один раз")
+			return
+		}
+		logger.Errorf("Ошибка изменения порядка тем чата %d: %v", chat.ID, err)
+		SendInternalError(c, "Ошибка изменения порядка тем")
+		return
+	}
+
+	event := chatTopicEvent{ChatID: chat.ID, Action: topicReordered, TopicIDs: req.TopicIDs, ActorID: user.ID}
+	s.sendToChat(chat.ID, WSTypeChatTopic, event, 0)
+
+	c.JSON(http.StatusOK, event)
+}
+
+// handleGetTopicMessages возвращает страницу сообщений темы. Страницы листаются
+// к началу темы параметром before_seq.
+func (s *Server) handleGetTopicMessages(c *gin.Context) {
+	user, chat, member, ok := s.loadTopicChat(c)
+	if !ok {
+		return
+	}
+	topic, ok := s.loadChatTopic(c, chat.ID)
+	if !ok {
+		return
+	}
+
+	limit := defaultTopicPage
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxTopicPageSize {
+			SendBadRequest(c, fmt.Sprintf("limit должен быть от 1 до %d", maxTopicPageSize))
+			return
+		}
+		limit = parsed
+	}
+	var beforeSeq uint64
+	if value := c.Query("before_seq"); value != "" {
+		parsed, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			SendBadRequest(c, "Некорректный before_seq")
+			return
+		}
+		beforeSeq = parsed
+	}
+
+	messages, err := s.db.GetTopicMessages(chat.ID, topic.ID, chat.HistoryVisibleSince(member), beforeSeq, limit)
+	if err != nil {
+		logger.Errorf("Ошибка получения сообщений темы #%d: %v", topic.ID, err)
+		SendInternalError(c, "Ошибка получения сообщений")
+		return
+	}
+
+	response := make([]messageResponse, 0, len(messages))
+	for i := range messages {
+		response = append(response, newMessageResponse(&messages[i]))
+	}
+	s.attachPollResults(messages, response, user.ID)
+
+	c.JSON(http.StatusOK, gin.H{
+		"messages": response,
+		"has_more": len(messages) == limit,
+	})
+}
+
+// handleMarkTopicRead сдвигает курсор прочтения темы текущим пользователем
+func (s *Server) handleMarkTopicRead(c *gin.Context) {
+	user, chat, _, ok := s.loadTopicChat(c)
+	if !ok {
+		return
+	}
+	topic, ok := s.loadChatTopic(c, chat.ID)
+	if !ok {
+		return
+	}
+
+	var req markTopicReadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		SendBadRequest(c, "Не указан seq")
+		return
+	}
+	// Курсор не может опережать последнее сообщение чата
+	seq := req.Seq
+	if seq > chat.LastSeq {
+		seq = chat.LastSeq
+	}
+
+	advanced, err := s.db.MarkTopicRead(topic.ID, user.ID, seq)
+	if err != nil {
+		logger.Errorf("Ошибка отметки прочтения темы #%d пользователем %d: %v", topic.ID, user.ID, err)
+		SendInternalError(c, "Ошибка отметки прочтения")
+		return
+	}
+
+	event := topicReadEvent{ChatID: chat.ID, TopicID: topic.ID, LastReadSeq: seq}
+	if advanced {
+		if err := s.sendMessageToUser(user.ID, wsResponse{Type: WSTypeTopicRead, Payload: event}); err != nil {
+			logger.Errorf("Ошибка отправки прочтения темы #%d пользователю %d: %v", topic.ID, user.ID, err)
+		}
+	}
+
+	c.JSON(http.StatusOK, event)
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"messenger/logger"
+	"messenger/models"
+)
+
+// voiceListenedPayload - событие о прослушивании голосового сообщения
+type voiceListenedPayload struct {
+	ChatID     uint      `json:"chat_id"`
+	MessageID  uint      `json:"message_id"`
+	UserID     uint      `json:"user_id"`
+	ListenedAt time.Time `json:"listened_at"`
+}
+
+// loadVoiceMessage проверяет доступ к чату и возвращает голосовое сообщение из него
+func (s *Server) loadVoiceMessage(c *gin.Context, userID uint) (*models.Message, bool) {
+	chatID, err := strconv.ParseUint(c.Param("chatID"), 10, 32)
+	if err != nil {
+		SendBadRequest(c, "Некорректный ID чата")
+		return nil, false
+	}
+	messageID, err := strconv.ParseUint(c.Param("messageID"), 10, 32)
+	if err != nil {
+		SendBadRequest(c, "Некорректный ID сообщения")
+		return nil, false
+	}
+
+	if !s.db.IsUserInChat(userID, uint(chatID)) {
+		SendForbidden(c, "У вас нет доступа к этому чату")
+		return nil, false
+	}
+
+	message, err := s.db.GetMessageByID(uint(messageID))
+	if err != nil || message.ChatID != uint(chatID) || !s.messageVisible(userID, message.ChatID, message.CreatedAt) {
+		if err != nil && err != gorm.ErrRecordNotFound {
+			SendInternalError(c, "Ошибка получения сообщения")
+			return nil, false
+		}
+		SendNotFound(c, "Сообщение не найдено")
+		return nil, false
+	}
+	if message.Type != string(models.MessageTypeVoice) {
+		SendBadRequest(c, "Сообщение не является голосовым")
+		return nil, false
+	}
+
+	return message, true
+}
+
+// handleMarkVoiceListened отмечает голосовое сообщение прослушанным текущим пользователем.
+// Участники чата получают событие voice_listened при первом прослушивании.
+func (s *Server) handleMarkVoiceListened(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	message, ok := s.loadVoiceMessage(c, userID)
+	if !ok {
+		return
+	}
+
+	// Автор свое сообщение не "прослушивает"
+	if message.UserID == userID {
+		c.JSON(http.StatusOK, gin.H{"listened": false})
+		return
+	}
+
+	now := time.Now()
+	first, err := s.db.MarkVoiceListened(message.ID, userID, now)
+	if err != nil {
+		logger.Errorf("Ошибка отметки прослушивания сообщения #%d: %v", message.ID, err)
+		SendInternalError(c, "Ошибка отметки прослушивания")
+		return
+	}
+
+	if first {
+		s.sendToChat(message.ChatID, WSTypeVoiceListened, voiceListenedPayload{
+			ChatID:     message.ChatID,
+			MessageID:  message.ID,
+			UserID:     userID,
+			ListenedAt: now,
+		}, userID)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"listened": true})
+}
+
+// handleGetVoiceListeners возвращает получателей, прослушавших голосовое сообщение
+func (s *Server) handleGetVoiceListeners(c *gin.Context) {
+	message, ok := s.loadVoiceMessage(c, c.GetUint("userID"))
+	if !ok {
+		return
+	}
+
+	listeners, err := s.db.GetVoiceListeners(message.ID)
+	if err != nil {
+		logger.Errorf("Ошибка получения прослушиваний сообщения #%d: %v", message.ID, err)
+		SendInternalError(c, "Ошибка получения прослушиваний")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message_id":  message.ID,
+		"listened_by": listeners,
+	})
+}
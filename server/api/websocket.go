@@ -15,7 +15,6 @@ import (
 	"messenger/logger"
 	"messenger/middleware"
 	"messenger/models"
-	"messenger/utils/crypto"
 )
 
 // Константы для WebSocket
@@ -28,12 +27,34 @@ const (
 	// Максимальный размер сообщения
 	maxMessageSize = 10 * 1024 // 10KB
 
+	// Размер списка, с которым рассылка обходится одним запросом участников
+	broadcastMembersLimit = 1000
+
 	// Типы сообщений WebSocket
-	WSTypeMessage = "message"
-	WSTypeTyping  = "typing"
-	WSTypeRead    = "read"
-	WSTypeError   = "error"
-	WSTypeDebug   = "debug" // Добавляем тип сообщения для отладки
+	WSTypeMessage          = "message"
+	WSTypeMessageUpdated   = "message_updated"
+	WSTypeMessageDeleted   = "message_deleted"
+	WSTypePollUpdated      = "poll_updated"
+	WSTypeExportFinished   = "export_finished"
+	WSTypeCommandReply     = "command_reply" // Ответ на команду, видимый только ее автору
+	WSTypeReminder         = "reminder"
+	WSTypeVoiceListened    = "voice_listened"
+	WSTypeLiveLocation     = "live_location" // Координаты трансляции местоположения (от клиента и клиентам)
+	WSTypeLiveLocationStop = "live_location_stop"
+	WSTypeChatUpdated      = "chat_updated"
+	WSTypeChatMembers      = "chat_members" // Изменение состава чата
+	WSTypeChatMemberRole   = "chat_member_role"
+	WSTypeChatSettings     = "chat_settings" // Личные настройки чата изменены (на любом из устройств пользователя)
+	WSTypePinnedChats      = "pinned_chats"
+	WSTypeJoinRequest      = "chat_join_request" // Новая заявка на вступление или решение по ней
+	WSTypeChatTopic        = "chat_topic"        // Тема создана, изменена или темы переупорядочены
+	WSTypeTopicRead        = "topic_read"        // Курсор прочтения темы сдвинут (на любом из устройств пользователя)
+	WSTypeChatRestriction  = "chat_restriction"  // Участник заблокирован, заглушен или исключен либо ограничение снято
+	WSTypeTyping           = "typing"
+	WSTypeRead             = "read"
+	WSTypeDelivered        = "delivered"
+	WSTypeError            = "error"
+	WSTypeDebug            = "debug" // Добавляем тип сообщения для отладки
 )
 
 // Client представляет WebSocket клиента (для обратной совместимости)
@@ -50,11 +71,21 @@ type Client struct {
 type WSClient struct {
 	server        *Server
 	conn          *websocket.Conn
-	send          chan []byte
+	send          chan wsFrame
 	userID        uint
 	authenticated bool
 	mu            sync.Mutex
 	clientInfo    string // Добавляем информацию о клиенте для логирования
+	closed        bool   // Очередь отправки закрыта, защищено mu
+}
+
+// wsFrame представляет исходящий кадр в очереди клиента.
+// Для сообщений чата заполняются chatID и seq, чтобы после фактической записи
+// в соединение сдвинуть курсор доставки получателя.
+type wsFrame struct {
+	data   []byte
+	chatID uint
+	seq    uint64
 }
 
 // WSMessage представляет сообщение WebSocket
@@ -77,9 +108,20 @@ type wsResponse struct {
 
 // Структуры для разных типов сообщений
 type wsNewMessagePayload struct {
-	ChatID  uint   `json:"chatId"`
-	Content string `json:"content"`
-	Type    string `json:"type"`
+	ChatID   uint             `json:"chatId"`
+	TopicID  *uint            `json:"topicId,omitempty"`
+	Content  string           `json:"content"`
+	Type     string           `json:"type"`
+	Poll     *pollRequest     `json:"poll,omitempty"`
+	Contact  *contactPayload  `json:"contact,omitempty"`
+	Location *locationPayload `json:"location,omitempty"`
+}
+
+// wsLiveLocationPayload - новые координаты трансляции или ее остановка
+type wsLiveLocationPayload struct {
+	ChatID    uint `json:"chatId"`
+	MessageID uint `json:"messageId"`
+	liveLocationUpdate
 }
 
 type typingPayload struct {
@@ -87,8 +129,12 @@ type typingPayload struct {
 	Status bool `json:"status"`
 }
 
+// readPayload отмечает чат прочитанным до seq включительно.
+// Для совместимости вместо пары chatId/seq можно передать messageId.
 type readPayload struct {
-	MessageID uint `json:"messageId"`
+	ChatID    uint   `json:"chatId"`
+	Seq       uint64 `json:"seq"`
+	MessageID uint   `json:"messageId"`
 }
 
 // ReadReceiptPayload представляет данные о прочтении сообщений
@@ -213,14 +259,14 @@ func (s *Server) WebSocketHandler(c *gin.Context) {
 	client := &WSClient{
 		server:        s,
 		conn:          conn,
-		send:          make(chan []byte, 256),
+		send:          make(chan wsFrame, 256),
 		userID:        userID,
 		authenticated: true,
 		clientInfo:    clientInfo,
 	}
 
-	// Сохраняем клиента в карте соединений
-	s.wsClients.Store(userID, client)
+	// Регистрируем соединение: остальные устройства пользователя остаются подключенными
+	s.wsClients.add(client)
 
 	// Отправляем диагностическое сообщение клиенту
 	debugMsg := wsResponse{
@@ -237,19 +283,22 @@ func (s *Server) WebSocketHandler(c *gin.Context) {
 		},
 	}
 	debugJSON, _ := json.Marshal(debugMsg)
-	client.send <- debugJSON
+	client.send <- wsFrame{data: debugJSON}
 
 	// Запускаем горутины для чтения и записи
 	go client.writePump()
 	go client.readPump()
 
+	// Досылаем сообщения, пришедшие, пока пользователь был не в сети
+	go s.sendMessageHistory(client)
+
 	logger.Infof("Пользователь %d подключен по WebSocket (клиент: %s)", userID, clientInfo)
 }
 
 // readPump читает сообщения от клиента
 func (c *WSClient) readPump() {
 	defer func() {
-		c.server.wsClients.Delete(c.userID)
+		c.server.wsClients.remove(c)
 		c.conn.Close()
 		logger.Infof("Пользователь %d отключен от WebSocket (клиент: %s)", c.userID, c.clientInfo)
 	}()
@@ -292,7 +341,7 @@ func (c *WSClient) writePump() {
 
 	for {
 		select {
-		case message, ok := <-c.send:
+		case frame, ok := <-c.send:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				// Канал закрыт
@@ -308,23 +357,33 @@ func (c *WSClient) writePump() {
 			}
 
 			// Логируем отправляемое сообщение
-			logger.Debugf("WebSocket: Отправка сообщения пользователю %d (клиент: %s): %s", c.userID, c.clientInfo, string(message))
+			logger.Debugf("WebSocket: Отправка сообщения пользователю %d (клиент: %s): %s", c.userID, c.clientInfo, string(frame.data))
+
+			// Максимальные seq сообщений по чатам, попавших в этот пакет
+			delivered := make(map[uint]uint64)
+			trackDelivery(delivered, frame)
 
-			w.Write(message)
+			w.Write(frame.data)
 
 			// Добавляем все ожидающие сообщения в текущую отправку
 			n := len(c.send)
 			for i := 0; i < n; i++ {
 				w.Write([]byte("\n"))
-				msg := <-c.send
-				logger.Debugf("WebSocket: Добавление в пакет сообщения для пользователя %d (клиент: %s): %s", c.userID, c.clientInfo, string(msg))
-				w.Write(msg)
+				next := <-c.send
+				logger.Debugf("WebSocket: Добавление в пакет сообщения для пользователя %d (клиент: %s): %s", c.userID, c.clientInfo, string(next.data))
+				w.Write(next.data)
+				trackDelivery(delivered, next)
 			}
 
 			if err := w.Close(); err != nil {
 				logger.Errorf("WebSocket: Ошибка закрытия writer для пользователя %d (клиент: %s): %v", c.userID, c.clientInfo, err)
 				return
 			}
+
+			// Кадр записан в соединение - сообщения считаются доставленными
+			if len(delivered) > 0 {
+				go c.server.markDelivered(c.userID, delivered)
+			}
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			logger.Debugf("WebSocket: Отправка PING пользователю %d (клиент: %s)", c.userID, c.clientInfo)
@@ -356,15 +415,23 @@ func (c *WSClient) processMessage(msg []byte) {
 			return
 		}
 
-		// Проверка доступа к чату
-		if !c.server.db.IsUserInChat(c.userID, payload.ChatID) {
-			logger.Warnf("WebSocket: Попытка доступа к чату %d от пользователя %d (клиент: %s) запрещена", payload.ChatID, c.userID, c.clientInfo)
-			c.sendError("Доступ к чату запрещен")
+		// Обработка нового сообщения (проверка доступа выполняется в postMessage)
+		c.processNewMessage(payload)
+
+	case WSTypeLiveLocation, WSTypeLiveLocationStop:
+		var payload wsLiveLocationPayload
+		if err := json.Unmarshal(wsMsg.Payload, &payload); err != nil {
+			c.sendError("Некорректный формат данных местоположения")
 			return
 		}
 
-		// Обработка нового сообщения через функцию в messages.go
-		c.processNewMessage(payload)
+		update := &payload.liveLocationUpdate
+		if wsMsg.Type == WSTypeLiveLocationStop {
+			update = nil
+		}
+		if _, sendErr := c.server.updateLiveLocation(c.userID, payload.ChatID, payload.MessageID, update); sendErr != nil {
+			c.sendResponse(WSTypeError, gin.H{"message": sendErr.Message, "code": sendErr.Code})
+		}
 
 	case WSTypeTyping:
 		var payload typingPayload
@@ -373,9 +440,9 @@ func (c *WSClient) processMessage(msg []byte) {
 			return
 		}
 
-		// Проверка доступа к чату
-		if !c.server.db.IsUserInChat(c.userID, payload.ChatID) {
-			c.sendError("Доступ к чату запрещен")
+		// Статус набора показывается только тем, кто может писать в чат
+		if _, _, _, sendErr := c.server.checkChatPermission(c.userID, payload.ChatID, models.PermSendMessages); sendErr != nil {
+			c.sendError(sendErr.Message)
 			return
 		}
 
@@ -389,94 +456,68 @@ func (c *WSClient) processMessage(msg []byte) {
 			return
 		}
 
-		// Отмечаем сообщение как прочитанное
-		if err := c.server.db.MarkMessageAsRead(payload.MessageID, c.userID); err != nil {
-			c.sendError("Ошибка при отметке сообщения как прочитанного")
-			return
-		}
-
-		// Получаем сообщение для проверки чата
-		message, err := c.server.db.GetMessageByID(payload.MessageID)
-		if err != nil {
-			c.sendError("Сообщение не найдено")
-			return
+		chatID, seq := payload.ChatID, payload.Seq
+		if payload.MessageID != 0 {
+			// Старый формат: определяем чат и seq по сообщению
+			message, err := c.server.db.GetMessageByID(payload.MessageID)
+			if err != nil {
+				c.sendError("Сообщение не найдено")
+				return
+			}
+			chatID, seq = message.ChatID, message.Seq
 		}
 
 		// Проверка доступа к чату
-		if !c.server.db.IsUserInChat(c.userID, message.ChatID) {
+		if !c.server.db.IsUserInChat(c.userID, chatID) {
 			c.sendError("Доступ к чату запрещен")
 			return
 		}
 
-		// Отправляем статус прочтения всем участникам чата
-		c.server.broadcastReadStatus(c.userID, message)
+		// Сдвигаем курсор прочтения и оповещаем участников чата
+		if err := c.server.markChatRead(c.userID, chatID, seq); err != nil {
+			c.sendError("Ошибка при отметке сообщений как прочитанных")
+			return
+		}
 	}
 }
 
 // processNewMessage обрабатывает новое сообщение из WebSocket
 func (c *WSClient) processNewMessage(payload wsNewMessagePayload) {
-	// Получаем информацию о чате
-	chat, err := c.server.db.GetChatByID(payload.ChatID)
-	if err != nil {
-		c.sendError("Чат не найден")
+	wait, reserved := c.server.reserveSlowMode(c.userID, payload.ChatID)
+	if wait > 0 {
+		c.sendResponse(WSTypeError, gin.H{"message": slowModeMessage(wait), "code": errCodeSlowMode, "retry_after": retryAfterSeconds(wait)})
 		return
 	}
 
-	// Получаем информацию о пользователе
-	user, err := c.server.db.GetUserByID(c.userID)
-	if err != nil {
-		c.sendError("Ошибка получения данных пользователя")
-		return
-	}
-
-	// Шифруем содержимое сообщения
-	encryptedContent, err := crypto.Encrypt([]byte(payload.Content))
-	if err != nil {
-		c.sendError("Ошибка шифрования сообщения")
-		return
-	}
-
-	// Создаем новое сообщение
-	message := models.Message{
-		ChatID:    payload.ChatID,
-		UserID:    c.userID,
-		Content:   encryptedContent,
-		Type:      payload.Type,
-		PlainText: payload.Content, // Для ответа клиенту
+	message, reply, sendErr := c.server.submitMessage(c.userID, outgoingMessage{
+		ChatID:   payload.ChatID,
+		TopicID:  payload.TopicID,
+		Content:  payload.Content,
+		Type:     payload.Type,
+		Poll:     payload.Poll,
+		Contact:  payload.Contact,
+		Location: payload.Location,
+		Origin:   c,
+	})
+	if reserved && message == nil {
+		// Сообщение не отправлено: медленный режим не должен мешать повторной попытке
+		c.server.releaseSlowMode(c.userID, payload.ChatID)
 	}
-
-	// Сохраняем сообщение в базе данных
-	if err := c.server.db.CreateMessage(&message); err != nil {
-		c.sendError("Ошибка сохранения сообщения")
+	if sendErr != nil {
+		if sendErr.Status == http.StatusForbidden {
+			logger.Warnf("WebSocket: Попытка доступа к чату %d от пользователя %d (клиент: %s) запрещена", payload.ChatID, c.userID, c.clientInfo)
+		}
+		c.sendResponse(WSTypeError, gin.H{"message": sendErr.Message, "code": sendErr.Code})
 		return
 	}
 
-	// Обновляем время последней активности чата
-	chat.LastActivity = time.Now()
-	if err := c.server.db.UpdateChat(chat); err != nil {
-		logger.Errorf("Ошибка обновления времени активности чата: %v", err)
+	// Отправляем сообщение текущему пользователю
+	if message != nil {
+		c.sendResponse(WSTypeMessage, message)
 	}
-
-	// Формируем ответное сообщение
-	msgResponse := messageResponse{
-		ID:        message.ID,
-		ChatID:    message.ChatID,
-		UserID:    message.UserID,
-		Content:   payload.Content, // Отправляем открытый текст в ответе
-		Type:      message.Type,
-		CreatedAt: message.CreatedAt,
+	if reply != nil {
+		c.sendResponse(WSTypeCommandReply, reply)
 	}
-
-	// Добавляем информацию о пользователе
-	msgResponse.User.ID = user.ID
-	msgResponse.User.Username = user.Username
-	msgResponse.User.Avatar = user.Avatar
-
-	// Отправляем сообщение текущему пользователю
-	c.sendResponse(WSTypeMessage, msgResponse)
-
-	// Отправляем сообщение другим участникам чата
-	c.broadcastMessageToChat(payload.ChatID, msgResponse)
 }
 
 // sendResponse отправляет ответ клиенту
@@ -492,15 +533,35 @@ func (c *WSClient) sendResponse(msgType string, payload interface{}) {
 		return
 	}
 
+	c.enqueue(wsFrame{data: data})
+}
+
+// sendChatMessage отправляет клиенту сообщение чата с отслеживанием доставки
+func (c *WSClient) sendChatMessage(message messageResponse) {
+	data, err := json.Marshal(wsResponse{Type: WSTypeMessage, Payload: message})
+	if err != nil {
+		logger.Errorf("Ошибка маршалинга сообщения: %v", err)
+		return
+	}
+
+	c.enqueue(wsFrame{data: data, chatID: message.ChatID, seq: message.Seq})
+}
+
+// enqueue помещает кадр в очередь отправки клиента
+func (c *WSClient) enqueue(frame wsFrame) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if c.closed {
+		return
+	}
 	select {
-	case c.send <- data:
+	case c.send <- frame:
 		// Успешно отправлено в канал
 	default:
 		// Буфер полон, закрываем соединение
-		c.server.wsClients.Delete(c.userID)
+		c.server.wsClients.remove(c)
+		c.closed = true
 		close(c.send)
 		logger.Warnf("Клиент %d отключен: буфер полон", c.userID)
 	}
@@ -513,13 +574,6 @@ func (c *WSClient) sendError(message string) {
 
 // broadcastTypingStatus отправляет статус набора текста всем участникам чата
 func (s *Server) broadcastTypingStatus(senderID, chatID uint, status bool) {
-	// Получаем всех участников чата
-	users, err := s.db.GetChatUsers(chatID)
-	if err != nil {
-		logger.Errorf("Ошибка получения участников чата: %v", err)
-		return
-	}
-
 	// Данные о наборе текста
 	typingData := gin.H{
 		"user_id": senderID,
@@ -528,71 +582,165 @@ func (s *Server) broadcastTypingStatus(senderID, chatID uint, status bool) {
 	}
 
 	// Отправляем статус каждому участнику чата кроме отправителя
-	for _, user := range users {
-		if user.ID == senderID {
+	s.sendToChat(chatID, WSTypeTyping, typingData, senderID)
+}
+
+// trackDelivery запоминает максимальный seq сообщения чата из кадра
+func trackDelivery(delivered map[uint]uint64, frame wsFrame) {
+	if frame.seq > delivered[frame.chatID] {
+		delivered[frame.chatID] = frame.seq
+	}
+}
+
+// markDelivered сдвигает курсоры доставки пользователя после записи кадра в соединение
+func (s *Server) markDelivered(userID uint, delivered map[uint]uint64) {
+	for chatID, seq := range delivered {
+		stored, err := s.db.MarkChatDelivered(chatID, userID, seq)
+		if err != nil {
+			logger.Errorf("Ошибка обновления курсора доставки (чат %d, пользователь %d): %v", chatID, userID, err)
 			continue
 		}
+		if stored > 0 && !s.isChannel(chatID) {
+			s.broadcastReceiptStatus(WSTypeDelivered, userID, chatID, stored)
+		}
+	}
+}
 
-		// Получаем WebSocket клиента для пользователя
-		if clientObj, ok := s.wsClients.Load(user.ID); ok {
-			if client, ok := clientObj.(*WSClient); ok {
-				client.sendResponse(WSTypeTyping, typingData)
-			}
+// markChatRead сдвигает курсор прочтения пользователя и оповещает участников чата
+func (s *Server) markChatRead(userID, chatID uint, seq uint64) error {
+	// Подписчики канала не видят статусов друг друга: прочтение учитывается только в просмотрах
+	if s.isChannel(chatID) {
+		if _, err := s.db.MarkChannelRead(chatID, userID, seq); err != nil {
+			logger.Errorf("Ошибка обновления курсора прочтения (канал %d, пользователь %d): %v", chatID, userID, err)
+			return err
 		}
+		return nil
+	}
+
+	stored, err := s.db.MarkChatRead(chatID, userID, seq)
+	if err != nil {
+		logger.Errorf("Ошибка обновления курсора прочтения (чат %d, пользователь %d): %v", chatID, userID, err)
+		return err
 	}
+	if stored > 0 {
+		// Рассылается сохраненный курсор: seq клиента может превышать номер последнего сообщения
+		s.broadcastReceiptStatus(WSTypeRead, userID, chatID, stored)
+	}
+	return nil
 }
 
-// broadcastMessageToChat отправляет сообщение всем участникам чата кроме отправителя
-func (c *WSClient) broadcastMessageToChat(chatID uint, message messageResponse) {
-	// Получаем всех участников чата
-	users, err := c.server.db.GetChatUsers(chatID)
+// isChannel проверяет, является ли чат каналом. Тип чата кэшируется.
+func (s *Server) isChannel(chatID uint) bool {
+	if chatType, ok := s.chatTypes.Load(chatID); ok {
+		return chatType == models.ChatTypeChannel
+	}
+
+	chatType, err := s.db.GetChatType(chatID)
 	if err != nil {
-		logger.Errorf("Ошибка получения участников чата: %v", err)
+		logger.Errorf("Ошибка получения типа чата %d: %v", chatID, err)
+		return false
+	}
+	s.chatTypes.Store(chatID, chatType)
+	return chatType == models.ChatTypeChannel
+}
+
+// broadcastReceiptStatus отправляет участникам чата статус доставки или прочтения
+func (s *Server) broadcastReceiptStatus(msgType string, userID, chatID uint, seq uint64) {
+	s.sendToChat(chatID, msgType, gin.H{
+		"user_id":   userID,
+		"chat_id":   chatID,
+		"seq":       seq,
+		"timestamp": time.Now(),
+	}, 0)
+}
+
+// sendToChat отправляет событие всем подключенным участникам чата, кроме exceptUserID
+func (s *Server) sendToChat(chatID uint, msgType string, payload interface{}, exceptUserID uint) {
+	s.forEachOnlineMember(chatID, exceptUserID, func(client *WSClient) {
+		client.sendResponse(msgType, payload)
+	})
+}
+
+// sendToMessageViewers отправляет событие о сообщении, отправленном в момент sentAt, подключенным
+// участникам чата, кроме exceptUserID, которым сообщение видно: в группе со скрытой историей
+// вступившие после отправки его не получают
+func (s *Server) sendToMessageViewers(chatID uint, sentAt time.Time, msgType string, payload interface{}, exceptUserID uint) {
+	chat, err := s.db.GetChatByID(chatID)
+	if err != nil {
+		logger.Errorf("Ошибка получения чата %d: %v", chatID, err)
+		return
+	}
+	if chat.Type != models.ChatTypeGroup || chat.HistoryVisibility != models.HistoryVisibilityJoined {
+		s.sendToChat(chatID, msgType, payload, exceptUserID)
 		return
 	}
 
-	// Отправляем сообщение каждому участнику чата кроме отправителя
-	for _, user := range users {
-		if user.ID == c.userID {
-			continue
+	joinedLater, err := s.db.GetChatMemberIDsJoinedAfter(chatID, sentAt)
+	if err != nil {
+		logger.Errorf("Ошибка получения участников чата %d: %v", chatID, err)
+		return
+	}
+	hidden := make(map[uint]bool, len(joinedLater))
+	for _, userID := range joinedLater {
+		hidden[userID] = true
+	}
+	s.forEachOnlineMember(chatID, exceptUserID, func(client *WSClient) {
+		if !hidden[client.userID] {
+			client.sendResponse(msgType, payload)
 		}
+	})
+}
 
-		// Получаем WebSocket клиента для пользователя
-		if clientObj, ok := c.server.wsClients.Load(user.ID); ok {
-			if client, ok := clientObj.(*WSClient); ok {
-				client.sendResponse(WSTypeMessage, message)
-			}
-		}
-	}
+// onlineUserIDs возвращает ID пользователей с открытым WebSocket соединением
+func (s *Server) onlineUserIDs() []uint {
+	return s.wsClients.userIDs()
 }
 
-// broadcastReadStatus отправляет статус прочтения сообщения
-func (s *Server) broadcastReadStatus(userID uint, message *models.Message) {
-	// Данные о прочтении
-	readData := gin.H{
-		"user_id":    userID,
-		"message_id": message.ID,
-		"chat_id":    message.ChatID,
+// forEachOnlineMember вызывает fn для каждого подключенного участника чата, кроме exceptUserID.
+// Выбирается меньший из двух списков: при небольшом числе подключений участники ищутся среди
+// подключенных пользователей, иначе загружаются участники чата. Только в большом чате при
+// большом числе подключений подключенные пользователи сверяются с участниками пачками,
+// поэтому рассылка в канал с тысячами подписчиков не загружает их всех из БД.
+func (s *Server) forEachOnlineMember(chatID, exceptUserID uint, fn func(client *WSClient)) {
+	online := s.onlineUserIDs()
+	if len(online) == 0 {
+		return
 	}
 
-	// Получаем всех участников чата
-	users, err := s.db.GetChatUsers(message.ChatID)
+	members, err := s.onlineChatMembers(chatID, online)
 	if err != nil {
-		logger.Errorf("Ошибка получения участников чата: %v", err)
+		logger.Errorf("Ошибка получения участников чата %d: %v", chatID, err)
 		return
 	}
 
-	// Отправляем статус каждому участнику чата
-	for _, user := range users {
-		// Получаем WebSocket клиента для пользователя
-		if clientObj, ok := s.wsClients.Load(user.ID); ok {
-			if client, ok := clientObj.(*WSClient); ok {
-				client.sendResponse(WSTypeRead, readData)
-			}
+	for _, userID := range members {
+		if userID == exceptUserID {
+			continue
+		}
+		for _, client := range s.wsClients.userClients(userID) {
+			fn(client)
 		}
 	}
 }
 
+// onlineChatMembers возвращает участников чата среди подключенных пользователей online.
+// Каждый вариант укладывается в один запрос, кроме большого чата при большом числе подключений.
+func (s *Server) onlineChatMembers(chatID uint, online []uint) ([]uint, error) {
+	if len(online) <= broadcastMembersLimit {
+		return s.db.FilterChatMembers(chatID, online)
+	}
+
+	members, small, err := s.db.SmallChatMembers(chatID, broadcastMembersLimit)
+	if err != nil {
+		return nil, err
+	}
+	if !small {
+		return s.db.FilterChatMembers(chatID, online)
+	}
+	// Участники без подключений пропускаются при поиске соединений
+	return members, nil
+}
+
 // sendDebugMessage отправляет отладочное сообщение клиенту
 func (c *WSClient) sendDebugMessage(data interface{}) {
 	log.Printf("WebSocket: Отправка отладочного сообщения клиенту user_id=%d, ip=%s", c.userID, c.clientInfo)
@@ -619,7 +767,7 @@ func (c *WSClient) sendDebugMessage(data interface{}) {
 		return
 	}
 
-	c.send <- msgBytes
+	c.send <- wsFrame{data: msgBytes}
 }
 
 // maskToken маскирует токен для безопасного отображения в логах
@@ -667,5 +815,5 @@ func (c *WSClient) sendErrorMessage(message string) {
 		return
 	}
 
-	c.send <- msgBytes
+	c.send <- wsFrame{data: msgBytes}
 }
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"sync"
+)
+
+// clientRegistry хранит WebSocket соединения пользователей. У пользователя может быть
+// несколько соединений одновременно - по одному с каждого устройства.
+type clientRegistry struct {
+	mu      sync.RWMutex
+	clients map[uint]map[*WSClient]struct{}
+}
+
+// add регистрирует соединение
+func (r *clientRegistry) add(client *WSClient) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.clients == nil {
+		r.clients = make(map[uint]map[*WSClient]struct{})
+	}
+	userClients, ok := r.clients[client.userID]
+	if !ok {
+		userClients = make(map[*WSClient]struct{})
+		r.clients[client.userID] = userClients
+	}
+	userClients[client] = struct{}{}
+}
+
+// remove удаляет соединение. Возвращает false, если соединение уже было удалено.
+func (r *clientRegistry) remove(client *WSClient) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	userClients, ok := r.clients[client.userID]
+	if !ok {
+		return false
+	}
+	if _, ok := userClients[client]; !ok {
+		return false
+	}
+	delete(userClients, client)
+	if len(userClients) == 0 {
+		delete(r.clients, client.userID)
+	}
+	return true
+}
+
+// userClients возвращает все соединения пользователя
+func (r *clientRegistry) userClients(userID uint) []*WSClient {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	result := make([]*WSClient, 0, len(r.clients[userID]))
+	for client := range r.clients[userID] {
+		result = append(result, client)
+	}
+	return result
+}
+
+// userIDs возвращает ID пользователей, у которых есть хотя бы одно соединение
+func (r *clientRegistry) userIDs() []uint {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	result := make([]uint, 0, len(r.clients))
+	for userID := range r.clients {
+		result = append(result, userID)
+	}
+	return result
+}
+
+// count возвращает общее число соединений
+func (r *clientRegistry) count() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	total := 0
+	for _, userClients := range r.clients {
+		total += len(userClients)
+	}
+	return total
+}
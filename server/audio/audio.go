@@ -0,0 +1,104 @@
+// Package audio определяет длительность и форму волны аудиозаписей без декодирования звука.
+//
+// Поддерживаются Ogg (Opus, Vorbis), WebM/Matroska и MP3. Форма волны приблизительная:
+// громкость фрагмента оценивается по объему данных, который кодек потратил на его кадры
+// (тишина кодируется почти без затрат, речь - заметно дороже).
+package audio
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"time"
+)
+
+// Число отсчетов формы волны
+const WaveformSamples = 100
+
+// ErrUnsupported возвращается для форматов, которые не удалось распознать
+var ErrUnsupported = errors.New("неподдерживаемый формат аудио")
+
+// Info содержит метаданные аудиозаписи
+type Info struct {
+	Duration time.Duration
+	Waveform []byte // WaveformSamples отсчетов от 0 до 255
+}
+
+// frame - закодированный фрагмент записи: время начала и объем данных
+type frame struct {
+	at     time.Duration
+	weight int
+}
+
+// Analyze определяет формат по сигнатуре и вычисляет длительность и форму волны
+func Analyze(r io.Reader) (*Info, error) {
+	br := bufio.NewReaderSize(r, 64*1024)
+	head, err := br.Peek(4)
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+
+	var duration time.Duration
+	var frames []frame
+	switch {
+	case bytes.Equal(head, []byte("OggS")):
+		duration, frames, err = analyzeOgg(br)
+	case bytes.Equal(head, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		duration, frames, err = analyzeWebM(br)
+	case bytes.HasPrefix(head, []byte("ID3")) || isMP3Header(head):
+		duration, frames, err = analyzeMP3(br)
+	default:
+		return nil, ErrUnsupported
+	}
+	if err != nil {
+		return nil, err
+	}
+	if duration <= 0 {
+		return nil, errors.New("не удалось определить длительность записи")
+	}
+
+	return &Info{
+		Duration: duration,
+		Waveform: buildWaveform(frames, duration),
+	}, nil
+}
+
+// buildWaveform усредняет объем кадров по WaveformSamples интервалам и нормирует
+// результат так, что самый громкий интервал равен 255
+func buildWaveform(frames []frame, duration time.Duration) []byte {
+	var sums, counts [WaveformSamples]int
+	for _, f := range frames {
+		i := int(int64(f.at) * WaveformSamples / int64(duration))
+		if i < 0 {
+			i = 0
+		} else if i >= WaveformSamples {
+			i = WaveformSamples - 1
+		}
+		sums[i] += f.weight
+		counts[i]++
+	}
+
+	var levels [WaveformSamples]int
+	peak := 0
+	for i := range sums {
+		if counts[i] > 0 {
+			levels[i] = sums[i] / counts[i]
+		} else if i > 0 {
+			// У коротких записей на интервал может не прийтись ни одного кадра
+			levels[i] = levels[i-1]
+		}
+		if levels[i] > peak {
+			peak = levels[i]
+		}
+	}
+
+	waveform := make([]byte, WaveformSamples)
+	if peak == 0 {
+		return waveform
+	}
+	for i, level := range levels {
+		waveform[i] = byte(level * 255 / peak)
+	}
+	return waveform
+}
@@ -0,0 +1,263 @@
+package audio
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"time"
+)
+
+// Битрейты MPEG в кбит/с: [MPEG1/MPEG2][слой 1..3][индекс]
+var mp3Bitrates = [2][3][15]int{
+	{
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	},
+	{
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	},
+}
+
+// Частоты дискретизации: [MPEG1, MPEG2, MPEG2.5][индекс]
+var mp3SampleRates = [3][3]int{
+	{44100, 48000, 32000},
+	{22050, 24000, 16000},
+	{11025, 12000, 8000},
+}
+
+// mp3Header - разобранный заголовок кадра MPEG
+type mp3Header struct {
+	version    int // 0 - MPEG1, 1 - MPEG2, 2 - MPEG2.5
+	layer      int // 1..3
+	crc        bool
+	mono       bool
+	sampleRate int
+	samples    int // Сэмплов в кадре
+	length     int // Длина кадра вместе с заголовком
+}
+
+// isMP3Header проверяет синхрослово кадра
+func isMP3Header(b []byte) bool {
+	_, ok := parseMP3Header(b)
+	return ok
+}
+
+func parseMP3Header(b []byte) (mp3Header, bool) {
+	var h mp3Header
+	if len(b) < 4 || b[0] != 0xFF || b[1]&0xE0 != 0xE0 {
+		return h, false
+	}
+
+	switch (b[1] >> 3) & 3 {
+	case 3:
+		h.version = 0
+	case 2:
+		h.version = 1
+	case 0:
+		h.version = 2
+	default:
+		return h, false
+	}
+	h.layer = 4 - int((b[1]>>1)&3)
+	if h.layer == 4 {
+		return h, false
+	}
+	h.crc = b[1]&1 == 0
+
+	bitrateIndex := int(b[2] >> 4)
+	rateIndex := int((b[2] >> 2) & 3)
+	if bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return h, false // Свободный битрейт не поддерживается
+	}
+	table := h.version
+	if table > 1 {
+		table = 1
+	}
+	bitrate := mp3Bitrates[table][h.layer-1][bitrateIndex] * 1000
+	h.sampleRate = mp3SampleRates[h.version][rateIndex]
+	padding := int((b[2] >> 1) & 1)
+	h.mono = b[3]>>6 == 3
+
+	switch {
+	case h.layer == 1:
+		h.samples = 384
+		h.length = (12*bitrate/h.sampleRate + padding) * 4
+	case h.layer == 3 && h.version > 0:
+		h.samples = 576
+		h.length = 72*bitrate/h.sampleRate + padding
+	default:
+		h.samples = 1152
+		h.length = 144*bitrate/h.sampleRate + padding
+	}
+	return h, h.length > 4
+}
+
+// sideInfoLen возвращает размер служебной информации кадра слоя 3
+func (h mp3Header) sideInfoLen() int {
+	switch {
+	case h.version == 0 && h.mono:
+		return 17
+	case h.version == 0:
+		return 32
+	case h.mono:
+		return 9
+	default:
+		return 17
+	}
+}
+
+// analyzeMP3 перебирает кадры MPEG. Длительность - сумма длительностей кадров,
+// поэтому файлы с переменным битрейтом обрабатываются так же, как с постоянным.
+func analyzeMP3(r *bufio.Reader) (time.Duration, []frame, error) {
+	if err := skipID3v2(r); err != nil {
+		return 0, nil, err
+	}
+
+	var (
+		duration time.Duration
+		frames   []frame
+		first    = true
+	)
+	for {
+		head, err := r.Peek(4)
+		if err != nil {
+			break
+		}
+		h, ok := parseMP3Header(head)
+		if !ok {
+			if bytes.HasPrefix(head, []byte("TAG")) {
+				break // ID3v1 в конце файла
+			}
+			// Мусор между кадрами: ищем следующее синхрослово
+			if _, err := r.Discard(1); err != nil {
+				break
+			}
+			continue
+		}
+
+		data := make([]byte, h.length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			break // Последний кадр обрезан
+		}
+
+		// Первый кадр может содержать не звук, а заголовок Xing/Info/VBRI
+		if first {
+			first = false
+			if h.layer == 3 && isVBRHeader(h, data) {
+				continue
+			}
+		}
+
+		weight := h.length
+		if h.layer == 3 {
+			weight = layer3Bits(h, data)
+		}
+		frames = append(frames, frame{at: duration, weight: weight})
+		duration += time.Duration(h.samples) * time.Second / time.Duration(h.sampleRate)
+	}
+
+	if len(frames) == 0 {
+		return 0, nil, ErrUnsupported
+	}
+	return duration, frames, nil
+}
+
+// skipID3v2 пропускает тег ID3v2 в начале файла
+func skipID3v2(r *bufio.Reader) error {
+	head, err := r.Peek(10)
+	if err != nil || !bytes.HasPrefix(head, []byte("ID3")) {
+		return nil
+	}
+
+	size := int(head[6]&0x7F)<<21 | int(head[7]&0x7F)<<14 | int(head[8]&0x7F)<<7 | int(head[9]&0x7F)
+	size += 10
+	if head[5]&0x10 != 0 {
+		size += 10 // Футер тега
+	}
+	if _, err := r.Discard(size); err != nil {
+		return errors.New("поврежден тег ID3")
+	}
+	return nil
+}
+
+func isVBRHeader(h mp3Header, data []byte) bool {
+	offset := 4 + h.sideInfoLen()
+	if h.crc {
+		offset += 2
+	}
+	if len(data) >= offset+4 {
+		tag := string(data[offset : offset+4])
+		if tag == "Xing" || tag == "Info" {
+			return true
+		}
+	}
+	return len(data) >= 40 && string(data[36:40]) == "VBRI"
+}
+
+// layer3Bits возвращает число бит, потраченных на звук в кадре слоя 3 (сумма part2_3_length)
+func layer3Bits(h mp3Header, data []byte) int {
+	offset := 4
+	if h.crc {
+		offset += 2
+	}
+	if len(data) < offset+h.sideInfoLen() {
+		return 0
+	}
+	bits := bitReader{data: data[offset : offset+h.sideInfoLen()]}
+
+	channels := 2
+	if h.mono {
+		channels = 1
+	}
+
+	granules, granuleBits := 1, 63 // Поля гранулы канала после part2_3_length
+	if h.version == 0 {
+		granules, granuleBits = 2, 59
+		bits.skip(9)
+		if h.mono {
+			bits.skip(5 + 4)
+		} else {
+			bits.skip(3 + 8)
+		}
+	} else {
+		bits.skip(8)
+		bits.skip(channels)
+	}
+
+	total := 0
+	for g := 0; g < granules; g++ {
+		for ch := 0; ch < channels; ch++ {
+			total += bits.read(12)
+			bits.skip(granuleBits - 12)
+		}
+	}
+	return total
+}
+
+// bitReader читает биты от старшего к младшему
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (b *bitReader) read(n int) int {
+	value := 0
+	for i := 0; i < n; i++ {
+		byteIndex := b.pos >> 3
+		if byteIndex >= len(b.data) {
+			return value
+		}
+		bit := (b.data[byteIndex] >> (7 - uint(b.pos&7))) & 1
+		value = value<<1 | int(bit)
+		b.pos++
+	}
+	return value
+}
+
+func (b *bitReader) skip(n int) {
+	b.pos += n
+}
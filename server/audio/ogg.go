@@ -0,0 +1,136 @@
+package audio
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// analyzeOgg читает страницы Ogg первого логического потока. Длительность берется
+// из позиции последней страницы, время пакетов распределяется внутри страницы равномерно.
+func analyzeOgg(r *bufio.Reader) (time.Duration, []frame, error) {
+	var (
+		serial      uint32
+		started     bool
+		rate        int64
+		preSkip     int64
+		headers     = 1 // Число служебных пакетов, известно после разбора первого
+		packetIndex int
+		packetSize  int
+		ident       []byte
+		pending     []int // Размеры аудиопакетов, время которых еще не известно
+		prevGranule int64
+		lastGranule int64
+		frames      []frame
+	)
+
+	header := make([]byte, 27)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if started && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+				break
+			}
+			return 0, nil, err
+		}
+		if !bytes.Equal(header[:4], []byte("OggS")) {
+			return 0, nil, errors.New("повреждена страница Ogg")
+		}
+
+		granule := int64(binary.LittleEndian.Uint64(header[6:14]))
+		pageSerial := binary.LittleEndian.Uint32(header[14:18])
+
+		segments := make([]byte, header[26])
+		if _, err := io.ReadFull(r, segments); err != nil {
+			return 0, nil, err
+		}
+		bodyLen := 0
+		for _, lace := range segments {
+			bodyLen += int(lace)
+		}
+
+		if started && pageSerial != serial {
+			// Другие логические потоки (например, обложка) пропускаются
+			if _, err := r.Discard(bodyLen); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		if !started {
+			serial, started = pageSerial, true
+		}
+
+		body := make([]byte, bodyLen)
+		if _, err := io.ReadFull(r, body); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				break
+			}
+			return 0, nil, err
+		}
+
+		pos := 0
+		for _, lace := range segments {
+			if packetIndex == 0 {
+				ident = append(ident, body[pos:pos+int(lace)]...)
+			}
+			pos += int(lace)
+			packetSize += int(lace)
+			if lace == 255 {
+				continue // Пакет продолжается в следующем сегменте
+			}
+
+			if packetIndex == 0 {
+				var err error
+				if rate, preSkip, headers, err = parseOggIdent(ident); err != nil {
+					return 0, nil, err
+				}
+			} else if packetIndex >= headers {
+				pending = append(pending, packetSize)
+			}
+			packetIndex++
+			packetSize = 0
+		}
+
+		// Позиция -1 означает, что на странице не завершился ни один пакет
+		if granule == -1 || packetIndex <= headers {
+			continue
+		}
+		for i, size := range pending {
+			at := prevGranule + (granule-prevGranule)*int64(i)/int64(len(pending)) - preSkip
+			if at < 0 {
+				at = 0
+			}
+			frames = append(frames, frame{at: time.Duration(at * int64(time.Second) / rate), weight: size})
+		}
+		pending = pending[:0]
+		prevGranule, lastGranule = granule, granule
+	}
+
+	if rate == 0 {
+		return 0, nil, ErrUnsupported
+	}
+	samples := lastGranule - preSkip
+	if samples < 0 {
+		samples = 0
+	}
+	return time.Duration(samples * int64(time.Second) / rate), frames, nil
+}
+
+// parseOggIdent разбирает первый пакет потока: частоту, число сэмплов кодека
+// в начале записи и число служебных пакетов перед звуком
+func parseOggIdent(packet []byte) (rate, preSkip int64, headers int, err error) {
+	switch {
+	case len(packet) >= 19 && bytes.HasPrefix(packet, []byte("OpusHead")):
+		// Позиция в потоке Opus всегда отсчитывается в сэмплах 48 кГц
+		return 48000, int64(binary.LittleEndian.Uint16(packet[10:12])), 2, nil
+	case len(packet) >= 30 && bytes.HasPrefix(packet, []byte("\x01vorbis")):
+		rate = int64(binary.LittleEndian.Uint32(packet[12:16]))
+		if rate == 0 {
+			return 0, 0, 0, ErrUnsupported
+		}
+		return rate, 0, 3, nil
+	}
+	return 0, 0, 0, ErrUnsupported
+}
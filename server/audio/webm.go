@@ -0,0 +1,250 @@
+package audio
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"time"
+)
+
+// Идентификаторы элементов Matroska, которые нужны для разбора
+const (
+	ebmlSegment       = 0x18538067
+	ebmlInfo          = 0x1549A966
+	ebmlTimecodeScale = 0x2AD7B1
+	ebmlDuration      = 0x4489
+	ebmlCluster       = 0x1F43B675
+	ebmlTimecode      = 0xE7
+	ebmlBlockGroup    = 0xA0
+	ebmlTracks        = 0x1654AE6B
+	ebmlTrackEntry    = 0xAE
+	ebmlTrackNumber   = 0xD7
+	ebmlTrackType     = 0x83
+	ebmlBlock         = 0xA1
+	ebmlSimpleBlock   = 0xA3
+)
+
+// Тип звуковой дорожки
+const ebmlTrackAudio = 2
+
+// Максимальный размер элемента, значение которого читается целиком
+const ebmlMaxValueSize = 8
+
+// analyzeWebM читает элементы Matroska последовательно, не соблюдая вложенность:
+// в контейнеры (сегмент, кластер) просто заходим. Так обрабатываются и записи
+// MediaRecorder, у которых размер сегмента и кластеров не указан.
+func analyzeWebM(r *bufio.Reader) (time.Duration, []frame, error) {
+	var (
+		scale       uint64 = 1000000 // Единица времени в наносекундах
+		duration    float64
+		cluster     uint64
+		track       uint64 // Звуковая дорожка, блоки других дорожек пропускаются
+		entryNumber uint64
+		entryType   uint64
+		frames      []frame
+		last, prior time.Duration
+	)
+
+	// Обрезанный конец файла не считается ошибкой: учитываем то, что успели прочитать
+loop:
+	for {
+		id, err := readEBMLID(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return 0, nil, err
+		}
+		size, unknown, err := readEBMLSize(r)
+		if err != nil {
+			break
+		}
+
+		switch id {
+		case ebmlSegment, ebmlInfo, ebmlCluster, ebmlBlockGroup, ebmlTracks:
+			continue
+		case ebmlTrackEntry:
+			entryNumber, entryType = 0, 0
+			continue
+		}
+		if unknown {
+			return 0, nil, errors.New("элемент WebM без размера")
+		}
+
+		switch id {
+		case ebmlTimecodeScale, ebmlTimecode:
+			value, err := readEBMLUint(r, size)
+			if err != nil {
+				return 0, nil, err
+			}
+			if id == ebmlTimecode {
+				cluster = value
+			} else if value > 0 {
+				scale = value
+			}
+
+		case ebmlTrackNumber, ebmlTrackType:
+			value, err := readEBMLUint(r, size)
+			if err != nil {
+				return 0, nil, err
+			}
+			if id == ebmlTrackNumber {
+				entryNumber = value
+			} else {
+				entryType = value
+			}
+			if track == 0 && entryNumber != 0 && entryType == ebmlTrackAudio {
+				track = entryNumber
+			}
+
+		case ebmlDuration:
+			if duration, err = readEBMLFloat(r, size); err != nil {
+				return 0, nil, err
+			}
+
+		case ebmlSimpleBlock, ebmlBlock:
+			trackNumber, n, err := readEBMLVint(r)
+			if err != nil {
+				break loop
+			}
+			var rel [2]byte
+			if _, err := io.ReadFull(r, rel[:]); err != nil {
+				break loop
+			}
+			rest := int(size) - n - 2
+			if rest < 0 {
+				return 0, nil, errors.New("поврежден блок WebM")
+			}
+			if _, err := r.Discard(rest); err != nil {
+				break loop
+			}
+
+			// Если описания дорожек нет, учитывается первая встреченная
+			if track == 0 {
+				track = trackNumber
+			}
+			if trackNumber != track {
+				continue
+			}
+			timecode := int64(cluster) + int64(int16(binary.BigEndian.Uint16(rel[:])))
+			if timecode < 0 {
+				timecode = 0
+			}
+			at := time.Duration(uint64(timecode) * scale)
+			frames = append(frames, frame{at: at, weight: rest - 1}) // Без байта флагов
+			if at > last {
+				prior, last = last, at
+			}
+
+		default:
+			if _, err := r.Discard(int(size)); err != nil {
+				break loop
+			}
+		}
+	}
+
+	if duration > 0 {
+		return time.Duration(duration * float64(scale)), frames, nil
+	}
+	// Длительность не записана: время последнего блока плюс длина одного блока
+	if len(frames) == 0 {
+		return 0, nil, ErrUnsupported
+	}
+	return last + (last - prior), frames, nil
+}
+
+// readEBMLID читает идентификатор элемента вместе с битами длины
+func readEBMLID(r *bufio.Reader) (uint32, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	length := bitsLen(first)
+	if length == 0 || length > 4 {
+		return 0, errors.New("некорректный идентификатор элемента WebM")
+	}
+
+	id := uint32(first)
+	for i := 1; i < length; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		id = id<<8 | uint32(b)
+	}
+	return id, nil
+}
+
+// readEBMLSize читает размер элемента. unknown - размер не указан (все биты значения единицы).
+func readEBMLSize(r *bufio.Reader) (size uint64, unknown bool, err error) {
+	size, length, err := readEBMLVint(r)
+	if err != nil {
+		return 0, false, err
+	}
+	return size, size == 1<<(7*uint(length))-1, nil
+}
+
+// readEBMLVint читает целое переменной длины без бита длины
+func readEBMLVint(r *bufio.Reader) (uint64, int, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	length := bitsLen(first)
+	if length == 0 {
+		return 0, 0, errors.New("некорректное число WebM")
+	}
+
+	value := uint64(first) & (0xFF >> uint(length))
+	for i := 1; i < length; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, err
+		}
+		value = value<<8 | uint64(b)
+	}
+	return value, length, nil
+}
+
+// bitsLen возвращает длину числа переменной длины по первому байту
+func bitsLen(first byte) int {
+	for i := 0; i < 8; i++ {
+		if first&(0x80>>uint(i)) != 0 {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func readEBMLUint(r *bufio.Reader, size uint64) (uint64, error) {
+	if size > ebmlMaxValueSize {
+		return 0, errors.New("некорректный размер числа WebM")
+	}
+	var value uint64
+	for i := uint64(0); i < size; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		value = value<<8 | uint64(b)
+	}
+	return value, nil
+}
+
+func readEBMLFloat(r *bufio.Reader, size uint64) (float64, error) {
+	switch size {
+	case 4, 8:
+	default:
+		return 0, errors.New("некорректный размер числа WebM")
+	}
+	bits, err := readEBMLUint(r, size)
+	if err != nil {
+		return 0, err
+	}
+	if size == 4 {
+		return float64(math.Float32frombits(uint32(bits))), nil
+	}
+	return math.Float64frombits(bits), nil
+}
@@ -48,6 +48,13 @@ type Config struct {
 		MaxSizeMB        int    `json:"max_size_mb" validate:"required,min=1,max=1000"`
 		AllowedMimeTypes string `json:"allowed_mime_types" validate:"required"`
 	} `json:"file_storage"`
+
+	LinkPreview struct {
+		Enabled         bool `json:"enabled"`
+		TimeoutSeconds  int  `json:"timeout_seconds" validate:"min=0,max=30"`
+		MaxBodyKB       int  `json:"max_body_kb" validate:"min=0,max=4096"`
+		CacheTTLMinutes int  `json:"cache_ttl_minutes" validate:"min=0,max=1440"`
+	} `json:"link_preview"`
 }
 
 func Load() (*Config, error) {
@@ -129,6 +136,10 @@ func Load() (*Config, error) {
 		config.Redis.Enabled = os.Getenv("REDIS_ENABLED") == "true"
 	}
 
+	if os.Getenv("LINK_PREVIEW_ENABLED") != "" {
+		config.LinkPreview.Enabled = os.Getenv("LINK_PREVIEW_ENABLED") == "true"
+	}
+
 	// Устанавливаем значения по умолчанию для файлового хранилища, если не заданы
 	if config.FileStorage.Path == "" {
 		config.FileStorage.Path = "./uploads"
@@ -142,6 +153,19 @@ func Load() (*Config, error) {
 		config.FileStorage.AllowedMimeTypes = "image/jpeg,image/png,image/gif,application/pdf,audio/mpeg,video/mp4"
 	}
 
+	// Значения по умолчанию для предпросмотра ссылок
+	if config.LinkPreview.TimeoutSeconds == 0 {
+		config.LinkPreview.TimeoutSeconds = 5
+	}
+
+	if config.LinkPreview.MaxBodyKB == 0 {
+		config.LinkPreview.MaxBodyKB = 512
+	}
+
+	if config.LinkPreview.CacheTTLMinutes == 0 {
+		config.LinkPreview.CacheTTLMinutes = 30
+	}
+
 	// Валидация конфигурации
 	validate := validator.New()
 	if err := validate.Struct(config); err != nil {
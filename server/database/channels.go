@@ -0,0 +1,68 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"messenger/models"
+)
+
+// MarkChannelRead сдвигает курсор прочтения подписчика канала и засчитывает просмотр
+// постам, которые он прочитал впервые. Курсор только растет, поэтому каждый подписчик
+// увеличивает счетчик поста не больше одного раза.
+// Возвращает true, если курсор прочтения действительно сдвинулся.
+func (db *Database) MarkChannelRead(chatID, userID uint, seq uint64) (bool, error) {
+	advanced := false
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		var member models.ChatUser
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("chat_id = ? AND user_id = ?", chatID, userID).
+			First(&member).Error; err != nil {
+			return err
+		}
+
+		seq, err := clampToLastSeq(tx, chatID, seq)
+		if err != nil {
+			return err
+		}
+		if seq <= member.LastReadSeq {
+			return nil
+		}
+
+		now := time.Now()
+		updates := map[string]interface{}{
+			"last_read_seq": seq,
+			"last_read_at":  now,
+		}
+		if seq > member.LastDeliveredSeq {
+			updates["last_delivered_seq"] = seq
+			updates["last_delivered_at"] = now
+		}
+		if err := tx.Model(&models.ChatUser{}).
+			Where("chat_id = ? AND user_id = ?", chatID, userID).
+			Updates(updates).Error; err != nil {
+			return err
+		}
+		advanced = true
+
+		if err := refreshUnreadCount(tx, chatID, userID); err != nil {
+			return err
+		}
+		return tx.Model(&models.Message{}).
+			Where("chat_id = ? AND seq > ? AND seq <= ? AND user_id != ? AND type != ?",
+				chatID, member.LastReadSeq, seq, userID, models.MessageTypeSystem).
+			UpdateColumn("views", gorm.Expr("views + 1")).Error
+	})
+	return advanced, err
+}
+
+// GetChatType возвращает тип чата
+func (db *Database) GetChatType(chatID uint) (string, error) {
+	var chat models.Chat
+	if err := db.DB.Unscoped().Select("type").First(&chat, chatID).Error; err != nil {
+		return "", err
+	}
+	return chat.Type, nil
+}
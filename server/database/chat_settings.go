@@ -0,0 +1,169 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"messenger/models"
+)
+
+// MaxPinnedChats - сколько чатов пользователь может закрепить
+const MaxPinnedChats = 10
+
+// ErrTooManyPinnedChats возвращается при попытке закрепить больше MaxPinnedChats чатов
+var ErrTooManyPinnedChats = errors.New("закреплено слишком много чатов")
+
+// ChatSettingsUpdate - изменение личных настроек чата. Поля со значением nil не меняются.
+type ChatSettingsUpdate struct {
+	Archived   *bool
+	Pinned     *bool
+	Folder     *string
+	SetMute    bool       // Менять ли MutedUntil
+	MutedUntil *time.Time // nil - уведомления включены
+}
+
+// ChatFolder - папка пользователя с числом чатов в ней
+type ChatFolder struct {
+	Name       string `json:"name"`
+	ChatsCount int64  `json:"chats_count"`
+}
+
+// lockPinnedChats блокирует строку пользователя до конца транзакции tx. Закрепленные
+// чаты пользователя меняются только под этой блокировкой, поэтому одновременные
+// закрепления не превысят MaxPinnedChats и не получат одинаковый порядок.
+// Блокировка берется до строк chat_users, чтобы порядок блокировок был общим.
+func lockPinnedChats(tx *gorm.DB, userID uint) error {
+	var user models.User
+	return tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Select("id").
+		Take(&user, userID).Error
+}
+
+// UpdateChatSettings меняет личные настройки участника чата и возвращает их новое состояние.
+// Закрепленный чат ставится последним среди закрепленных, а при откреплении
+// следующие за ним чаты сдвигаются, чтобы порядок оставался непрерывным.
+func (db *Database) UpdateChatSettings(chatID, userID uint, update ChatSettingsUpdate) (*models.ChatUser, error) {
+	var member models.ChatUser
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if update.Pinned != nil {
+			if err := lockPinnedChats(tx, userID); err != nil {
+				return err
+			}
+		}
+
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("chat_id = ? AND user_id = ?", chatID, userID).
+			First(&member).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotChatMember
+		}
+		if err != nil {
+			return err
+		}
+
+		columns := map[string]interface{}{}
+		if update.Archived != nil {
+			columns["archived"] = *update.Archived
+		}
+		if update.Folder != nil {
+			columns["folder"] = *update.Folder
+		}
+		if update.SetMute {
+			columns["muted_until"] = update.MutedUntil
+		}
+		if update.Pinned != nil && *update.Pinned && member.PinOrder == 0 {
+			var pinned struct {
+				Count    int64
+				MaxOrder int
+			}
+			if err := tx.Model(&models.ChatUser{}).
+				Select("COUNT(*) AS count, COALESCE(MAX(pin_order), 0) AS max_order").
+				Where("user_id = ? AND pin_order > 0", userID).
+				Scan(&pinned).Error; err != nil {
+				return err
+			}
+			if pinned.Count >= MaxPinnedChats {
+				return ErrTooManyPinnedChats
+			}
+			columns["pin_order"] = pinned.MaxOrder + 1
+		}
+		if update.Pinned != nil && !*update.Pinned && member.PinOrder > 0 {
+			if err := tx.Model(&models.ChatUser{}).
+				Where("user_id = ? AND pin_order > ?", userID, member.PinOrder).
+				UpdateColumn("pin_order", gorm.Expr("pin_order - 1")).Error; err != nil {
+				return err
+			}
+			columns["pin_order"] = 0
+		}
+		if len(columns) == 0 {
+			return nil
+		}
+
+		if err := tx.Model(&models.ChatUser{}).
+			Where("chat_id = ? AND user_id = ?", chatID, userID).
+			UpdateColumns(columns).Error; err != nil {
+			return err
+		}
+		return tx.Where("chat_id = ? AND user_id = ?", chatID, userID).First(&member).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+// SetPinnedChats заменяет список закрепленных чатов пользователя: чаты закрепляются
+// в переданном порядке, остальные открепляются. Все чаты должны быть чатами пользователя.
+func (db *Database) SetPinnedChats(userID uint, chatIDs []uint) error {
+	if len(chatIDs) > MaxPinnedChats {
+		return ErrTooManyPinnedChats
+	}
+
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := lockPinnedChats(tx, userID); err != nil {
+			return err
+		}
+
+		if len(chatIDs) > 0 {
+			var count int64
+			if err := tx.Model(&models.ChatUser{}).
+				Where("user_id = ? AND chat_id IN ?", userID, chatIDs).
+				Count(&count).Error; err != nil {
+				return err
+			}
+			if count != int64(len(chatIDs)) {
+				return ErrNotChatMember
+			}
+		}
+
+		if err := tx.Model(&models.ChatUser{}).
+			Where("user_id = ? AND pin_order > 0", userID).
+			UpdateColumn("pin_order", 0).Error; err != nil {
+			return err
+		}
+		for i, chatID := range chatIDs {
+			if err := tx.Model(&models.ChatUser{}).
+				Where("chat_id = ? AND user_id = ?", chatID, userID).
+				UpdateColumn("pin_order", i+1).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetChatFolders возвращает папки пользователя в алфавитном порядке
+func (db *Database) GetChatFolders(userID uint) ([]ChatFolder, error) {
+	var folders []ChatFolder
+	err := db.DB.Table("chat_users").
+		Select("chat_users.folder AS name, COUNT(*) AS chats_count").
+		Joins("JOIN chats ON chats.id = chat_users.chat_id AND chats.deleted_at IS NULL").
+		Where("chat_users.user_id = ? AND chat_users.folder != ''", userID).
+		Group("chat_users.folder").
+		Order("chat_users.folder").
+		Scan(&folders).Error
+	return folders, err
+}
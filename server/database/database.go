@@ -3,6 +3,8 @@ package database
 import (
 	"time"
 
+	"gorm.io/gorm"
+
 	"messenger/models"
 )
 
@@ -62,14 +64,22 @@ func (db *Database) GetChatUsers(chatID uint) ([]models.User, error) {
 	return users, nil
 }
 
-// GetChatMessages возвращает сообщения чата
-func (db *Database) GetChatMessages(chatID uint, limit int) ([]models.Message, error) {
+// GetChatMessages возвращает последние сообщения общей ленты чата: сообщения тем
+// в нее не входят, см. GetTopicMessages. Если since не nil, возвращаются только
+// сообщения, отправленные не раньше него.
+func (db *Database) GetChatMessages(chatID uint, since *time.Time, limit int) ([]models.Message, error) {
 	var messages []models.Message
 
 	// Получаем сообщения с данными отправителя
-	result := db.DB.Preload("User").
-		Where("chat_id = ?", chatID).
-		Order("created_at DESC").
+	query := db.DB.Preload("User").
+		Preload("File").
+		Preload("Poll.Options", func(tx *gorm.DB) *gorm.DB { return tx.Order("position") }).
+		Where("chat_id = ? AND topic_id IS NULL", chatID)
+	if since != nil {
+		query = query.Where("created_at >= ?", *since)
+	}
+	result := query.
+		Order("seq DESC").
 		Limit(limit).
 		Find(&messages)
 
@@ -85,10 +95,74 @@ func (db *Database) GetChatMessages(chatID uint, limit int) ([]models.Message, e
 	return messages, nil
 }
 
-// CreateMessage создает новое сообщение
+// CreateMessage создает новое сообщение и присваивает ему очередной порядковый номер в чате.
+// В той же транзакции обновляется время активности чата, а курсоры отправителя
+// сдвигаются на новое сообщение: свое сообщение считается доставленным и прочитанным.
+// Прикрепленный файл привязывается к сообщению; уже привязанный файл дает ErrFileUnavailable.
 func (db *Database) CreateMessage(message *models.Message) error {
-	result := db.DB.Create(message)
-	return result.Error
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+
+		var seq uint64
+		if err := tx.Raw("UPDATE chats SET last_seq = last_seq + 1, last_activity = ? WHERE id = ? AND deleted_at IS NULL RETURNING last_seq",
+			now, message.ChatID).Scan(&seq).Error; err != nil {
+			return err
+		}
+		if seq == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		message.Seq = seq
+		if err := tx.Create(message).Error; err != nil {
+			return err
+		}
+
+		// Файл может принадлежать только одному сообщению. Изображения чатов к сообщениям не прикрепляются.
+		if message.FileID != nil {
+			result := tx.Model(&models.File{}).
+				Where("id = ? AND message_id = 0", *message.FileID).
+				Where("NOT EXISTS (SELECT 1 FROM chats WHERE chats.avatar_file_id = files.id)").
+				UpdateColumn("message_id", message.ID)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return ErrFileUnavailable
+			}
+		}
+
+		if err := tx.Model(&models.Chat{}).Where("id = ?", message.ChatID).
+			UpdateColumn("last_message_id", message.ID).Error; err != nil {
+			return err
+		}
+
+		// Для остальных участников сообщение непрочитанное. Служебные сообщения не считаются,
+		// сообщения тем учитываются курсорами прочтения тем.
+		if message.Type != string(models.MessageTypeSystem) && message.TopicID == nil {
+			if err := tx.Model(&models.ChatUser{}).
+				Where("chat_id = ? AND user_id != ?", message.ChatID, message.UserID).
+				UpdateColumn("unread_count", gorm.Expr("unread_count + 1")).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Model(&models.ChatUser{}).
+			Where("chat_id = ? AND user_id = ?", message.ChatID, message.UserID).
+			Updates(map[string]interface{}{
+				"last_delivered_seq": gorm.Expr("GREATEST(last_delivered_seq, ?)", seq),
+				"last_delivered_at":  now,
+				"last_read_seq":      gorm.Expr("GREATEST(last_read_seq, ?)", seq),
+				"last_read_at":       now,
+				"unread_count":       0,
+			}).Error
+	})
+}
+
+// SetMessagePreview сохраняет шифрованный предпросмотр ссылки сообщения
+func (db *Database) SetMessagePreview(messageID uint, preview []byte) error {
+	return db.DB.Model(&models.Message{}).
+		Where("id = ?", messageID).
+		UpdateColumn("preview", preview).Error
 }
 
 // UpdateChat обновляет информацию о чате
@@ -107,6 +181,23 @@ func (db *Database) GetUserByID(userID uint) (*models.User, error) {
 	return &user, nil
 }
 
+// GetMessagesByIDs возвращает сообщения с авторами по списку ID
+func (db *Database) GetMessagesByIDs(messageIDs []uint) (map[uint]*models.Message, error) {
+	result := make(map[uint]*models.Message, len(messageIDs))
+	if len(messageIDs) == 0 {
+		return result, nil
+	}
+
+	var messages []models.Message
+	if err := db.DB.Preload("User").Where("id IN ?", messageIDs).Find(&messages).Error; err != nil {
+		return nil, err
+	}
+	for i := range messages {
+		result[messages[i].ID] = &messages[i]
+	}
+	return result, nil
+}
+
 // GetMessageByID возвращает сообщение по ID
 func (db *Database) GetMessageByID(messageID uint) (*models.Message, error) {
 	var message models.Message
@@ -117,23 +208,38 @@ func (db *Database) GetMessageByID(messageID uint) (*models.Message, error) {
 	return &message, nil
 }
 
-// MarkMessageAsRead отмечает сообщение как прочитанное
-func (db *Database) MarkMessageAsRead(messageID, userID uint) error {
-	// Проверяем, существует ли запись о прочтении
-	var count int64
-	db.DB.Model(&models.MessageRead{}).
-		Where("message_id = ? AND user_id = ?", messageID, userID).
-		Count(&count)
+// lastMessageIDExpr находит последнее неудаленное сообщение чата
+const lastMessageIDExpr = `(SELECT id FROM messages
+	WHERE messages.chat_id = chats.id AND messages.deleted_at IS NULL
+	ORDER BY messages.seq DESC LIMIT 1)`
+
+// DeleteMessage удаляет сообщение. Трансляция местоположения из удаленного
+// сообщения останавливается, счетчики непрочитанных и последнее сообщение чата обновляются.
+func (db *Database) DeleteMessage(messageID uint) error {
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		var message models.Message
+		if err := tx.Select("id", "chat_id", "user_id", "seq", "type", "topic_id").First(&message, messageID).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&models.Message{}, messageID).Error; err != nil {
+			return err
+		}
 
-	// Если записи нет, создаем новую
-	if count == 0 {
-		read := models.MessageRead{
-			MessageID: messageID,
-			UserID:    userID,
-			ReadAt:    time.Now(),
+		if message.Type != string(models.MessageTypeSystem) && message.TopicID == nil {
+			if err := tx.Model(&models.ChatUser{}).
+				Where("chat_id = ? AND user_id != ? AND last_read_seq < ? AND unread_count > 0", message.ChatID, message.UserID, message.Seq).
+				UpdateColumn("unread_count", gorm.Expr("unread_count - 1")).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Model(&models.Chat{}).
+			Where("id = ? AND last_message_id = ?", message.ChatID, messageID).
+			UpdateColumn("last_message_id", gorm.Expr(lastMessageIDExpr)).Error; err != nil {
+			return err
 		}
-		return db.DB.Create(&read).Error
-	}
 
-	return nil
+		return tx.Model(&models.LiveLocation{}).
+			Where("message_id = ? AND stopped_at IS NULL", messageID).
+			UpdateColumn("stopped_at", time.Now()).Error
+	})
 }
@@ -117,12 +117,32 @@ func NewDatabase(cfg *config.Config) (*Database, error) {
 		&models.ChatUser{},
 		&models.Message{},
 		&models.File{},
-		&models.DirectMessage{},
+		&models.Poll{},
+		&models.PollOption{},
+		&models.PollVote{},
+		&models.SavedMessage{},
+		&models.ExportJob{},
+		&models.ImportedChat{},
+		&models.ImportedMessage{},
+		&models.Reminder{},
+		&models.VoiceListen{},
+		&models.LiveLocation{},
+		&models.ChatInvite{},
+		&models.ChatInviteUse{},
+		&models.ChatJoinRequest{},
+		&models.ChatTopic{},
+		&models.ChatTopicRead{},
+		&models.ChatRestriction{},
 	)
 	if err != nil {
 		return nil, fmt.Errorf("ошибка миграции: %w", err)
 	}
 
+	// Миграции данных, которые не покрываются AutoMigrate
+	if err := runDataMigrations(db); err != nil {
+		return nil, fmt.Errorf("ошибка миграции данных: %w", err)
+	}
+
 	// Проверка миграции
 	var count int64
 	result := db.Model(&models.User{}).Count(&count)
@@ -156,6 +176,13 @@ func (db *Database) Reset() error {
 		return err
 	}
 
+	// Закладки, опросы и прослушивания ссылаются на сообщения, напоминания и приглашения - на пользователей: удаляются раньше них
+	for _, table := range []string{"saved_messages", "poll_votes", "poll_options", "polls", "voice_listens", "live_locations", "reminders", "chat_join_requests", "chat_invite_uses", "chat_invites", "chat_topic_reads", "chat_topics", "chat_restrictions"} {
+		if err := db.DB.Exec("DELETE FROM " + table).Error; err != nil {
+			return err
+		}
+	}
+
 	if err := db.DB.Exec("DELETE FROM messages").Error; err != nil {
 		return err
 	}
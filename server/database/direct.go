@@ -0,0 +1,111 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"messenger/models"
+)
+
+// FindDirectChat возвращает личный чат между двумя пользователями
+func (db *Database) FindDirectChat(userA, userB uint) (*models.Chat, error) {
+	chatID, err := findDirectChatID(db.DB, userA, userB)
+	if err != nil {
+		return nil, err
+	}
+	return db.GetChatByID(chatID)
+}
+
+// GetOrCreateDirectChat возвращает личный чат между двумя пользователями, создавая его при необходимости
+func (db *Database) GetOrCreateDirectChat(userA, userB uint) (*models.Chat, error) {
+	chat, _, err := db.FindOrCreateDirectChat(userA, userB)
+	return chat, err
+}
+
+// FindOrCreateDirectChat возвращает личный чат между двумя пользователями, создавая его
+// при необходимости. created сообщает, что чат был создан этим вызовом.
+func (db *Database) FindOrCreateDirectChat(userA, userB uint) (chat *models.Chat, created bool, err error) {
+	var chatID uint
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		id, err := findDirectChatID(tx, userA, userB)
+		if err == gorm.ErrRecordNotFound {
+			id, err = createDirectChat(tx, userA, userB, time.Now())
+			created = err == nil && id != 0
+		}
+		if err == nil && id == 0 {
+			// Чат этой пары одновременно создал параллельный запрос
+			id, err = findDirectChatID(tx, userA, userB)
+		}
+		chatID = id
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	chat, err = db.GetChatByID(chatID)
+	return chat, created, err
+}
+
+// findDirectChatID ищет личный чат пары пользователей по ключу пары
+func findDirectChatID(tx *gorm.DB, userA, userB uint) (uint, error) {
+	var chatIDs []uint
+	err := tx.Model(&models.Chat{}).
+		Where("direct_key = ?", models.DirectChatKey(userA, userB)).
+		Limit(1).
+		Pluck("id", &chatIDs).Error
+	if err != nil {
+		return 0, err
+	}
+	if len(chatIDs) == 0 {
+		return 0, gorm.ErrRecordNotFound
+	}
+	return chatIDs[0], nil
+}
+
+// findDirectChatIDByMembers ищет личный чат, в котором состоят оба пользователя.
+// Нужен миграциям, которые выполняются до заполнения ключей пар.
+func findDirectChatIDByMembers(tx *gorm.DB, userA, userB uint) (uint, error) {
+	var chatIDs []uint
+	err := tx.Table("chats").
+		Select("chats.id").
+		Joins("JOIN chat_users a ON a.chat_id = chats.id AND a.user_id = ?", userA).
+		Joins("JOIN chat_users b ON b.chat_id = chats.id AND b.user_id = ?", userB).
+		Where("chats.type = ? AND chats.deleted_at IS NULL", models.ChatTypeDirect).
+		Order("chats.id").
+		Limit(1).
+		Pluck("chats.id", &chatIDs).Error
+	if err != nil {
+		return 0, err
+	}
+	if len(chatIDs) == 0 {
+		return 0, gorm.ErrRecordNotFound
+	}
+	return chatIDs[0], nil
+}
+
+// createDirectChat создает личный чат двух пользователей. Если чат этой пары уже
+// существует, ничего не создает и возвращает 0.
+func createDirectChat(tx *gorm.DB, userA, userB uint, createdAt time.Time) (uint, error) {
+	key := models.DirectChatKey(userA, userB)
+	chat := models.Chat{
+		Type:         models.ChatTypeDirect,
+		DirectKey:    &key,
+		CreatedAt:    createdAt,
+		LastActivity: createdAt,
+	}
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&chat)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return 0, result.Error
+	}
+
+	members := []models.ChatUser{
+		{ChatID: chat.ID, UserID: userA, JoinedAt: createdAt},
+		{ChatID: chat.ID, UserID: userB, JoinedAt: createdAt},
+	}
+	if err := tx.Create(&members).Error; err != nil {
+		return 0, err
+	}
+	return chat.ID, nil
+}
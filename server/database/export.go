@@ -0,0 +1,69 @@
+package database
+
+import (
+	"time"
+
+	"messenger/models"
+)
+
+// GetMessagesAfterSeq возвращает до limit сообщений чата с номером больше afterSeq по возрастанию.
+// Используется для постраничного обхода истории без загрузки ее целиком.
+// Если since не nil, возвращаются только сообщения, отправленные не раньше него.
+func (db *Database) GetMessagesAfterSeq(chatID uint, afterSeq uint64, since *time.Time, limit int) ([]models.Message, error) {
+	var messages []models.Message
+	query := db.DB.Preload("User").
+		Preload("File").
+		Where("chat_id = ? AND seq > ?", chatID, afterSeq)
+	if since != nil {
+		query = query.Where("created_at >= ?", *since)
+	}
+	result := query.
+		Order("seq").
+		Limit(limit).
+		Find(&messages)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return messages, nil
+}
+
+// CreateExportJob сохраняет новую фоновую выгрузку
+func (db *Database) CreateExportJob(job *models.ExportJob) error {
+	return db.DB.Create(job).Error
+}
+
+// GetExportJob возвращает фоновую выгрузку по ID
+func (db *Database) GetExportJob(jobID uint) (*models.ExportJob, error) {
+	var job models.ExportJob
+	result := db.DB.First(&job, jobID)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &job, nil
+}
+
+// UpdateExportJob сохраняет состояние фоновой выгрузки
+func (db *Database) UpdateExportJob(job *models.ExportJob) error {
+	return db.DB.Save(job).Error
+}
+
+// FailInterruptedExportJobs помечает выгрузки, прерванные перезапуском сервера, как неудавшиеся
+func (db *Database) FailInterruptedExportJobs() error {
+	return db.DB.Model(&models.ExportJob{}).
+		Where("status IN ?", []string{models.ExportStatusPending, models.ExportStatusRunning}).
+		Updates(map[string]interface{}{
+			"status":      models.ExportStatusFailed,
+			"error":       "Выгрузка прервана перезапуском сервера",
+			"finished_at": time.Now(),
+		}).Error
+}
+
+// GetExpiredExportJobs возвращает завершенные выгрузки с истекшим сроком хранения
+func (db *Database) GetExpiredExportJobs(now time.Time) ([]models.ExportJob, error) {
+	var jobs []models.ExportJob
+	result := db.DB.Where("expires_at IS NOT NULL AND expires_at < ? AND file_path != ''", now).Find(&jobs)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return jobs, nil
+}
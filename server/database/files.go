@@ -0,0 +1,30 @@
+package database
+
+import (
+	"errors"
+
+	"messenger/models"
+)
+
+// ErrFileUnavailable возвращается при попытке прикрепить файл, который уже принадлежит другому сообщению
+var ErrFileUnavailable = errors.New("файл уже прикреплен к другому сообщению")
+
+// GetFileByID возвращает информацию о файле по ID
+func (db *Database) GetFileByID(fileID uint) (*models.File, error) {
+	var file models.File
+	result := db.DB.First(&file, fileID)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &file, nil
+}
+
+// CreateFile сохраняет информацию о загруженном файле
+func (db *Database) CreateFile(file *models.File) error {
+	return db.DB.Create(file).Error
+}
+
+// DeleteFile удаляет информацию о файле
+func (db *Database) DeleteFile(fileID uint) error {
+	return db.DB.Delete(&models.File{}, fileID).Error
+}
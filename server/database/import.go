@@ -0,0 +1,203 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"messenger/models"
+)
+
+// GetImportedChat возвращает запись о ранее импортированном чате
+func (db *Database) GetImportedChat(source, externalID string) (*models.ImportedChat, error) {
+	var imported models.ImportedChat
+	result := db.DB.Where("source = ? AND external_id = ?", source, externalID).First(&imported)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &imported, nil
+}
+
+// GetImportedMessageIDs возвращает внешние ID уже импортированных сообщений чата
+func (db *Database) GetImportedMessageIDs(importedChatID uint) (map[int64]bool, error) {
+	var ids []int64
+	if err := db.DB.Model(&models.ImportedMessage{}).
+		Where("imported_chat_id = ?", importedChatID).
+		Pluck("external_id", &ids).Error; err != nil {
+		return nil, err
+	}
+
+	result := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		result[id] = true
+	}
+	return result, nil
+}
+
+// CreateImportedChat создает чат с участниками и запись о его внешнем источнике.
+// Если chat.ID уже задан, используется существующий чат.
+func (db *Database) CreateImportedChat(chat *models.Chat, members []models.ChatUser, imported *models.ImportedChat) error {
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		if chat.ID == 0 {
+			if err := tx.Create(chat).Error; err != nil {
+				return err
+			}
+		}
+		if err := addChatMembers(tx, chat.ID, members); err != nil {
+			return err
+		}
+
+		imported.ChatID = chat.ID
+		return tx.Create(imported).Error
+	})
+}
+
+// EnsureChatMembers добавляет в чат недостающих участников
+func (db *Database) EnsureChatMembers(chatID uint, members []models.ChatUser) error {
+	return addChatMembers(db.DB, chatID, members)
+}
+
+func addChatMembers(tx *gorm.DB, chatID uint, members []models.ChatUser) error {
+	if len(members) == 0 {
+		return nil
+	}
+	for i := range members {
+		members[i].ChatID = chatID
+	}
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&members).Error
+}
+
+// InsertImportedMessages добавляет импортированные сообщения в чат. Сообщения получают
+// очередные номера seq; если они старше уже имеющихся, сообщения чата перенумеровываются
+// по времени отправки. Файлы привязываются к сообщениям, а внешние ID запоминаются
+// для пропуска при повторном импорте.
+func (db *Database) InsertImportedMessages(importedChatID uint, messages []models.Message, externalIDs []int64) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		chatID := messages[0].ChatID
+
+		// Нумерация остается хронологической, только если пачка идет строго после имеющихся сообщений
+		var newest *time.Time
+		if err := tx.Raw("SELECT MAX(created_at) FROM messages WHERE chat_id = ?", chatID).Scan(&newest).Error; err != nil {
+			return err
+		}
+		renumber := false
+		lastActivity := messages[0].CreatedAt
+		for i, m := range messages {
+			if (i == 0 && newest != nil && m.CreatedAt.Before(*newest)) || (i > 0 && m.CreatedAt.Before(messages[i-1].CreatedAt)) {
+				renumber = true
+			}
+			if m.CreatedAt.After(lastActivity) {
+				lastActivity = m.CreatedAt
+			}
+		}
+
+		var lastSeq uint64
+		if err := tx.Raw("UPDATE chats SET last_seq = last_seq + ?, last_activity = GREATEST(last_activity, ?) WHERE id = ? AND deleted_at IS NULL RETURNING last_seq",
+			len(messages), lastActivity, chatID).Scan(&lastSeq).Error; err != nil {
+			return err
+		}
+		if lastSeq == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		firstSeq := lastSeq - uint64(len(messages)) + 1
+		for i := range messages {
+			message := &messages[i]
+			message.Seq = firstSeq + uint64(i)
+
+			// Файл создается вместе с сообщением как связанная запись
+			if err := tx.Create(message).Error; err != nil {
+				return err
+			}
+			if message.FileID != nil {
+				if err := tx.Model(&models.File{}).Where("id = ?", *message.FileID).
+					UpdateColumn("message_id", message.ID).Error; err != nil {
+					return err
+				}
+			}
+
+			if err := tx.Create(&models.ImportedMessage{
+				ImportedChatID: importedChatID,
+				ExternalID:     externalIDs[i],
+				MessageID:      message.ID,
+			}).Error; err != nil {
+				return err
+			}
+		}
+
+		if renumber {
+			if err := renumberChatMessages(tx, chatID); err != nil {
+				return err
+			}
+		}
+		if err := tx.Model(&models.Chat{}).Where("id = ?", chatID).
+			UpdateColumn("last_message_id", gorm.Expr(lastMessageIDExpr)).Error; err != nil {
+			return err
+		}
+		if err := refreshUnreadCount(tx, chatID, 0); err != nil {
+			return err
+		}
+
+		return tx.Model(&models.ImportedChat{}).Where("id = ?", importedChatID).
+			UpdateColumn("updated_at", time.Now()).Error
+	})
+}
+
+// renumberChatMessages перенумеровывает сообщения чата по времени отправки, как при
+// объединении личных чатов. Курсор участника переходит на наибольший новый номер среди
+// сообщений, которые он уже прочитал или получил; то же для курсоров прочтения тем.
+func renumberChatMessages(tx *gorm.DB, chatID uint) error {
+	steps := []string{
+		`CREATE TEMP TABLE import_renumber ON COMMIT DROP AS
+		SELECT m.id, m.topic_id, m.seq AS old_seq,
+			ROW_NUMBER() OVER (ORDER BY m.created_at, m.id) AS new_seq
+		FROM messages m
+		WHERE m.chat_id = ?`,
+		`UPDATE chat_users SET
+			last_read_seq = COALESCE((
+				SELECT MAX(r.new_seq) FROM import_renumber r
+				WHERE r.old_seq BETWEEN 1 AND chat_users.last_read_seq
+			), 0),
+			last_delivered_seq = COALESCE((
+				SELECT MAX(r.new_seq) FROM import_renumber r
+				WHERE r.old_seq BETWEEN 1 AND chat_users.last_delivered_seq
+			), 0)
+		WHERE chat_id = ?`,
+		`UPDATE chat_users SET last_delivered_seq = GREATEST(last_delivered_seq, last_read_seq)
+		WHERE chat_id = ?`,
+		`UPDATE chat_topic_reads SET last_read_seq = COALESCE((
+				SELECT MAX(r.new_seq) FROM import_renumber r
+				WHERE r.topic_id = chat_topic_reads.topic_id AND r.old_seq BETWEEN 1 AND chat_topic_reads.last_read_seq
+			), 0)
+		WHERE topic_id IN (SELECT id FROM chat_topics WHERE chat_id = ?)`,
+		`UPDATE messages SET seq = r.new_seq
+		FROM import_renumber r
+		WHERE messages.id = r.id AND messages.chat_id = ? AND messages.seq <> r.new_seq`,
+		`UPDATE chats SET last_seq = COALESCE((SELECT MAX(new_seq) FROM import_renumber), 0)
+		WHERE id = ?`,
+	}
+	for _, step := range steps {
+		if err := tx.Exec(step, chatID).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarkChatReadByAll сдвигает курсоры всех участников чата на последнее сообщение.
+// Используется после импорта, чтобы перенесенная история не считалась непрочитанной.
+func (db *Database) MarkChatReadByAll(chatID uint) error {
+	now := time.Now()
+	return db.DB.Exec(`UPDATE chat_users SET
+		last_delivered_seq = GREATEST(last_delivered_seq, chats.last_seq),
+		last_read_seq = GREATEST(last_read_seq, chats.last_seq),
+		unread_count = 0,
+		last_delivered_at = ?, last_read_at = ?
+		FROM chats
+		WHERE chats.id = chat_users.chat_id AND chat_users.chat_id = ?`, now, now, chatID).Error
+}
@@ -0,0 +1,147 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"messenger/models"
+)
+
+// Ошибки вступления по пригласительной ссылке
+var (
+	ErrInviteNotFound = errors.New("пригласительная ссылка не найдена")
+	ErrInviteInactive = errors.New("пригласительная ссылка отозвана, истекла или исчерпана")
+	ErrAlreadyMember  = errors.New("пользователь уже состоит в чате")
+)
+
+// InviteMember - пользователь, вступивший в чат по ссылке
+type InviteMember struct {
+	UserID   uint      `json:"id"`
+	Username string    `json:"username"`
+	Avatar   string    `json:"avatar,omitempty"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// CreateChatInvite сохраняет новую пригласительную ссылку
+func (db *Database) CreateChatInvite(invite *models.ChatInvite) error {
+	return db.DB.Create(invite).Error
+}
+
+// GetChatInvites возвращает ссылки чата, начиная с новых
+func (db *Database) GetChatInvites(chatID uint) ([]models.ChatInvite, error) {
+	var invites []models.ChatInvite
+	err := db.DB.Where("chat_id = ?", chatID).Order("created_at DESC, id DESC").Find(&invites).Error
+	return invites, err
+}
+
+// GetChatInvite возвращает ссылку чата по ID
+func (db *Database) GetChatInvite(chatID, inviteID uint) (*models.ChatInvite, error) {
+	var invite models.ChatInvite
+	if err := db.DB.Where("id = ? AND chat_id = ?", inviteID, chatID).First(&invite).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInviteNotFound
+		}
+		return nil, err
+	}
+	return &invite, nil
+}
+
+// GetChatInviteByCode возвращает ссылку по коду
+func (db *Database) GetChatInviteByCode(code string) (*models.ChatInvite, error) {
+	var invite models.ChatInvite
+	if err := db.DB.Where("code = ?", code).First(&invite).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInviteNotFound
+		}
+		return nil, err
+	}
+	return &invite, nil
+}
+
+// RevokeChatInvite отзывает ссылку. Возвращает false, если она уже была отозвана.
+func (db *Database) RevokeChatInvite(inviteID uint, now time.Time) (bool, error) {
+	result := db.DB.Model(&models.ChatInvite{}).
+		Where("id = ? AND revoked_at IS NULL", inviteID).
+		UpdateColumn("revoked_at", now)
+	return result.RowsAffected > 0, result.Error
+}
+
+// GetChatInviteMembers возвращает пользователей, вступивших в чат по ссылке
+func (db *Database) GetChatInviteMembers(inviteID uint) ([]InviteMember, error) {
+	var members []InviteMember
+	err := db.DB.Table("chat_invite_uses").
+		Select("chat_invite_uses.user_id, users.username, users.avatar, chat_invite_uses.joined_at").
+		Joins("JOIN users ON users.id = chat_invite_uses.user_id AND users.deleted_at IS NULL").
+		Where("chat_invite_uses.invite_id = ?", inviteID).
+		Order("chat_invite_uses.joined_at").
+		Scan(&members).Error
+	return members, err
+}
+
+// JoinChatByInvite добавляет пользователя в чат по ссылке. Ссылка блокируется на время
+// вступления, поэтому ограничение числа использований не превышается при гонке.
+func (db *Database) JoinChatByInvite(code string, userID uint, now time.Time) (*models.ChatInvite, error) {
+	var invite models.ChatInvite
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("code = ?", code).
+			First(&invite).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInviteNotFound
+			}
+			return err
+		}
+		if !invite.IsActive(now) {
+			return ErrInviteInactive
+		}
+
+		var count int64
+		if err := tx.Model(&models.ChatUser{}).
+			Where("chat_id = ? AND user_id = ?", invite.ChatID, userID).
+			Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrAlreadyMember
+		}
+
+		return joinByInvite(tx, &invite, userID, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &invite, nil
+}
+
+// joinByInvite добавляет пользователя в чат заблокированной ссылки и учитывает использование ссылки
+func joinByInvite(tx *gorm.DB, invite *models.ChatInvite, userID uint, now time.Time) error {
+	// Ссылки удаленного чата не действуют
+	var chat models.Chat
+	if err := tx.Select("id", "last_seq").First(&chat, invite.ChatID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInviteNotFound
+		}
+		return err
+	}
+	if err := checkJoinRestriction(tx, invite.ChatID, []uint{userID}, now); err != nil {
+		return err
+	}
+	if err := addChatMembers(tx, invite.ChatID, []models.ChatUser{{
+		UserID:           userID,
+		JoinedAt:         now,
+		LastDeliveredSeq: chat.LastSeq,
+		LastReadSeq:      chat.LastSeq,
+	}}); err != nil {
+		return err
+	}
+
+	invite.UseCount++
+	if err := tx.Model(invite).UpdateColumn("use_count", invite.UseCount).Error; err != nil {
+		return err
+	}
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&models.ChatInviteUse{InviteID: invite.ID, UserID: userID, JoinedAt: now}).Error
+}
@@ -0,0 +1,183 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"messenger/models"
+)
+
+// Ошибки заявок на вступление
+var (
+	ErrJoinRequestNotFound = errors.New("заявка на вступление не найдена или уже рассмотрена")
+	ErrJoinRequestPending  = errors.New("заявка на вступление уже подана")
+)
+
+// JoinRequestInfo - заявка на вступление с данными пользователя
+type JoinRequestInfo struct {
+	ID        uint      `json:"id"`
+	ChatID    uint      `json:"chat_id"`
+	UserID    uint      `json:"user_id"`
+	Username  string    `json:"username"`
+	Avatar    string    `json:"avatar,omitempty"`
+	InviteID  uint      `json:"invite_id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// CreateJoinRequest подает заявку на вступление в чат по ссылке. Ссылка блокируется
+// на время проверки, как и при вступлении без одобрения.
+func (db *Database) CreateJoinRequest(code string, userID uint, now time.Time, ttl time.Duration) (*models.ChatJoinRequest, error) {
+	var request models.ChatJoinRequest
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		var invite models.ChatInvite
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("code = ?", code).
+			First(&invite).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInviteNotFound
+			}
+			return err
+		}
+		if !invite.IsActive(now) {
+			return ErrInviteInactive
+		}
+
+		var count int64
+		if err := tx.Model(&models.ChatUser{}).
+			Where("chat_id = ? AND user_id = ?", invite.ChatID, userID).
+			Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrAlreadyMember
+		}
+		if err := checkJoinRestriction(tx, invite.ChatID, []uint{userID}, now); err != nil {
+			return err
+		}
+
+		// Просроченная, но еще не закрытая фоновой задачей заявка не мешает подать новую
+		if err := tx.Model(&models.ChatJoinRequest{}).
+			Where("chat_id = ? AND user_id = ? AND status = ? AND expires_at <= ?", invite.ChatID, userID, models.JoinRequestPending, now).
+			UpdateColumn("status", models.JoinRequestExpired).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.ChatJoinRequest{}).
+			Where("chat_id = ? AND user_id = ? AND status = ?", invite.ChatID, userID, models.JoinRequestPending).
+			Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrJoinRequestPending
+		}
+
+		request = models.ChatJoinRequest{
+			ChatID:    invite.ChatID,
+			UserID:    userID,
+			InviteID:  invite.ID,
+			Status:    models.JoinRequestPending,
+			CreatedAt: now,
+			ExpiresAt: now.Add(ttl),
+		}
+		return tx.Create(&request).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+// GetPendingJoinRequests возвращает рассматриваемые заявки чата в порядке подачи
+func (db *Database) GetPendingJoinRequests(chatID uint, now time.Time) ([]JoinRequestInfo, error) {
+	var requests []JoinRequestInfo
+	err := db.DB.Table("chat_join_requests").
+		Select("chat_join_requests.id, chat_join_requests.chat_id, chat_join_requests.user_id, users.username, users.avatar, "+
+			"chat_join_requests.invite_id, chat_join_requests.created_at, chat_join_requests.expires_at").
+		Joins("JOIN users ON users.id = chat_join_requests.user_id AND users.deleted_at IS NULL").
+		Where("chat_join_requests.chat_id = ? AND chat_join_requests.status = ? AND chat_join_requests.expires_at > ?",
+			chatID, models.JoinRequestPending, now).
+		Order("chat_join_requests.created_at, chat_join_requests.id").
+		Scan(&requests).Error
+	return requests, err
+}
+
+// ApproveJoinRequest одобряет заявку: пользователь вступает в чат, а вступление
+// засчитывается ссылке, по которой подана заявка. Если ссылку отозвали, срок ее действия
+// истек или лимит вступлений исчерпан, возвращается ErrInviteInactive.
+func (db *Database) ApproveJoinRequest(chatID, requestID, deciderID uint, now time.Time) (*models.ChatJoinRequest, error) {
+	return db.decideJoinRequest(chatID, requestID, deciderID, now, models.JoinRequestApproved, func(tx *gorm.DB, request *models.ChatJoinRequest) error {
+		// Пока заявка рассматривалась, пользователя могли добавить в чат иначе
+		var count int64
+		if err := tx.Model(&models.ChatUser{}).
+			Where("chat_id = ? AND user_id = ?", request.ChatID, request.UserID).
+			Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrAlreadyMember
+		}
+
+		var invite models.ChatInvite
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&invite, request.InviteID).Error; err != nil {
+			return err
+		}
+		if !invite.IsActive(now) {
+			return ErrInviteInactive
+		}
+		return joinByInvite(tx, &invite, request.UserID, now)
+	})
+}
+
+// DeclineJoinRequest отклоняет заявку
+func (db *Database) DeclineJoinRequest(chatID, requestID, deciderID uint, now time.Time) (*models.ChatJoinRequest, error) {
+	return db.decideJoinRequest(chatID, requestID, deciderID, now, models.JoinRequestDeclined, nil)
+}
+
+// decideJoinRequest закрывает рассматриваемую заявку с указанным решением.
+// apply выполняется в той же транзакции до смены состояния заявки.
+func (db *Database) decideJoinRequest(chatID, requestID, deciderID uint, now time.Time, status models.JoinRequestStatus,
+	apply func(tx *gorm.DB, request *models.ChatJoinRequest) error) (*models.ChatJoinRequest, error) {
+	var request models.ChatJoinRequest
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND chat_id = ? AND status = ? AND expires_at > ?", requestID, chatID, models.JoinRequestPending, now).
+			First(&request).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrJoinRequestNotFound
+			}
+			return err
+		}
+
+		if apply != nil {
+			if err := apply(tx, &request); err != nil {
+				return err
+			}
+		}
+
+		request.Status = status
+		request.DecidedBy = &deciderID
+		request.DecidedAt = &now
+		return tx.Model(&request).UpdateColumns(map[string]interface{}{
+			"status":     status,
+			"decided_by": deciderID,
+			"decided_at": now,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+// ExpireJoinRequests закрывает просроченные заявки и возвращает их
+func (db *Database) ExpireJoinRequests(now time.Time) ([]models.ChatJoinRequest, error) {
+	var expired []models.ChatJoinRequest
+	err := db.DB.Model(&expired).
+		Clauses(clause.Returning{}).
+		Where("status = ? AND expires_at <= ?", models.JoinRequestPending, now).
+		UpdateColumn("status", models.JoinRequestExpired).Error
+	return expired, err
+}
@@ -0,0 +1,69 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"messenger/models"
+)
+
+// ErrLiveLocationEnded возвращается при изменении завершенной трансляции местоположения
+var ErrLiveLocationEnded = errors.New("трансляция местоположения завершена")
+
+// GetLiveLocation возвращает трансляцию местоположения сообщения
+func (db *Database) GetLiveLocation(messageID uint) (*models.LiveLocation, error) {
+	var live models.LiveLocation
+	result := db.DB.First(&live, "message_id = ?", messageID)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &live, nil
+}
+
+// UpdateLiveLocation сохраняет новое шифрованное содержимое сообщения с трансляцией.
+// При stop трансляция завершается. Строка трансляции блокируется, чтобы обновление
+// не прошло одновременно с остановкой. Время изменения сообщения не трогается:
+// новая точка трансляции - не редактирование, время обновления хранит сама трансляция.
+func (db *Database) UpdateLiveLocation(messageID uint, content []byte, stop bool) error {
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		var live models.LiveLocation
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(&live, "message_id = ?", messageID).Error; err != nil {
+			return err
+		}
+		now := time.Now()
+		if !live.IsActive(now) {
+			return ErrLiveLocationEnded
+		}
+
+		if err := tx.Model(&models.Message{}).Where("id = ?", messageID).
+			UpdateColumn("content", content).Error; err != nil {
+			return err
+		}
+
+		updates := map[string]interface{}{"updated_at": now}
+		if stop {
+			updates["stopped_at"] = now
+		}
+		return tx.Model(&models.LiveLocation{}).Where("message_id = ?", messageID).Updates(updates).Error
+	})
+}
+
+// ExpireLiveLocation отмечает истекшую трансляцию завершенной.
+// Возвращает true, если трансляция не была остановлена раньше.
+func (db *Database) ExpireLiveLocation(messageID uint, now time.Time) (bool, error) {
+	result := db.DB.Model(&models.LiveLocation{}).
+		Where("message_id = ? AND stopped_at IS NULL AND expires_at <= ?", messageID, now).
+		UpdateColumn("stopped_at", gorm.Expr("expires_at"))
+	return result.RowsAffected > 0, result.Error
+}
+
+// GetActiveLiveLocations возвращает трансляции, которые еще не завершены
+func (db *Database) GetActiveLiveLocations() ([]models.LiveLocation, error) {
+	var live []models.LiveLocation
+	result := db.DB.Where("stopped_at IS NULL").Find(&live)
+	return live, result.Error
+}
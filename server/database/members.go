@@ -0,0 +1,354 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"messenger/models"
+)
+
+// ErrNotChatMember возвращается, если пользователь не состоит в чате
+var ErrNotChatMember = errors.New("пользователь не состоит в чате")
+
+// ChatMember - участник чата с данными пользователя
+type ChatMember struct {
+	UserID   uint            `json:"id"`
+	Username string          `json:"username"`
+	Avatar   string          `json:"avatar,omitempty"`
+	Role     models.ChatRole `json:"role"`
+	JoinedAt time.Time       `json:"joined_at"`
+}
+
+// GetChatMembers возвращает участников чата в порядке вступления
+func (db *Database) GetChatMembers(chatID uint) ([]ChatMember, error) {
+	var members []ChatMember
+	err := db.DB.Table("chat_users").
+		Select("chat_users.user_id, users.username, users.avatar, chat_users.role, chat_users.joined_at").
+		Joins("JOIN users ON users.id = chat_users.user_id AND users.deleted_at IS NULL").
+		Where("chat_users.chat_id = ?", chatID).
+		Order("chat_users.joined_at, chat_users.user_id").
+		Scan(&members).Error
+	return members, err
+}
+
+// GetChatsMembers возвращает участников нескольких чатов одним запросом, по чатам
+// в порядке вступления
+func (db *Database) GetChatsMembers(chatIDs []uint) (map[uint][]ChatMember, error) {
+	result := make(map[uint][]ChatMember, len(chatIDs))
+	if len(chatIDs) == 0 {
+		return result, nil
+	}
+
+	var rows []struct {
+		ChatID uint
+		ChatMember
+	}
+	if err := db.DB.Table("chat_users").
+		Select("chat_users.chat_id, chat_users.user_id, users.username, users.avatar, chat_users.role, chat_users.joined_at").
+		Joins("JOIN users ON users.id = chat_users.user_id AND users.deleted_at IS NULL").
+		Where("chat_users.chat_id IN ?", chatIDs).
+		Order("chat_users.chat_id, chat_users.joined_at, chat_users.user_id").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		result[row.ChatID] = append(result[row.ChatID], row.ChatMember)
+	}
+	return result, nil
+}
+
+// GetChatMemberIDsJoinedAfter возвращает ID участников чата, вступивших позже since
+func (db *Database) GetChatMemberIDsJoinedAfter(chatID uint, since time.Time) ([]uint, error) {
+	var userIDs []uint
+	err := db.DB.Model(&models.ChatUser{}).
+		Where("chat_id = ? AND joined_at > ?", chatID, since).
+		Pluck("user_id", &userIDs).Error
+	return userIDs, err
+}
+
+// GetChatMemberIDsByRoles возвращает ID участников чата с указанными ролями
+func (db *Database) GetChatMemberIDsByRoles(chatID uint, roles []models.ChatRole) ([]uint, error) {
+	var userIDs []uint
+	err := db.DB.Model(&models.ChatUser{}).
+		Where("chat_id = ? AND role IN ?", chatID, roles).
+		Pluck("user_id", &userIDs).Error
+	return userIDs, err
+}
+
+// UpdateChatName меняет название чата, не затрагивая остальные поля
+func (db *Database) UpdateChatName(chatID uint, name string) error {
+	return db.DB.Model(&models.Chat{}).Where("id = ?", chatID).UpdateColumn("name", name).Error
+}
+
+// UpdateChatHistoryVisibility меняет видимость истории группы для участников
+func (db *Database) UpdateChatHistoryVisibility(chatID uint, visibility string) error {
+	return db.DB.Model(&models.Chat{}).Where("id = ?", chatID).UpdateColumn("history_visibility", visibility).Error
+}
+
+// UpdateChatSlowMode меняет интервал медленного режима чата
+func (db *Database) UpdateChatSlowMode(chatID uint, seconds int) error {
+	return db.DB.Model(&models.Chat{}).Where("id = ?", chatID).UpdateColumn("slow_mode", seconds).Error
+}
+
+// UpdateChatSignMessages включает или выключает подпись постов канала
+func (db *Database) UpdateChatSignMessages(chatID uint, sign bool) error {
+	return db.DB.Model(&models.Chat{}).Where("id = ?", chatID).UpdateColumn("sign_messages", sign).Error
+}
+
+// ErrHandleTaken возвращается, если публичное имя уже занято другим чатом
+var ErrHandleTaken = errors.New("публичное имя чата занято")
+
+// UpdateChatDescription меняет описание чата
+func (db *Database) UpdateChatDescription(chatID uint, description string) error {
+	return db.DB.Model(&models.Chat{}).Where("id = ?", chatID).UpdateColumn("description", description).Error
+}
+
+// SetChatHandle назначает чату публичное имя. nil убирает публичное имя.
+func (db *Database) SetChatHandle(chatID uint, handle *string) error {
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		if handle != nil {
+			var count int64
+			if err := tx.Model(&models.Chat{}).
+				Where("handle = ? AND id != ?", *handle, chatID).
+				Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				return ErrHandleTaken
+			}
+		}
+		return tx.Model(&models.Chat{}).Where("id = ?", chatID).UpdateColumn("handle", handle).Error
+	})
+}
+
+// GetChatByHandle возвращает чат по публичному имени
+func (db *Database) GetChatByHandle(handle string) (*models.Chat, error) {
+	var chat models.Chat
+	if err := db.DB.Where("handle = ?", handle).First(&chat).Error; err != nil {
+		return nil, err
+	}
+	return &chat, nil
+}
+
+// SetChatAvatar меняет изображение чата. fileID nil убирает изображение.
+func (db *Database) SetChatAvatar(chatID uint, fileID *uint, avatar string) error {
+	return db.DB.Model(&models.Chat{}).Where("id = ?", chatID).UpdateColumns(map[string]interface{}{
+		"avatar_file_id": fileID,
+		"avatar":         avatar,
+	}).Error
+}
+
+// AddChatMembers добавляет пользователей в чат. Курсоры новых участников ставятся
+// на последнее сообщение чата, чтобы прежняя история не считалась непрочитанной.
+// Возвращает ID действительно добавленных пользователей.
+func (db *Database) AddChatMembers(chatID uint, userIDs []uint) ([]uint, error) {
+	var added []uint
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		var lastSeq uint64
+		if err := tx.Model(&models.Chat{}).Where("id = ?", chatID).
+			Pluck("last_seq", &lastSeq).Error; err != nil {
+			return err
+		}
+		now := time.Now()
+		if err := checkJoinRestriction(tx, chatID, userIDs, now); err != nil {
+			return err
+		}
+
+		var existing []uint
+		if err := tx.Model(&models.ChatUser{}).
+			Where("chat_id = ? AND user_id IN ?", chatID, userIDs).
+			Pluck("user_id", &existing).Error; err != nil {
+			return err
+		}
+		member := make(map[uint]bool, len(existing))
+		for _, id := range existing {
+			member[id] = true
+		}
+
+		var members []models.ChatUser
+		for _, id := range userIDs {
+			if member[id] {
+				continue
+			}
+			member[id] = true
+			members = append(members, models.ChatUser{
+				UserID:           id,
+				JoinedAt:         now,
+				LastDeliveredSeq: lastSeq,
+				LastReadSeq:      lastSeq,
+			})
+			added = append(added, id)
+		}
+		return addChatMembers(tx, chatID, members)
+	})
+	return added, err
+}
+
+// MemberRemoval описывает последствия исключения участника
+type MemberRemoval struct {
+	NewOwnerID  uint // Участник, ставший владельцем вместо ушедшего
+	ChatDeleted bool // В чате не осталось участников, и он удален
+}
+
+// RemoveChatMember исключает пользователя из чата. Если ушел владелец группы,
+// владельцем становится участник с самой высокой ролью, вступивший раньше остальных.
+// Опустевший чат удаляется.
+func (db *Database) RemoveChatMember(chatID, userID uint) (*MemberRemoval, error) {
+	var result *MemberRemoval
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		result, err = removeChatMember(tx, chatID, userID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// removeChatMember исключает участника в рамках транзакции tx
+func removeChatMember(tx *gorm.DB, chatID, userID uint) (*MemberRemoval, error) {
+	var result MemberRemoval
+	var member models.ChatUser
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("chat_id = ? AND user_id = ?", chatID, userID).
+		First(&member).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotChatMember
+		}
+		return nil, err
+	}
+	if err := tx.Where("chat_id = ? AND user_id = ?", chatID, userID).Delete(&models.ChatUser{}).Error; err != nil {
+		return nil, err
+	}
+
+	var remaining []models.ChatUser
+	if err := tx.Where("chat_id = ?", chatID).
+		Order("joined_at, user_id").
+		Find(&remaining).Error; err != nil {
+		return nil, err
+	}
+	if len(remaining) == 0 {
+		result.ChatDeleted = true
+		return &result, tx.Delete(&models.Chat{}, chatID).Error
+	}
+	if member.Role != models.ChatRoleOwner {
+		return &result, nil
+	}
+
+	heir := remaining[0]
+	for _, m := range remaining[1:] {
+		if m.Role.Rank() > heir.Role.Rank() {
+			heir = m
+		}
+	}
+	result.NewOwnerID = heir.UserID
+	return &result, tx.Model(&models.ChatUser{}).
+		Where("chat_id = ? AND user_id = ?", chatID, heir.UserID).
+		UpdateColumn("role", models.ChatRoleOwner).Error
+}
+
+// SetChatMemberRole меняет роль участника. Передача роли владельца делает
+// прежнего владельца администратором.
+func (db *Database) SetChatMemberRole(chatID, userID uint, role models.ChatRole) error {
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		if role == models.ChatRoleOwner {
+			if err := tx.Model(&models.ChatUser{}).
+				Where("chat_id = ? AND role = ?", chatID, models.ChatRoleOwner).
+				UpdateColumn("role", models.ChatRoleAdmin).Error; err != nil {
+				return err
+			}
+		}
+
+		result := tx.Model(&models.ChatUser{}).
+			Where("chat_id = ? AND user_id = ?", chatID, userID).
+			UpdateColumn("role", role)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrNotChatMember
+		}
+		return nil
+	})
+}
+
+// UpdateChatPermissions сохраняет матрицу прав чата, не затрагивая остальные поля
+func (db *Database) UpdateChatPermissions(chatID uint, permissions models.ChatPermissions) error {
+	return db.DB.Model(&models.Chat{}).Where("id = ?", chatID).UpdateColumn("permissions", permissions).Error
+}
+
+// CountChatMembers возвращает число участников чата
+func (db *Database) CountChatMembers(chatID uint) (int64, error) {
+	var count int64
+	err := db.DB.Model(&models.ChatUser{}).Where("chat_id = ?", chatID).Count(&count).Error
+	return count, err
+}
+
+// CountChatsMembers возвращает число участников нескольких чатов одним запросом
+func (db *Database) CountChatsMembers(chatIDs []uint) (map[uint]int64, error) {
+	result := make(map[uint]int64, len(chatIDs))
+	if len(chatIDs) == 0 {
+		return result, nil
+	}
+
+	var rows []struct {
+		ChatID uint
+		Count  int64
+	}
+	if err := db.DB.Model(&models.ChatUser{}).
+		Select("chat_id, COUNT(*) AS count").
+		Where("chat_id IN ?", chatIDs).
+		Group("chat_id").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		result[row.ChatID] = row.Count
+	}
+	return result, nil
+}
+
+// Размер пачки ID в запросе участников среди подключенных пользователей
+const onlineMembersBatch = 1000
+
+// SmallChatMembers возвращает ID участников чата, если их не больше limit.
+// Для большего чата возвращает false, не загружая всех участников.
+func (db *Database) SmallChatMembers(chatID uint, limit int) ([]uint, bool, error) {
+	var members []uint
+	if err := db.DB.Model(&models.ChatUser{}).
+		Where("chat_id = ?", chatID).
+		Limit(limit+1).
+		Pluck("user_id", &members).Error; err != nil {
+		return nil, false, err
+	}
+	if len(members) > limit {
+		return nil, false, nil
+	}
+	return members, true, nil
+}
+
+// FilterChatMembers оставляет из переданных пользователей только участников чата.
+// Используется для рассылки в большие чаты: кандидаты - подключенные пользователи,
+// поэтому объем запроса зависит от числа подключений, а не от числа участников чата.
+func (db *Database) FilterChatMembers(chatID uint, userIDs []uint) ([]uint, error) {
+	var members []uint
+	for start := 0; start < len(userIDs); start += onlineMembersBatch {
+		end := start + onlineMembersBatch
+		if end > len(userIDs) {
+			end = len(userIDs)
+		}
+
+		var batch []uint
+		if err := db.DB.Model(&models.ChatUser{}).
+			Where("chat_id = ? AND user_id IN ?", chatID, userIDs[start:end]).
+			Pluck("user_id", &batch).Error; err != nil {
+			return nil, err
+		}
+		members = append(members, batch...)
+	}
+	return members, nil
+}
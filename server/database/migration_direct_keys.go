@@ -0,0 +1,128 @@
+package database
+
+import (
+	"gorm.io/gorm"
+
+	"messenger/logger"
+)
+
+// Таблицы, строки которых привязаны к чату и переносятся вместе с сообщениями
+var directChatMergeTables = []string{"polls", "live_locations", "reminders", "export_jobs", "imported_chats"}
+
+// migrateDirectChatKeys заполняет ключи пар личных чатов и объединяет дубликаты.
+//
+// Раньше каждый запрос на создание личного чата создавал новый чат, поэтому у пары
+// могло накопиться несколько чатов. Основным остается самый ранний: в него переносятся
+// сообщения и связанные с чатом данные остальных чатов пары, сообщения перенумеровываются
+// по времени создания, а курсоры участников пересчитываются так, чтобы прочитанное
+// в любом из чатов осталось прочитанным. Дубликаты удаляются мягко.
+func migrateDirectChatKeys(tx *gorm.DB) error {
+	steps := []string{
+		// Ключ пары для каждого личного чата с двумя участниками
+		`CREATE TEMP TABLE direct_chat_keys ON COMMIT DROP AS
+		SELECT cu.chat_id, MIN(cu.user_id) || ':' || MAX(cu.user_id) AS direct_key
+		FROM chat_users cu
+		JOIN chats ON chats.id = cu.chat_id AND chats.type = 'direct' AND chats.deleted_at IS NULL
+		GROUP BY cu.chat_id
+		HAVING COUNT(*) = 2 AND MIN(cu.user_id) != MAX(cu.user_id)`,
+		// Дубликат -> основной чат пары
+		`CREATE TEMP TABLE direct_chat_merge ON COMMIT DROP AS
+		SELECT k.chat_id, keep.chat_id AS keep_id
+		FROM direct_chat_keys k
+		JOIN (SELECT direct_key, MIN(chat_id) AS chat_id FROM direct_chat_keys GROUP BY direct_key) AS keep
+			ON keep.direct_key = k.direct_key
+		WHERE k.chat_id != keep.chat_id`,
+	}
+	for _, step := range steps {
+		if err := tx.Exec(step).Error; err != nil {
+			return err
+		}
+	}
+
+	var duplicates int64
+	if err := tx.Table("direct_chat_merge").Count(&duplicates).Error; err != nil {
+		return err
+	}
+	if duplicates > 0 {
+		if err := mergeDirectChats(tx); err != nil {
+			return err
+		}
+		logger.Infof("Объединено дубликатов личных чатов: %d", duplicates)
+	}
+
+	return tx.Exec(`UPDATE chats SET direct_key = k.direct_key
+		FROM direct_chat_keys k
+		WHERE chats.id = k.chat_id AND chats.id NOT IN (SELECT chat_id FROM direct_chat_merge)`).Error
+}
+
+// mergeDirectChats переносит содержимое чатов из direct_chat_merge в основные чаты пар
+func mergeDirectChats(tx *gorm.DB) error {
+	affected := `(SELECT chat_id FROM direct_chat_merge UNION SELECT keep_id FROM direct_chat_merge)`
+
+	// Прежние номера сообщений и курсоры нужны для пересчета курсоров после переноса
+	steps := []string{
+		`CREATE TEMP TABLE direct_merge_messages ON COMMIT DROP AS
+		SELECT m.id, m.chat_id AS old_chat_id, m.seq AS old_seq, COALESCE(mg.keep_id, m.chat_id) AS keep_id
+		FROM messages m
+		LEFT JOIN direct_chat_merge mg ON mg.chat_id = m.chat_id
+		WHERE m.chat_id IN ` + affected,
+		`CREATE TEMP TABLE direct_merge_cursors ON COMMIT DROP AS
+		SELECT chat_id, user_id, last_read_seq, last_delivered_seq
+		FROM chat_users
+		WHERE chat_id IN ` + affected,
+		`UPDATE messages SET chat_id = mg.keep_id
+		FROM direct_chat_merge mg
+		WHERE messages.chat_id = mg.chat_id`,
+	}
+	for _, table := range directChatMergeTables {
+		steps = append(steps, `UPDATE `+table+` SET chat_id = mg.keep_id
+		FROM direct_chat_merge mg
+		WHERE `+table+`.chat_id = mg.chat_id`)
+	}
+
+	numbered := `WITH numbered AS (
+		SELECT dm.id, dm.keep_id, dm.old_chat_id, dm.old_seq,
+			ROW_NUMBER() OVER (PARTITION BY dm.keep_id ORDER BY m.created_at, m.id) AS new_seq
+		FROM direct_merge_messages dm
+		JOIN messages m ON m.id = dm.id
+	)`
+
+	steps = append(steps,
+		numbered+`
+		UPDATE chat_users SET
+			last_read_seq = COALESCE((
+				SELECT MAX(n.new_seq) FROM numbered n
+				JOIN direct_merge_cursors cur ON cur.chat_id = n.old_chat_id AND cur.user_id = chat_users.user_id
+				WHERE n.keep_id = chat_users.chat_id AND n.old_seq BETWEEN 1 AND cur.last_read_seq
+			), 0),
+			last_delivered_seq = COALESCE((
+				SELECT MAX(n.new_seq) FROM numbered n
+				JOIN direct_merge_cursors cur ON cur.chat_id = n.old_chat_id AND cur.user_id = chat_users.user_id
+				WHERE n.keep_id = chat_users.chat_id AND n.old_seq BETWEEN 1 AND cur.last_delivered_seq
+			), 0)
+		WHERE chat_id IN (SELECT keep_id FROM direct_chat_merge)`,
+		`UPDATE chat_users SET last_delivered_seq = GREATEST(last_delivered_seq, last_read_seq)
+		WHERE chat_id IN (SELECT keep_id FROM direct_chat_merge)`,
+		numbered+`
+		UPDATE messages SET seq = numbered.new_seq
+		FROM numbered
+		WHERE messages.id = numbered.id`,
+		`UPDATE chats SET
+			last_seq = COALESCE((SELECT MAX(seq) FROM messages WHERE messages.chat_id = chats.id), 0),
+			last_activity = GREATEST(last_activity, COALESCE((
+				SELECT MAX(last_activity) FROM chats dup
+				JOIN direct_chat_merge mg ON mg.chat_id = dup.id
+				WHERE mg.keep_id = chats.id
+			), last_activity))
+		WHERE id IN (SELECT keep_id FROM direct_chat_merge)`,
+		`DELETE FROM chat_users WHERE chat_id IN (SELECT chat_id FROM direct_chat_merge)`,
+		`UPDATE chats SET deleted_at = NOW() WHERE id IN (SELECT chat_id FROM direct_chat_merge)`,
+	)
+
+	for _, step := range steps {
+		if err := tx.Exec(step).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"messenger/logger"
+	"messenger/models"
+	"messenger/utils/crypto"
+)
+
+// legacyDirectMessage - строка устаревшей таблицы direct_messages
+type legacyDirectMessage struct {
+	ID          uint
+	SenderID    uint
+	RecipientID uint
+	Content     []byte
+	MessageType string
+	IsRead      bool
+	FileID      *uint
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// Размер пачки переносимых сообщений
+const directMessagesBatchSize = 500
+
+// migrateDirectMessages переносит сообщения из direct_messages в личные чаты.
+//
+// Для каждой пары собеседников используется существующий личный чат или создается новый.
+// Содержимое, сохраненное без шифрования, шифруется заново. Файлы перепривязываются
+// к новым сообщениям. Сообщения затронутых чатов перенумеровываются по времени создания,
+// а курсоры участников пересчитываются: прежние курсоры сохраняют смысл, перенесенные
+// сообщения считаются доставленными, а прочитанными - свои и отмеченные is_read.
+// Старая таблица переименовывается в direct_messages_legacy.
+func migrateDirectMessages(tx *gorm.DB) error {
+	if !tx.Migrator().HasTable("direct_messages") {
+		return nil
+	}
+
+	// Ранее использовавшийся тип личных чатов
+	if err := tx.Exec("UPDATE chats SET type = ? WHERE type = 'personal'", models.ChatTypeDirect).Error; err != nil {
+		return err
+	}
+
+	// Соответствие старых и новых сообщений для пересчета курсоров
+	if err := tx.Exec(`CREATE TEMP TABLE direct_message_map (
+		legacy_id BIGINT PRIMARY KEY,
+		message_id BIGINT NOT NULL,
+		chat_id BIGINT NOT NULL,
+		is_read BOOLEAN NOT NULL
+	) ON COMMIT DROP`).Error; err != nil {
+		return err
+	}
+
+	cryptoReady := false
+	chats := make(map[[2]uint]uint)
+	migrated := 0
+
+	var batch []legacyDirectMessage
+	err := tx.Table("direct_messages").
+		Select("direct_messages.*").
+		// Сообщения удаленных из базы пользователей перенести некуда
+		Joins("JOIN users s ON s.id = direct_messages.sender_id").
+		Joins("JOIN users r ON r.id = direct_messages.recipient_id").
+		Where("direct_messages.deleted_at IS NULL AND direct_messages.sender_id != direct_messages.recipient_id").
+		Order("direct_messages.id").
+		FindInBatches(&batch, directMessagesBatchSize, func(batchTx *gorm.DB, _ int) error {
+			if !cryptoReady {
+				if err := crypto.InitCrypto(); err != nil {
+					return fmt.Errorf("для переноса личных сообщений нужен ключ шифрования: %w", err)
+				}
+				cryptoReady = true
+			}
+
+			for _, dm := range batch {
+				chatID, err := directChatForMigration(tx, chats, dm.SenderID, dm.RecipientID, dm.CreatedAt)
+				if err != nil {
+					return err
+				}
+
+				content, err := reencryptLegacyContent(dm.Content)
+				if err != nil {
+					return err
+				}
+
+				fileID, err := legacyMessageFile(tx, dm)
+				if err != nil {
+					return err
+				}
+
+				messageType := dm.MessageType
+				if messageType == "" {
+					messageType = string(models.MessageTypeText)
+				}
+
+				message := models.Message{
+					ChatID:    chatID,
+					UserID:    dm.SenderID,
+					Content:   content,
+					Type:      messageType,
+					FileID:    fileID,
+					CreatedAt: dm.CreatedAt,
+					UpdatedAt: dm.UpdatedAt,
+				}
+				if err := tx.Create(&message).Error; err != nil {
+					return err
+				}
+
+				if fileID != nil {
+					if err := tx.Model(&models.File{}).Where("id = ?", *fileID).
+						UpdateColumn("message_id", message.ID).Error; err != nil {
+						return err
+					}
+				}
+
+				if err := tx.Exec("INSERT INTO direct_message_map (legacy_id, message_id, chat_id, is_read) VALUES (?, ?, ?, ?)",
+					dm.ID, message.ID, chatID, dm.IsRead).Error; err != nil {
+					return err
+				}
+				migrated++
+			}
+			return nil
+		}).Error
+	if err != nil {
+		return err
+	}
+
+	if migrated > 0 {
+		if err := renumberMigratedChats(tx); err != nil {
+			return err
+		}
+	}
+
+	logger.Infof("Перенесено личных сообщений: %d, личных чатов: %d", migrated, len(chats))
+
+	return tx.Exec("ALTER TABLE direct_messages RENAME TO direct_messages_legacy").Error
+}
+
+// directChatForMigration возвращает личный чат пары пользователей, создавая его при необходимости
+func directChatForMigration(tx *gorm.DB, cache map[[2]uint]uint, userA, userB uint, createdAt time.Time) (uint, error) {
+	key := [2]uint{userA, userB}
+	if userA > userB {
+		key = [2]uint{userB, userA}
+	}
+	if chatID, ok := cache[key]; ok {
+		return chatID, nil
+	}
+
+	chatID, err := findDirectChatIDByMembers(tx, key[0], key[1])
+	if err == gorm.ErrRecordNotFound {
+		// Сообщения идут по возрастанию ID, поэтому первое из них - самое раннее
+		chatID, err = createDirectChat(tx, key[0], key[1], createdAt)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	cache[key] = chatID
+	return chatID, nil
+}
+
+// reencryptLegacyContent возвращает шифрованное содержимое старого сообщения.
+// Часть старых сообщений (подписи к файлам) сохранялась открытым текстом.
+func reencryptLegacyContent(content []byte) ([]byte, error) {
+	if len(content) == 0 {
+		return nil, nil
+	}
+	if _, err := crypto.Decrypt(content); err == nil {
+		return content, nil
+	}
+	return crypto.Encrypt(content)
+}
+
+// legacyMessageFile находит файл старого сообщения. Загрузка файлов записывала
+// ID сообщения в files.message_id, не заполняя direct_messages.file_id.
+func legacyMessageFile(tx *gorm.DB, dm legacyDirectMessage) (*uint, error) {
+	if dm.FileID != nil {
+		return dm.FileID, nil
+	}
+
+	var fileIDs []uint
+	err := tx.Model(&models.File{}).
+		Where("message_id = ?", dm.ID).
+		// Файл уже может принадлежать сообщению чата с тем же ID
+		Where("NOT EXISTS (SELECT 1 FROM messages WHERE messages.file_id = files.id)").
+		Order("id").
+		Limit(1).
+		Pluck("id", &fileIDs).Error
+	if err != nil || len(fileIDs) == 0 {
+		return nil, err
+	}
+	return &fileIDs[0], nil
+}
+
+// renumberMigratedChats перенумеровывает сообщения чатов, в которые были перенесены
+// личные сообщения, и пересчитывает курсоры доставки и прочтения участников.
+func renumberMigratedChats(tx *gorm.DB) error {
+	numbered := `WITH numbered AS (
+		SELECT m.id, m.chat_id, m.user_id, m.seq AS old_seq,
+			ROW_NUMBER() OVER (PARTITION BY m.chat_id ORDER BY m.created_at, m.id) AS new_seq,
+			map.message_id IS NOT NULL AS legacy,
+			COALESCE(map.is_read, FALSE) AS is_read
+		FROM messages m
+		LEFT JOIN direct_message_map map ON map.message_id = m.id
+		WHERE m.chat_id IN (SELECT DISTINCT chat_id FROM direct_message_map)
+	)`
+
+	steps := []string{
+		numbered + `
+		UPDATE chat_users SET
+			last_read_seq = COALESCE((
+				SELECT MAX(n.new_seq) FROM numbered n
+				WHERE n.chat_id = chat_users.chat_id AND (
+					(NOT n.legacy AND n.old_seq BETWEEN 1 AND chat_users.last_read_seq) OR
+					(n.legacy AND (n.is_read OR n.user_id = chat_users.user_id)))
+			), 0),
+			last_delivered_seq = COALESCE((
+				SELECT MAX(n.new_seq) FROM numbered n
+				WHERE n.chat_id = chat_users.chat_id AND (
+					(NOT n.legacy AND n.old_seq BETWEEN 1 AND chat_users.last_delivered_seq) OR n.legacy)
+			), 0)
+		WHERE chat_id IN (SELECT DISTINCT chat_id FROM direct_message_map)`,
+		`UPDATE chat_users SET last_delivered_seq = GREATEST(last_delivered_seq, last_read_seq)
+		WHERE chat_id IN (SELECT DISTINCT chat_id FROM direct_message_map)`,
+		numbered + `
+		UPDATE messages SET seq = numbered.new_seq
+		FROM numbered
+		WHERE messages.id = numbered.id`,
+		`UPDATE chats SET
+			last_seq = COALESCE((SELECT MAX(seq) FROM messages WHERE messages.chat_id = chats.id), 0),
+			last_activity = GREATEST(last_activity, COALESCE((SELECT MAX(created_at) FROM messages WHERE messages.chat_id = chats.id), last_activity))
+		WHERE id IN (SELECT DISTINCT chat_id FROM direct_message_map)`,
+	}
+
+	for _, step := range steps {
+		if err := tx.Exec(step).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"messenger/logger"
+)
+
+// dataMigration описывает миграцию данных, которую нельзя выразить через AutoMigrate
+type dataMigration struct {
+	Name string
+	Run  func(tx *gorm.DB) error
+}
+
+// appliedMigration хранит отметку о выполненной миграции данных
+type appliedMigration struct {
+	Name      string `gorm:"primaryKey;size:100"`
+	AppliedAt time.Time
+}
+
+func (appliedMigration) TableName() string {
+	return "data_migrations"
+}
+
+// Список миграций данных в порядке выполнения. Новые миграции добавляются только в конец.
+var dataMigrations = []dataMigration{
+	{Name: "0001_message_seq", Run: backfillMessageSeq},
+	{Name: "0002_direct_messages", Run: migrateDirectMessages},
+	{Name: "0003_chat_roles", Run: migrateChatRoles},
+	{Name: "0004_direct_chat_keys", Run: migrateDirectChatKeys},
+	{Name: "0005_chat_list_counters", Run: backfillChatListCounters},
+	{Name: "0006_unread_without_system", Run: recountUnreadWithoutSystem},
+	{Name: "0007_unread_without_topics", Run: recountUnreadWithoutTopics},
+}
+
+// runDataMigrations выполняет еще не примененные миграции данных.
+// Каждая миграция выполняется в отдельной транзакции вместе с отметкой о применении.
+func runDataMigrations(db *gorm.DB) error {
+	if err := db.AutoMigrate(&appliedMigration{}); err != nil {
+		return err
+	}
+
+	for _, m := range dataMigrations {
+		var count int64
+		if err := db.Model(&appliedMigration{}).Where("name = ?", m.Name).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+
+		logger.Infof("Выполнение миграции данных %s", m.Name)
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Run(tx); err != nil {
+				return err
+			}
+			return tx.Create(&appliedMigration{Name: m.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("миграция данных %s: %w", m.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// backfillMessageSeq нумерует существующие сообщения внутри каждого чата
+// и выставляет курсоры участников так, чтобы старая история считалась прочитанной.
+func backfillMessageSeq(tx *gorm.DB) error {
+	steps := []string{
+		`UPDATE messages SET seq = numbered.seq
+		FROM (
+			SELECT id, ROW_NUMBER() OVER (PARTITION BY chat_id ORDER BY created_at, id) AS seq
+			FROM messages
+		) AS numbered
+		WHERE messages.id = numbered.id`,
+		`UPDATE chats SET last_seq = COALESCE((SELECT MAX(seq) FROM messages WHERE messages.chat_id = chats.id), 0)`,
+		`UPDATE chat_users SET
+			last_delivered_seq = chats.last_seq,
+			last_read_seq = chats.last_seq
+		FROM chats
+		WHERE chats.id = chat_users.chat_id`,
+	}
+
+	for _, step := range steps {
+		if err := tx.Exec(step).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillChatListCounters заполняет последнее сообщение чатов и счетчики непрочитанных участников
+func backfillChatListCounters(tx *gorm.DB) error {
+	steps := []string{
+		`UPDATE chats SET last_message_id = ` + lastMessageIDExpr,
+		`UPDATE chat_users SET unread_count = ` + unreadCountExpr,
+	}
+
+	for _, step := range steps {
+		if err := tx.Exec(step).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recountUnreadWithoutSystem пересчитывает счетчики непрочитанных: служебные сообщения
+// больше не считаются непрочитанными
+func recountUnreadWithoutSystem(tx *gorm.DB) error {
+	return tx.Exec(`UPDATE chat_users SET unread_count = ` + unreadCountExpr).Error
+}
+
+// recountUnreadWithoutTopics пересчитывает счетчики непрочитанных: сообщения тем
+// считаются по курсорам прочтения тем и в счетчик общей ленты не входят
+func recountUnreadWithoutTopics(tx *gorm.DB) error {
+	return tx.Exec(`UPDATE chat_users SET unread_count = ` + unreadCountExpr + ` WHERE chat_id IN (SELECT chat_id FROM chat_topics)`).Error
+}
+
+// migrateChatRoles переводит флаг is_admin в роли участников. Администраторы групп
+// становятся admin, а вступивший раньше всех администратор - владельцем. В группах
+// без администраторов владельцем становится самый ранний участник.
+func migrateChatRoles(tx *gorm.DB) error {
+	if !tx.Migrator().HasColumn("chat_users", "is_admin") {
+		return nil // Новая база: колонки никогда не было
+	}
+
+	steps := []string{
+		`UPDATE chat_users SET role = 'admin'
+		FROM chats
+		WHERE chats.id = chat_users.chat_id AND chats.type = 'group' AND chat_users.is_admin`,
+		`UPDATE chat_users SET role = 'owner'
+		FROM (
+			SELECT DISTINCT ON (cu.chat_id) cu.chat_id, cu.user_id
+			FROM chat_users cu
+			JOIN chats ON chats.id = cu.chat_id AND chats.type = 'group'
+			ORDER BY cu.chat_id, cu.is_admin DESC, cu.joined_at, cu.user_id
+		) AS owners
+		WHERE chat_users.chat_id = owners.chat_id AND chat_users.user_id = owners.user_id`,
+		`ALTER TABLE chat_users DROP COLUMN is_admin`,
+	}
+
+	for _, step := range steps {
+		if err := tx.Exec(step).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"messenger/models"
+)
+
+// ErrPollClosed возвращается при попытке изменить голос в закрытом опросе
+var ErrPollClosed = errors.New("опрос закрыт")
+
+// GetPoll возвращает опрос с вариантами ответа в порядке их следования.
+// Опрос удаленного сообщения не возвращается: gorm.ErrRecordNotFound.
+func (db *Database) GetPoll(pollID uint) (*models.Poll, error) {
+	var poll models.Poll
+	result := db.DB.Preload("Options", func(tx *gorm.DB) *gorm.DB { return tx.Order("position") }).
+		Joins("JOIN messages ON messages.id = polls.message_id AND messages.deleted_at IS NULL").
+		Where("polls.id = ?", pollID).
+		First(&poll)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &poll, nil
+}
+
+// GetPollVotes возвращает голоса для набора опросов
+func (db *Database) GetPollVotes(pollIDs []uint) ([]models.PollVote, error) {
+	var votes []models.PollVote
+	if len(pollIDs) == 0 {
+		return votes, nil
+	}
+	result := db.DB.Where("poll_id IN ?", pollIDs).Order("created_at").Find(&votes)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return votes, nil
+}
+
+// SetPollVotes заменяет голоса пользователя в опросе на выбранные варианты.
+// Строка опроса блокируется, чтобы голос не прошел одновременно с закрытием.
+func (db *Database) SetPollVotes(pollID, userID uint, optionIDs []uint) error {
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		var poll models.Poll
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&poll, pollID).Error; err != nil {
+			return err
+		}
+		if poll.IsClosed(time.Now()) {
+			return ErrPollClosed
+		}
+
+		if err := tx.Where("poll_id = ? AND user_id = ?", pollID, userID).Delete(&models.PollVote{}).Error; err != nil {
+			return err
+		}
+
+		votes := make([]models.PollVote, 0, len(optionIDs))
+		for _, optionID := range optionIDs {
+			votes = append(votes, models.PollVote{PollID: pollID, OptionID: optionID, UserID: userID})
+		}
+		return tx.Create(&votes).Error
+	})
+}
+
+// RetractPollVotes удаляет голоса пользователя в опросе.
+// Возвращает true, если пользователь действительно голосовал.
+func (db *Database) RetractPollVotes(pollID, userID uint) (bool, error) {
+	var retracted bool
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		var poll models.Poll
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&poll, pollID).Error; err != nil {
+			return err
+		}
+		if poll.IsClosed(time.Now()) {
+			return ErrPollClosed
+		}
+
+		result := tx.Where("poll_id = ? AND user_id = ?", pollID, userID).Delete(&models.PollVote{})
+		retracted = result.RowsAffected > 0
+		return result.Error
+	})
+	return retracted, err
+}
+
+// ClosePoll закрывает опрос. Возвращает true, если опрос был открыт.
+func (db *Database) ClosePoll(pollID uint, closedAt time.Time) (bool, error) {
+	result := db.DB.Model(&models.Poll{}).
+		Where("id = ? AND closed_at IS NULL", pollID).
+		UpdateColumn("closed_at", closedAt)
+	return result.RowsAffected > 0, result.Error
+}
+
+// GetScheduledPolls возвращает открытые опросы с заданным временем закрытия
+func (db *Database) GetScheduledPolls() ([]models.Poll, error) {
+	var polls []models.Poll
+	result := db.DB.Where("closed_at IS NULL AND closes_at IS NOT NULL").Find(&polls)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return polls, nil
+}
@@ -0,0 +1,149 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+
+	"messenger/models"
+)
+
+// MemberReceipt описывает состояние доставки и прочтения для одного участника чата
+type MemberReceipt struct {
+	UserID           uint       `json:"user_id"`
+	Username         string     `json:"username"`
+	Avatar           string     `json:"avatar,omitempty"`
+	LastDeliveredSeq uint64     `json:"last_delivered_seq"`
+	LastDeliveredAt  *time.Time `json:"delivered_at,omitempty"`
+	LastReadSeq      uint64     `json:"last_read_seq"`
+	LastReadAt       *time.Time `json:"read_at,omitempty"`
+}
+
+// GetChatMember возвращает запись участника чата
+func (db *Database) GetChatMember(chatID, userID uint) (*models.ChatUser, error) {
+	var member models.ChatUser
+	result := db.DB.Where("chat_id = ? AND user_id = ?", chatID, userID).First(&member)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &member, nil
+}
+
+// MarkChatDelivered сдвигает курсор доставки участника до seq.
+// Курсор только растет и не может превысить номер последнего сообщения чата.
+// Возвращает новое значение курсора или 0, если курсор не сдвинулся.
+func (db *Database) MarkChatDelivered(chatID, userID uint, seq uint64) (uint64, error) {
+	seq, err := clampToLastSeq(db.DB, chatID, seq)
+	if err != nil || seq == 0 {
+		return 0, err
+	}
+	result := db.DB.Model(&models.ChatUser{}).
+		Where("chat_id = ? AND user_id = ? AND last_delivered_seq < ?", chatID, userID, seq).
+		Updates(map[string]interface{}{
+			"last_delivered_seq": seq,
+			"last_delivered_at":  time.Now(),
+		})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return 0, result.Error
+	}
+	return seq, nil
+}
+
+// MarkChatRead сдвигает курсор прочтения участника до seq и пересчитывает число непрочитанных.
+// Прочитанное сообщение одновременно считается доставленным.
+// Возвращает новое значение курсора прочтения или 0, если курсор не сдвинулся.
+func (db *Database) MarkChatRead(chatID, userID uint, seq uint64) (uint64, error) {
+	var advancedTo uint64
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		seq, err := clampToLastSeq(tx, chatID, seq)
+		if err != nil || seq == 0 {
+			return err
+		}
+
+		now := time.Now()
+		result := tx.Model(&models.ChatUser{}).
+			Where("chat_id = ? AND user_id = ? AND last_read_seq < ?", chatID, userID, seq).
+			Updates(map[string]interface{}{
+				"last_read_seq":      seq,
+				"last_read_at":       now,
+				"last_delivered_seq": gorm.Expr("GREATEST(last_delivered_seq, ?)", seq),
+				"last_delivered_at":  now,
+			})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		advancedTo = seq
+		return refreshUnreadCount(tx, chatID, userID)
+	})
+	return advancedTo, err
+}
+
+// unreadCountExpr считает непрочитанные участника в общей ленте: чужие неудаленные сообщения
+// без темы после курсора прочтения, кроме служебных. Сообщения тем считаются по курсорам
+// прочтения тем, см. GetTopicUnreadCounts.
+const unreadCountExpr = `(SELECT COUNT(*) FROM messages
+	WHERE messages.chat_id = chat_users.chat_id AND messages.seq > chat_users.last_read_seq
+	AND messages.user_id != chat_users.user_id AND messages.type != 'system' AND messages.topic_id IS NULL
+	AND messages.deleted_at IS NULL)`
+
+// refreshUnreadCount пересчитывает счетчик непрочитанных участника чата.
+// userID 0 пересчитывает счетчики всех участников.
+func refreshUnreadCount(tx *gorm.DB, chatID, userID uint) error {
+	query := tx.Model(&models.ChatUser{}).Where("chat_id = ?", chatID)
+	if userID != 0 {
+		query = query.Where("user_id = ?", userID)
+	}
+	return query.UpdateColumn("unread_count", gorm.Expr(unreadCountExpr)).Error
+}
+
+// GetMessageReceipts возвращает участников чата (кроме автора), которым сообщение
+// с номером seq уже доставлено. Прочитавшие отличаются по LastReadSeq >= seq.
+func (db *Database) GetMessageReceipts(chatID uint, seq uint64, authorID uint) ([]MemberReceipt, error) {
+	var receipts []MemberReceipt
+	result := db.DB.Table("chat_users").
+		Select("chat_users.user_id, users.username, users.avatar, "+
+			"chat_users.last_delivered_seq, chat_users.last_delivered_at, "+
+			"chat_users.last_read_seq, chat_users.last_read_at").
+		Joins("JOIN users ON users.id = chat_users.user_id AND users.deleted_at IS NULL").
+		Where("chat_users.chat_id = ? AND chat_users.user_id != ? AND chat_users.last_delivered_seq >= ?", chatID, authorID, seq).
+		Order("chat_users.last_read_at DESC NULLS LAST").
+		Scan(&receipts)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return receipts, nil
+}
+
+// clampToLastSeq ограничивает seq номером последнего сообщения чата
+func clampToLastSeq(tx *gorm.DB, chatID uint, seq uint64) (uint64, error) {
+	var lastSeq uint64
+	if err := tx.Model(&models.Chat{}).Where("id = ?", chatID).
+		Pluck("last_seq", &lastSeq).Error; err != nil {
+		return 0, err
+	}
+	if seq > lastSeq {
+		seq = lastSeq
+	}
+	return seq, nil
+}
+
+// GetUndeliveredMessages возвращает чужие сообщения после курсоров доставки пользователя
+// во всех его чатах: не более limit самых ранних, в хронологическом порядке. В каждом чате
+// выбираются сообщения подряд от курсора, поэтому курсор можно сдвинуть до последнего
+// отправленного, а не вошедшие в выборку останутся недоставленными.
+func (db *Database) GetUndeliveredMessages(userID uint, limit int) ([]models.Message, error) {
+	var messages []models.Message
+	result := db.DB.
+		Joins("JOIN chat_users ON chat_users.chat_id = messages.chat_id AND chat_users.user_id = ?", userID).
+		Where("messages.seq > chat_users.last_delivered_seq AND messages.user_id != ?", userID).
+		Preload("User").
+		Preload("File").
+		Preload("Poll.Options", func(tx *gorm.DB) *gorm.DB { return tx.Order("position") }).
+		Order("messages.created_at, messages.chat_id, messages.seq").
+		Limit(limit).
+		Find(&messages)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return messages, nil
+}
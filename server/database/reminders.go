@@ -0,0 +1,31 @@
+package database
+
+import (
+	"time"
+
+	"messenger/models"
+)
+
+// CreateReminder сохраняет напоминание
+func (db *Database) CreateReminder(reminder *models.Reminder) error {
+	return db.DB.Create(reminder).Error
+}
+
+// GetDueReminders возвращает наступившие недоставленные напоминания указанных пользователей
+func (db *Database) GetDueReminders(userIDs []uint, now time.Time, limit int) ([]models.Reminder, error) {
+	var reminders []models.Reminder
+	if len(userIDs) == 0 {
+		return reminders, nil
+	}
+	result := db.DB.
+		Where("user_id IN ? AND remind_at <= ? AND delivered_at IS NULL", userIDs, now).
+		Order("remind_at").
+		Limit(limit).
+		Find(&reminders)
+	return reminders, result.Error
+}
+
+// MarkReminderDelivered отмечает напоминание доставленным
+func (db *Database) MarkReminderDelivered(reminderID uint, at time.Time) error {
+	return db.DB.Model(&models.Reminder{}).Where("id = ?", reminderID).UpdateColumn("delivered_at", at).Error
+}
@@ -0,0 +1,133 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"messenger/models"
+)
+
+// Ошибки ограничений участников
+var (
+	ErrUserBanned          = errors.New("пользователь заблокирован в чате")
+	ErrRestrictionNotFound = errors.New("действующее ограничение не найдено")
+)
+
+// RestrictionInfo - действующее ограничение с данными пользователя
+type RestrictionInfo struct {
+	models.ChatRestriction
+	Username string `json:"username"`
+	Avatar   string `json:"avatar,omitempty"`
+}
+
+// activeRestrictions ограничивает запрос действующими на момент now ограничениями
+func activeRestrictions(tx *gorm.DB, now time.Time) *gorm.DB {
+	return tx.Where("chat_restrictions.lifted_at IS NULL AND (chat_restrictions.expires_at IS NULL OR chat_restrictions.expires_at > ?)", now)
+}
+
+// RestrictChatMember накладывает ограничение на пользователя. Действующее ограничение того же
+// вида заменяется новым. Блокировка и исключение выводят пользователя из чата, заглушить
+// можно только участника. Если пользователь был исключен, возвращаются последствия исключения.
+func (db *Database) RestrictChatMember(restriction *models.ChatRestriction) (*MemberRemoval, error) {
+	var removal *MemberRemoval
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		isMember := true
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("chat_id = ? AND user_id = ?", restriction.ChatID, restriction.UserID).
+			First(&models.ChatUser{}).Error; err != nil {
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+			isMember = false
+		}
+		// Заблокировать можно и того, кто еще не вступил, чтобы он не смог вступить
+		if !isMember && restriction.Type != models.ChatRestrictionBan {
+			return ErrNotChatMember
+		}
+
+		if err := liftRestriction(tx, restriction.ChatID, restriction.UserID, restriction.Type,
+			restriction.CreatedBy, restriction.CreatedAt); err != nil && !errors.Is(err, ErrRestrictionNotFound) {
+			return err
+		}
+		if err := tx.Create(restriction).Error; err != nil {
+			return err
+		}
+
+		if !isMember || restriction.Type == models.ChatRestrictionMute {
+			return nil
+		}
+		var err error
+		removal, err = removeChatMember(tx, restriction.ChatID, restriction.UserID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return removal, nil
+}
+
+// LiftChatRestriction досрочно снимает действующее ограничение указанного вида
+func (db *Database) LiftChatRestriction(chatID, userID uint, restrictionType models.ChatRestrictionType, liftedBy uint, now time.Time) error {
+	return liftRestriction(db.DB, chatID, userID, restrictionType, liftedBy, now)
+}
+
+// liftRestriction снимает действующие ограничения вида restrictionType в рамках tx
+func liftRestriction(tx *gorm.DB, chatID, userID uint, restrictionType models.ChatRestrictionType, liftedBy uint, now time.Time) error {
+	result := activeRestrictions(tx.Model(&models.ChatRestriction{}), now).
+		Where("chat_id = ? AND user_id = ? AND type = ?", chatID, userID, restrictionType).
+		Updates(map[string]interface{}{"lifted_by": liftedBy, "lifted_at": now})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrRestrictionNotFound
+	}
+	return nil
+}
+
+// GetActiveRestriction возвращает действующее ограничение пользователя указанного вида
+func (db *Database) GetActiveRestriction(chatID, userID uint, restrictionType models.ChatRestrictionType, now time.Time) (*models.ChatRestriction, error) {
+	var restriction models.ChatRestriction
+	err := activeRestrictions(db.DB, now).
+		Where("chat_id = ? AND user_id = ? AND type = ?", chatID, userID, restrictionType).
+		Order("created_at DESC").
+		First(&restriction).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrRestrictionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &restriction, nil
+}
+
+// GetActiveChatRestrictions возвращает действующие ограничения чата, начиная с новых
+func (db *Database) GetActiveChatRestrictions(chatID uint, now time.Time) ([]RestrictionInfo, error) {
+	var restrictions []RestrictionInfo
+	err := activeRestrictions(db.DB.Table("chat_restrictions"), now).
+		Select("chat_restrictions.*, users.username, users.avatar").
+		Joins("JOIN users ON users.id = chat_restrictions.user_id AND users.deleted_at IS NULL").
+		Where("chat_restrictions.chat_id = ?", chatID).
+		Order("chat_restrictions.created_at DESC, chat_restrictions.id DESC").
+		Scan(&restrictions).Error
+	return restrictions, err
+}
+
+// checkJoinRestriction возвращает ErrUserBanned, если кому-то из пользователей запрещено
+// вступать в чат: он заблокирован или исключен и срок исключения еще не вышел
+func checkJoinRestriction(tx *gorm.DB, chatID uint, userIDs []uint, now time.Time) error {
+	var count int64
+	if err := activeRestrictions(tx.Model(&models.ChatRestriction{}), now).
+		Where("chat_id = ? AND user_id IN ? AND type IN ?", chatID, userIDs,
+			[]models.ChatRestrictionType{models.ChatRestrictionBan, models.ChatRestrictionKick}).
+		Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrUserBanned
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package database
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"messenger/models"
+)
+
+// SaveMessage добавляет сообщение в закладки пользователя.
+// Повторное добавление не считается ошибкой: возвращается существующая закладка.
+func (db *Database) SaveMessage(userID, messageID uint) (*models.SavedMessage, error) {
+	saved := models.SavedMessage{UserID: userID, MessageID: messageID}
+	err := db.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&saved).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if saved.ID == 0 {
+		if err := db.DB.Where("user_id = ? AND message_id = ?", userID, messageID).First(&saved).Error; err != nil {
+			return nil, err
+		}
+	}
+	return &saved, nil
+}
+
+// DeleteSavedMessage удаляет сообщение из закладок пользователя.
+// Возвращает true, если закладка существовала.
+func (db *Database) DeleteSavedMessage(userID, messageID uint) (bool, error) {
+	result := db.DB.Where("user_id = ? AND message_id = ?", userID, messageID).Delete(&models.SavedMessage{})
+	return result.RowsAffected > 0, result.Error
+}
+
+// GetSavedMessages возвращает закладки пользователя от новых к старым.
+// Закладки на удаленные сообщения, сообщения чатов, в которых пользователь больше
+// не состоит, и сообщения скрытой от него истории группы до вступления отфильтровываются.
+// beforeID задает курсор постраничной выборки.
+func (db *Database) GetSavedMessages(userID uint, beforeID uint, limit int) ([]models.SavedMessage, error) {
+	var saved []models.SavedMessage
+
+	query := db.DB.Select("saved_messages.*").
+		Joins("JOIN messages ON messages.id = saved_messages.message_id AND messages.deleted_at IS NULL").
+		Joins("JOIN chats ON chats.id = messages.chat_id AND chats.deleted_at IS NULL").
+		Joins("JOIN chat_users ON chat_users.chat_id = messages.chat_id AND chat_users.user_id = saved_messages.user_id").
+		Where("saved_messages.user_id = ?", userID).
+		Where("chats.type <> ? OR chats.history_visibility <> ? OR messages.created_at >= chat_users.joined_at",
+			models.ChatTypeGroup, models.HistoryVisibilityJoined)
+	if beforeID > 0 {
+		query = query.Where("saved_messages.id < ?", beforeID)
+	}
+
+	result := query.
+		Preload("Message.User").
+		Preload("Message.File").
+		Preload("Message.Poll.Options", func(tx *gorm.DB) *gorm.DB { return tx.Order("position") }).
+		Order("saved_messages.id DESC").
+		Limit(limit).
+		Find(&saved)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return saved, nil
+}
+
+// GetChatsByIDs возвращает чаты по списку ID
+func (db *Database) GetChatsByIDs(chatIDs []uint) ([]models.Chat, error) {
+	var chats []models.Chat
+	if len(chatIDs) == 0 {
+		return chats, nil
+	}
+	result := db.DB.Where("id IN ?", chatIDs).Find(&chats)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return chats, nil
+}
@@ -0,0 +1,207 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"messenger/models"
+)
+
+// MaxChatTopics - сколько тем можно создать в одном чате
+const MaxChatTopics = 100
+
+// Ошибки тем
+var (
+	ErrTopicNotFound  = errors.New("тема не найдена")
+	ErrTooManyTopics  = errors.New("в чате слишком много тем")
+	ErrTopicsMismatch = errors.New("список тем не совпадает с темами чата")
+)
+
+// TopicInfo - тема с курсором прочтения и числом непрочитанных сообщений участника
+type TopicInfo struct {
+	models.ChatTopic
+	LastSeq     uint64 `json:"last_seq"` // Номер последнего сообщения темы в чате
+	LastReadSeq uint64 `json:"last_read_seq"`
+	UnreadCount int64  `json:"unread_count"`
+}
+
+// CreateChatTopic создает тему и ставит ее последней в списке тем чата
+func (db *Database) CreateChatTopic(topic *models.ChatTopic) error {
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		// Блокировка чата не дает параллельным созданиям получить одинаковую позицию
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Select("id").
+			First(&models.Chat{}, topic.ChatID).Error; err != nil {
+			return err
+		}
+
+		var existing struct {
+			Count       int64
+			MaxPosition int
+		}
+		if err := tx.Model(&models.ChatTopic{}).
+			Select("COUNT(*) AS count, COALESCE(MAX(position), 0) AS max_position").
+			Where("chat_id = ?", topic.ChatID).
+			Scan(&existing).Error; err != nil {
+			return err
+		}
+		if existing.Count >= MaxChatTopics {
+			return ErrTooManyTopics
+		}
+
+		topic.Position = existing.MaxPosition + 1
+		return tx.Create(topic).Error
+	})
+}
+
+// GetChatTopic возвращает тему чата
+func (db *Database) GetChatTopic(chatID, topicID uint) (*models.ChatTopic, error) {
+	var topic models.ChatTopic
+	err := db.DB.Where("id = ? AND chat_id = ?", topicID, chatID).First(&topic).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrTopicNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &topic, nil
+}
+
+// UpdateChatTopic сохраняет название, значок и состояние темы
+func (db *Database) UpdateChatTopic(topic *models.ChatTopic) error {
+	return db.DB.Model(topic).Select("name", "icon", "closed").Updates(topic).Error
+}
+
+// ReorderChatTopics задает порядок тем чата. Список должен содержать все темы чата.
+func (db *Database) ReorderChatTopics(chatID uint, topicIDs []uint) error {
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		var ids []uint
+		if err := tx.Model(&models.ChatTopic{}).
+			Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("chat_id = ?", chatID).
+			Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+		if len(ids) != len(topicIDs) {
+			return ErrTopicsMismatch
+		}
+		existing := make(map[uint]bool, len(ids))
+		for _, id := range ids {
+			existing[id] = true
+		}
+		for _, id := range topicIDs {
+			if !existing[id] {
+				return ErrTopicsMismatch
+			}
+			delete(existing, id) // Повторы тоже дают несовпадение
+		}
+
+		for i, topicID := range topicIDs {
+			if err := tx.Model(&models.ChatTopic{}).
+				Where("id = ?", topicID).
+				UpdateColumn("position", i+1).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetChatTopics возвращает темы чата по порядку вместе с числом непрочитанных сообщений
+// участника. Непрочитанными считаются чужие сообщения, кроме служебных, после курсора
+// прочтения темы, отправленные после вступления участника в чат.
+func (db *Database) GetChatTopics(chatID, userID uint) ([]TopicInfo, error) {
+	var topics []TopicInfo
+	err := db.DB.Table("chat_topics").
+		Select("chat_topics.*, "+
+			"COALESCE(chat_topic_reads.last_read_seq, 0) AS last_read_seq, "+
+			"(SELECT COALESCE(MAX(messages.seq), 0) FROM messages "+
+			"WHERE messages.topic_id = chat_topics.id AND messages.deleted_at IS NULL) AS last_seq, "+
+			"(SELECT COUNT(*) FROM messages "+
+			"WHERE messages.topic_id = chat_topics.id AND messages.deleted_at IS NULL AND messages.user_id != ? AND messages.type != 'system' "+
+			"AND messages.seq > COALESCE(chat_topic_reads.last_read_seq, 0) AND messages.created_at >= chat_users.joined_at) AS unread_count",
+			userID).
+		Joins("JOIN chat_users ON chat_users.chat_id = chat_topics.chat_id AND chat_users.user_id = ?", userID).
+		Joins("LEFT JOIN chat_topic_reads ON chat_topic_reads.topic_id = chat_topics.id AND chat_topic_reads.user_id = ?", userID).
+		Where("chat_topics.chat_id = ?", chatID).
+		Order("chat_topics.position, chat_topics.id").
+		Scan(&topics).Error
+	return topics, err
+}
+
+// GetTopicUnreadCounts возвращает для чатов пользователя сумму непрочитанных сообщений
+// во всех темах, посчитанных так же, как в GetChatTopics. Чаты без непрочитанных
+// сообщений в темах в результат не попадают.
+func (db *Database) GetTopicUnreadCounts(userID uint) (map[uint]int, error) {
+	var rows []struct {
+		ChatID      uint
+		UnreadCount int
+	}
+	err := db.DB.Table("messages").
+		Select("messages.chat_id, COUNT(*) AS unread_count").
+		Joins("JOIN chat_users ON chat_users.chat_id = messages.chat_id AND chat_users.user_id = ?", userID).
+		Joins("LEFT JOIN chat_topic_reads ON chat_topic_reads.topic_id = messages.topic_id AND chat_topic_reads.user_id = ?", userID).
+		Where("messages.topic_id IS NOT NULL AND messages.deleted_at IS NULL AND messages.user_id != ? AND messages.type != 'system'", userID).
+		Where("messages.seq > COALESCE(chat_topic_reads.last_read_seq, 0) AND messages.created_at >= chat_users.joined_at").
+		Group("messages.chat_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[uint]int, len(rows))
+	for _, row := range rows {
+		counts[row.ChatID] = row.UnreadCount
+	}
+	return counts, nil
+}
+
+// GetTopicMessages возвращает до limit последних сообщений темы с номером меньше beforeSeq
+// (0 - с конца) в хронологическом порядке. Если since не nil, возвращаются только
+// сообщения, отправленные не раньше него.
+func (db *Database) GetTopicMessages(chatID, topicID uint, since *time.Time, beforeSeq uint64, limit int) ([]models.Message, error) {
+	var messages []models.Message
+
+	query := db.DB.Preload("User").
+		Preload("File").
+		Preload("Poll.Options", func(tx *gorm.DB) *gorm.DB { return tx.Order("position") }).
+		Where("chat_id = ? AND topic_id = ?", chatID, topicID)
+	if beforeSeq > 0 {
+		query = query.Where("seq < ?", beforeSeq)
+	}
+	if since != nil {
+		query = query.Where("created_at >= ?", *since)
+	}
+	if err := query.Order("seq DESC").Limit(limit).Find(&messages).Error; err != nil {
+		return nil, err
+	}
+
+	// Меняем порядок на хронологический
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// MarkTopicRead сдвигает курсор прочтения темы участником до seq. Курсор только растет.
+// Возвращает true, если курсор действительно сдвинулся.
+func (db *Database) MarkTopicRead(topicID, userID uint, seq uint64) (bool, error) {
+	now := time.Now()
+	read := models.ChatTopicRead{
+		TopicID:     topicID,
+		UserID:      userID,
+		LastReadSeq: seq,
+		LastReadAt:  &now,
+	}
+	result := db.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "topic_id"}, {Name: "user_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"last_read_seq": seq, "last_read_at": now}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			clause.Expr{SQL: "chat_topic_reads.last_read_seq < ?", Vars: []interface{}{seq}},
+		}},
+	}).Create(&read)
+	return result.RowsAffected > 0, result.Error
+}
@@ -0,0 +1,37 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm/clause"
+
+	"messenger/models"
+)
+
+// VoiceListener - участник чата, прослушавший голосовое сообщение
+type VoiceListener struct {
+	UserID     uint      `json:"user_id"`
+	Username   string    `json:"username"`
+	Avatar     string    `json:"avatar,omitempty"`
+	ListenedAt time.Time `json:"listened_at"`
+}
+
+// MarkVoiceListened отмечает прослушивание голосового сообщения.
+// Возвращает true, если пользователь прослушал его впервые.
+func (db *Database) MarkVoiceListened(messageID, userID uint, at time.Time) (bool, error) {
+	listen := models.VoiceListen{MessageID: messageID, UserID: userID, ListenedAt: at}
+	result := db.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&listen)
+	return result.RowsAffected > 0, result.Error
+}
+
+// GetVoiceListeners возвращает участников чата, прослушавших голосовое сообщение
+func (db *Database) GetVoiceListeners(messageID uint) ([]VoiceListener, error) {
+	var listeners []VoiceListener
+	err := db.DB.Table("voice_listens").
+		Select("voice_listens.user_id, users.username, users.avatar, voice_listens.listened_at").
+		Joins("JOIN users ON users.id = voice_listens.user_id").
+		Where("voice_listens.message_id = ?", messageID).
+		Order("voice_listens.listened_at").
+		Scan(&listeners).Error
+	return listeners, err
+}
@@ -0,0 +1,239 @@
+// Package export записывает историю чата в форматах JSON, HTML и текст.
+//
+// Писатели работают потоково: сообщения передаются по одному и сразу пишутся
+// в выходной поток, поэтому размер истории не ограничен объемом памяти.
+package export
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+	"time"
+
+	"messenger/richtext"
+)
+
+// Поддерживаемые форматы выгрузки
+const (
+	FormatJSON = "json"
+	FormatHTML = "html"
+	FormatText = "txt"
+)
+
+// ChatInfo описывает выгружаемый чат
+type ChatInfo struct {
+	ID         uint      `json:"id"`
+	Name       string    `json:"name"`
+	Type       string    `json:"type"`
+	ExportedAt time.Time `json:"exported_at"`
+}
+
+// FileRef описывает файл, прикрепленный к сообщению
+type FileRef struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	MimeType string `json:"mime_type"`
+	URL      string `json:"url"`
+}
+
+// Message описывает выгружаемое сообщение
+type Message struct {
+	ID        uint              `json:"id"`
+	Seq       uint64            `json:"seq"`
+	AuthorID  uint              `json:"author_id"`
+	Author    string            `json:"author"`
+	Type      string            `json:"type"`
+	Text      string            `json:"text"`
+	Entities  []richtext.Entity `json:"entities,omitempty"`
+	File      *FileRef          `json:"file,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	EditedAt  *time.Time        `json:"edited_at,omitempty"`
+}
+
+// Writer записывает выгрузку чата: Begin, затем WriteMessage для каждого сообщения, затем End
+type Writer interface {
+	Begin(chat ChatInfo) error
+	WriteMessage(message Message) error
+	End() error
+}
+
+// IsSupported проверяет, поддерживается ли формат
+func IsSupported(format string) bool {
+	switch format {
+	case FormatJSON, FormatHTML, FormatText:
+		return true
+	}
+	return false
+}
+
+// ContentType возвращает MIME-тип файла выгрузки
+func ContentType(format string) string {
+	switch format {
+	case FormatJSON:
+		return "application/json; charset=utf-8"
+	case FormatHTML:
+		return "text/html; charset=utf-8"
+	default:
+		return "text/plain; charset=utf-8"
+	}
+}
+
+// NewWriter создает писателя для формата
+func NewWriter(format string, w io.Writer) (Writer, error) {
+	bw := bufio.NewWriter(w)
+	switch format {
+	case FormatJSON:
+		return &jsonWriter{w: bw}, nil
+	case FormatHTML:
+		return &htmlWriter{w: bw}, nil
+	case FormatText:
+		return &textWriter{w: bw}, nil
+	}
+	return nil, fmt.Errorf("неподдерживаемый формат выгрузки: %s", format)
+}
+
+// jsonWriter пишет объект {"chat": ..., "messages": [...]}
+type jsonWriter struct {
+	w     *bufio.Writer
+	count int
+}
+
+func (j *jsonWriter) Begin(chat ChatInfo) error {
+	data, err := json.Marshal(chat)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(j.w, "{\"chat\":%s,\"messages\":[", data)
+	return err
+}
+
+func (j *jsonWriter) WriteMessage(message Message) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	if j.count > 0 {
+		j.w.WriteByte(',')
+	}
+	j.w.WriteByte('\n')
+	j.count++
+	_, err = j.w.Write(data)
+	return err
+}
+
+func (j *jsonWriter) End() error {
+	if _, err := j.w.WriteString("\n]}\n"); err != nil {
+		return err
+	}
+	return j.w.Flush()
+}
+
+// htmlWriter пишет самодостаточную HTML-страницу
+type htmlWriter struct {
+	w *bufio.Writer
+}
+
+func (h *htmlWriter) Begin(chat ChatInfo) error {
+	title := html.EscapeString(chatTitle(chat))
+	_, err := fmt.Fprintf(h.w, `<!DOCTYPE html>
+<html lang="ru">
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<style>
+body{font-family:sans-serif;max-width:800px;margin:0 auto;padding:16px;color:#222}
+.message{padding:8px 0;border-bottom:1px solid #eee}
+.author{font-weight:bold}
+.meta{color:#888;font-size:12px;margin-left:8px}
+.text{margin-top:4px;white-space:pre-wrap;word-wrap:break-word}
+.file{margin-top:4px;font-size:14px}
+</style>
+</head>
+<body>
+<h1>%s</h1>
+<p class="meta">Выгружено %s</p>
+`, title, title, chat.ExportedAt.Format("02.01.2006 15:04:05"))
+	return err
+}
+
+func (h *htmlWriter) WriteMessage(message Message) error {
+	fmt.Fprintf(h.w, "<div class=\"message\" id=\"message-%d\">\n<span class=\"author\">%s</span><span class=\"meta\">%s",
+		message.ID, html.EscapeString(message.Author), message.CreatedAt.Format("02.01.2006 15:04:05"))
+	if message.EditedAt != nil {
+		h.w.WriteString(" (изменено)")
+	}
+	h.w.WriteString("</span>\n")
+	if message.Text != "" {
+		fmt.Fprintf(h.w, "<div class=\"text\">%s</div>\n", html.EscapeString(message.Text))
+	}
+	if message.File != nil {
+		fmt.Fprintf(h.w, "<div class=\"file\">Файл: <a href=\"%s\">%s</a> (%s)</div>\n",
+			html.EscapeString(message.File.URL), html.EscapeString(message.File.Name), formatSize(message.File.Size))
+	}
+	_, err := h.w.WriteString("</div>\n")
+	return err
+}
+
+func (h *htmlWriter) End() error {
+	if _, err := h.w.WriteString("</body>\n</html>\n"); err != nil {
+		return err
+	}
+	return h.w.Flush()
+}
+
+// textWriter пишет историю в виде простого текста
+type textWriter struct {
+	w *bufio.Writer
+}
+
+func (t *textWriter) Begin(chat ChatInfo) error {
+	_, err := fmt.Fprintf(t.w, "%s\nВыгружено %s\n\n", chatTitle(chat), chat.ExportedAt.Format("02.01.2006 15:04:05"))
+	return err
+}
+
+func (t *textWriter) WriteMessage(message Message) error {
+	fmt.Fprintf(t.w, "[%s] %s", message.CreatedAt.Format("02.01.2006 15:04:05"), message.Author)
+	if message.EditedAt != nil {
+		t.w.WriteString(" (изменено)")
+	}
+	t.w.WriteString(":\n")
+	if message.Text != "" {
+		// Многострочный текст выводится с отступом
+		t.w.WriteString("  " + strings.ReplaceAll(message.Text, "\n", "\n  ") + "\n")
+	}
+	if message.File != nil {
+		fmt.Fprintf(t.w, "  [Файл: %s, %s] %s\n", message.File.Name, formatSize(message.File.Size), message.File.URL)
+	}
+	_, err := t.w.WriteString("\n")
+	return err
+}
+
+func (t *textWriter) End() error {
+	return t.w.Flush()
+}
+
+func chatTitle(chat ChatInfo) string {
+	if chat.Name != "" {
+		return chat.Name
+	}
+	return fmt.Sprintf("Чат #%d", chat.ID)
+}
+
+// formatSize возвращает размер файла в удобном для чтения виде
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d Б", size)
+	}
+	value, suffix := float64(size)/unit, "КБ"
+	for _, next := range []string{"МБ", "ГБ"} {
+		if value < unit {
+			break
+		}
+		value, suffix = value/unit, next
+	}
+	return fmt.Sprintf("%.1f %s", value, suffix)
+}
@@ -1,38 +1,124 @@
 package models
 
 import (
+	"errors"
+	"fmt"
 	"time"
 
 	"gorm.io/gorm"
 )
 
+// Типы чатов
+const (
+	ChatTypeDirect  = "direct" // Личный чат двух пользователей
+	ChatTypeGroup   = "group"
+	ChatTypeChannel = "channel" // Публикуют администраторы, подписчики только читают
+)
+
+// Видимость истории группы для участников
+const (
+	HistoryVisibilityFull   = "full"   // Вся история чата
+	HistoryVisibilityJoined = "joined" // Только сообщения с момента вступления участника
+)
+
 // Chat представляет чат между пользователями
 type Chat struct {
-	ID           uint           `gorm:"primarykey" json:"id"`
-	Name         string         `json:"name"`                         // Название чата
-	Type         string         `gorm:"size:20;not null" json:"type"` // тип: "personal" или "group"
-	CreatedAt    time.Time      `json:"created_at"`
-	UpdatedAt    time.Time      `json:"updated_at"`
-	LastActivity time.Time      `json:"last_activity"` // Время последней активности
-	DeletedAt    gorm.DeletedAt `gorm:"index" json:"-"`
+	ID                uint            `gorm:"primarykey" json:"id"`
+	Name              string          `json:"name"`                                                                       // Название чата
+	Type              string          `gorm:"size:20;not null" json:"type"`                                               // тип: "direct", "group" или "channel"
+	DirectKey         *string         `gorm:"size:41;uniqueIndex:idx_chats_direct_key,where:deleted_at IS NULL" json:"-"` // Пара собеседников личного чата, см. DirectChatKey
+	CreatedAt         time.Time       `json:"created_at"`
+	UpdatedAt         time.Time       `json:"updated_at"`
+	LastActivity      time.Time       `json:"last_activity"`                                           // Время последней активности
+	LastSeq           uint64          `gorm:"not null;default:0" json:"last_seq"`                      // Порядковый номер последнего сообщения
+	LastMessageID     *uint           `json:"last_message_id,omitempty"`                               // Последнее неудаленное сообщение, для списка чатов
+	Permissions       ChatPermissions `gorm:"type:jsonb" json:"permissions,omitempty"`                 // Матрица прав; nil - значения по умолчанию
+	SignMessages      bool            `gorm:"not null;default:false" json:"sign_messages"`             // Посты канала подписываются именем автора
+	SlowMode          int             `gorm:"not null;default:0" json:"slow_mode"`                     // Медленный режим: секунд между сообщениями участника, 0 - выключен
+	HistoryVisibility string          `gorm:"size:20;not null;default:full" json:"history_visibility"` // Видимость истории группы, см. HistoryVisibilityFull
+	Description       string          `gorm:"size:255;not null;default:''" json:"description,omitempty"`
+	Handle            *string         `gorm:"size:32;uniqueIndex:idx_chats_handle,where:deleted_at IS NULL" json:"handle,omitempty"` // Публичное имя группы или канала в нижнем регистре
+	Avatar            string          `gorm:"not null;default:''" json:"avatar,omitempty"`                                           // Ссылка на изображение, как у пользователей
+	AvatarFileID      *uint           `json:"-"`                                                                                     // Файл изображения в подсистеме файлов
+	DeletedAt         gorm.DeletedAt  `gorm:"index" json:"-"`
 
 	// Связи с другими моделями
 	Users    []User    `gorm:"many2many:chat_users;" json:"users,omitempty"`
 	Messages []Message `json:"messages,omitempty"`
 }
 
+// DirectChatKey возвращает ключ личного чата пары пользователей. Ключ не зависит
+// от порядка пользователей, а уникальный индекс по нему не дает завести второй чат той же пары.
+func DirectChatKey(userA, userB uint) string {
+	if userA > userB {
+		userA, userB = userB, userA
+	}
+	return fmt.Sprintf("%d:%d", userA, userB)
+}
+
+// HasRoles сообщает, есть ли в чате роли и матрица прав: в группах и каналах они есть,
+// в личных чатах собеседники равноправны
+func (c *Chat) HasRoles() bool {
+	return c.Type == ChatTypeGroup || c.Type == ChatTypeChannel
+}
+
+// DefaultPermissions возвращает матрицу прав по умолчанию для типа чата
+func (c *Chat) DefaultPermissions() ChatPermissions {
+	if c.Type == ChatTypeChannel {
+		return DefaultChannelPermissions
+	}
+	return DefaultChatPermissions
+}
+
+// Allows проверяет, разрешено ли действие участнику с указанной ролью
+func (c *Chat) Allows(role ChatRole, perm ChatPermission) bool {
+	return role == ChatRoleOwner || role.AtLeast(c.Permissions.MinRole(perm, c.DefaultPermissions()))
+}
+
+// HistoryVisibleSince возвращает, с какого момента участнику видна история чата,
+// или nil, если видна вся история
+func (c *Chat) HistoryVisibleSince(member *ChatUser) *time.Time {
+	if c.Type != ChatTypeGroup || c.HistoryVisibility != HistoryVisibilityJoined {
+		return nil
+	}
+	since := member.JoinedAt
+	return &since
+}
+
+// ValidatePermissions проверяет изменения матрицы прав. В канале публиковать
+// могут только администраторы.
+func (c *Chat) ValidatePermissions(p ChatPermissions) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	if role, ok := p[PermSendMessages]; ok && c.Type == ChatTypeChannel && !role.AtLeast(ChatRoleAdmin) {
+		return errors.New("в канале публиковать могут только администраторы")
+	}
+	return nil
+}
+
+// EffectivePermissions возвращает полную матрицу прав с учетом значений по умолчанию
+func (c *Chat) EffectivePermissions() ChatPermissions {
+	return c.Permissions.Effective(c.DefaultPermissions())
+}
+
 // ChatUser представляет связь между чатом и пользователем
 type ChatUser struct {
 	ChatID   uint      `gorm:"primaryKey;autoIncrement:false" json:"chat_id"`
 	UserID   uint      `gorm:"primaryKey;autoIncrement:false" json:"user_id"`
 	JoinedAt time.Time `json:"joined_at"`
-	IsAdmin  bool      `json:"is_admin"`
-}
+	Role     ChatRole  `gorm:"size:20;not null;default:member" json:"role"`
+
+	// Курсоры доставки и прочтения: участник получил/прочитал все сообщения чата до seq включительно
+	LastDeliveredSeq uint64     `gorm:"not null;default:0" json:"last_delivered_seq"`
+	LastDeliveredAt  *time.Time `json:"last_delivered_at,omitempty"`
+	LastReadSeq      uint64     `gorm:"not null;default:0" json:"last_read_seq"`
+	LastReadAt       *time.Time `json:"last_read_at,omitempty"`
+	UnreadCount      int        `gorm:"not null;default:0" json:"unread_count"` // Чужие неудаленные сообщения общей ленты после курсора прочтения
 
-// MessageRead представляет запись о прочтении сообщения
-type MessageRead struct {
-	ID        uint      `gorm:"primarykey" json:"id"`
-	MessageID uint      `gorm:"index" json:"message_id"`
-	UserID    uint      `gorm:"index" json:"user_id"`
-	ReadAt    time.Time `json:"read_at"`
+	// Личные настройки участника: видны только ему самому
+	Archived   bool       `gorm:"not null;default:false" json:"archived"`
+	PinOrder   int        `gorm:"not null;default:0" json:"pin_order"` // Место среди закрепленных чатов, начиная с 1; 0 - не закреплен
+	MutedUntil *time.Time `json:"muted_until,omitempty"`               // Уведомления отключены до этого момента
+	Folder     string     `gorm:"size:64;not null;default:''" json:"folder,omitempty"`
 }
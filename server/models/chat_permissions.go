@@ -0,0 +1,136 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+)
+
+// ChatRole - роль участника в групповом чате
+type ChatRole string
+
+const (
+	ChatRoleOwner     ChatRole = "owner" // Создатель чата, всегда один
+	ChatRoleAdmin     ChatRole = "admin"
+	ChatRoleModerator ChatRole = "moderator"
+	ChatRoleMember    ChatRole = "member"
+)
+
+// ChatRoles - все роли от старшей к младшей
+var ChatRoles = []ChatRole{ChatRoleOwner, ChatRoleAdmin, ChatRoleModerator, ChatRoleMember}
+
+// Ранги ролей: роль с большим рангом имеет все права ролей с меньшим
+var chatRoleRanks = map[ChatRole]int{
+	ChatRoleMember:    1,
+	ChatRoleModerator: 2,
+	ChatRoleAdmin:     3,
+	ChatRoleOwner:     4,
+}
+
+// Valid проверяет, что роль известна
+func (r ChatRole) Valid() bool {
+	_, ok := chatRoleRanks[r]
+	return ok
+}
+
+// Rank возвращает ранг роли. Пустая роль считается ролью участника.
+func (r ChatRole) Rank() int {
+	if r == "" {
+		return chatRoleRanks[ChatRoleMember]
+	}
+	return chatRoleRanks[r]
+}
+
+// AtLeast проверяет, что роль не ниже указанной
+func (r ChatRole) AtLeast(min ChatRole) bool {
+	return r.Rank() >= min.Rank()
+}
+
+// ChatPermission - действие в чате, доступ к которому настраивается
+type ChatPermission string
+
+const (
+	PermSendMessages   ChatPermission = "send_messages"
+	PermAddMembers     ChatPermission = "add_members"
+	PermPinMessages    ChatPermission = "pin_messages"
+	PermChangeInfo     ChatPermission = "change_info"
+	PermDeleteMessages ChatPermission = "delete_messages" // Удаление чужих сообщений
+	PermStartCalls     ChatPermission = "start_calls"
+)
+
+// DefaultChatPermissions - минимальные роли для действий в новом групповом чате
+var DefaultChatPermissions = ChatPermissions{
+	PermSendMessages:   ChatRoleMember,
+	PermAddMembers:     ChatRoleAdmin,
+	PermPinMessages:    ChatRoleModerator,
+	PermChangeInfo:     ChatRoleAdmin,
+	PermDeleteMessages: ChatRoleModerator,
+	PermStartCalls:     ChatRoleMember,
+}
+
+// DefaultChannelPermissions - минимальные роли для действий в новом канале.
+// Подписчики канала только читают.
+var DefaultChannelPermissions = ChatPermissions{
+	PermSendMessages:   ChatRoleAdmin,
+	PermAddMembers:     ChatRoleAdmin,
+	PermPinMessages:    ChatRoleAdmin,
+	PermChangeInfo:     ChatRoleAdmin,
+	PermDeleteMessages: ChatRoleAdmin,
+	PermStartCalls:     ChatRoleAdmin,
+}
+
+// ChatPermissions - матрица прав чата: минимальная роль для каждого действия.
+// Действия, отсутствующие в матрице, берутся из матрицы по умолчанию для типа чата.
+// В БД хранится как jsonb.
+type ChatPermissions map[ChatPermission]ChatRole
+
+// MinRole возвращает минимальную роль, которой разрешено действие
+func (p ChatPermissions) MinRole(perm ChatPermission, defaults ChatPermissions) ChatRole {
+	if role, ok := p[perm]; ok {
+		return role
+	}
+	return defaults[perm]
+}
+
+// Effective возвращает полную матрицу с учетом значений по умолчанию
+func (p ChatPermissions) Effective(defaults ChatPermissions) ChatPermissions {
+	result := make(ChatPermissions, len(defaults))
+	for perm := range defaults {
+		result[perm] = p.MinRole(perm, defaults)
+	}
+	return result
+}
+
+// Validate проверяет, что матрица содержит только известные действия и роли
+func (p ChatPermissions) Validate() error {
+	for perm, role := range p {
+		if _, ok := DefaultChatPermissions[perm]; !ok {
+			return errors.New("неизвестное право: " + string(perm))
+		}
+		if !role.Valid() {
+			return errors.New("неизвестная роль: " + string(role))
+		}
+	}
+	return nil
+}
+
+func (p ChatPermissions) Value() (driver.Value, error) {
+	if p == nil {
+		return nil, nil
+	}
+	return json.Marshal(p)
+}
+
+func (p *ChatPermissions) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*p = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, p)
+	case string:
+		return json.Unmarshal([]byte(v), p)
+	default:
+		return errors.New("некорректное значение прав чата")
+	}
+}
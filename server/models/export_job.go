@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+)
+
+// Статусы фоновой выгрузки чата
+const (
+	ExportStatusPending = "pending"
+	ExportStatusRunning = "running"
+	ExportStatusDone    = "done"
+	ExportStatusFailed  = "failed"
+)
+
+// ExportJob представляет фоновую выгрузку истории чата
+type ExportJob struct {
+	ID         uint       `gorm:"primarykey" json:"id"`
+	ChatID     uint       `gorm:"index;not null" json:"chat_id"`
+	UserID     uint       `gorm:"index;not null" json:"user_id"` // Кто запросил выгрузку
+	Format     string     `gorm:"size:10;not null" json:"format"`
+	Status     string     `gorm:"size:20;not null" json:"status"`
+	Messages   int        `json:"messages"`            // Число выгруженных сообщений
+	FilePath   string     `json:"-"`                   // Путь к файлу результата
+	FileSize   int64      `json:"file_size,omitempty"` // Размер файла результата
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"` // После этого времени файл удаляется
+}
@@ -1,6 +1,9 @@
 package models
 
 import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"time"
 
 	"gorm.io/gorm"
@@ -27,7 +30,63 @@ type File struct {
 	FilePath      string         `json:"-" gorm:"not null"` // Скрываем от клиента
 	MimeType      string         `json:"mime_type" gorm:"not null"`
 	DownloadToken string         `json:"download_token" gorm:"not null;uniqueIndex"`
+	DurationMs    int64          `json:"duration_ms,omitempty"`                // Длительность аудиозаписи
+	Waveform      Waveform       `json:"waveform,omitempty" gorm:"type:bytea"` // Форма волны аудиозаписи
 	CreatedAt     time.Time      `json:"created_at"`
 	UpdatedAt     time.Time      `json:"updated_at"`
 	DeletedAt     gorm.DeletedAt `json:"-" gorm:"index"`
 }
+
+// Waveform - форма волны аудиозаписи: отсчеты громкости от 0 до 255.
+// В JSON передается массивом чисел, в БД хранится как bytea.
+type Waveform []byte
+
+func (w Waveform) MarshalJSON() ([]byte, error) {
+	if w == nil {
+		return []byte("null"), nil
+	}
+	values := make([]int, len(w))
+	for i, v := range w {
+		values[i] = int(v)
+	}
+	return json.Marshal(values)
+}
+
+func (w *Waveform) UnmarshalJSON(data []byte) error {
+	var values []int
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	if values == nil {
+		*w = nil
+		return nil
+	}
+	result := make(Waveform, len(values))
+	for i, v := range values {
+		if v < 0 || v > 255 {
+			return errors.New("отсчет формы волны вне диапазона 0..255")
+		}
+		result[i] = byte(v)
+	}
+	*w = result
+	return nil
+}
+
+func (w Waveform) Value() (driver.Value, error) {
+	if w == nil {
+		return nil, nil
+	}
+	return []byte(w), nil
+}
+
+func (w *Waveform) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*w = nil
+	case []byte:
+		*w = append(Waveform(nil), v...)
+	default:
+		return errors.New("некорректное значение формы волны")
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+)
+
+// Источники импорта истории
+const (
+	ImportSourceTelegram = "telegram"
+)
+
+// ImportedChat связывает чат из внешней системы с созданным для него чатом
+type ImportedChat struct {
+	ID         uint      `gorm:"primarykey" json:"id"`
+	Source     string    `gorm:"size:20;not null;uniqueIndex:idx_imported_chats_external,priority:1" json:"source"`
+	ExternalID string    `gorm:"size:64;not null;uniqueIndex:idx_imported_chats_external,priority:2" json:"external_id"`
+	ChatID     uint      `gorm:"index;not null" json:"chat_id"`
+	ImportedBy uint      `json:"imported_by"` // Администратор, выполнивший первый импорт
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"` // Время последнего импорта
+}
+
+// ImportedMessage отмечает уже импортированное сообщение, чтобы повторный импорт его пропускал
+type ImportedMessage struct {
+	ImportedChatID uint  `gorm:"primaryKey;autoIncrement:false" json:"imported_chat_id"`
+	ExternalID     int64 `gorm:"primaryKey;autoIncrement:false" json:"external_id"`
+	MessageID      uint  `gorm:"index;not null" json:"message_id"`
+}
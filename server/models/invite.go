@@ -0,0 +1,38 @@
+package models
+
+import (
+	"time"
+)
+
+// ChatInvite - пригласительная ссылка в групповой чат
+type ChatInvite struct {
+	ID               uint       `gorm:"primarykey" json:"id"`
+	ChatID           uint       `gorm:"index;not null" json:"chat_id"`
+	Code             string     `gorm:"size:32;uniqueIndex;not null" json:"code"`
+	Name             string     `gorm:"size:100" json:"name,omitempty"` // Подпись, чтобы отличать ссылки друг от друга
+	CreatedBy        uint       `gorm:"not null" json:"created_by"`
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+	MaxUses          int        `gorm:"not null;default:0" json:"max_uses"` // 0 - без ограничения
+	UseCount         int        `gorm:"not null;default:0" json:"use_count"`
+	ApprovalRequired bool       `gorm:"not null;default:false" json:"approval_required"` // Вступление требует одобрения администратора
+	RevokedAt        *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+}
+
+// IsActive проверяет, можно ли вступить в чат по ссылке
+func (i *ChatInvite) IsActive(now time.Time) bool {
+	if i.RevokedAt != nil {
+		return false
+	}
+	if i.ExpiresAt != nil && !now.Before(*i.ExpiresAt) {
+		return false
+	}
+	return i.MaxUses == 0 || i.UseCount < i.MaxUses
+}
+
+// ChatInviteUse отмечает вступление пользователя в чат по ссылке
+type ChatInviteUse struct {
+	InviteID uint      `gorm:"primaryKey;autoIncrement:false" json:"invite_id"`
+	UserID   uint      `gorm:"primaryKey;autoIncrement:false" json:"user_id"`
+	JoinedAt time.Time `gorm:"not null" json:"joined_at"`
+}
@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+)
+
+// JoinRequestStatus - состояние заявки на вступление в чат
+type JoinRequestStatus string
+
+const (
+	JoinRequestPending  JoinRequestStatus = "pending"
+	JoinRequestApproved JoinRequestStatus = "approved"
+	JoinRequestDeclined JoinRequestStatus = "declined"
+	JoinRequestExpired  JoinRequestStatus = "expired" // Не рассмотрена до истечения срока
+)
+
+// ChatJoinRequest - заявка на вступление в чат по ссылке, требующей одобрения администратора.
+// У пользователя может быть только одна рассматриваемая заявка в чат.
+type ChatJoinRequest struct {
+	ID        uint              `gorm:"primarykey" json:"id"`
+	ChatID    uint              `gorm:"not null;index;uniqueIndex:idx_chat_join_requests_pending,where:status = 'pending'" json:"chat_id"`
+	UserID    uint              `gorm:"not null;uniqueIndex:idx_chat_join_requests_pending" json:"user_id"`
+	InviteID  uint              `gorm:"not null" json:"invite_id"`
+	Status    JoinRequestStatus `gorm:"size:20;not null;default:pending;index" json:"status"`
+	CreatedAt time.Time         `json:"created_at"`
+	ExpiresAt time.Time         `gorm:"not null" json:"expires_at"`
+	DecidedBy *uint             `json:"decided_by,omitempty"`
+	DecidedAt *time.Time        `json:"decided_at,omitempty"`
+}
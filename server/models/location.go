@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+)
+
+// Ограничения трансляции местоположения
+const (
+	LiveLocationMinPeriod = time.Minute
+	LiveLocationMaxPeriod = 24 * time.Hour
+)
+
+// LiveLocation описывает трансляцию местоположения. Текущие координаты хранятся
+// в шифрованном содержимом сообщения, здесь - только время действия.
+type LiveLocation struct {
+	MessageID uint       `gorm:"primaryKey;autoIncrement:false" json:"message_id"`
+	ChatID    uint       `gorm:"index;not null" json:"chat_id"`
+	UserID    uint       `gorm:"not null" json:"user_id"`
+	ExpiresAt time.Time  `gorm:"index;not null" json:"expires_at"`
+	StoppedAt *time.Time `json:"stopped_at,omitempty"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// IsActive проверяет, продолжается ли трансляция
+func (l *LiveLocation) IsActive(now time.Time) bool {
+	return l.StoppedAt == nil && now.Before(l.ExpiresAt)
+}
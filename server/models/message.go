@@ -12,35 +12,45 @@ type MessageType string
 const (
 	MessageTypeText MessageType = "text"
 	MessageTypeFile MessageType = "file"
+	MessageTypePoll MessageType = "poll"
+
+	// Голосовое сообщение: файл с аудиозаписью, длительностью и формой волны
+	MessageTypeVoice MessageType = "voice"
+
+	// Карточка контакта и местоположение: содержимое - шифрованный JSON с данными
+	MessageTypeContact  MessageType = "contact"
+	MessageTypeLocation MessageType = "location"
+
+	// Служебное сообщение: результат команды или изменение чата. UserID - инициатор.
+	MessageTypeSystem MessageType = "system"
+
+	// Действие от третьего лица (команда /me). Хранится как служебное сообщение с событием,
+	// но это содержимое участника: оно считается непрочитанным и просмотренным, как обычное.
+	MessageTypeAction MessageType = "action"
 )
 
 // Message представляет сообщение в чате
 type Message struct {
 	ID        uint           `gorm:"primarykey" json:"id"`
-	ChatID    uint           `gorm:"index" json:"chat_id"`
+	ChatID    uint           `gorm:"index;index:idx_messages_chat_seq,priority:1" json:"chat_id"`
+	Seq       uint64         `gorm:"not null;default:0;index:idx_messages_chat_seq,priority:2" json:"seq"` // Порядковый номер в чате
 	UserID    uint           `gorm:"index" json:"user_id"`
-	Content   []byte         `gorm:"type:bytea" json:"-"` // Шифрованное содержимое, не сериализуется в JSON
-	PlainText string         `gorm:"-" json:"content"`    // Расшифрованный текст, только для JSON
+	TopicID   *uint          `gorm:"index" json:"topic_id,omitempty"` // Тема группового чата; nil - общая лента
+	Content   []byte         `gorm:"type:bytea" json:"-"`             // Шифрованное содержимое, не сериализуется в JSON
+	PlainText string         `gorm:"-" json:"content"`                // Расшифрованный текст, только для JSON
+	Entities  []byte         `gorm:"type:bytea" json:"-"`             // Шифрованный список сущностей форматирования (JSON)
+	Preview   []byte         `gorm:"type:bytea" json:"-"`             // Шифрованный предпросмотр ссылки (JSON)
+	Event     []byte         `gorm:"type:bytea" json:"-"`             // Шифрованное описание служебного события (JSON)
 	Type      string         `gorm:"size:20;not null" json:"type"`
+	Views     uint64         `gorm:"not null;default:0" json:"views"`         // Просмотры поста канала
+	Anonymous bool           `gorm:"not null;default:false" json:"anonymous"` // Пост канала без подписи автора
 	FileID    *uint          `json:"file_id,omitempty"`
 	File      *File          `gorm:"foreignKey:FileID" json:"file,omitempty"`
 	CreatedAt time.Time      `json:"created_at"`
 	UpdatedAt time.Time      `json:"updated_at"`
 	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
 	User      User           `gorm:"foreignKey:UserID" json:"user"`
-}
+	Poll      *Poll          `gorm:"foreignKey:MessageID" json:"poll,omitempty"`
 
-// GroupMessage для будущей реализации групповых чатов
-type GroupMessage struct {
-	ID          uint           `json:"id" gorm:"primaryKey"`
-	SenderID    uint           `json:"sender_id" gorm:"index;not null"`
-	GroupID     uint           `json:"group_id" gorm:"index;not null"`
-	Content     string         `json:"content" gorm:"type:text"`
-	MessageType MessageType    `json:"message_type" gorm:"type:varchar(10);default:'text'"`
-	CreatedAt   time.Time      `json:"created_at"`
-	UpdatedAt   time.Time      `json:"updated_at"`
-	DeletedAt   gorm.DeletedAt `json:"-" gorm:"index"`
-
-	Sender User   `json:"-" gorm:"foreignKey:SenderID"`
-	Files  []File `json:"files,omitempty" gorm:"foreignKey:MessageID"`
+	LiveLocation *LiveLocation `gorm:"foreignKey:MessageID" json:"-"` // Только для трансляций местоположения
 }
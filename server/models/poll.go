@@ -0,0 +1,49 @@
+package models
+
+import (
+	"time"
+)
+
+// Ограничения опросов
+const (
+	PollMinOptions      = 2
+	PollMaxOptions      = 10
+	PollMaxOptionLength = 100
+)
+
+// Poll представляет опрос, привязанный к сообщению типа poll.
+// Вопрос опроса хранится в содержимом сообщения.
+type Poll struct {
+	ID             uint       `gorm:"primarykey" json:"id"`
+	MessageID      uint       `gorm:"uniqueIndex;not null" json:"message_id"`
+	ChatID         uint       `gorm:"index;not null" json:"chat_id"`
+	Anonymous      bool       `gorm:"not null;default:true" json:"anonymous"`        // Голоса не раскрываются участникам
+	MultipleChoice bool       `gorm:"not null;default:false" json:"multiple_choice"` // Можно выбрать несколько вариантов
+	ClosesAt       *time.Time `json:"closes_at,omitempty"`                           // Время автоматического закрытия
+	ClosedAt       *time.Time `json:"closed_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+
+	Options []PollOption `gorm:"foreignKey:PollID" json:"options,omitempty"`
+}
+
+// IsClosed проверяет, закрыт ли опрос вручную или по времени
+func (p *Poll) IsClosed(now time.Time) bool {
+	return p.ClosedAt != nil || (p.ClosesAt != nil && !now.Before(*p.ClosesAt))
+}
+
+// PollOption представляет вариант ответа опроса
+type PollOption struct {
+	ID       uint   `gorm:"primarykey" json:"id"`
+	PollID   uint   `gorm:"index;not null" json:"poll_id"`
+	Position int    `gorm:"not null" json:"position"`
+	Text     []byte `gorm:"type:bytea" json:"-"` // Шифрованный текст варианта
+}
+
+// PollVote представляет голос пользователя за вариант опроса
+type PollVote struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	PollID    uint      `gorm:"index;not null;uniqueIndex:idx_poll_votes_unique,priority:1" json:"poll_id"`
+	OptionID  uint      `gorm:"not null;uniqueIndex:idx_poll_votes_unique,priority:2" json:"option_id"`
+	UserID    uint      `gorm:"index;not null;uniqueIndex:idx_poll_votes_unique,priority:3" json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
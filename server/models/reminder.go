@@ -0,0 +1,16 @@
+package models
+
+import (
+	"time"
+)
+
+// Reminder представляет напоминание, созданное командой /remind
+type Reminder struct {
+	ID          uint       `gorm:"primarykey" json:"id"`
+	UserID      uint       `gorm:"not null;index:idx_reminders_pending,priority:1" json:"user_id"`
+	ChatID      uint       `gorm:"not null" json:"chat_id"`
+	Text        []byte     `gorm:"type:bytea" json:"-"` // Шифрованный текст напоминания
+	RemindAt    time.Time  `gorm:"not null;index:idx_reminders_pending,priority:2" json:"remind_at"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
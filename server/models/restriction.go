@@ -0,0 +1,34 @@
+package models
+
+import (
+	"time"
+)
+
+// ChatRestrictionType - вид ограничения участника чата
+type ChatRestrictionType string
+
+const (
+	ChatRestrictionBan  ChatRestrictionType = "ban"  // Исключен и не может вернуться в чат
+	ChatRestrictionMute ChatRestrictionType = "mute" // Не может отправлять сообщения
+	ChatRestrictionKick ChatRestrictionType = "kick" // Исключен; вернуться можно после ExpiresAt
+)
+
+// ChatRestriction - ограничение, наложенное на пользователя администратором чата.
+// Ограничение действует, пока не истек срок и оно не снято досрочно.
+type ChatRestriction struct {
+	ID        uint                `gorm:"primarykey" json:"id"`
+	ChatID    uint                `gorm:"not null;index:idx_chat_restrictions_user,priority:1" json:"chat_id"`
+	UserID    uint                `gorm:"not null;index:idx_chat_restrictions_user,priority:2" json:"user_id"`
+	Type      ChatRestrictionType `gorm:"size:10;not null" json:"type"`
+	Reason    string              `gorm:"size:255;not null;default:''" json:"reason,omitempty"`
+	CreatedBy uint                `gorm:"not null" json:"created_by"`
+	CreatedAt time.Time           `json:"created_at"`
+	ExpiresAt *time.Time          `json:"expires_at,omitempty"` // nil - бессрочно
+	LiftedBy  *uint               `json:"lifted_by,omitempty"`
+	LiftedAt  *time.Time          `json:"lifted_at,omitempty"` // Снято досрочно
+}
+
+// IsActive сообщает, действует ли ограничение в момент now
+func (r *ChatRestriction) IsActive(now time.Time) bool {
+	return r.LiftedAt == nil && (r.ExpiresAt == nil || r.ExpiresAt.After(now))
+}
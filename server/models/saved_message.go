@@ -0,0 +1,15 @@
+package models
+
+import (
+	"time"
+)
+
+// SavedMessage представляет закладку пользователя на сообщение из любого его чата
+type SavedMessage struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_saved_messages_user_message,priority:1" json:"user_id"`
+	MessageID uint      `gorm:"not null;index;uniqueIndex:idx_saved_messages_user_message,priority:2" json:"message_id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	Message Message `gorm:"foreignKey:MessageID" json:"-"`
+}
@@ -0,0 +1,59 @@
+package models
+
+// SystemEventKind - вид события, о котором сообщает служебное сообщение
+type SystemEventKind string
+
+const (
+	SystemEventMemberJoined         SystemEventKind = "member_joined"  // Вступил по пригласительной ссылке
+	SystemEventJoinApproved         SystemEventKind = "join_approved"  // Заявка цели одобрена инициатором
+	SystemEventMembersAdded         SystemEventKind = "members_added"  // Цели добавлены инициатором
+	SystemEventMemberRemoved        SystemEventKind = "member_removed" // Цель удалена инициатором
+	SystemEventMemberLeft           SystemEventKind = "member_left"
+	SystemEventChatRenamed          SystemEventKind = "chat_renamed"
+	SystemEventDescriptionChanged   SystemEventKind = "description_changed"
+	SystemEventDescriptionRemoved   SystemEventKind = "description_removed"
+	SystemEventHandleChanged        SystemEventKind = "handle_changed"
+	SystemEventHandleRemoved        SystemEventKind = "handle_removed"
+	SystemEventAvatarChanged        SystemEventKind = "avatar_changed"
+	SystemEventAvatarRemoved        SystemEventKind = "avatar_removed"
+	SystemEventHistoryVisibility    SystemEventKind = "history_visibility_changed"
+	SystemEventSlowModeChanged      SystemEventKind = "slow_mode_changed"
+	SystemEventRoleChanged          SystemEventKind = "role_changed"
+	SystemEventOwnershipTransferred SystemEventKind = "ownership_transferred"
+	SystemEventPermissionsChanged   SystemEventKind = "permissions_changed"
+	SystemEventMemberBanned         SystemEventKind = "member_banned"
+	SystemEventMemberUnbanned       SystemEventKind = "member_unbanned"
+	SystemEventMemberMuted          SystemEventKind = "member_muted"
+	SystemEventMemberUnmuted        SystemEventKind = "member_unmuted"
+	SystemEventMemberKicked         SystemEventKind = "member_kicked"
+	SystemEventAction               SystemEventKind = "action" // Действие от третьего лица (команда /me)
+)
+
+// Параметры служебных событий
+const (
+	SystemParamName       = "name"       // Новое название чата
+	SystemParamHandle     = "handle"     // Новое публичное имя чата
+	SystemParamVisibility = "visibility" // Новая видимость истории
+	SystemParamSeconds    = "seconds"    // Интервал медленного режима, 0 - выключен
+	SystemParamRole       = "role"       // Новая роль цели
+	SystemParamNewOwner   = "new_owner"  // Новый владелец после ухода прежнего
+	SystemParamExpiresAt  = "expires_at" // Окончание ограничения (RFC 3339), без него - бессрочно
+	SystemParamReason     = "reason"     // Причина ограничения
+	SystemParamText       = "text"       // Текст действия
+)
+
+// SystemEventUser - участник события. Имя сохраняется на момент события,
+// чтобы история читалась и после переименования или удаления пользователя.
+type SystemEventUser struct {
+	ID       uint   `json:"id"`
+	Username string `json:"username"`
+}
+
+// SystemEvent - структурированное описание служебного сообщения. Клиент может
+// показать его на языке пользователя; текст сообщения - готовое описание на русском.
+type SystemEvent struct {
+	Kind    SystemEventKind   `json:"kind"`
+	Actor   SystemEventUser   `json:"actor"`
+	Targets []SystemEventUser `json:"targets,omitempty"`
+	Params  map[string]string `json:"params,omitempty"`
+}
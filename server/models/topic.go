@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+)
+
+// ChatTopic - тема в групповом чате: отдельная лента сообщений со своим названием.
+// Сообщения без темы относятся к общей ленте чата.
+type ChatTopic struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	ChatID    uint      `gorm:"not null;index" json:"chat_id"`
+	Name      string    `gorm:"size:128;not null" json:"name"`
+	Icon      string    `gorm:"size:32;not null;default:''" json:"icon,omitempty"` // Эмодзи темы
+	Closed    bool      `gorm:"not null;default:false" json:"closed"`              // В закрытую тему пишут только администраторы
+	Position  int       `gorm:"not null;default:0" json:"position"`                // Порядок в списке тем, начиная с 1
+	CreatedBy uint      `gorm:"not null" json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ChatTopicRead - курсор прочтения темы участником: прочитаны все сообщения темы до seq включительно
+type ChatTopicRead struct {
+	TopicID     uint       `gorm:"primaryKey;autoIncrement:false" json:"topic_id"`
+	UserID      uint       `gorm:"primaryKey;autoIncrement:false;index" json:"user_id"`
+	LastReadSeq uint64     `gorm:"not null;default:0" json:"last_read_seq"`
+	LastReadAt  *time.Time `json:"last_read_at,omitempty"`
+}
@@ -0,0 +1,12 @@
+package models
+
+import (
+	"time"
+)
+
+// VoiceListen отмечает, что получатель прослушал голосовое сообщение
+type VoiceListen struct {
+	MessageID  uint      `gorm:"primaryKey;autoIncrement:false" json:"message_id"`
+	UserID     uint      `gorm:"primaryKey;autoIncrement:false" json:"user_id"`
+	ListenedAt time.Time `gorm:"not null" json:"listened_at"`
+}
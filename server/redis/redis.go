@@ -87,6 +87,42 @@ func (r *RedisClient) Ping(ctx context.Context) error {
 	return r.client.Ping(ctx).Err()
 }
 
+// Reserve занимает ключ на время ttl, если он свободен. Если ключ уже занят,
+// возвращает false и оставшееся время его жизни.
+func (r *RedisClient) Reserve(key string, ttl time.Duration) (bool, time.Duration, error) {
+	if !r.enabled {
+		return false, 0, fmt.Errorf("Redis client is not enabled or initialized")
+	}
+
+	ctx, cancel := context.WithTimeout(r.ctx, 2*time.Second)
+	defer cancel()
+
+	reserved, err := r.client.SetNX(ctx, key, 1, ttl).Result()
+	if err != nil || reserved {
+		return reserved, 0, err
+	}
+	remaining, err := r.client.PTTL(ctx, key).Result()
+	if err != nil {
+		return false, 0, err
+	}
+	// Ключ мог истечь между командами
+	if remaining < 0 {
+		remaining = 0
+	}
+	return false, remaining, nil
+}
+
+// Release освобождает ключ, занятый Reserve
+func (r *RedisClient) Release(key string) error {
+	if !r.enabled {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(r.ctx, 2*time.Second)
+	defer cancel()
+	return r.client.Del(ctx, key).Err()
+}
+
 // Закрытие соединения с Redis
 func (r *RedisClient) Close() error {
 	if !r.enabled {
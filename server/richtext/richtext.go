@@ -0,0 +1,427 @@
+// Package richtext разбирает подмножество markdown в текст и нормализованный список сущностей.
+//
+// Поддерживаемая разметка:
+//
+//	**жирный**, _курсив_ или *курсив*, ~~зачеркнутый~~,
+//	`код`, ```язык
+//	блок кода```, [текст](https://example.com)
+//
+// Служебные символы экранируются обратной косой чертой. Незакрытые маркеры остаются
+// в тексте как есть. HTML-теги, изображения и ссылки с небезопасными схемами отклоняются.
+//
+// Смещения и длины сущностей измеряются в кодовых единицах UTF-16, как в JavaScript-клиентах.
+package richtext
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// EntityType определяет тип сущности форматирования
+type EntityType string
+
+const (
+	EntityBold          EntityType = "bold"
+	EntityItalic        EntityType = "italic"
+	EntityStrikethrough EntityType = "strikethrough"
+	EntityCode          EntityType = "code"
+	EntityPre           EntityType = "pre"
+	EntityLink          EntityType = "link"
+)
+
+// Ограничения разметки
+const (
+	MaxEntities   = 100
+	maxURLLength  = 2048
+	maxLangLength = 20
+)
+
+// Entity описывает участок текста с форматированием
+type Entity struct {
+	Type     EntityType `json:"type"`
+	Offset   int        `json:"offset"`             // Смещение в кодовых единицах UTF-16
+	Length   int        `json:"length"`             // Длина в кодовых единицах UTF-16
+	URL      string     `json:"url,omitempty"`      // Для ссылок
+	Language string     `json:"language,omitempty"` // Для блоков кода
+}
+
+// ParseError описывает запрещенную конструкцию в тексте
+type ParseError struct {
+	Position int // Позиция в исходном тексте (в символах)
+	Reason   string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("недопустимая разметка (позиция %d): %s", e.Position, e.Reason)
+}
+
+var (
+	allowedLinkSchemes = map[string]bool{"http": true, "https": true, "mailto": true}
+	languagePattern    = regexp.MustCompile(`^[A-Za-z0-9_+#.-]+$`)
+)
+
+// Маркеры парного форматирования
+var markers = []struct {
+	text string
+	typ  EntityType
+}{
+	// Двойные маркеры проверяются раньше одинарных
+	{"**", EntityBold},
+	{"~~", EntityStrikethrough},
+	{"*", EntityItalic},
+	{"_", EntityItalic},
+}
+
+// Символы, которые можно экранировать обратной косой чертой
+const escapable = "\\*_~`[]()"
+
+type tokenKind int
+
+const (
+	tokenText tokenKind = iota
+	tokenMarker
+	tokenCode
+	tokenPre
+	tokenLink
+)
+
+type token struct {
+	kind     tokenKind
+	text     string // Текст для вывода (для маркера - сам маркер)
+	typ      EntityType
+	canOpen  bool
+	canClose bool
+	url      string
+	language string
+
+	pair int // Индекс парного маркера или -1
+}
+
+// Parse разбирает разметку и возвращает текст без маркеров и список сущностей.
+// Текст без разметки возвращается без изменений и с пустым списком сущностей.
+func Parse(input string) (string, []Entity, error) {
+	tokens, err := tokenize([]rune(input))
+	if err != nil {
+		return "", nil, err
+	}
+	pairMarkers(tokens)
+
+	var (
+		out      strings.Builder
+		offset   int
+		entities []Entity
+		open     []int // Индексы сущностей, ожидающих закрывающего маркера
+	)
+
+	write := func(s string) {
+		out.WriteString(s)
+		offset += UTF16Len(s)
+	}
+
+	for i, t := range tokens {
+		switch {
+		case t.kind == tokenMarker && t.pair > i:
+			entities = append(entities, Entity{Type: t.typ, Offset: offset})
+			open = append(open, len(entities)-1)
+		case t.kind == tokenMarker && t.pair >= 0:
+			idx := open[len(open)-1]
+			open = open[:len(open)-1]
+			entities[idx].Length = offset - entities[idx].Offset
+		case t.kind == tokenCode || t.kind == tokenPre || t.kind == tokenLink:
+			start := offset
+			write(t.text)
+			typ := map[tokenKind]EntityType{tokenCode: EntityCode, tokenPre: EntityPre, tokenLink: EntityLink}[t.kind]
+			entities = append(entities, Entity{Type: typ, Offset: start, Length: offset - start, URL: t.url, Language: t.language})
+		default:
+			write(t.text)
+		}
+	}
+
+	// Пустые сущности не несут информации
+	result := entities[:0]
+	for _, e := range entities {
+		if e.Length > 0 {
+			result = append(result, e)
+		}
+	}
+	if len(result) > MaxEntities {
+		return "", nil, &ParseError{Reason: fmt.Sprintf("слишком много элементов форматирования (максимум %d)", MaxEntities)}
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Offset != result[j].Offset {
+			return result[i].Offset < result[j].Offset
+		}
+		return result[i].Length > result[j].Length
+	})
+
+	if len(result) == 0 {
+		result = nil
+	}
+	return out.String(), result, nil
+}
+
+// tokenize разбивает текст на токены, проверяя запрещенные конструкции
+func tokenize(runes []rune) ([]token, error) {
+	var (
+		tokens []token
+		text   []rune
+	)
+
+	flush := func() {
+		if len(text) > 0 {
+			tokens = append(tokens, token{kind: tokenText, text: string(text), pair: -1})
+			text = text[:0]
+		}
+	}
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		switch {
+		case r == '\\' && i+1 < len(runes) && strings.ContainsRune(escapable, runes[i+1]):
+			text = append(text, runes[i+1])
+			i++
+
+		case r == '<' && i+1 < len(runes) && (unicode.IsLetter(runes[i+1]) || runes[i+1] == '/' || runes[i+1] == '!'):
+			return nil, &ParseError{Position: i, Reason: "HTML-разметка не поддерживается"}
+
+		case r == '!' && i+1 < len(runes) && runes[i+1] == '[':
+			if _, _, end := matchLink(runes, i+1); end > 0 {
+				return nil, &ParseError{Position: i, Reason: "изображения не поддерживаются"}
+			}
+			text = append(text, r)
+
+		case hasPrefix(runes, i, "```"):
+			end := indexFrom(runes, i+3, "```")
+			if end < 0 {
+				text = append(text, r)
+				continue
+			}
+			body := runes[i+3 : end]
+			language := ""
+			if nl := indexRune(body, '\n'); nl >= 0 {
+				candidate := strings.TrimSpace(string(body[:nl]))
+				if candidate == "" || (len(candidate) <= maxLangLength && languagePattern.MatchString(candidate)) {
+					language = candidate
+					body = body[nl+1:]
+				}
+			}
+			// Перевод строки перед закрывающим ``` не относится к коду
+			if n := len(body); n > 0 && body[n-1] == '\n' {
+				body = body[:n-1]
+			}
+			flush()
+			tokens = append(tokens, token{kind: tokenPre, text: string(body), language: language, pair: -1})
+			i = end + 2
+
+		case r == '`':
+			end := indexFrom(runes, i+1, "`")
+			if end < 0 || end == i+1 || indexRune(runes[i+1:end], '\n') >= 0 {
+				text = append(text, r)
+				continue
+			}
+			flush()
+			tokens = append(tokens, token{kind: tokenCode, text: string(runes[i+1 : end]), pair: -1})
+			i = end
+
+		case r == '[':
+			label, target, end := matchLink(runes, i)
+			if end < 0 {
+				text = append(text, r)
+				continue
+			}
+			link, err := ValidateLink(target)
+			if err != nil {
+				return nil, &ParseError{Position: i, Reason: err.Error()}
+			}
+			flush()
+			tokens = append(tokens, token{kind: tokenLink, text: label, url: link, pair: -1})
+			i = end
+
+		default:
+			if m := markerAt(runes, i); m >= 0 {
+				marker := markers[m]
+				n := len([]rune(marker.text))
+				before, after := runeAt(runes, i-1), runeAt(runes, i+n)
+				t := token{
+					kind:     tokenMarker,
+					text:     marker.text,
+					typ:      marker.typ,
+					canOpen:  after != 0 && !unicode.IsSpace(after),
+					canClose: before != 0 && !unicode.IsSpace(before),
+					pair:     -1,
+				}
+				// Подчеркивания внутри слов (snake_case) не считаются разметкой
+				if marker.text == "_" {
+					t.canOpen = t.canOpen && !isWordRune(before)
+					t.canClose = t.canClose && !isWordRune(after)
+				}
+				if t.canOpen || t.canClose {
+					flush()
+					tokens = append(tokens, t)
+					i += n - 1
+					continue
+				}
+			}
+			text = append(text, r)
+		}
+	}
+	flush()
+
+	return tokens, nil
+}
+
+// pairMarkers сопоставляет открывающие и закрывающие маркеры.
+// Несопоставленные маркеры превращаются в обычный текст.
+func pairMarkers(tokens []token) {
+	var stack []int
+
+	for i := range tokens {
+		t := &tokens[i]
+		if t.kind != tokenMarker {
+			continue
+		}
+
+		// Ищем открытый маркер того же вида
+		match := -1
+		if t.canClose {
+			for j := len(stack) - 1; j >= 0; j-- {
+				if tokens[stack[j]].text == t.text {
+					match = j
+					break
+				}
+			}
+		}
+
+		// Маркеры вплотную друг к другу (****) не образуют форматирования
+		if match >= 0 && stack[match] != i-1 {
+			// Маркеры, открытые внутри закрываемого, остаются текстом
+			opener := stack[match]
+			stack = stack[:match]
+			tokens[opener].pair = i
+			t.pair = opener
+			continue
+		}
+
+		if t.canOpen {
+			stack = append(stack, i)
+		}
+	}
+
+	for i := range tokens {
+		if tokens[i].kind == tokenMarker && tokens[i].pair < 0 {
+			tokens[i].kind = tokenText
+		}
+	}
+}
+
+// matchLink разбирает ссылку вида [текст](адрес), начинающуюся с позиции start.
+// Возвращает текст, адрес и позицию закрывающей скобки или -1.
+func matchLink(runes []rune, start int) (string, string, int) {
+	closeLabel := -1
+	for j := start + 1; j < len(runes) && runes[j] != '\n'; j++ {
+		if runes[j] == ']' {
+			closeLabel = j
+			break
+		}
+	}
+	if closeLabel <= start+1 || runeAt(runes, closeLabel+1) != '(' {
+		return "", "", -1
+	}
+
+	for j := closeLabel + 2; j < len(runes); j++ {
+		switch runes[j] {
+		case ')':
+			return string(runes[start+1 : closeLabel]), string(runes[closeLabel+2 : j]), j
+		case ' ', '\n', '\t':
+			return "", "", -1
+		}
+	}
+	return "", "", -1
+}
+
+// ValidateLink проверяет адрес ссылки и возвращает его нормализованную форму
+func ValidateLink(target string) (string, error) {
+	if target == "" || len(target) > maxURLLength {
+		return "", fmt.Errorf("некорректный адрес ссылки")
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", fmt.Errorf("некорректный адрес ссылки")
+	}
+	if !allowedLinkSchemes[strings.ToLower(u.Scheme)] {
+		return "", fmt.Errorf("недопустимая схема ссылки %q", u.Scheme)
+	}
+	if u.Scheme != "mailto" && u.Host == "" {
+		return "", fmt.Errorf("некорректный адрес ссылки")
+	}
+	return u.String(), nil
+}
+
+func markerAt(runes []rune, i int) int {
+	for m, marker := range markers {
+		if hasPrefix(runes, i, marker.text) {
+			return m
+		}
+	}
+	return -1
+}
+
+func hasPrefix(runes []rune, i int, prefix string) bool {
+	for _, p := range prefix {
+		if i >= len(runes) || runes[i] != p {
+			return false
+		}
+		i++
+	}
+	return true
+}
+
+func indexFrom(runes []rune, from int, s string) int {
+	for i := from; i < len(runes); i++ {
+		if hasPrefix(runes, i, s) {
+			return i
+		}
+	}
+	return -1
+}
+
+func indexRune(runes []rune, r rune) int {
+	for i, c := range runes {
+		if c == r {
+			return i
+		}
+	}
+	return -1
+}
+
+// runeAt возвращает символ по индексу или 0 за границами текста
+func runeAt(runes []rune, i int) rune {
+	if i < 0 || i >= len(runes) {
+		return 0
+	}
+	return runes[i]
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// UTF16Len возвращает длину строки в кодовых единицах UTF-16, в которых измеряются сущности
+func UTF16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		// Символы вне базовой плоскости кодируются суррогатной парой
+		if r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,258 @@
+// Package tgimport читает выгрузку одного чата из Telegram Desktop (result.json).
+//
+// Файл разбирается потоково: сообщения передаются обработчику по одному,
+// поэтому большие выгрузки не загружаются в память целиком.
+package tgimport
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"messenger/richtext"
+)
+
+// Типы чатов Telegram
+const (
+	ChatTypePersonal = "personal_chat"
+)
+
+// Типы сообщений Telegram
+const (
+	MessageTypeRegular = "message"
+	MessageTypeService = "service"
+)
+
+// Chat содержит сведения о выгруженном чате
+type Chat struct {
+	ID   int64
+	Name string
+	Type string
+}
+
+// TextEntity представляет фрагмент текста сообщения с форматированием
+type TextEntity struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	Href     string `json:"href,omitempty"`
+	Language string `json:"language,omitempty"`
+}
+
+// Message представляет сообщение выгрузки
+type Message struct {
+	ID             int64           `json:"id"`
+	Type           string          `json:"type"`
+	Date           string          `json:"date"`
+	DateUnixtime   string          `json:"date_unixtime"`
+	Edited         string          `json:"edited"`
+	EditedUnixtime string          `json:"edited_unixtime"`
+	From           string          `json:"from"`
+	FromID         string          `json:"from_id"`
+	Text           json.RawMessage `json:"text"`
+	TextEntities   []TextEntity    `json:"text_entities"`
+	Photo          string          `json:"photo"`
+	File           string          `json:"file"`
+	FileName       string          `json:"file_name"`
+	MimeType       string          `json:"mime_type"`
+	MediaType      string          `json:"media_type"`
+}
+
+// ErrNotChatExport возвращается для файлов, не являющихся выгрузкой одного чата
+var ErrNotChatExport = errors.New("файл не является выгрузкой чата Telegram")
+
+// Decode разбирает выгрузку. onChat вызывается один раз перед первым сообщением,
+// onMessage - для каждого сообщения в порядке выгрузки.
+func Decode(r io.Reader, onChat func(Chat) error, onMessage func(Message) error) error {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+
+	if err := expectDelim(dec, '{'); err != nil {
+		return ErrNotChatExport
+	}
+
+	var chat Chat
+	seenMessages := false
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := token.(string)
+
+		switch key {
+		case "name":
+			if err := dec.Decode(&chat.Name); err != nil {
+				return err
+			}
+		case "type":
+			if err := dec.Decode(&chat.Type); err != nil {
+				return err
+			}
+		case "id":
+			var id json.Number
+			if err := dec.Decode(&id); err != nil {
+				return err
+			}
+			if chat.ID, err = id.Int64(); err != nil {
+				return err
+			}
+		case "messages":
+			seenMessages = true
+			if err := onChat(chat); err != nil {
+				return err
+			}
+			if err := expectDelim(dec, '['); err != nil {
+				return err
+			}
+			for dec.More() {
+				var message Message
+				if err := dec.Decode(&message); err != nil {
+					return err
+				}
+				if err := onMessage(message); err != nil {
+					return err
+				}
+			}
+			if err := expectDelim(dec, ']'); err != nil {
+				return err
+			}
+		default:
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !seenMessages {
+		return ErrNotChatExport
+	}
+	return nil
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := token.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("ожидался символ %q", delim)
+	}
+	return nil
+}
+
+// Time возвращает время отправки сообщения
+func (m *Message) Time() (time.Time, error) {
+	return parseTime(m.DateUnixtime, m.Date)
+}
+
+// EditedTime возвращает время последнего изменения сообщения или nil
+func (m *Message) EditedTime() *time.Time {
+	if m.EditedUnixtime == "" && m.Edited == "" {
+		return nil
+	}
+	t, err := parseTime(m.EditedUnixtime, m.Edited)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+// parseTime предпочитает unix-время: локальное время выгрузки не содержит часового пояса
+func parseTime(unix, local string) (time.Time, error) {
+	if unix != "" {
+		sec, err := strconv.ParseInt(unix, 10, 64)
+		if err == nil {
+			return time.Unix(sec, 0), nil
+		}
+	}
+	return time.ParseInLocation("2006-01-02T15:04:05", local, time.Local)
+}
+
+// MediaPath возвращает путь к прикрепленному файлу внутри выгрузки
+func (m *Message) MediaPath() string {
+	if m.Photo != "" {
+		return m.Photo
+	}
+	return m.File
+}
+
+// Content возвращает текст сообщения без разметки и сущности форматирования.
+// Типы форматирования, которых нет в richtext, превращаются в обычный текст.
+func (m *Message) Content() (string, []richtext.Entity) {
+	parts := m.TextEntities
+	if len(parts) == 0 {
+		parts = decodeTextParts(m.Text)
+	}
+
+	var (
+		text     strings.Builder
+		offset   int
+		entities []richtext.Entity
+	)
+	for _, part := range parts {
+		length := richtext.UTF16Len(part.Text)
+		entity := richtext.Entity{Offset: offset, Length: length}
+
+		switch part.Type {
+		case "bold":
+			entity.Type = richtext.EntityBold
+		case "italic":
+			entity.Type = richtext.EntityItalic
+		case "strikethrough":
+			entity.Type = richtext.EntityStrikethrough
+		case "code":
+			entity.Type = richtext.EntityCode
+		case "pre":
+			entity.Type = richtext.EntityPre
+			entity.Language = part.Language
+		case "text_link":
+			// Ссылки с небезопасными схемами остаются обычным текстом
+			if link, err := richtext.ValidateLink(part.Href); err == nil {
+				entity.Type = richtext.EntityLink
+				entity.URL = link
+			}
+		}
+
+		if entity.Type != "" && length > 0 && len(entities) < richtext.MaxEntities {
+			entities = append(entities, entity)
+		}
+		text.WriteString(part.Text)
+		offset += length
+	}
+
+	return text.String(), entities
+}
+
+// decodeTextParts разбирает поле text старых выгрузок: строку или массив строк и объектов
+func decodeTextParts(raw json.RawMessage) []TextEntity {
+	if len(raw) == 0 {
+		return nil
+	}
+
+	var plain string
+	if err := json.Unmarshal(raw, &plain); err == nil {
+		return []TextEntity{{Type: "plain", Text: plain}}
+	}
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return nil
+	}
+
+	parts := make([]TextEntity, 0, len(items))
+	for _, item := range items {
+		var part TextEntity
+		if err := json.Unmarshal(item, &plain); err == nil {
+			part = TextEntity{Type: "plain", Text: plain}
+		} else if err := json.Unmarshal(item, &part); err != nil {
+			continue
+		}
+		parts = append(parts, part)
+	}
+	return parts
+}
@@ -0,0 +1,413 @@
+// Package unfurl получает метаданные OpenGraph/Twitter Card для предпросмотра ссылок.
+//
+// Загрузка выполняется в "песочнице": строгие таймауты, ограничение размера ответа,
+// запрет соединений с приватными и служебными адресами (проверяется при каждом
+// соединении, включая редиректы), кэширование результатов.
+package unfurl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+// Ограничения длины полей предпросмотра (в символах)
+const (
+	maxTitleLength       = 300
+	maxDescriptionLength = 1000
+	maxURLLength         = 2048
+)
+
+var (
+	// ErrBlockedAddress возвращается при попытке соединения с приватным или служебным адресом
+	ErrBlockedAddress = errors.New("unfurl: адрес запрещен")
+	// ErrUnsupportedURL возвращается для ссылок с неподдерживаемой схемой
+	ErrUnsupportedURL = errors.New("unfurl: неподдерживаемая ссылка")
+	// ErrNoMetadata возвращается, если на странице нет данных для предпросмотра
+	ErrNoMetadata = errors.New("unfurl: нет метаданных")
+)
+
+// urlPattern находит http(s)-ссылки в тексте сообщения
+var urlPattern = regexp.MustCompile(`https?://[^\s<>"']+`)
+
+// Preview содержит метаданные страницы для предпросмотра ссылки
+type Preview struct {
+	URL         string `json:"url"`
+	SiteName    string `json:"site_name,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	ImageURL    string `json:"image_url,omitempty"`
+}
+
+// Options задает ограничения загрузчика
+type Options struct {
+	Timeout      time.Duration // Общий таймаут запроса, включая редиректы
+	MaxBodyBytes int64         // Максимальный объем читаемого HTML
+	MaxRedirects int           // Максимальное число редиректов
+	CacheTTL     time.Duration // Время жизни записи в кэше (и успешной, и неудачной)
+	CacheSize    int           // Максимальное число записей в кэше
+	UserAgent    string
+
+	// AllowPrivateNetworks отключает блокировку приватных адресов.
+	// Предназначено только для тестов с локальным httptest-сервером.
+	AllowPrivateNetworks bool
+}
+
+// DefaultOptions возвращает ограничения по умолчанию
+func DefaultOptions() Options {
+	return Options{
+		Timeout:      5 * time.Second,
+		MaxBodyBytes: 512 * 1024,
+		MaxRedirects: 3,
+		CacheTTL:     30 * time.Minute,
+		CacheSize:    1000,
+		UserAgent:    "MessengerLinkPreview/1.0",
+	}
+}
+
+type cacheEntry struct {
+	preview   *Preview
+	err       error
+	expiresAt time.Time
+}
+
+// Unfurler загружает и кэширует предпросмотры ссылок
+type Unfurler struct {
+	opts   Options
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+}
+
+// New создает загрузчик с указанными ограничениями.
+// Нулевые значения полей заменяются значениями из DefaultOptions.
+func New(opts Options) *Unfurler {
+	defaults := DefaultOptions()
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaults.Timeout
+	}
+	if opts.MaxBodyBytes <= 0 {
+		opts.MaxBodyBytes = defaults.MaxBodyBytes
+	}
+	if opts.MaxRedirects <= 0 {
+		opts.MaxRedirects = defaults.MaxRedirects
+	}
+	if opts.CacheTTL <= 0 {
+		opts.CacheTTL = defaults.CacheTTL
+	}
+	if opts.CacheSize <= 0 {
+		opts.CacheSize = defaults.CacheSize
+	}
+	if opts.UserAgent == "" {
+		opts.UserAgent = defaults.UserAgent
+	}
+
+	dialer := &net.Dialer{Timeout: opts.Timeout}
+	if !opts.AllowPrivateNetworks {
+		// Проверяем адрес уже после DNS-резолвинга, чтобы исключить обход через DNS
+		dialer.Control = checkDialAddress
+	}
+
+	transport := &http.Transport{
+		Proxy:                 nil, // Прокси из окружения обошел бы проверку адресов
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   opts.Timeout,
+		ResponseHeaderTimeout: opts.Timeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	}
+
+	maxRedirects := opts.MaxRedirects
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   opts.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return fmt.Errorf("unfurl: слишком много редиректов")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return ErrUnsupportedURL
+			}
+			return nil
+		},
+	}
+
+	return &Unfurler{
+		opts:   opts,
+		client: client,
+		cache:  make(map[string]cacheEntry),
+	}
+}
+
+// FindURL возвращает первую http(s)-ссылку из текста или пустую строку
+func FindURL(text string) string {
+	link := urlPattern.FindString(text)
+	// Отбрасываем завершающую пунктуацию, которая обычно не относится к ссылке
+	return strings.TrimRight(link, ".,;:!?)]}»")
+}
+
+// Unfurl возвращает предпросмотр для ссылки, используя кэш
+func (u *Unfurler) Unfurl(ctx context.Context, rawURL string) (*Preview, error) {
+	target, err := normalizeURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	key := target.String()
+
+	if entry, ok := u.cached(key); ok {
+		return entry.preview, entry.err
+	}
+
+	preview, err := u.fetch(ctx, target)
+	// Ошибки отмены контекста не кэшируем - это не свойство ссылки
+	if !errors.Is(err, context.Canceled) {
+		u.store(key, cacheEntry{preview: preview, err: err, expiresAt: time.Now().Add(u.opts.CacheTTL)})
+	}
+	return preview, err
+}
+
+func (u *Unfurler) cached(key string) (cacheEntry, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	entry, ok := u.cache[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(u.cache, key)
+		return cacheEntry{}, false
+	}
+	return entry, true
+}
+
+func (u *Unfurler) store(key string, entry cacheEntry) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if len(u.cache) >= u.opts.CacheSize {
+		// Сначала удаляем устаревшие записи, затем при необходимости любую
+		now := time.Now()
+		for k, e := range u.cache {
+			if now.After(e.expiresAt) {
+				delete(u.cache, k)
+			}
+		}
+		for k := range u.cache {
+			if len(u.cache) < u.opts.CacheSize {
+				break
+			}
+			delete(u.cache, k)
+		}
+	}
+	u.cache[key] = entry
+}
+
+func (u *Unfurler) fetch(ctx context.Context, target *url.URL) (*Preview, error) {
+	ctx, cancel := context.WithTimeout(ctx, u.opts.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", u.opts.UserAgent)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unfurl: статус ответа %d", resp.StatusCode)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil, ErrNoMetadata
+	}
+
+	// Адрес после редиректов - от него разрешаются относительные ссылки
+	preview := parseHTML(io.LimitReader(resp.Body, u.opts.MaxBodyBytes), resp.Request.URL)
+	if preview.Title == "" && preview.Description == "" {
+		return nil, ErrNoMetadata
+	}
+	return preview, nil
+}
+
+// parseHTML извлекает метаданные из заголовка HTML-документа
+func parseHTML(r io.Reader, base *url.URL) *Preview {
+	meta := make(map[string]string)
+	var title string
+
+	z := html.NewTokenizer(r)
+	inTitle := false
+loop:
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			// Конец документа, ошибка чтения или достигнут лимит размера
+			break loop
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			switch string(name) {
+			case "body":
+				break loop
+			case "title":
+				inTitle = true
+			case "meta":
+				if !hasAttr {
+					continue
+				}
+				var key, content string
+				for {
+					attrName, attrValue, more := z.TagAttr()
+					switch string(attrName) {
+					case "property", "name":
+						key = strings.ToLower(string(attrValue))
+					case "content":
+						content = string(attrValue)
+					}
+					if !more {
+						break
+					}
+				}
+				if key != "" && content != "" {
+					if _, exists := meta[key]; !exists {
+						meta[key] = content
+					}
+				}
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "head":
+				break loop
+			case "title":
+				inTitle = false
+			}
+		case html.TextToken:
+			if inTitle && title == "" {
+				title = string(z.Text())
+			}
+		}
+	}
+
+	preview := &Preview{
+		URL:         base.String(),
+		SiteName:    clean(meta["og:site_name"], maxTitleLength),
+		Title:       clean(firstNonEmpty(meta["og:title"], meta["twitter:title"], title), maxTitleLength),
+		Description: clean(firstNonEmpty(meta["og:description"], meta["twitter:description"], meta["description"]), maxDescriptionLength),
+	}
+
+	if image := firstNonEmpty(meta["og:image"], meta["og:image:url"], meta["twitter:image"]); image != "" {
+		if ref, err := url.Parse(strings.TrimSpace(image)); err == nil {
+			resolved := base.ResolveReference(ref)
+			if (resolved.Scheme == "http" || resolved.Scheme == "https") && len(resolved.String()) <= maxURLLength {
+				preview.ImageURL = resolved.String()
+			}
+		}
+	}
+
+	return preview
+}
+
+// normalizeURL проверяет ссылку перед загрузкой
+func normalizeURL(rawURL string) (*url.URL, error) {
+	if len(rawURL) > maxURLLength {
+		return nil, ErrUnsupportedURL
+	}
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, ErrUnsupportedURL
+	}
+	if target.Scheme != "http" && target.Scheme != "https" || target.Host == "" || target.User != nil {
+		return nil, ErrUnsupportedURL
+	}
+	target.Fragment = ""
+	return target, nil
+}
+
+// checkDialAddress запрещает соединение с приватным или служебным адресом
+func checkDialAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || isBlockedIP(ip) {
+		return ErrBlockedAddress
+	}
+	return nil
+}
+
+// isBlockedIP сообщает, относится ли адрес к приватным или служебным диапазонам
+func isBlockedIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Служебные диапазоны, не покрытые методами net.IP
+var blockedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",     // "Этот" хост
+	"100.64.0.0/10", // Carrier-grade NAT
+	"192.0.0.0/24",  // IETF Protocol Assignments
+	"198.18.0.0/15", // Тестирование производительности
+	"240.0.0.0/4",   // Зарезервировано
+	"64:ff9b::/96",  // NAT64 может вести во внутреннюю сеть
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// clean нормализует пробелы, удаляет некорректный UTF-8 и обрезает строку
+func clean(s string, maxLen int) string {
+	s = strings.Join(strings.Fields(strings.ToValidUTF8(s, "")), " ")
+	if utf8.RuneCountInString(s) <= maxLen {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:maxLen-1]) + "…"
+}